@@ -9,7 +9,8 @@ import (
 )
 
 // Signs auth token
-func signAuthToken(secret string, action string, streamId string) (string, error) {
+// secretId - ID of the secret, set as the key ID (kid) header. If empty, the header is not set.
+func signAuthToken(secret string, secretId string, action string, streamId string) (string, error) {
 	if secret == "" {
 		return "", nil
 	}
@@ -19,6 +20,10 @@ func signAuthToken(secret string, action string, streamId string) (string, error
 		"exp": time.Now().Add(1 * time.Hour).Unix(),
 	})
 
+	if secretId != "" {
+		token.Header["kid"] = secretId
+	}
+
 	tokenString, err := token.SignedString([]byte(secret))
 
 	if err != nil {
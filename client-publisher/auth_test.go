@@ -51,12 +51,12 @@ func TestSignFunctions(t *testing.T) {
 	secret := "test-secret"
 	streamId := "stream1"
 
-	tokenPull, _ := signAuthToken(secret, "PULL", streamId)
+	tokenPull, _ := signAuthToken(secret, "", "PULL", streamId)
 	if !validateAuthToken(tokenPull, secret, "PULL", streamId) {
 		t.Errorf("Token does not pass validation: %v", tokenPull)
 	}
 
-	tokenPush, _ := signAuthToken(secret, "PUSH", streamId)
+	tokenPush, _ := signAuthToken(secret, "", "PUSH", streamId)
 	if !validateAuthToken(tokenPush, secret, "PUSH", streamId) {
 		t.Errorf("Token does not pass validation: %v", tokenPush)
 	}
@@ -71,8 +71,20 @@ func TestSignFunctions(t *testing.T) {
 		t.Errorf("Invalid token passed validation: %v", tokenPull)
 	}
 
-	invalidTokenOther, _ := signAuthToken("other-secret", "PULL", streamId)
+	invalidTokenOther, _ := signAuthToken("other-secret", "", "PULL", streamId)
 	if validateAuthToken(invalidTokenOther, secret, "PULL", streamId) {
 		t.Errorf("Invalid token passed validation: %v", invalidTokenOther)
 	}
+
+	// Key ID
+
+	tokenWithId, _ := signAuthToken(secret, "k1", "PUSH", streamId)
+	if !validateAuthToken(tokenWithId, secret, "PUSH", streamId) {
+		t.Errorf("Token does not pass validation: %v", tokenWithId)
+	}
+
+	parsedToken, _, err := jwt.NewParser().ParseUnverified(tokenWithId, jwt.MapClaims{})
+	if err != nil || parsedToken.Header["kid"] != "k1" {
+		t.Errorf("Expected key ID k1 in token: %v", tokenWithId)
+	}
 }
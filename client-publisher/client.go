@@ -33,6 +33,18 @@ type HlsWebSocketPublisher struct {
 	// Queue of pending fragments
 	pendingQueue []cdnPublisherPendingFragment
 
+	// Parts of the fragment being generated
+	currentParts []cdnPublisherPendingFragment
+
+	// Number of parts of the current fragment sent to the server
+	currentPartsSent int
+
+	// Stream metadata (sent again after reconnecting)
+	metadata map[string]string
+
+	// Cues waiting for the next fragment to be queued
+	pendingCues []map[string]string
+
 	// Channel to interrupt the heartbeat process
 	heartbeatInterruptChannel chan bool
 }
@@ -47,6 +59,10 @@ func NewHlsWebSocketPublisher(config HlsWebSocketPublisherConfiguration) *HlsWeb
 		ready:                     false,
 		socket:                    nil,
 		pendingQueue:              make([]cdnPublisherPendingFragment, 0),
+		currentParts:              make([]cdnPublisherPendingFragment, 0),
+		currentPartsSent:          0,
+		metadata:                  nil,
+		pendingCues:               nil,
 		heartbeatInterruptChannel: make(chan bool, 1),
 	}
 
@@ -108,7 +124,7 @@ func (publisher *HlsWebSocketPublisher) run() {
 		// Connected, send authentication
 
 		cdnStreamId := publisher.Config.StreamId
-		authToken, err := signAuthToken(publisher.Config.AuthSecret, "PUSH", cdnStreamId)
+		authToken, err := signAuthToken(publisher.Config.AuthSecret, publisher.Config.AuthSecretId, "PUSH", cdnStreamId)
 
 		if err != nil {
 			socket.Close()
@@ -235,6 +251,42 @@ func (pub *HlsWebSocketPublisher) sendFragmentInternal(duration float32, data []
 	pub.socket.WriteMessage(websocket.BinaryMessage, data)
 }
 
+// Internal function to send the fragment part message
+func (pub *HlsWebSocketPublisher) sendFragmentPartInternal(index int, duration float32, data []byte, independent bool, last bool) {
+	msg := WebsocketProtocolMessage{
+		MessageType: "P",
+		Parameters: map[string]string{
+			"index":       fmt.Sprint(index),
+			"independent": fmt.Sprint(independent),
+			"duration":    fmt.Sprint(duration),
+			"last":        fmt.Sprint(last),
+		},
+	}
+
+	pub.socket.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+	pub.socket.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// Internal function to send the metadata message
+func (pub *HlsWebSocketPublisher) sendMetadataInternal() {
+	msg := WebsocketProtocolMessage{
+		MessageType: "META",
+		Parameters:  pub.metadata,
+	}
+
+	pub.socket.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+}
+
+// Internal function to send the cue message
+func (pub *HlsWebSocketPublisher) sendCueInternal(cue map[string]string) {
+	msg := WebsocketProtocolMessage{
+		MessageType: "CUE",
+		Parameters:  cue,
+	}
+
+	pub.socket.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+}
+
 // Called when the connection is opened
 func (pub *HlsWebSocketPublisher) onConnected(socket *websocket.Conn) {
 	pub.mu.Lock()
@@ -258,7 +310,15 @@ func (pub *HlsWebSocketPublisher) onReady() {
 
 	pub.ready = true
 
+	if pub.metadata != nil {
+		pub.sendMetadataInternal()
+	}
+
 	for _, f := range pub.pendingQueue {
+		for _, cue := range f.cues {
+			pub.sendCueInternal(cue)
+		}
+
 		pub.sendFragmentInternal(f.duration, f.data)
 	}
 
@@ -280,6 +340,88 @@ func (pub *HlsWebSocketPublisher) onDisconnected() {
 
 	pub.ready = false
 	pub.socket = nil
+	pub.currentPartsSent = 0
+}
+
+// Queues a fragment to be sent when the publisher is ready
+// (must be called with the mutex locked)
+func (pub *HlsWebSocketPublisher) queueFragment(duration float32, data []byte) {
+	queueMaxLength := pub.Config.QueueMaxLength
+
+	if queueMaxLength == 0 {
+		queueMaxLength = 10
+	}
+
+	pendingFragment := cdnPublisherPendingFragment{
+		duration: duration,
+		data:     data,
+		cues:     pub.pendingCues,
+	}
+
+	pub.pendingCues = nil
+
+	if len(pub.pendingQueue) >= queueMaxLength && len(pub.pendingQueue) > 0 {
+		pub.pendingQueue = append(pub.pendingQueue[1:], pendingFragment)
+	} else {
+		pub.pendingQueue = append(pub.pendingQueue, pendingFragment)
+	}
+}
+
+// Sends a part of the fragment being generated,
+// so spectators can receive it with lower latency.
+// duration - Duration of the part in seconds
+// data - Part data
+// independent - True if the part starts with a keyframe
+// last - True if the part is the last one of the fragment
+// If the parts cannot be sent as they arrive, the complete fragment is sent after the last part
+func (pub *HlsWebSocketPublisher) SendFragmentPart(duration float32, data []byte, independent bool, last bool) {
+	if len(data) == 0 {
+		return
+	}
+
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+
+	if pub.closed {
+		return
+	}
+
+	index := len(pub.currentParts)
+
+	pub.currentParts = append(pub.currentParts, cdnPublisherPendingFragment{
+		duration: duration,
+		data:     data,
+	})
+
+	if pub.ready && pub.currentPartsSent == index {
+		// All the previous parts were sent, send this one
+		pub.sendFragmentPartInternal(index, duration, data, independent, last)
+		pub.currentPartsSent++
+	}
+
+	if !last {
+		return
+	}
+
+	if pub.currentPartsSent < len(pub.currentParts) {
+		// Some parts could not be sent, send the complete fragment
+		totalDuration := float32(0)
+		totalData := make([]byte, 0)
+
+		for _, p := range pub.currentParts {
+			totalDuration += p.duration
+			totalData = append(totalData, p.data...)
+		}
+
+		if pub.ready {
+			pub.sendFragmentInternal(totalDuration, totalData)
+		} else {
+			pub.queueFragment(totalDuration, totalData)
+		}
+	}
+
+	pub.currentParts = make([]cdnPublisherPendingFragment, 0)
+	pub.currentPartsSent = 0
 }
 
 func (pub *HlsWebSocketPublisher) SendFragment(duration float32, data []byte) {
@@ -299,24 +441,57 @@ func (pub *HlsWebSocketPublisher) SendFragment(duration float32, data []byte) {
 		pub.sendFragmentInternal(duration, data)
 	} else {
 		// Not ready, append to the queue
-		queueMaxLength := pub.Config.QueueMaxLength
+		pub.queueFragment(duration, data)
+	}
 
-		if queueMaxLength == 0 {
-			queueMaxLength = 10
-		}
+}
 
-		pendingFragment := cdnPublisherPendingFragment{
-			duration: duration,
-			data:     data,
-		}
+// Sets the stream metadata (codec info, resolution, custom tags, etc)
+// The metadata replaces the previous one, and it is sent to the spectators
+func (pub *HlsWebSocketPublisher) SetMetadata(metadata map[string]string) {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
 
-		if len(pub.pendingQueue) >= queueMaxLength && len(pub.pendingQueue) > 0 {
-			pub.pendingQueue = append(pub.pendingQueue[1:], pendingFragment)
-		} else {
-			pub.pendingQueue = append(pub.pendingQueue, pendingFragment)
-		}
+	if pub.closed {
+		return
+	}
+
+	pub.metadata = make(map[string]string)
+
+	for k, v := range metadata {
+		pub.metadata[k] = v
+	}
+
+	if pub.ready {
+		pub.sendMetadataInternal()
+	}
+}
+
+// Sends a timed cue (poll, ad marker, etc)
+// The cue is attached to the next fragment (or fragment part) sent
+func (pub *HlsWebSocketPublisher) SendCue(cue map[string]string) {
+	if len(cue) == 0 {
+		return
+	}
+
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+
+	if pub.closed {
+		return
 	}
 
+	cueCopy := make(map[string]string)
+
+	for k, v := range cue {
+		cueCopy[k] = v
+	}
+
+	if pub.ready {
+		pub.sendCueInternal(cueCopy)
+	} else {
+		pub.pendingCues = append(pub.pendingCues, cueCopy)
+	}
 }
 
 // Finish the publisher
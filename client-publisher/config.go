@@ -19,6 +19,10 @@ type HlsWebSocketPublisherConfiguration struct {
 	// Secret to generate authentication tokens
 	AuthSecret string
 
+	// ID of the secret, required if the server has several secrets configured.
+	// It is sent as the key ID (kid) of the authentication tokens.
+	AuthSecretId string
+
 	// Max length of the queue to keep fragments
 	// if they cannot be sent to the server immediately
 	// (10 by default)
@@ -9,4 +9,7 @@ type cdnPublisherPendingFragment struct {
 
 	// Fragment data
 	data []byte
+
+	// Cues to send before the fragment
+	cues []map[string]string
 }
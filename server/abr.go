@@ -0,0 +1,175 @@
+// Server-assisted adaptive bitrate (ABR)
+//
+// This is a heuristic. The server can only measure how long it takes to write
+// the data to the socket, which mostly measures the kernel send buffer, not the link.
+// Because of that, the decisions are conservative:
+//  - Downshifts are based on the backlog of the listener queue, and on the writes
+//    that block (the only ones showing the real throughput).
+//  - Upshifts require a sustained period without backlog, and are delayed
+//    further each time the connection has to be downshifted.
+
+package main
+
+import (
+	"time"
+)
+
+// Weight of the new samples for the throughput estimation (exponential moving average)
+const ABR_THROUGHPUT_SAMPLE_WEIGHT = 0.3
+
+// Min duration of a send operation to be used for the throughput estimation
+// Faster writes only show that the data fit in the socket buffer, so they are not measured
+const ABR_MIN_MEASURED_SEND_DURATION = 10 * time.Millisecond
+
+// Ratio of the listener channel capacity that, once filled, causes a downshift
+const ABR_QUEUE_DOWNSHIFT_RATIO = 0.5
+
+// Max ratio between the time spent sending a fragment and the fragment duration, before causing a downshift
+const ABR_MAX_SEND_TIME_RATIO = 0.8
+
+// Max ratio between the time spent sending a fragment and the fragment duration, in order to upshift
+const ABR_UPSHIFT_MAX_SEND_TIME_RATIO = 0.25
+
+// The estimated throughput must be this many times the bandwidth of the higher rendition to upshift
+const ABR_UPSHIFT_THROUGHPUT_FACTOR = 1.5
+
+// Min number of fragments sent since the last switch, before upshifting
+// Doubled after each downshift, up to ABR_UPSHIFT_MAX_FRAGMENTS
+const ABR_UPSHIFT_MIN_FRAGMENTS = 5
+
+// Max number of fragments to wait before upshifting
+const ABR_UPSHIFT_MAX_FRAGMENTS = 40
+
+// Adaptive bitrate controller for a pull connection
+type HlsAbrController struct {
+	// Estimated throughput (bits per second), from the writes that blocked. 0 if unknown.
+	throughput float64
+
+	// Ratio between the time spent sending the last fragment and its duration
+	sendTimeRatio float64
+
+	// Number of fragments sent since the last switch
+	fragmentsSinceSwitch int
+
+	// Number of fragments to send before upshifting
+	upshiftMinFragments int
+}
+
+// Creates an adaptive bitrate controller
+func NewHlsAbrController() *HlsAbrController {
+	return &HlsAbrController{
+		throughput:           0,
+		sendTimeRatio:        0,
+		fragmentsSinceSwitch: 0,
+		upshiftMinFragments:  ABR_UPSHIFT_MIN_FRAGMENTS,
+	}
+}
+
+// Adds a sample of sent data
+// size - Size of the data (bytes)
+// elapsed - Time spent sending the data
+// duration - Duration of the media sent (seconds)
+func (abr *HlsAbrController) AddSample(size int, elapsed time.Duration, duration float32) {
+	if duration > 0 {
+		abr.sendTimeRatio = elapsed.Seconds() / float64(duration)
+	}
+
+	if elapsed < ABR_MIN_MEASURED_SEND_DURATION {
+		return // Absorbed by the socket buffer, not a throughput measure
+	}
+
+	sampleThroughput := float64(size*8) / elapsed.Seconds()
+
+	if abr.throughput <= 0 {
+		abr.throughput = sampleThroughput
+	} else {
+		abr.throughput = abr.throughput*(1-ABR_THROUGHPUT_SAMPLE_WEIGHT) + sampleThroughput*ABR_THROUGHPUT_SAMPLE_WEIGHT
+	}
+}
+
+// Call when a complete fragment was sent
+func (abr *HlsAbrController) OnFragmentSent() {
+	abr.fragmentsSinceSwitch++
+}
+
+// Call when the stream was switched
+func (abr *HlsAbrController) OnSwitch() {
+	abr.fragmentsSinceSwitch = 0
+	abr.sendTimeRatio = 0
+}
+
+// Chooses the rendition to pull
+// variants - Renditions of the group
+// currentStreamId - ID of the stream being pulled
+// queueLength - Number of events waiting in the listener channel
+// queueCapacity - Capacity of the listener channel
+// Returns the rendition to switch to, or nil to keep the current one
+func (abr *HlsAbrController) ChooseRendition(variants *HlsVariants, currentStreamId string, queueLength int, queueCapacity int) *HlsRendition {
+	if variants == nil {
+		return nil
+	}
+
+	currentIndex := -1
+
+	for i, r := range variants.Renditions {
+		if r.StreamId == currentStreamId {
+			currentIndex = i
+			break
+		}
+	}
+
+	if currentIndex < 0 || variants.Renditions[currentIndex].Bandwidth <= 0 {
+		return nil
+	}
+
+	current := variants.Renditions[currentIndex]
+
+	// Downshift if the connection cannot keep up with the stream
+
+	queueLimit := int(float64(queueCapacity) * ABR_QUEUE_DOWNSHIFT_RATIO)
+
+	if queueLimit < 1 {
+		queueLimit = 1
+	}
+
+	congested := queueLength >= queueLimit ||
+		abr.sendTimeRatio > ABR_MAX_SEND_TIME_RATIO ||
+		(abr.throughput > 0 && abr.throughput < float64(current.Bandwidth))
+
+	if congested {
+		for i := currentIndex + 1; i < len(variants.Renditions); i++ {
+			r := variants.Renditions[i]
+
+			if r.Bandwidth > 0 && r.Bandwidth < current.Bandwidth {
+				// Wait longer before trying to upshift again
+				abr.upshiftMinFragments = min(abr.upshiftMinFragments*2, ABR_UPSHIFT_MAX_FRAGMENTS)
+				return &r
+			}
+		}
+
+		return nil
+	}
+
+	// Upshift after a sustained period without backlog.
+	// If the throughput was measured, it must also be enough for the next higher rendition.
+
+	if queueLength > 0 || abr.fragmentsSinceSwitch < abr.upshiftMinFragments || abr.sendTimeRatio > ABR_UPSHIFT_MAX_SEND_TIME_RATIO {
+		return nil
+	}
+
+	for i := currentIndex - 1; i >= 0; i-- {
+		r := variants.Renditions[i]
+
+		if r.Bandwidth <= current.Bandwidth {
+			continue
+		}
+
+		if abr.throughput <= 0 || abr.throughput >= float64(r.Bandwidth)*ABR_UPSHIFT_THROUGHPUT_FACTOR {
+			return &r
+		}
+
+		return nil
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+// Tests for server-assisted adaptive bitrate
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+func TestAbrChooseRendition(t *testing.T) {
+	variants := &HlsVariants{
+		GroupId: "group",
+		Renditions: []HlsRendition{
+			{StreamId: "high", Bandwidth: 4000000},
+			{StreamId: "mid", Bandwidth: 2000000},
+			{StreamId: "low", Bandwidth: 500000},
+		},
+	}
+
+	// No decision without variants or unknown stream
+
+	abr := NewHlsAbrController()
+
+	if abr.ChooseRendition(nil, "mid", 0, 10) != nil {
+		t.Errorf("Expected no switch without variants")
+	}
+
+	if abr.ChooseRendition(variants, "other", 10, 10) != nil {
+		t.Errorf("Expected no switch for a stream not in the group")
+	}
+
+	// Downshift when the queue backs up
+
+	r := abr.ChooseRendition(variants, "mid", 5, 10)
+
+	if r == nil || r.StreamId != "low" {
+		t.Errorf("Expected downshift to low, but got: %v", r)
+	}
+
+	if abr.ChooseRendition(variants, "low", 5, 10) != nil {
+		t.Errorf("Expected no switch for the lowest rendition")
+	}
+
+	// Downshift when the throughput is lower than the bandwidth
+
+	abr = NewHlsAbrController()
+	abr.AddSample(100000, time.Second, 1)
+
+	r = abr.ChooseRendition(variants, "mid", 0, 10)
+
+	if r == nil || r.StreamId != "low" {
+		t.Errorf("Expected downshift to low, but got: %v", r)
+	}
+
+	// Downshift when sending takes too long compared to the fragment duration
+
+	abr = NewHlsAbrController()
+	abr.AddSample(10000000, 900*time.Millisecond, 1)
+
+	r = abr.ChooseRendition(variants, "mid", 0, 10)
+
+	if r == nil || r.StreamId != "low" {
+		t.Errorf("Expected downshift to low, but got: %v", r)
+	}
+
+	// Upshift only after enough fragments with enough throughput
+
+	abr = NewHlsAbrController()
+	abr.AddSample(43750, 100*time.Millisecond, 1) // 3.5 Mbps
+
+	if abr.ChooseRendition(variants, "low", 0, 10) != nil {
+		t.Errorf("Expected no upshift before enough fragments were sent")
+	}
+
+	for i := 0; i < ABR_UPSHIFT_MIN_FRAGMENTS; i++ {
+		abr.OnFragmentSent()
+	}
+
+	r = abr.ChooseRendition(variants, "low", 0, 10)
+
+	if r == nil || r.StreamId != "mid" {
+		t.Errorf("Expected upshift to mid, but got: %v", r)
+	}
+
+	if abr.ChooseRendition(variants, "low", 1, 10) != nil {
+		t.Errorf("Expected no upshift with events in the queue")
+	}
+
+	if abr.ChooseRendition(variants, "mid", 0, 10) != nil {
+		t.Errorf("Expected no upshift without enough throughput")
+	}
+
+	abr.OnSwitch()
+
+	if abr.ChooseRendition(variants, "low", 0, 10) != nil {
+		t.Errorf("Expected no upshift right after a switch")
+	}
+
+	// Fast writes (absorbed by the socket buffer) are not used to estimate the throughput
+
+	abr = NewHlsAbrController()
+	abr.AddSample(10000000, time.Millisecond, 1)
+
+	if abr.throughput != 0 {
+		t.Errorf("Expected the throughput to be unknown, but got: %v", abr.throughput)
+	}
+
+	// After a downshift, the upshift is delayed further
+
+	abr = NewHlsAbrController()
+
+	if r = abr.ChooseRendition(variants, "mid", 5, 10); r == nil || r.StreamId != "low" {
+		t.Errorf("Expected downshift to low, but got: %v", r)
+	}
+
+	abr.OnSwitch()
+
+	for i := 0; i < ABR_UPSHIFT_MIN_FRAGMENTS; i++ {
+		abr.OnFragmentSent()
+	}
+
+	if abr.ChooseRendition(variants, "low", 0, 10) != nil {
+		t.Errorf("Expected no upshift right after a downshift")
+	}
+
+	for i := 0; i < ABR_UPSHIFT_MIN_FRAGMENTS; i++ {
+		abr.OnFragmentSent()
+	}
+
+	if r = abr.ChooseRendition(variants, "low", 0, 10); r == nil || r.StreamId != "mid" {
+		t.Errorf("Expected upshift to mid, but got: %v", r)
+	}
+}
+
+func TestAbrUpshift(t *testing.T) {
+	// The token allows all the renditions of the group
+
+	runTestAbrUpshift(signTestAuthTokenWithClaims(TEST_JWT_SECRET, jwt.MapClaims{
+		"sub":     "PULL",
+		"streams": "abr/stream/*",
+	}), true, t)
+}
+
+func TestAbrUpshiftNotAllowedByToken(t *testing.T) {
+	// The token only allows the low rendition
+
+	lowToken, _ := signAuthToken(TEST_JWT_SECRET, "PULL", "abr/stream/low")
+
+	runTestAbrUpshift(lowToken, false, t)
+}
+
+// Runs a spectator with adaptive bitrate, in a group with a low and a high rendition
+// spectatorToken - Auth token of the spectator
+// expectUpshift - True if the spectator must be switched to the high rendition
+func runTestAbrUpshift(spectatorToken string, expectUpshift bool, t *testing.T) {
+	logger := testMain()
+
+	server := makeTestServer(logger.CreateChildLogger("[Server] "), nil, true, "")
+	defer server.Close()
+
+	groupId := "abr/stream"
+	streamHigh := "abr/stream/high"
+	streamLow := "abr/stream/low"
+
+	publisherHigh := connectTestClient(server.url, "PUSH", streamHigh, map[string]string{
+		"auth":      signTestGroupPushToken(streamHigh, groupId),
+		"group":     groupId,
+		"bandwidth": "200000",
+	}, t)
+
+	if publisherHigh == nil {
+		return
+	}
+
+	defer publisherHigh.Close()
+
+	publisherLow := connectTestClient(server.url, "PUSH", streamLow, map[string]string{
+		"auth":      signTestGroupPushToken(streamLow, groupId),
+		"group":     groupId,
+		"bandwidth": "100000",
+	}, t)
+
+	if publisherLow == nil {
+		return
+	}
+
+	defer publisherLow.Close()
+
+	spectator := connectTestClient(server.url, "PULL", streamLow, map[string]string{
+		"abr":  "true",
+		"auth": spectatorToken,
+	}, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	if expectTestVariants(spectator, groupId, 2, t) == nil {
+		return
+	}
+
+	fragmentMessage := WebsocketProtocolMessage{
+		MessageType: "F",
+		Parameters: map[string]string{
+			"duration": "1",
+		},
+	}
+
+	fragmentData := make([]byte, 1000)
+
+	// After enough fragments with a good throughput, the spectator is upshifted
+
+	for i := 0; i < ABR_UPSHIFT_MIN_FRAGMENTS; i++ {
+		_ = publisherLow.WriteMessage(websocket.TextMessage, []byte(fragmentMessage.Serialize()))
+		_ = publisherLow.WriteMessage(websocket.BinaryMessage, fragmentData)
+
+		msg, _ := readTestMessage(spectator, t)
+
+		if msg == nil || msg.MessageType != "F" {
+			t.Errorf("Expected F message, but received: %v", msg)
+			return
+		}
+
+		_, _ = readTestMessage(spectator, t)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	_ = publisherHigh.WriteMessage(websocket.TextMessage, []byte(fragmentMessage.Serialize()))
+	_ = publisherHigh.WriteMessage(websocket.BinaryMessage, TEST_STREAM_DATA_1[0].Data)
+
+	if !expectUpshift {
+		// The spectator must keep receiving the low rendition
+
+		time.Sleep(100 * time.Millisecond)
+
+		_ = publisherLow.WriteMessage(websocket.TextMessage, []byte(fragmentMessage.Serialize()))
+		_ = publisherLow.WriteMessage(websocket.BinaryMessage, TEST_STREAM_DATA_2[0].Data)
+
+		msg, _ := readTestMessage(spectator, t)
+
+		if msg == nil || msg.MessageType != "F" {
+			t.Errorf("Expected F message, but received: %v", msg)
+			return
+		}
+
+		_, data := readTestMessage(spectator, t)
+
+		if !bytes.Equal(data, TEST_STREAM_DATA_2[0].Data) {
+			t.Errorf("Expected a fragment of the low rendition, but received: %v", data)
+		}
+
+		return
+	}
+
+	msg, _ := readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "SWITCHED" || msg.GetParameter("stream") != streamHigh || msg.GetParameter("reason") != HLS_SWITCH_REASON_ABR {
+		t.Errorf("Expected SWITCHED message, but received: %v", msg)
+		return
+	}
+
+	msg, _ = readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "F" {
+		t.Errorf("Expected F message, but received: %v", msg)
+		return
+	}
+
+	_, data := readTestMessage(spectator, t)
+
+	if !bytes.Equal(data, TEST_STREAM_DATA_1[0].Data) {
+		t.Errorf("Fragment data does not match. Expected: %v, Actual: %v", TEST_STREAM_DATA_1[0].Data, data)
+	}
+}
@@ -0,0 +1,416 @@
+// Admin API
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Max size (in bytes) for admin API request bodies
+const ADMIN_API_MAX_BODY_SIZE = 64 * 1024
+
+// Admin API error response
+type AdminApiErrorResponse struct {
+	// Error code
+	Code string `json:"code"`
+
+	// Error message
+	Message string `json:"message"`
+}
+
+// Sends an admin API error response
+func writeAdminApiError(w http.ResponseWriter, status int, code string, message string) {
+	writeAdminApiJson(w, status, AdminApiErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// Sends an admin API JSON response
+func writeAdminApiJson(w http.ResponseWriter, status int, body interface{}) {
+	jsonBody, err := json.Marshal(body)
+
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(jsonBody)
+}
+
+// Reads the JSON body of an admin API request
+// Returns false if the body is not valid (the error response is already sent)
+func readAdminApiJsonBody(w http.ResponseWriter, req *http.Request, dest interface{}) bool {
+	bodyData, err := io.ReadAll(io.LimitReader(req.Body, ADMIN_API_MAX_BODY_SIZE))
+
+	if err != nil {
+		writeAdminApiError(w, 400, "BAD_REQUEST", "Could not read the request body")
+		return false
+	}
+
+	err = json.Unmarshal(bodyData, dest)
+
+	if err != nil {
+		writeAdminApiError(w, 400, "BAD_REQUEST", "Invalid JSON body: "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+// Checks the authorization of an admin API request
+// Requests are never allowed without a secret
+func (server *HttpServer) checkAdminApiAuth(req *http.Request) bool {
+	if server.config.AdminApiSecret == "" {
+		return false
+	}
+
+	authHeader := req.Header.Get("Authorization")
+
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return false
+	}
+
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(server.config.AdminApiSecret)) == 1
+}
+
+// Serves an admin API request
+func (server *HttpServer) ServeAdminApi(w http.ResponseWriter, req *http.Request) {
+	if !server.checkAdminApiAuth(req) {
+		writeAdminApiError(w, 401, "UNAUTHORIZED", "Invalid or missing admin API secret")
+		return
+	}
+
+	route := strings.TrimPrefix(req.URL.Path, server.config.AdminApiPrefix)
+
+	switch route {
+	case "cue":
+		if req.Method != "POST" {
+			writeAdminApiError(w, 405, "METHOD_NOT_ALLOWED", "Method not allowed")
+			return
+		}
+		server.HandleAdminApiCue(w, req)
+	case "record":
+		switch req.Method {
+		case "POST":
+			server.HandleAdminApiStartRecording(w, req)
+		case "DELETE":
+			server.HandleAdminApiStopRecording(w, req)
+		default:
+			writeAdminApiError(w, 405, "METHOD_NOT_ALLOWED", "Method not allowed")
+		}
+	case "origin":
+		switch req.Method {
+		case "POST":
+			server.HandleAdminApiStartOriginPull(w, req)
+		case "DELETE":
+			server.HandleAdminApiStopOriginPull(w, req)
+		default:
+			writeAdminApiError(w, 405, "METHOD_NOT_ALLOWED", "Method not allowed")
+		}
+	case "group":
+		switch req.Method {
+		case "GET":
+			server.HandleAdminApiGetGroup(w, req)
+		case "POST":
+			server.HandleAdminApiDeclareGroup(w, req)
+		case "DELETE":
+			server.HandleAdminApiRemoveGroup(w, req)
+		default:
+			writeAdminApiError(w, 405, "METHOD_NOT_ALLOWED", "Method not allowed")
+		}
+	case "revoke":
+		if req.Method != "POST" {
+			writeAdminApiError(w, 405, "METHOD_NOT_ALLOWED", "Method not allowed")
+			return
+		}
+		server.HandleAdminApiRevokeTokens(w, req)
+	default:
+		writeAdminApiError(w, 404, "NOT_FOUND", "Admin API route not found")
+	}
+}
+
+// Handles the request to inject a cue into a live source
+// POST {prefix}cue?stream={streamId}
+// Body: JSON object with the cue parameters (string values)
+func (server *HttpServer) HandleAdminApiCue(w http.ResponseWriter, req *http.Request) {
+	streamId := req.URL.Query().Get("stream")
+
+	if streamId == "" {
+		writeAdminApiError(w, 400, "BAD_REQUEST", "Stream ID cannot be empty")
+		return
+	}
+
+	cueParameters := make(map[string]string)
+
+	if !readAdminApiJsonBody(w, req, &cueParameters) {
+		return
+	}
+
+	if len(cueParameters) == 0 {
+		writeAdminApiError(w, 400, "BAD_REQUEST", "The cue must have at least one parameter")
+		return
+	}
+
+	source := server.sourceController.GetSource(streamId)
+
+	if source == nil {
+		writeAdminApiError(w, 404, "STREAM_NOT_FOUND", "There is no live source for the stream in this node")
+		return
+	}
+
+	if !source.AddCue(&HlsCue{Parameters: cueParameters}) {
+		writeAdminApiError(w, 409, "CUE_REJECTED", "The source is closed or has too many pending cues")
+		return
+	}
+
+	writeAdminApiJson(w, 200, map[string]string{"status": "OK"})
+}
+
+// Admin API request body to declare a stream group
+type AdminApiDeclareGroupBody struct {
+	// Renditions of the group
+	Renditions []HlsRendition `json:"renditions"`
+}
+
+// Admin API response with the variants of a stream group
+type AdminApiGroupResponse struct {
+	// ID of the group
+	Id string `json:"id"`
+
+	// Renditions of the group
+	Renditions []HlsRendition `json:"renditions"`
+}
+
+// Handles the request to get a stream group
+// GET {prefix}group?id={groupId}
+func (server *HttpServer) HandleAdminApiGetGroup(w http.ResponseWriter, req *http.Request) {
+	groupId := req.URL.Query().Get("id")
+
+	variants := server.sourceController.GetGroupVariants(groupId)
+
+	if variants == nil {
+		writeAdminApiError(w, 404, "GROUP_NOT_FOUND", "The stream group does not exist")
+		return
+	}
+
+	writeAdminApiJson(w, 200, AdminApiGroupResponse{
+		Id:         variants.GroupId,
+		Renditions: variants.Renditions,
+	})
+}
+
+// Handles the request to declare a stream group
+// POST {prefix}group?id={groupId}
+// Body: JSON object with the renditions of the group
+func (server *HttpServer) HandleAdminApiDeclareGroup(w http.ResponseWriter, req *http.Request) {
+	groupId := req.URL.Query().Get("id")
+
+	if groupId == "" {
+		writeAdminApiError(w, 400, "BAD_REQUEST", "Group ID cannot be empty")
+		return
+	}
+
+	body := AdminApiDeclareGroupBody{}
+
+	if !readAdminApiJsonBody(w, req, &body) {
+		return
+	}
+
+	if len(body.Renditions) == 0 {
+		writeAdminApiError(w, 400, "BAD_REQUEST", "The group must have at least one rendition")
+		return
+	}
+
+	for _, r := range body.Renditions {
+		if r.StreamId == "" || len(r.StreamId) > 255 {
+			writeAdminApiError(w, 400, "BAD_REQUEST", "Invalid rendition stream ID")
+			return
+		}
+	}
+
+	server.sourceController.DeclareGroup(groupId, body.Renditions)
+
+	writeAdminApiJson(w, 200, map[string]string{"status": "OK"})
+}
+
+// Handles the request to remove a stream group
+// DELETE {prefix}group?id={groupId}
+// Only the renditions declared by the admin API are removed
+func (server *HttpServer) HandleAdminApiRemoveGroup(w http.ResponseWriter, req *http.Request) {
+	groupId := req.URL.Query().Get("id")
+
+	if groupId == "" {
+		writeAdminApiError(w, 400, "BAD_REQUEST", "Group ID cannot be empty")
+		return
+	}
+
+	server.sourceController.RemoveDeclaredGroup(groupId)
+
+	writeAdminApiJson(w, 200, map[string]string{"status": "OK"})
+}
+
+// Admin API response for a recording
+type AdminApiRecordingResponse struct {
+	// Status
+	Status string `json:"status"`
+
+	// Location of the recording in the storage
+	Location string `json:"location"`
+}
+
+// Handles the request to start recording a live source
+// POST {prefix}record?stream={streamId}
+func (server *HttpServer) HandleAdminApiStartRecording(w http.ResponseWriter, req *http.Request) {
+	if !server.sourceController.recordingController.IsEnabled() {
+		writeAdminApiError(w, 409, "RECORDING_DISABLED", "Recording is disabled in this node")
+		return
+	}
+
+	source := server.sourceController.GetSource(req.URL.Query().Get("stream"))
+
+	if source == nil {
+		writeAdminApiError(w, 404, "STREAM_NOT_FOUND", "There is no live source for the stream in this node")
+		return
+	}
+
+	location := source.StartRecording()
+
+	if location == "" {
+		writeAdminApiError(w, 500, "RECORDING_ERROR", "Could not start the recording")
+		return
+	}
+
+	writeAdminApiJson(w, 200, AdminApiRecordingResponse{
+		Status:   "OK",
+		Location: location,
+	})
+}
+
+// Handles the request to stop recording a live source
+// DELETE {prefix}record?stream={streamId}
+func (server *HttpServer) HandleAdminApiStopRecording(w http.ResponseWriter, req *http.Request) {
+	source := server.sourceController.GetSource(req.URL.Query().Get("stream"))
+
+	if source == nil {
+		writeAdminApiError(w, 404, "STREAM_NOT_FOUND", "There is no live source for the stream in this node")
+		return
+	}
+
+	if !source.StopRecording() {
+		writeAdminApiError(w, 409, "NOT_RECORDING", "The stream is not being recorded")
+		return
+	}
+
+	writeAdminApiJson(w, 200, map[string]string{"status": "OK"})
+}
+
+// Admin API request body to pull a stream from an HTTP origin
+type AdminApiOriginPullBody struct {
+	// URL of the HLS playlist (m3u8)
+	Url string `json:"url"`
+}
+
+// Handles the request to start pulling a stream from an HTTP origin
+// POST {prefix}origin?stream={streamId}
+// Body: JSON object with the URL of the playlist
+func (server *HttpServer) HandleAdminApiStartOriginPull(w http.ResponseWriter, req *http.Request) {
+	streamId := req.URL.Query().Get("stream")
+
+	if streamId == "" || len(streamId) > 255 {
+		writeAdminApiError(w, 400, "BAD_REQUEST", "Invalid stream ID")
+		return
+	}
+
+	body := AdminApiOriginPullBody{}
+
+	if !readAdminApiJsonBody(w, req, &body) {
+		return
+	}
+
+	err := server.originPullController.Start(streamId, body.Url)
+
+	if err != nil {
+		writeAdminApiError(w, 400, "BAD_REQUEST", err.Error())
+		return
+	}
+
+	writeAdminApiJson(w, 200, map[string]string{"status": "OK"})
+}
+
+// Handles the request to stop pulling a stream from an HTTP origin
+// DELETE {prefix}origin?stream={streamId}
+func (server *HttpServer) HandleAdminApiStopOriginPull(w http.ResponseWriter, req *http.Request) {
+	if !server.originPullController.Stop(req.URL.Query().Get("stream")) {
+		writeAdminApiError(w, 404, "NOT_PULLING", "The stream is not being pulled from an origin")
+		return
+	}
+
+	writeAdminApiJson(w, 200, map[string]string{"status": "OK"})
+}
+
+// Admin API request body to revoke tokens
+type AdminApiRevokeTokensBody struct {
+	// Token ID (jti claim) to revoke
+	TokenId string `json:"jti"`
+
+	// User ID (uid claim) to revoke
+	UserId string `json:"uid"`
+
+	// Duration of the revocation (seconds). If 0, the default one is used.
+	Ttl int `json:"ttl"`
+}
+
+// Handles the request to revoke tokens
+// POST {prefix}revoke
+// Body: JSON object with the token ID or user ID to revoke
+func (server *HttpServer) HandleAdminApiRevokeTokens(w http.ResponseWriter, req *http.Request) {
+	body := AdminApiRevokeTokensBody{}
+
+	if !readAdminApiJsonBody(w, req, &body) {
+		return
+	}
+
+	if body.TokenId == "" && body.UserId == "" {
+		writeAdminApiError(w, 400, "BAD_REQUEST", "A token ID (jti) or user ID (uid) is required")
+		return
+	}
+
+	if body.Ttl < 0 {
+		writeAdminApiError(w, 400, "BAD_REQUEST", "The TTL cannot be negative")
+		return
+	}
+
+	ttl := time.Duration(body.Ttl) * time.Second
+
+	if body.TokenId != "" {
+		err := server.authController.RevokeTokens("jti", body.TokenId, ttl)
+
+		if err != nil {
+			server.logger.Errorf("Could not share the revocation of token %v: %v", body.TokenId, err)
+			writeAdminApiError(w, 500, "REVOCATION_ERROR", "The token was revoked in this node, but the revocation could not be shared with other nodes")
+			return
+		}
+	}
+
+	if body.UserId != "" {
+		err := server.authController.RevokeTokens("uid", body.UserId, ttl)
+
+		if err != nil {
+			server.logger.Errorf("Could not share the revocation of user %v: %v", body.UserId, err)
+			writeAdminApiError(w, 500, "REVOCATION_ERROR", "The user was revoked in this node, but the revocation could not be shared with other nodes")
+			return
+		}
+	}
+
+	writeAdminApiJson(w, 200, map[string]string{"status": "OK"})
+}
@@ -3,7 +3,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/AgustinSRG/glog"
@@ -12,11 +15,21 @@ import (
 
 // Signs auth token
 func signAuthToken(secret string, action string, streamId string) (string, error) {
+	return signAuthTokenWithKeyId(secret, "", action, streamId)
+}
+
+// Signs auth token, setting the key ID (kid) header
+// keyId - ID of the secret. If empty, the header is not set.
+func signAuthTokenWithKeyId(secret string, keyId string, action string, streamId string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"sub": action + ":" + streamId,
 		"exp": time.Now().Add(1 * time.Hour).Unix(),
 	})
 
+	if keyId != "" {
+		token.Header["kid"] = keyId
+	}
+
 	tokenString, err := token.SignedString([]byte(secret))
 
 	if err != nil {
@@ -28,16 +41,37 @@ func signAuthToken(secret string, action string, streamId string) (string, error
 
 // Validates authentication token
 func validateAuthToken(tokenString string, secret string, action string, streamId string) bool {
+	valid, _ := validateAuthTokenClaims(tokenString, secret, action, streamId)
+	return valid
+}
+
+// Validates authentication token, returning its claims
+func validateAuthTokenClaims(tokenString string, secret string, action string, streamId string) (bool, jwt.MapClaims) {
+	return validateAuthTokenClaimsWithKeys(tokenString, NewAuthSecretSet(AuthSecretSetConfig{Secret: secret}, nil), nil, action, streamId)
+}
+
+// Validates authentication token, returning its claims
+// secrets - Secrets for HMAC tokens. If nil, HMAC tokens are rejected.
+// keys - Public keys for tokens signed with asymmetric algorithms. If nil, those tokens are rejected.
+func validateAuthTokenClaimsWithKeys(tokenString string, secrets *AuthSecretSet, keys *JwtKeySet, action string, streamId string) (bool, jwt.MapClaims) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			if secrets == nil {
+				return nil, errors.New("HMAC tokens are not accepted")
+			}
+
+			return secrets.GetKey(token)
+		}
+
+		if keys == nil {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		return []byte(secret), nil
+		return keys.GetKey(token)
 	})
 
 	if err != nil {
-		return false
+		return false, nil
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok {
@@ -45,22 +79,148 @@ func validateAuthToken(tokenString string, secret string, action string, streamI
 		d, err := claims.GetExpirationTime()
 
 		if err != nil || d == nil || d.UnixMilli() < time.Now().UnixMilli() {
-			return false
+			return false, nil
 		}
 
 		// Validate subject
-		sub, err := claims.GetSubject()
+		if matchTokenSubject(claims, action, streamId) {
+			return true, claims
+		}
+
+		return false, nil
+	} else {
+		return false, nil
+	}
+}
+
+// Checks if the subject of a token allows an action for a stream
+// The subject can be {ACTION}:{STREAM_ID}, or the action for scoped tokens (streams claim)
+func matchTokenSubject(claims jwt.MapClaims, action string, streamId string) bool {
+	sub, err := claims.GetSubject()
+
+	if err != nil {
+		return false
+	}
+
+	if sub == action+":"+streamId {
+		return true
+	}
+
+	// Scoped tokens: The subject is the action, and the streams claim has the allowed stream patterns
+
+	return sub == action && matchStreamScopes(getStringListClaim(claims, "streams"), streamId)
+}
+
+// Gets a claim that can be a string or a list of strings
+// Returns nil if the claim is not present or it has a different type
+func getStringListClaim(claims jwt.MapClaims, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		list := make([]string, 0, len(value))
+
+		for _, item := range value {
+			str, ok := item.(string)
+
+			if !ok {
+				return nil
+			}
+
+			list = append(list, str)
+		}
+
+		return list
+	default:
+		return nil
+	}
+}
+
+// Checks if a push token allows to join a stream group (group claim)
+// The claim can be a group ID or a list of group IDs
+func isGroupAllowedByClaims(claims jwt.MapClaims, groupId string) bool {
+	if claims == nil {
+		return false
+	}
+
+	for _, allowedGroup := range getStringListClaim(claims, "group") {
+		if allowedGroup == groupId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if a stream ID matches any of the patterns of a scoped token
+func matchStreamScopes(patterns []string, streamId string) bool {
+	for _, pattern := range patterns {
+		if matchStreamPattern(pattern, streamId) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if a stream ID matches a pattern
+// In the pattern, '*' matches any sequence of characters (including '/'), and '?' matches a single character
+func matchStreamPattern(pattern string, streamId string) bool {
+	p := []rune(pattern)
+	s := []rune(streamId)
+
+	pi, si := 0, 0
+
+	// Position to backtrack to, after the last '*'
+	starPi, starSi := -1, 0
 
-		if err != nil {
+	for si < len(s) {
+		if pi < len(p) && (p[pi] == '?' || p[pi] == s[si]) {
+			pi++
+			si++
+		} else if pi < len(p) && p[pi] == '*' {
+			starPi = pi
+			starSi = si
+			pi++
+		} else if starPi >= 0 {
+			// Let the last '*' match one more character
+			starSi++
+			si = starSi
+			pi = starPi + 1
+		} else {
 			return false
 		}
+	}
 
-		expectedSubject := action + ":" + streamId
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
 
-		return sub == expectedSubject
-	} else {
+	return pi == len(p)
+}
+
+// Gets a numeric claim
+// Returns false if the claim is not present or it is not a number
+func getNumberClaim(claims jwt.MapClaims, name string) (float64, bool) {
+	if claims == nil {
+		return 0, false
+	}
+
+	value, ok := claims[name].(float64)
+
+	return value, ok
+}
+
+// Gets a boolean claim
+// Returns false if the claim is not present or it is not a boolean
+func getBoolClaim(claims jwt.MapClaims, name string) bool {
+	if claims == nil {
 		return false
 	}
+
+	value, ok := claims[name].(bool)
+
+	return ok && value
 }
 
 // Auth configuration
@@ -71,23 +231,108 @@ type AuthConfiguration struct {
 	// Secret for push tokens
 	PushSecret string
 
+	// Secret for the tokens of the nodes relaying streams between them
+	// If empty, the nodes use pull tokens instead
+	RelaySecret string
+
+	// Identities of the nodes allowed to relay streams using their TLS client certificates, separated by commas
+	// They are matched against the common name and the subject alternative names. '*' and '?' are wildcards.
+	// If empty, any client certificate verified by the node TLS listener is allowed.
+	NodeIdentities string
+
+	// File with the secrets for pull tokens
+	PullSecretsFile string
+
+	// File with the secrets for push tokens
+	PushSecretsFile string
+
+	// Period to reload the secrets files (seconds)
+	SecretsReloadSeconds int
+
+	// Public keys for pull tokens
+	PullKeys JwtKeySetConfig
+
+	// Public keys for push tokens
+	PushKeys JwtKeySetConfig
+
 	// True to allow push
 	AllowPush bool
+
+	// Token revocation list
+	Revocations TokenRevocationListConfig
+
+	// Default duration of the token revocations (seconds)
+	RevocationTtlSeconds int
+
+	// Authorization webhook, to authorize clients without valid tokens
+	Webhook AuthWebhookConfig
 }
 
 // Creates new instance of AuthController
-func NewAuthController(config AuthConfiguration, logger *glog.Logger) *AuthController {
-	if config.PullSecret == "" {
-		logger.Warning("PULL_SECRET is empty. This means authentication is disabled for pulling streams.")
+// revocationStore - Store to share the revoked tokens between nodes (can be nil)
+func NewAuthController(config AuthConfiguration, revocationStore TokenRevocationStore, logger *glog.Logger) *AuthController {
+	pullSecretsConfig := AuthSecretSetConfig{
+		Secret:              config.PullSecret,
+		SecretsFile:         config.PullSecretsFile,
+		ReloadPeriodSeconds: config.SecretsReloadSeconds,
+	}
+
+	pushSecretsConfig := AuthSecretSetConfig{
+		Secret:              config.PushSecret,
+		SecretsFile:         config.PushSecretsFile,
+		ReloadPeriodSeconds: config.SecretsReloadSeconds,
+	}
+
+	var pullSecrets *AuthSecretSet
+	var pushSecrets *AuthSecretSet
+
+	if !pullSecretsConfig.IsEmpty() {
+		pullSecrets = NewAuthSecretSet(pullSecretsConfig, logger.CreateChildLogger("[PullSecrets] "))
 	}
 
-	if config.PushSecret == "" {
+	if !pushSecretsConfig.IsEmpty() {
+		pushSecrets = NewAuthSecretSet(pushSecretsConfig, logger.CreateChildLogger("[PushSecrets] "))
+	}
+
+	var pullKeys *JwtKeySet
+	var pushKeys *JwtKeySet
+
+	if !config.PullKeys.IsEmpty() {
+		pullKeys = NewJwtKeySet(config.PullKeys, logger.CreateChildLogger("[PullKeys] "))
+	}
+
+	if !config.PushKeys.IsEmpty() {
+		pushKeys = NewJwtKeySet(config.PushKeys, logger.CreateChildLogger("[PushKeys] "))
+	}
+
+	if pullSecrets == nil {
+		if pullKeys == nil && config.Webhook.Url == "" {
+			logger.Warning("PULL_SECRET is empty. This means authentication is disabled for pulling streams.")
+		} else if config.RelaySecret == "" {
+			logger.Warning("PULL_SECRET is empty. The nodes will not be able to authenticate to relay streams between them.")
+		}
+	}
+
+	var webhook *AuthWebhook
+
+	if config.Webhook.Url != "" {
+		webhook = NewAuthWebhook(config.Webhook, logger.CreateChildLogger("[Webhook] "))
+	}
+
+	if pushSecrets == nil && pushKeys == nil && webhook == nil {
 		logger.Warning("PUSH_SECRET is empty. This means authentication is disabled for pushing streams.")
 	}
 
 	return &AuthController{
-		config: config,
-		logger: logger,
+		config:      config,
+		logger:      logger,
+		pullSecrets: pullSecrets,
+		pushSecrets: pushSecrets,
+		pullKeys:    pullKeys,
+		pushKeys:    pushKeys,
+		sessions:    NewPullSessionTracker(),
+		revocations: NewTokenRevocationList(config.Revocations, revocationStore, logger.CreateChildLogger("[Revocations] ")),
+		webhook:     webhook,
 	}
 }
 
@@ -98,6 +343,48 @@ type AuthController struct {
 
 	// Logger
 	logger *glog.Logger
+
+	// Secrets for pull tokens (nil if not configured)
+	pullSecrets *AuthSecretSet
+
+	// Secrets for push tokens (nil if not configured)
+	pushSecrets *AuthSecretSet
+
+	// Public keys for pull tokens (nil if not configured)
+	pullKeys *JwtKeySet
+
+	// Public keys for push tokens (nil if not configured)
+	pushKeys *JwtKeySet
+
+	// Tracker of the pull sessions
+	sessions *PullSessionTracker
+
+	// List of revoked tokens
+	revocations *TokenRevocationList
+
+	// Authorization webhook (nil if not configured)
+	webhook *AuthWebhook
+}
+
+// Stops reloading the secrets and the public keys
+func (ac *AuthController) Close() {
+	if ac.pullSecrets != nil {
+		ac.pullSecrets.Close()
+	}
+
+	if ac.pushSecrets != nil {
+		ac.pushSecrets.Close()
+	}
+
+	if ac.pullKeys != nil {
+		ac.pullKeys.Close()
+	}
+
+	if ac.pushKeys != nil {
+		ac.pushKeys.Close()
+	}
+
+	ac.revocations.Close()
 }
 
 // Checks if PUSH is allowed
@@ -105,20 +392,192 @@ func (ac *AuthController) IsPushAllowed() bool {
 	return ac.config.AllowPush
 }
 
-// Validates PULL token
+// Validates PULL token, without a known client IP address
+// Runs the same checks as ValidatePullTokenForClient, so tokens bound to an IP address are rejected
 func (ac *AuthController) ValidatePullToken(token string, streamId string) bool {
-	if ac.config.PullSecret == "" {
+	_, errMsg := ac.ValidatePullTokenForClient(token, streamId, "")
+	return errMsg == ""
+}
+
+// Validates PULL token for a client, checking the IP binding (ip claim)
+// Returns the claims (nil if authentication is disabled), or an error message if the token is not valid
+func (ac *AuthController) ValidatePullTokenForClient(token string, streamId string, ip string) (jwt.MapClaims, string) {
+	if ac.pullSecrets == nil && ac.pullKeys == nil {
+		if ac.webhook != nil && !ac.webhook.Authorize("PULL", streamId, ip, token) {
+			return nil, "Invalid auth token"
+		}
+
+		return nil, ""
+	}
+
+	valid, claims := validateAuthTokenClaimsWithKeys(token, ac.pullSecrets, ac.pullKeys, "PULL", streamId)
+
+	if !valid {
+		if ac.webhook != nil && ac.webhook.Authorize("PULL", streamId, ip, token) {
+			return nil, ""
+		}
+
+		return nil, "Invalid auth token"
+	}
+
+	if ac.revocations.IsRevoked(claims) {
+		return nil, "The auth token was revoked"
+	}
+
+	if _, present := claims["ip"]; present && !matchIpClaim(getStringListClaim(claims, "ip"), ip) {
+		return nil, "The auth token is not valid for the client IP address"
+	}
+
+	return claims, ""
+}
+
+// Checks if the claims of an already validated pull token allow another stream
+// Used to choose the renditions the server can switch a client to
+// claims - Claims of the token (nil if the client was not authenticated with a token)
+func (ac *AuthController) IsStreamAllowedByPullClaims(claims jwt.MapClaims, streamId string) bool {
+	if ac.pullSecrets == nil && ac.pullKeys == nil {
+		// Authentication disabled, or the decisions are made by the webhook
+		return ac.webhook == nil
+	}
+
+	if claims == nil || ac.revocations.IsRevoked(claims) {
+		return false
+	}
+
+	return matchTokenSubject(claims, "PULL", streamId)
+}
+
+// Starts a pull session for a client, enforcing the limits set by the token claims:
+// - max_conn: Max number of connections for the user (uid claim), the token ID (jti claim), or the token itself
+// - max_duration: Max duration of the session (seconds)
+// Returns the session, or nil with the error code and message
+func (ac *AuthController) StartPullSession(token string, streamId string, ip string) (session *PullSession, errCode string, errMsg string) {
+	if ac.ValidateRelayToken(token, streamId) {
+		// Other node relaying the stream, the limits do not apply
+		return &PullSession{
+			Internal: true,
+		}, "", ""
+	}
+
+	claims, errMsg := ac.ValidatePullTokenForClient(token, streamId, ip)
+
+	if errMsg != "" {
+		return nil, "AUTH_ERROR", errMsg
+	}
+
+	session = &PullSession{
+		Claims: claims,
+	}
+
+	if maxDuration, ok := getNumberClaim(claims, "max_duration"); ok && maxDuration > 0 {
+		session.MaxDuration = time.Duration(maxDuration * float64(time.Second))
+	}
+
+	if maxConnections, ok := getNumberClaim(claims, "max_conn"); ok {
+		key := "token:" + token
+
+		if uid, ok := claims["uid"].(string); ok && uid != "" {
+			key = "uid:" + uid
+		} else if jti, ok := claims["jti"].(string); ok && jti != "" {
+			key = "jti:" + jti
+		}
+
+		if !ac.sessions.Acquire(key, int(maxConnections)) {
+			return nil, "CONNECTION_LIMIT", "The max number of connections for the auth token was reached"
+		}
+
+		session.tracker = ac.sessions
+		session.key = key
+	}
+
+	return session, "", ""
+}
+
+// Checks if the client IP matches any of the addresses of the ip claim
+func matchIpClaim(addresses []string, ip string) bool {
+	clientIp := net.ParseIP(ip)
+
+	if clientIp == nil {
+		return false
+	}
+
+	for _, address := range addresses {
+		if clientIp.Equal(net.ParseIP(address)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validates a token of a node relaying a stream
+// Returns false if RELAY_SECRET is not configured
+func (ac *AuthController) ValidateRelayToken(token string, streamId string) bool {
+	if ac.config.RelaySecret == "" || token == "" {
+		return false
+	}
+
+	return validateAuthToken(token, ac.config.RelaySecret, "RELAY", streamId)
+}
+
+// Checks if a node authenticated by its TLS client certificate can relay streams
+// identities - Identities of the verified client certificate
+func (ac *AuthController) ValidateNodeIdentity(identities []string) bool {
+	if len(identities) == 0 {
+		return false
+	}
+
+	if ac.config.NodeIdentities == "" {
 		return true
 	}
-	return validateAuthToken(token, ac.config.PullSecret, "PULL", streamId)
+
+	for _, pattern := range strings.Split(ac.config.NodeIdentities, ",") {
+		pattern = strings.TrimSpace(pattern)
+
+		if pattern == "" {
+			continue
+		}
+
+		for _, identity := range identities {
+			if matchStreamPattern(pattern, identity) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Creates a token to relay a stream from another node
+// It is signed with RELAY_SECRET, or it is a PULL token if not configured
+func (ac *AuthController) CreateRelayToken(streamId string) string {
+	if ac.config.RelaySecret == "" {
+		return ac.CreatePullToken(streamId)
+	}
+
+	token, err := signAuthToken(ac.config.RelaySecret, "RELAY", streamId)
+
+	if err != nil {
+		ac.logger.Errorf("Error signing token: %v", err)
+	}
+
+	return token
 }
 
-// Creates a PULL token
+// Creates a PULL token, signed with the primary secret
 func (ac *AuthController) CreatePullToken(streamId string) string {
-	if ac.config.PullSecret == "" {
+	if ac.pullSecrets == nil {
 		return ""
 	}
-	token, err := signAuthToken(ac.config.PullSecret, "PULL", streamId)
+
+	secret, ok := ac.pullSecrets.GetPrimary()
+
+	if !ok {
+		ac.logger.Error("Error signing token: No secrets loaded")
+		return ""
+	}
+
+	token, err := signAuthTokenWithKeyId(secret.Secret, secret.Id, "PULL", streamId)
 
 	if err != nil {
 		ac.logger.Errorf("Error signing token: %v", err)
@@ -129,8 +588,63 @@ func (ac *AuthController) CreatePullToken(streamId string) string {
 
 // Validates PUSH token
 func (ac *AuthController) ValidatePushToken(token string, streamId string) bool {
-	if ac.config.PushSecret == "" {
-		return true
+	valid, _ := ac.ValidatePushTokenClaims(token, streamId, "")
+	return valid
+}
+
+// Validates PUSH token, returning its claims
+// ip - IP address of the client, sent to the authorization webhook
+// If authentication is disabled, or the client was authorized by the webhook, the claims will be nil
+func (ac *AuthController) ValidatePushTokenClaims(token string, streamId string, ip string) (bool, jwt.MapClaims) {
+	if ac.pushSecrets == nil && ac.pushKeys == nil {
+		if ac.webhook != nil {
+			return ac.webhook.Authorize("PUSH", streamId, ip, token), nil
+		}
+
+		return true, nil
+	}
+	valid, claims := validateAuthTokenClaimsWithKeys(token, ac.pushSecrets, ac.pushKeys, "PUSH", streamId)
+
+	if !valid && ac.webhook != nil && ac.webhook.Authorize("PUSH", streamId, ip, token) {
+		return true, nil
+	}
+
+	if !valid || ac.revocations.IsRevoked(claims) {
+		return false, nil
+	}
+
+	return true, claims
+}
+
+// Revokes the tokens with a token ID (jti claim) or user ID (uid claim)
+// idType - "jti" or "uid"
+// id - Token ID or user ID
+// ttl - Duration of the revocation. If 0, the default one is used.
+// The revocation must last at least until the revoked tokens expire.
+func (ac *AuthController) RevokeTokens(idType string, id string, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = time.Duration(ac.config.RevocationTtlSeconds) * time.Second
+	}
+
+	if ttl <= 0 {
+		ttl = DEFAULT_REVOCATION_TTL_SECONDS * time.Second
 	}
-	return validateAuthToken(token, ac.config.PushSecret, "PUSH", streamId)
+
+	ac.logger.Infof("Revoking tokens with %v=%v for %v", idType, id, ttl)
+
+	return ac.revocations.Revoke(idType+":"+id, time.Now().Add(ttl))
+}
+
+// Watches a connected session, in order to close it if its token is revoked
+// claims - Claims of the token (nil if authentication is disabled)
+// onRevoked - Function called if the token is revoked
+// Returns an ID to stop watching the session with UnwatchTokenRevocation
+func (ac *AuthController) WatchTokenRevocation(claims jwt.MapClaims, onRevoked func()) uint64 {
+	return ac.revocations.Watch(claims, onRevoked)
+}
+
+// Stops watching a session
+// Must be called once the session is closed
+func (ac *AuthController) UnwatchTokenRevocation(watcherId uint64) {
+	ac.revocations.Unwatch(watcherId)
 }
@@ -0,0 +1,495 @@
+// Public keys to validate authentication tokens (asymmetric algorithms)
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Timeout for the requests to download a JWKS
+const JWKS_REQUEST_TIMEOUT = 10 * time.Second
+
+// Max size (bytes) of a JWKS
+const JWKS_MAX_SIZE = 1024 * 1024
+
+// Configuration of a set of public keys
+type JwtKeySetConfig struct {
+	// List of PEM files with public keys, separated by commas
+	// The name of each file, without extension, is used as its key ID
+	PublicKeyFiles string
+
+	// Path or URL (http or https) of a JSON Web Key Set
+	Jwks string
+
+	// Period to reload the keys (seconds). If 0, the keys are only loaded once.
+	RefreshPeriodSeconds int
+}
+
+// Checks if the configuration has no keys
+func (config JwtKeySetConfig) IsEmpty() bool {
+	return strings.TrimSpace(config.PublicKeyFiles) == "" && config.Jwks == ""
+}
+
+// Public key to validate tokens
+type JwtPublicKey struct {
+	// Key ID (can be empty)
+	Id string
+
+	// Algorithm the key is restricted to (can be empty)
+	Algorithm string
+
+	// Public key (*rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey)
+	Key crypto.PublicKey
+}
+
+// Checks if the key can be used to validate a token signed with a method
+func (key *JwtPublicKey) IsCompatible(method jwt.SigningMethod) bool {
+	if key.Algorithm != "" && key.Algorithm != method.Alg() {
+		return false
+	}
+
+	switch key.Key.(type) {
+	case *rsa.PublicKey:
+		switch method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return true
+		}
+	case *ecdsa.PublicKey:
+		_, ok := method.(*jwt.SigningMethodECDSA)
+		return ok
+	case ed25519.PublicKey:
+		_, ok := method.(*jwt.SigningMethodEd25519)
+		return ok
+	}
+
+	return false
+}
+
+// Set of public keys to validate tokens
+// The keys are reloaded periodically
+type JwtKeySet struct {
+	// Configuration
+	config JwtKeySetConfig
+
+	// Logger
+	logger *glog.Logger
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// HTTP client to download the JWKS
+	client *http.Client
+
+	// Loaded keys
+	keys []*JwtPublicKey
+
+	// Channel to interrupt the reload thread
+	interruptChannel chan bool
+}
+
+// Creates new instance of JwtKeySet
+// The keys are loaded before returning
+func NewJwtKeySet(config JwtKeySetConfig, logger *glog.Logger) *JwtKeySet {
+	keySet := &JwtKeySet{
+		config: config,
+		logger: logger,
+		mu:     &sync.Mutex{},
+		client: &http.Client{
+			Timeout: JWKS_REQUEST_TIMEOUT,
+		},
+		keys:             make([]*JwtPublicKey, 0),
+		interruptChannel: make(chan bool, 1),
+	}
+
+	keySet.Reload()
+
+	if config.RefreshPeriodSeconds > 0 {
+		go keySet.periodicallyReload()
+	}
+
+	return keySet
+}
+
+// Stops reloading the keys
+func (keySet *JwtKeySet) Close() {
+	select {
+	case keySet.interruptChannel <- true:
+	default:
+	}
+}
+
+// Reloads the keys periodically
+func (keySet *JwtKeySet) periodicallyReload() {
+	period := time.Duration(keySet.config.RefreshPeriodSeconds) * time.Second
+
+	for {
+		select {
+		case <-keySet.interruptChannel:
+			return
+		case <-time.After(period):
+			keySet.Reload()
+		}
+	}
+}
+
+// Reloads the keys
+// If any of the keys cannot be loaded, the previous keys are kept
+func (keySet *JwtKeySet) Reload() {
+	keys, err := keySet.load()
+
+	if err != nil {
+		keySet.logger.Errorf("Could not load public keys: %v", err)
+		return
+	}
+
+	keySet.mu.Lock()
+	keySet.keys = keys
+	keySet.mu.Unlock()
+
+	keySet.logger.Debugf("Loaded %v public keys", len(keys))
+}
+
+// Loads the keys from the configured sources
+func (keySet *JwtKeySet) load() ([]*JwtPublicKey, error) {
+	keys := make([]*JwtPublicKey, 0)
+
+	for _, file := range strings.Split(keySet.config.PublicKeyFiles, ",") {
+		file = strings.TrimSpace(file)
+
+		if file == "" {
+			continue
+		}
+
+		key, err := loadPemPublicKey(file)
+
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", file, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if keySet.config.Jwks != "" {
+		data, err := keySet.readJwks()
+
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", keySet.config.Jwks, err)
+		}
+
+		jwksKeys, err := parseJwks(data, keySet.logger)
+
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", keySet.config.Jwks, err)
+		}
+
+		keys = append(keys, jwksKeys...)
+	}
+
+	return keys, nil
+}
+
+// Reads the JWKS from a file or URL
+func (keySet *JwtKeySet) readJwks() ([]byte, error) {
+	source := keySet.config.Jwks
+
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+
+	res, err := keySet.client.Get(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %v", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, JWKS_MAX_SIZE+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > JWKS_MAX_SIZE {
+		return nil, errors.New("JWKS too large")
+	}
+
+	return data, nil
+}
+
+// Finds the key to validate a token
+// If the token has a key ID (kid header), only the key with that ID is used.
+// Otherwise, all the keys compatible with the signing method are tried.
+// Can be used as the key function of jwt.Parse
+func (keySet *JwtKeySet) GetKey(token *jwt.Token) (interface{}, error) {
+	keySet.mu.Lock()
+	keys := keySet.keys
+	keySet.mu.Unlock()
+
+	keyId, hasKeyId := token.Header["kid"].(string)
+
+	candidates := make([]jwt.VerificationKey, 0)
+
+	for _, key := range keys {
+		if hasKeyId && key.Id != keyId {
+			continue
+		}
+
+		if !key.IsCompatible(token.Method) {
+			continue
+		}
+
+		candidates = append(candidates, key.Key)
+	}
+
+	if len(candidates) == 0 {
+		if hasKeyId {
+			return nil, fmt.Errorf("no key found for kid %v and algorithm %v", keyId, token.Method.Alg())
+		}
+
+		return nil, fmt.Errorf("no key found for algorithm %v", token.Method.Alg())
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	return jwt.VerificationKeySet{
+		Keys: candidates,
+	}, nil
+}
+
+// Loads a public key from a PEM file
+// The file can contain a public key (PKIX or PKCS #1) or a certificate
+func loadPemPublicKey(file string) (*JwtPublicKey, error) {
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var key crypto.PublicKey
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	return &JwtPublicKey{
+		Id:  strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+		Key: key,
+	}, nil
+}
+
+// JSON Web Key
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JSON Web Key Set
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// Parses a JSON Web Key Set
+// Keys not intended for signatures, or with unsupported types, are skipped
+// Invalid keys are skipped with a warning, so they do not invalidate the rest of the set
+func parseJwks(data []byte, logger *glog.Logger) ([]*JwtPublicKey, error) {
+	jwks := jsonWebKeySet{}
+
+	err := json.Unmarshal(data, &jwks)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*JwtPublicKey, 0, len(jwks.Keys))
+
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		var key crypto.PublicKey
+
+		switch jwk.Kty {
+		case "RSA":
+			key, err = parseJwkRsaKey(jwk)
+		case "EC":
+			key, err = parseJwkEcKey(jwk)
+		case "OKP":
+			key, err = parseJwkOkpKey(jwk)
+		default:
+			continue
+		}
+
+		if err != nil {
+			logger.Warningf("Skipped invalid key %v: %v", jwk.Kid, err)
+			continue
+		}
+
+		if key == nil {
+			continue
+		}
+
+		keys = append(keys, &JwtPublicKey{
+			Id:        jwk.Kid,
+			Algorithm: jwk.Alg,
+			Key:       key,
+		})
+	}
+
+	return keys, nil
+}
+
+// Decodes a base64url field of a JWK
+func decodeJwkField(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// Parses a RSA JWK
+func parseJwkRsaKey(jwk jsonWebKey) (crypto.PublicKey, error) {
+	n, err := decodeJwkField(jwk.N)
+
+	if err != nil || len(n) == 0 {
+		return nil, errors.New("invalid modulus")
+	}
+
+	e, err := decodeJwkField(jwk.E)
+
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid exponent")
+	}
+
+	exponent := new(big.Int).SetBytes(e)
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(exponent.Int64()),
+	}, nil
+}
+
+// Parses an EC JWK
+// Returns nil if the curve is not supported
+func parseJwkEcKey(jwk jsonWebKey) (crypto.PublicKey, error) {
+	var curve elliptic.Curve
+	var ecdhCurve ecdh.Curve
+
+	switch jwk.Crv {
+	case "P-256":
+		curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+	case "P-384":
+		curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+	case "P-521":
+		curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, nil
+	}
+
+	size := (curve.Params().BitSize + 7) / 8
+
+	x, err := decodeJwkField(jwk.X)
+
+	if err != nil || len(x) != size {
+		return nil, errors.New("invalid x coordinate")
+	}
+
+	y, err := decodeJwkField(jwk.Y)
+
+	if err != nil || len(y) != size {
+		return nil, errors.New("invalid y coordinate")
+	}
+
+	// Check the point is on the curve
+
+	point := append([]byte{0x04}, x...)
+	point = append(point, y...)
+
+	_, err = ecdhCurve.NewPublicKey(point)
+
+	if err != nil {
+		return nil, errors.New("invalid point")
+	}
+
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}, nil
+}
+
+// Parses an OKP JWK
+// Returns nil if the curve is not supported
+func parseJwkOkpKey(jwk jsonWebKey) (crypto.PublicKey, error) {
+	if jwk.Crv != "Ed25519" {
+		return nil, nil
+	}
+
+	x, err := decodeJwkField(jwk.X)
+
+	if err != nil || len(x) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key")
+	}
+
+	return ed25519.PublicKey(x), nil
+}
@@ -0,0 +1,223 @@
+// Secrets to sign and validate authentication tokens (HMAC)
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Configuration of a set of secrets
+type AuthSecretSetConfig struct {
+	// Secret without key ID (can be empty)
+	Secret string
+
+	// Path of a file with secrets, one per line. Format: {KEY_ID}={SECRET}
+	// The first secret of the file is the primary one.
+	SecretsFile string
+
+	// Period to reload the secrets file (seconds). If 0, the file is only loaded once.
+	ReloadPeriodSeconds int
+}
+
+// Checks if the configuration has no secrets
+func (config AuthSecretSetConfig) IsEmpty() bool {
+	return config.Secret == "" && config.SecretsFile == ""
+}
+
+// Secret to sign and validate tokens
+type AuthSecret struct {
+	// Key ID (can be empty)
+	Id string
+
+	// Secret
+	Secret string
+}
+
+// Set of secrets to sign and validate tokens
+// All the secrets are accepted to validate tokens, and the primary one is used to sign new tokens
+type AuthSecretSet struct {
+	// Configuration
+	config AuthSecretSetConfig
+
+	// Logger
+	logger *glog.Logger
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Loaded secrets. The first one is the primary.
+	secrets []AuthSecret
+
+	// Channel to interrupt the reload thread
+	interruptChannel chan bool
+}
+
+// Creates new instance of AuthSecretSet
+// The secrets file is loaded before returning
+func NewAuthSecretSet(config AuthSecretSetConfig, logger *glog.Logger) *AuthSecretSet {
+	secretSet := &AuthSecretSet{
+		config:           config,
+		logger:           logger,
+		mu:               &sync.Mutex{},
+		secrets:          make([]AuthSecret, 0),
+		interruptChannel: make(chan bool, 1),
+	}
+
+	if config.SecretsFile == "" {
+		secretSet.secrets = append(secretSet.secrets, AuthSecret{Secret: config.Secret})
+		return secretSet
+	}
+
+	secretSet.Reload()
+
+	if config.ReloadPeriodSeconds > 0 {
+		go secretSet.periodicallyReload()
+	}
+
+	return secretSet
+}
+
+// Stops reloading the secrets file
+func (secretSet *AuthSecretSet) Close() {
+	select {
+	case secretSet.interruptChannel <- true:
+	default:
+	}
+}
+
+// Reloads the secrets file periodically
+func (secretSet *AuthSecretSet) periodicallyReload() {
+	period := time.Duration(secretSet.config.ReloadPeriodSeconds) * time.Second
+
+	for {
+		select {
+		case <-secretSet.interruptChannel:
+			return
+		case <-time.After(period):
+			secretSet.Reload()
+		}
+	}
+}
+
+// Reloads the secrets file
+// If the file cannot be loaded, the previous secrets are kept
+func (secretSet *AuthSecretSet) Reload() {
+	secrets, err := loadAuthSecretsFile(secretSet.config.SecretsFile)
+
+	if err != nil {
+		secretSet.logger.Errorf("Could not load secrets from %v: %v", secretSet.config.SecretsFile, err)
+		return
+	}
+
+	if secretSet.config.Secret != "" {
+		secrets = append(secrets, AuthSecret{Secret: secretSet.config.Secret})
+	}
+
+	secretSet.mu.Lock()
+	secretSet.secrets = secrets
+	secretSet.mu.Unlock()
+
+	secretSet.logger.Debugf("Loaded %v secrets", len(secrets))
+}
+
+// Gets the primary secret, to sign new tokens
+// Returns false if there are no secrets loaded
+func (secretSet *AuthSecretSet) GetPrimary() (AuthSecret, bool) {
+	secretSet.mu.Lock()
+	defer secretSet.mu.Unlock()
+
+	if len(secretSet.secrets) == 0 {
+		return AuthSecret{}, false
+	}
+
+	return secretSet.secrets[0], true
+}
+
+// Finds the secret to validate a token
+// If the token has a key ID (kid header), only the secret with that ID is used.
+// Otherwise, all the secrets are tried.
+// Can be used as the key function of jwt.Parse
+func (secretSet *AuthSecretSet) GetKey(token *jwt.Token) (interface{}, error) {
+	secretSet.mu.Lock()
+	secrets := secretSet.secrets
+	secretSet.mu.Unlock()
+
+	keyId, hasKeyId := token.Header["kid"].(string)
+
+	candidates := make([]jwt.VerificationKey, 0)
+
+	for _, secret := range secrets {
+		if hasKeyId && secret.Id != keyId {
+			continue
+		}
+
+		candidates = append(candidates, []byte(secret.Secret))
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no secret found for kid %v", keyId)
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	return jwt.VerificationKeySet{
+		Keys: candidates,
+	}, nil
+}
+
+// Loads a secrets file
+// Empty lines, and lines starting with # are ignored
+func loadAuthSecretsFile(file string) ([]AuthSecret, error) {
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make([]AuthSecret, 0)
+	ids := make(map[string]bool)
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, secret, found := strings.Cut(line, "=")
+
+		id = strings.TrimSpace(id)
+		secret = strings.TrimSpace(secret)
+
+		if !found || id == "" || secret == "" {
+			return nil, fmt.Errorf("line %v: expected {KEY_ID}={SECRET}", i+1)
+		}
+
+		if ids[id] {
+			return nil, fmt.Errorf("line %v: duplicated key ID %v", i+1, id)
+		}
+
+		ids[id] = true
+
+		secrets = append(secrets, AuthSecret{
+			Id:     id,
+			Secret: secret,
+		})
+	}
+
+	if len(secrets) == 0 {
+		return nil, errors.New("the file has no secrets")
+	}
+
+	return secrets, nil
+}
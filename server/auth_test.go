@@ -3,9 +3,26 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/AgustinSRG/glog"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 func TestSignFunctions(t *testing.T) {
@@ -56,7 +73,7 @@ func TestAuthController(t *testing.T) {
 		PullSecret: secretPull,
 		PushSecret: secretPush,
 		AllowPush:  true,
-	}, glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction))
+	}, nil, glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction))
 
 	tokenPull := authController.CreatePullToken(streamId)
 	if !authController.ValidatePullToken(tokenPull, streamId) {
@@ -71,3 +88,424 @@ func TestAuthController(t *testing.T) {
 		t.Errorf("Token does not pass validation: %v", tokenPush)
 	}
 }
+
+// Signs auth token with a private key
+// keyId - Key ID to set in the header (kid). Can be empty.
+func signAuthTokenWithKey(method jwt.SigningMethod, key crypto.PrivateKey, keyId string, action string, streamId string) (string, error) {
+	token := jwt.NewWithClaims(method, jwt.MapClaims{
+		"sub": action + ":" + streamId,
+		"exp": time.Now().Add(1 * time.Hour).Unix(),
+	})
+
+	if keyId != "" {
+		token.Header["kid"] = keyId
+	}
+
+	return token.SignedString(key)
+}
+
+// Writes a public key to a PEM file
+func writeTestPublicKeyFile(file string, key crypto.PublicKey, t *testing.T) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Encodes an EC public key as a JWK
+func encodeTestEcJwk(keyId string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": keyId,
+		"use": "sig",
+		"alg": "ES256",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func TestAsymmetricAuthTokens(t *testing.T) {
+	secretPull := "secret-pull"
+	streamId := "stream1"
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherEcKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edPublicKey, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Key files
+
+	dir := t.TempDir()
+
+	rsaFile := filepath.Join(dir, "rsa1.pem")
+	writeTestPublicKeyFile(rsaFile, &rsaKey.PublicKey, t)
+
+	edFile := filepath.Join(dir, "ed1.pem")
+	writeTestPublicKeyFile(edFile, edPublicKey, t)
+
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			encodeTestEcJwk("ec1", &ecKey.PublicKey),
+			{"kty": "RSA", "kid": "enc1", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		},
+	})
+
+	jwksFile := filepath.Join(dir, "jwks.json")
+	err = os.WriteFile(jwksFile, jwks, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authController := NewAuthController(AuthConfiguration{
+		PullSecret: secretPull,
+		PullKeys: JwtKeySetConfig{
+			PublicKeyFiles: rsaFile + "," + edFile,
+			Jwks:           jwksFile,
+		},
+		PushKeys: JwtKeySetConfig{
+			Jwks: jwksFile,
+		},
+		AllowPush: true,
+	}, nil, glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction))
+
+	defer authController.Close()
+
+	type testToken struct {
+		method jwt.SigningMethod
+		key    crypto.PrivateKey
+		keyId  string
+		action string
+		valid  bool
+	}
+
+	testTokens := map[string]testToken{
+		"RS256":             {jwt.SigningMethodRS256, rsaKey, "rsa1", "PULL", true},
+		"RS256 without kid": {jwt.SigningMethodRS256, rsaKey, "", "PULL", true},
+		"RS384":             {jwt.SigningMethodRS384, rsaKey, "rsa1", "PULL", true},
+		"PS256":             {jwt.SigningMethodPS256, rsaKey, "rsa1", "PULL", true},
+		"ES256":             {jwt.SigningMethodES256, ecKey, "ec1", "PULL", true},
+		"ES256 push":        {jwt.SigningMethodES256, ecKey, "ec1", "PUSH", true},
+		"EdDSA":             {jwt.SigningMethodEdDSA, edKey, "ed1", "PULL", true},
+		"HMAC (relay)":      {jwt.SigningMethodHS256, []byte(secretPull), "", "PULL", true},
+		"HMAC push":         {jwt.SigningMethodHS256, []byte(secretPull), "", "PUSH", false},
+		"Wrong key":         {jwt.SigningMethodES256, otherEcKey, "ec1", "PULL", false},
+		"Wrong kid":         {jwt.SigningMethodRS256, rsaKey, "ec1", "PULL", false},
+		"Unknown kid":       {jwt.SigningMethodES256, ecKey, "ec2", "PULL", false},
+		"Push not allowed":  {jwt.SigningMethodRS256, rsaKey, "rsa1", "PUSH", false},
+	}
+
+	for name, tt := range testTokens {
+		token, err := signAuthTokenWithKey(tt.method, tt.key, tt.keyId, tt.action, streamId)
+
+		if err != nil && tt.valid {
+			t.Errorf("[%v] Could not sign token: %v", name, err)
+			continue
+		}
+
+		var valid bool
+
+		if tt.action == "PUSH" {
+			valid = authController.ValidatePushToken(token, streamId)
+		} else {
+			valid = authController.ValidatePullToken(token, streamId)
+		}
+
+		if valid != tt.valid {
+			t.Errorf("[%v] Expected valid=%v, but got valid=%v", name, tt.valid, valid)
+		}
+	}
+
+	// Tokens for other streams are rejected
+
+	token, _ := signAuthTokenWithKey(jwt.SigningMethodRS256, rsaKey, "rsa1", "PULL", "stream2")
+
+	if authController.ValidatePullToken(token, streamId) {
+		t.Errorf("Token for another stream passed validation")
+	}
+}
+
+func TestJwksReload(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu := &sync.Mutex{}
+	jwks := []map[string]string{}
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": jwks})
+	}))
+	defer jwksServer.Close()
+
+	keySet := NewJwtKeySet(JwtKeySetConfig{
+		Jwks: jwksServer.URL,
+	}, glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction))
+
+	defer keySet.Close()
+
+	token, _ := signAuthTokenWithKey(jwt.SigningMethodES256, ecKey, "ec1", "PULL", "stream1")
+
+	if valid, _ := validateAuthTokenClaimsWithKeys(token, nil, keySet, "PULL", "stream1"); valid {
+		t.Errorf("Token passed validation before the key was published")
+	}
+
+	// Publish the key, along with an invalid one, which must be skipped
+
+	mu.Lock()
+	jwks = append(jwks, map[string]string{"kty": "RSA", "kid": "invalid", "n": "!", "e": "AQAB"})
+	jwks = append(jwks, encodeTestEcJwk("ec1", &ecKey.PublicKey))
+	mu.Unlock()
+
+	keySet.Reload()
+
+	if valid, _ := validateAuthTokenClaimsWithKeys(token, nil, keySet, "PULL", "stream1"); !valid {
+		t.Errorf("Token does not pass validation after the key was published")
+	}
+
+	// If the JWKS becomes unavailable, the previous keys are kept
+
+	jwksServer.Close()
+
+	keySet.Reload()
+
+	if valid, _ := validateAuthTokenClaimsWithKeys(token, nil, keySet, "PULL", "stream1"); !valid {
+		t.Errorf("Keys were discarded after a failed reload")
+	}
+}
+
+// Gets the key ID (kid header) of a token
+func getTestTokenKeyId(tokenString string, t *testing.T) string {
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
+
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+
+	keyId, _ := token.Header["kid"].(string)
+
+	return keyId
+}
+
+func TestAuthSecretRotation(t *testing.T) {
+	streamId := "stream1"
+
+	secretsFile := filepath.Join(t.TempDir(), "secrets.txt")
+
+	err := os.WriteFile(secretsFile, []byte("# Pull secrets\nk2=secret2\n\nk1=secret1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authController := NewAuthController(AuthConfiguration{
+		PullSecret:      "legacy-secret",
+		PullSecretsFile: secretsFile,
+		AllowPush:       true,
+	}, nil, glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction))
+
+	defer authController.Close()
+
+	// New tokens are signed with the primary secret
+
+	tokenPull := authController.CreatePullToken(streamId)
+
+	if getTestTokenKeyId(tokenPull, t) != "k2" {
+		t.Errorf("Expected token signed with the primary secret (k2): %v", tokenPull)
+	}
+
+	if !authController.ValidatePullToken(tokenPull, streamId) {
+		t.Errorf("Token does not pass validation: %v", tokenPull)
+	}
+
+	// All the secrets are accepted
+
+	type testToken struct {
+		secret string
+		keyId  string
+		valid  bool
+	}
+
+	testTokens := map[string]testToken{
+		"Secondary":             {"secret1", "k1", true},
+		"Secondary without kid": {"secret1", "", true},
+		"Legacy":                {"legacy-secret", "", true},
+		"Wrong kid":             {"secret2", "k1", false},
+		"Unknown kid":           {"secret1", "k3", false},
+		"Unknown secret":        {"other-secret", "", false},
+	}
+
+	for name, tt := range testTokens {
+		token, err := signAuthTokenWithKeyId(tt.secret, tt.keyId, "PULL", streamId)
+
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if authController.ValidatePullToken(token, streamId) != tt.valid {
+			t.Errorf("[%v] Expected valid=%v", name, tt.valid)
+		}
+	}
+
+	// Rotate the secrets
+
+	err = os.WriteFile(secretsFile, []byte("k3=secret3\nk2=secret2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authController.pullSecrets.Reload()
+
+	tokenPull = authController.CreatePullToken(streamId)
+
+	if getTestTokenKeyId(tokenPull, t) != "k3" {
+		t.Errorf("Expected token signed with the new primary secret (k3): %v", tokenPull)
+	}
+
+	tokenRemoved, _ := signAuthTokenWithKeyId("secret1", "k1", "PULL", streamId)
+
+	if authController.ValidatePullToken(tokenRemoved, streamId) {
+		t.Errorf("Token signed with a removed secret passed validation")
+	}
+
+	// Invalid files are not loaded
+
+	err = os.WriteFile(secretsFile, []byte("invalid line\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authController.pullSecrets.Reload()
+
+	if !authController.ValidatePullToken(tokenPull, streamId) {
+		t.Errorf("Secrets were discarded after a failed reload")
+	}
+}
+
+func TestMatchStreamPattern(t *testing.T) {
+	testCases := []struct {
+		pattern  string
+		streamId string
+		match    bool
+	}{
+		{"room1/*", "room1/stream1/1280x720-30~2000", true},
+		{"room1/*", "room1/", true},
+		{"room1/*", "room2/stream1", false},
+		{"room1/*", "room1", false},
+		{"*/stream1/*", "room1/stream1/720p", true},
+		{"*/stream1/*", "room1/stream2/720p", false},
+		{"room?/stream1", "room1/stream1", true},
+		{"room?/stream1", "room10/stream1", false},
+		{"*", "anything", true},
+		{"stream1", "stream1", true},
+		{"stream1", "stream10", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+	}
+
+	for _, tc := range testCases {
+		if matchStreamPattern(tc.pattern, tc.streamId) != tc.match {
+			t.Errorf("Pattern %v, Stream: %v. Expected match=%v", tc.pattern, tc.streamId, tc.match)
+		}
+	}
+}
+
+// Signs auth token with custom claims
+func signTestAuthTokenWithClaims(secret string, claims jwt.MapClaims) string {
+	claims["exp"] = time.Now().Add(1 * time.Hour).Unix()
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+
+	return token
+}
+
+func TestScopedAuthTokens(t *testing.T) {
+	secret := "secret"
+
+	authController := NewAuthController(AuthConfiguration{
+		PullSecret: secret,
+		PushSecret: secret,
+		AllowPush:  true,
+	}, nil, glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction))
+
+	roomPullToken := signTestAuthTokenWithClaims(secret, jwt.MapClaims{
+		"sub":     "PULL",
+		"streams": []string{"room1/*", "lobby"},
+	})
+
+	for _, streamId := range []string{"room1/s1/1280x720-30~2000", "room1/s2/640x360-30~500", "lobby"} {
+		if !authController.ValidatePullToken(roomPullToken, streamId) {
+			t.Errorf("Scoped token does not pass validation for stream %v", streamId)
+		}
+	}
+
+	for _, streamId := range []string{"room2/s1/1280x720-30~2000", "lobby2"} {
+		if authController.ValidatePullToken(roomPullToken, streamId) {
+			t.Errorf("Scoped token passed validation for stream %v", streamId)
+		}
+	}
+
+	if authController.ValidatePushToken(roomPullToken, "lobby") {
+		t.Errorf("Scoped pull token passed validation for push")
+	}
+
+	// Single pattern, as a string
+
+	pushToken := signTestAuthTokenWithClaims(secret, jwt.MapClaims{
+		"sub":     "PUSH",
+		"streams": "room1/s1/*",
+	})
+
+	if !authController.ValidatePushToken(pushToken, "room1/s1/640x360-30~500") {
+		t.Errorf("Scoped push token does not pass validation")
+	}
+
+	// The streams claim is ignored for exact subjects
+
+	exactToken := signTestAuthTokenWithClaims(secret, jwt.MapClaims{
+		"sub":     "PULL:lobby",
+		"streams": "*",
+	})
+
+	if authController.ValidatePullToken(exactToken, "room1/s1/640x360-30~500") {
+		t.Errorf("Exact token passed validation for another stream")
+	}
+
+	// Invalid streams claim
+
+	invalidToken := signTestAuthTokenWithClaims(secret, jwt.MapClaims{
+		"sub":     "PULL",
+		"streams": []interface{}{"room1/*", 1},
+	})
+
+	if authController.ValidatePullToken(invalidToken, "room1/s1") {
+		t.Errorf("Token with invalid streams claim passed validation")
+	}
+}
@@ -0,0 +1,196 @@
+// Authorization webhook
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+)
+
+// Max number of cached authorization decisions
+const AUTH_WEBHOOK_MAX_CACHE_SIZE = 10000
+
+// Configuration of the authorization webhook
+type AuthWebhookConfig struct {
+	// URL of the webhook. If empty, the webhook is disabled.
+	Url string
+
+	// Timeout for the webhook requests (milliseconds)
+	TimeoutMilliseconds int
+
+	// Time to cache the decisions of the webhook (seconds). If 0, the decisions are not cached.
+	CacheTtlSeconds int
+
+	// True to allow the requests if the webhook fails (fail-open)
+	// False to deny them (fail-closed)
+	FailOpen bool
+}
+
+// Body of the authorization webhook requests
+type AuthWebhookRequestBody struct {
+	// Action (PULL or PUSH)
+	Action string `json:"action"`
+
+	// Stream ID
+	Stream string `json:"stream"`
+
+	// IP address of the client
+	Ip string `json:"ip"`
+
+	// Auth string sent by the client
+	Auth string `json:"auth"`
+}
+
+// Cached decision of the authorization webhook
+type authWebhookCacheEntry struct {
+	// True if allowed
+	allowed bool
+
+	// Expiration time
+	expiration time.Time
+}
+
+// Authorization webhook
+// Asks an HTTP endpoint to allow or deny the clients
+// The endpoint must respond with a 2xx status to allow, or 401 / 403 to deny.
+// Any other response is considered a failure.
+type AuthWebhook struct {
+	// Configuration
+	config AuthWebhookConfig
+
+	// Logger
+	logger *glog.Logger
+
+	// HTTP client
+	client *http.Client
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Cached decisions (Request key -> Entry)
+	cache map[string]authWebhookCacheEntry
+}
+
+// Creates new instance of AuthWebhook
+func NewAuthWebhook(config AuthWebhookConfig, logger *glog.Logger) *AuthWebhook {
+	return &AuthWebhook{
+		config: config,
+		logger: logger,
+		client: &http.Client{
+			Timeout: time.Duration(config.TimeoutMilliseconds) * time.Millisecond,
+		},
+		mu:    &sync.Mutex{},
+		cache: make(map[string]authWebhookCacheEntry),
+	}
+}
+
+// Checks if a client is authorized
+// action - PULL or PUSH
+// streamId - ID of the stream
+// ip - IP address of the client
+// auth - Auth string sent by the client
+func (wh *AuthWebhook) Authorize(action string, streamId string, ip string, auth string) bool {
+	key := action + "\n" + streamId + "\n" + ip + "\n" + auth
+
+	if allowed, ok := wh.getCachedDecision(key); ok {
+		return allowed
+	}
+
+	allowed, err := wh.request(AuthWebhookRequestBody{
+		Action: action,
+		Stream: streamId,
+		Ip:     ip,
+		Auth:   auth,
+	})
+
+	if err != nil {
+		wh.logger.Errorf("Authorization webhook failed for %v %v: %v", action, streamId, err)
+		return wh.config.FailOpen
+	}
+
+	wh.cacheDecision(key, allowed)
+
+	return allowed
+}
+
+// Gets a cached decision
+// Returns the decision, and true if found
+func (wh *AuthWebhook) getCachedDecision(key string) (bool, bool) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	entry, ok := wh.cache[key]
+
+	if !ok {
+		return false, false
+	}
+
+	if !entry.expiration.After(time.Now()) {
+		delete(wh.cache, key)
+		return false, false
+	}
+
+	return entry.allowed, true
+}
+
+// Caches a decision
+func (wh *AuthWebhook) cacheDecision(key string, allowed bool) {
+	if wh.config.CacheTtlSeconds <= 0 {
+		return
+	}
+
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	now := time.Now()
+
+	if len(wh.cache) >= AUTH_WEBHOOK_MAX_CACHE_SIZE {
+		for k, entry := range wh.cache {
+			if !entry.expiration.After(now) {
+				delete(wh.cache, k)
+			}
+		}
+
+		if len(wh.cache) >= AUTH_WEBHOOK_MAX_CACHE_SIZE {
+			wh.cache = make(map[string]authWebhookCacheEntry)
+		}
+	}
+
+	wh.cache[key] = authWebhookCacheEntry{
+		allowed:    allowed,
+		expiration: now.Add(time.Duration(wh.config.CacheTtlSeconds) * time.Second),
+	}
+}
+
+// Sends a request to the webhook
+// Returns true if allowed, false if denied, or an error if the webhook failed
+func (wh *AuthWebhook) request(body AuthWebhookRequestBody) (bool, error) {
+	jsonBody, err := json.Marshal(body)
+
+	if err != nil {
+		return false, err
+	}
+
+	res, err := wh.client.Post(wh.config.Url, "application/json", bytes.NewReader(jsonBody))
+
+	if err != nil {
+		return false, err
+	}
+
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return true, nil
+	case res.StatusCode == 401 || res.StatusCode == 403:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code %v", res.StatusCode)
+	}
+}
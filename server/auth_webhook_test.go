@@ -0,0 +1,152 @@
+// Tests for the authorization webhook
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+)
+
+// Test webhook endpoint
+// Allows the auth string "allow", denies "deny", fails with "error" and times out with "slow"
+type testAuthWebhookHandler struct {
+	mu *sync.Mutex
+
+	// Received requests
+	requests []AuthWebhookRequestBody
+}
+
+func (h *testAuthWebhookHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body := AuthWebhookRequestBody{}
+
+	if json.NewDecoder(req.Body).Decode(&body) != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	h.mu.Lock()
+	h.requests = append(h.requests, body)
+	h.mu.Unlock()
+
+	switch body.Auth {
+	case "allow":
+		w.WriteHeader(200)
+	case "deny":
+		w.WriteHeader(403)
+	case "slow":
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(200)
+	default:
+		w.WriteHeader(500)
+	}
+}
+
+func (h *testAuthWebhookHandler) countRequests() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.requests)
+}
+
+func TestAuthWebhook(t *testing.T) {
+	secret := "secret"
+	streamId := "stream1"
+	ip := "10.0.0.1"
+
+	handler := &testAuthWebhookHandler{mu: &sync.Mutex{}}
+
+	webhookServer := httptest.NewServer(handler)
+	defer webhookServer.Close()
+
+	logger := glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction)
+
+	makeAuthController := func(failOpen bool) *AuthController {
+		return NewAuthController(AuthConfiguration{
+			PullSecret: secret,
+			AllowPush:  true,
+			Webhook: AuthWebhookConfig{
+				Url:                 webhookServer.URL,
+				TimeoutMilliseconds: 100,
+				CacheTtlSeconds:     60,
+				FailOpen:            failOpen,
+			},
+		}, nil, logger)
+	}
+
+	authController := makeAuthController(false)
+	defer authController.Close()
+
+	// Valid tokens do not call the webhook
+
+	validToken, _ := signAuthToken(secret, "PULL", streamId)
+
+	if _, errMsg := authController.ValidatePullTokenForClient(validToken, streamId, ip); errMsg != "" {
+		t.Errorf("Valid token rejected: %v", errMsg)
+	}
+
+	if handler.countRequests() != 0 {
+		t.Errorf("The webhook was called for a valid token")
+	}
+
+	// Decisions of the webhook
+
+	if _, errMsg := authController.ValidatePullTokenForClient("allow", streamId, ip); errMsg != "" {
+		t.Errorf("Token allowed by the webhook was rejected: %v", errMsg)
+	}
+
+	if _, errMsg := authController.ValidatePullTokenForClient("deny", streamId, ip); errMsg == "" {
+		t.Errorf("Token denied by the webhook was accepted")
+	}
+
+	if valid, _ := authController.ValidatePushTokenClaims("allow", streamId, ip); !valid {
+		t.Errorf("Push token allowed by the webhook was rejected")
+	}
+
+	if handler.countRequests() != 3 {
+		t.Fatalf("Expected 3 webhook requests, but got %v", handler.countRequests())
+	}
+
+	if handler.requests[2] != (AuthWebhookRequestBody{Action: "PUSH", Stream: streamId, Ip: ip, Auth: "allow"}) {
+		t.Errorf("Unexpected webhook request: %v", handler.requests[2])
+	}
+
+	// Cached decisions
+
+	authController.ValidatePullTokenForClient("allow", streamId, ip)
+	authController.ValidatePullTokenForClient("deny", streamId, ip)
+
+	if handler.countRequests() != 3 {
+		t.Errorf("Expected the decisions to be cached, but the webhook was called again")
+	}
+
+	authController.ValidatePullTokenForClient("allow", streamId, "10.0.0.2")
+
+	if handler.countRequests() != 4 {
+		t.Errorf("Expected a new webhook request for a different IP address")
+	}
+
+	// Failures (fail-closed)
+
+	for _, auth := range []string{"error", "slow"} {
+		if _, errMsg := authController.ValidatePullTokenForClient(auth, streamId, ip); errMsg == "" {
+			t.Errorf("[%v] Expected the token to be rejected (fail-closed)", auth)
+		}
+	}
+
+	// Failures (fail-open)
+
+	failOpenController := makeAuthController(true)
+	defer failOpenController.Close()
+
+	for _, auth := range []string{"error", "slow"} {
+		if _, errMsg := failOpenController.ValidatePullTokenForClient(auth, streamId, ip); errMsg != "" {
+			t.Errorf("[%v] Expected the token to be accepted (fail-open)", auth)
+		}
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/AgustinSRG/glog"
-	"github.com/gorilla/websocket"
 )
 
 // Period to send HEARTBEAT messages to the client
@@ -33,7 +32,7 @@ type ConnectionHandler struct {
 	ip string
 
 	// Connection
-	connection *websocket.Conn
+	connection ConnectionTransport
 
 	// HTTP server
 	server *HttpServer
@@ -56,6 +55,9 @@ type ConnectionHandler struct {
 	// Connection current mode
 	mode int
 
+	// Protocol version negotiated with the client
+	protocolVersion int
+
 	// Stream ID
 	streamId string
 
@@ -65,12 +67,44 @@ type ConnectionHandler struct {
 	// Current fragment to push
 	currentFragmentToPush *HlsFragment
 
+	// Current fragment part to push
+	currentPartToPush *HlsFragmentPart
+
 	// Channel to interrupt the pulling process
 	pullingInterruptChannel chan bool
+
+	// Channel to request switching the pulled stream
+	pullingSwitchChannel chan *HlsPullSwitchRequest
+
+	// Channel to request seeking the pulled stream
+	pullingSeekChannel chan *HlsPullSeekRequest
+
+	// True if the pulled stream can only be a local source (only_source option)
+	pullOnlySource bool
+
+	// Pull session (limits of the auth token)
+	pullSession *PullSession
+
+	// Timer to close the connection when the pull session expires
+	pullSessionTimer *time.Timer
+
+	// ID of the watcher to close the connection if the auth token is revoked
+	revocationWatcherId uint64
+
+	// True if the connection is of another node relaying a stream (RELAY token or node certificate)
+	// Internal connections are not counted by the rate limiter
+	internal bool
+
+	// Identities of the verified TLS client certificate (nil if not received)
+	nodeIdentities []string
+
+	// True if the connection was received by an internal listener
+	// Internal listeners only accept relays from other nodes, and are not limited by the rate limiter
+	internalListener bool
 }
 
 // Creates connection handler
-func CreateConnectionHandler(conn *websocket.Conn, ip string, server *HttpServer) *ConnectionHandler {
+func CreateConnectionHandler(conn ConnectionTransport, ip string, server *HttpServer) *ConnectionHandler {
 	return &ConnectionHandler{
 		id:                        0,
 		ip:                        ip,
@@ -82,10 +116,15 @@ func CreateConnectionHandler(conn *websocket.Conn, ip string, server *HttpServer
 		closed:                    false,
 		expectedBinary:            false,
 		mode:                      0,
+		protocolVersion:           PROTOCOL_VERSION_TEXT_HEADERS,
 		streamId:                  "",
 		sourceToPush:              nil,
 		currentFragmentToPush:     nil,
+		currentPartToPush:         nil,
 		pullingInterruptChannel:   nil,
+		pullingSwitchChannel:      make(chan *HlsPullSwitchRequest, 1),
+		pullingSeekChannel:        make(chan *HlsPullSeekRequest, 1),
+		pullOnlySource:            false,
 	}
 }
 
@@ -111,13 +150,31 @@ func (ch *ConnectionHandler) onClose() {
 		if ch.pullingInterruptChannel != nil {
 			ch.pullingInterruptChannel <- true
 		}
+
+		if !ch.internal {
+			ch.server.sourceController.eventWebhooks.Notify(EVENT_VIEWER_LEFT, ch.streamId, ch.getViewerEventData())
+		}
 	}
 
+	// Release pull session
+
+	if ch.pullSessionTimer != nil {
+		ch.pullSessionTimer.Stop()
+	}
+
+	if ch.pullSession != nil {
+		ch.pullSession.Release()
+	}
+
+	ch.server.authController.UnwatchTokenRevocation(ch.revocationWatcherId)
+
 	// Interrupt heartbeat
 	ch.heartbeatInterruptChannel <- true
 
 	// Update rate limiter
-	ch.server.rateLimiter.EndConnection(ch.ip)
+	if !ch.internal && !ch.internalListener {
+		ch.server.rateLimiter.EndConnection(ch.ip)
+	}
 }
 
 // Runs connection handler
@@ -169,20 +226,36 @@ func (ch *ConnectionHandler) Run() {
 }
 
 // Reads a text message, parses it, and handles it
+// When pushing with the protocol version 2, binary fragment frames are also accepted
 func (ch *ConnectionHandler) ReadTextMessage() bool {
-	ch.connection.SetReadLimit(TEXT_MSG_READ_LIMIT)
+	acceptFrames := ch.mode == CONNECTION_MODE_PUSH && ch.protocolVersion >= PROTOCOL_VERSION_BINARY_FRAMES
+
+	readLimit := int64(TEXT_MSG_READ_LIMIT)
 
-	mt, message, err := ch.connection.ReadMessage()
+	if acceptFrames {
+		readLimit = ch.server.config.MaxBinaryMessageSize + FRAGMENT_FRAME_HEADER_SIZE
+	}
+
+	message, binary, err := ch.connection.ReadMessage(readLimit)
 
 	if err != nil {
 		return false
 	}
 
-	if mt != websocket.TextMessage {
+	if binary {
+		if acceptFrames {
+			return ch.HandleFragmentFrame(message)
+		}
+
 		ch.SendErrorMessage("PROTOCOL_ERROR", "Expected text message, but received a binary one")
 		return false
 	}
 
+	if acceptFrames && len(message) > TEXT_MSG_READ_LIMIT {
+		ch.SendErrorMessage("PROTOCOL_ERROR", "Text message too large")
+		return false
+	}
+
 	if ch.logger.Config.TraceEnabled {
 		ch.logger.Trace("<<< " + string(message))
 	}
@@ -199,6 +272,16 @@ func (ch *ConnectionHandler) ReadTextMessage() bool {
 		return ch.HandlePush(parsedMessage)
 	case "F":
 		return ch.HandleFragmentMetadata(parsedMessage)
+	case "P":
+		return ch.HandleFragmentPartMetadata(parsedMessage)
+	case "META":
+		return ch.HandleMetadata(parsedMessage)
+	case "CUE":
+		return ch.HandleCue(parsedMessage)
+	case "SWITCH":
+		return ch.HandleSwitch(parsedMessage)
+	case "SEEK":
+		return ch.HandleSeek(parsedMessage)
 	case "CLOSE":
 		return ch.HandleClose()
 	}
@@ -213,21 +296,19 @@ func (ch *ConnectionHandler) ReadTextMessage() bool {
 
 // Reads binary message and handles it
 func (ch *ConnectionHandler) ReadBinaryMessage() bool {
-	if ch.currentFragmentToPush == nil || ch.sourceToPush == nil {
+	if (ch.currentFragmentToPush == nil && ch.currentPartToPush == nil) || ch.sourceToPush == nil {
 		ch.SendErrorMessage("PROTOCOL_ERROR", "Unexpected binary message")
 		return false
 	}
 
-	ch.connection.SetReadLimit(ch.server.config.MaxBinaryMessageSize)
-
-	mt, message, err := ch.connection.ReadMessage()
+	message, binary, err := ch.connection.ReadMessage(ch.server.config.MaxBinaryMessageSize)
 
 	if err != nil {
 		ch.logger.Errorf("Error reading binary message: %v", err)
 		return false
 	}
 
-	if mt != websocket.BinaryMessage {
+	if !binary {
 		ch.SendErrorMessage("PROTOCOL_ERROR", "Expected binary message, but received a text one")
 		return false
 	}
@@ -241,16 +322,55 @@ func (ch *ConnectionHandler) ReadBinaryMessage() bool {
 		ch.logger.Trace("<<< [BINARY] " + fmt.Sprint(len(message)) + " bytes")
 	}
 
-	ch.currentFragmentToPush.Data = message
+	if ch.currentPartToPush != nil {
+		ch.currentPartToPush.Data = message
 
-	ch.sourceToPush.AddFragment(ch.currentFragmentToPush)
+		if ch.sourceToPush.AddFragmentPart(ch.currentPartToPush) != nil {
+			ch.SendErrorMessage("PROTOCOL_ERROR", "The fragment parts exceed the max fragment size or number of parts")
+			return false
+		}
+	} else {
+		ch.currentFragmentToPush.Data = message
+
+		ch.sourceToPush.AddFragment(ch.currentFragmentToPush)
+	}
 
 	ch.expectedBinary = false
 	ch.currentFragmentToPush = nil
+	ch.currentPartToPush = nil
 
 	return true
 }
 
+// Called when the max duration of the pull session is reached
+// Sends an error message and closes the connection
+func (ch *ConnectionHandler) onPullSessionExpired() {
+	ch.logger.Debug("Pull session expired")
+
+	ch.closeWithError("SESSION_EXPIRED", "The max duration of the session was reached")
+}
+
+// Called when the auth token of the connection is revoked
+func (ch *ConnectionHandler) onTokenRevoked() {
+	ch.logger.Debug("Auth token revoked")
+
+	ch.closeWithError("TOKEN_REVOKED", "The auth token was revoked")
+}
+
+// Sends an error message and closes the connection
+func (ch *ConnectionHandler) closeWithError(code string, message string) {
+	ch.SendErrorMessage(code, message)
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return
+	}
+
+	_ = ch.connection.Close()
+}
+
 // Task to send HEARTBEAT periodically
 func (ch *ConnectionHandler) sendHeartbeatMessages() {
 	heartbeatInterval := HEARTBEAT_MSG_PERIOD_SECONDS * time.Second
@@ -281,9 +401,21 @@ func (ch *ConnectionHandler) SendErrorMessage(errorCode string, errorMessage str
 	}
 
 	ch.Send(&msg)
+
+	if ch.mode == CONNECTION_MODE_PUSH {
+		ch.server.sourceController.eventWebhooks.NotifyPublisherError(ch.streamId, errorCode, errorMessage)
+	}
 }
 
-// Sends a message to the websocket client
+// Gets the data of the viewer events
+func (ch *ConnectionHandler) getViewerEventData() map[string]string {
+	return map[string]string{
+		"connection": fmt.Sprint(ch.id),
+		"ip":         ch.ip,
+	}
+}
+
+// Sends a message to the client
 func (ch *ConnectionHandler) Send(msg *WebsocketProtocolMessage) {
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
@@ -296,10 +428,10 @@ func (ch *ConnectionHandler) Send(msg *WebsocketProtocolMessage) {
 		ch.logger.Trace(">>> " + msg.Serialize())
 	}
 
-	_ = ch.connection.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+	_ = ch.connection.WriteTextMessage(msg.Serialize())
 }
 
-// Sends a message to the websocket client with attached binary data
+// Sends a message to the client with attached binary data
 func (ch *ConnectionHandler) SendWithBinary(msg *WebsocketProtocolMessage, binaryData []byte) {
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
@@ -313,8 +445,44 @@ func (ch *ConnectionHandler) SendWithBinary(msg *WebsocketProtocolMessage, binar
 		ch.logger.Trace(">>> [BINARY] " + fmt.Sprint(len(binaryData)) + " bytes")
 	}
 
-	_ = ch.connection.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
-	_ = ch.connection.WriteMessage(websocket.BinaryMessage, []byte(binaryData))
+	_ = ch.connection.WriteMessageWithBinary(msg.Serialize(), binaryData)
+}
+
+// Sends a binary message to the client, made of the concatenation of the parts
+func (ch *ConnectionHandler) SendBinary(parts ...[]byte) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return
+	}
+
+	if ch.logger.Config.TraceEnabled {
+		size := 0
+
+		for _, part := range parts {
+			size += len(part)
+		}
+
+		ch.logger.Trace(">>> [BINARY] " + fmt.Sprint(size) + " bytes")
+	}
+
+	_ = ch.connection.WriteBinaryMessage(parts...)
+}
+
+// Sends the OK message, including the negotiated protocol version
+func (ch *ConnectionHandler) SendOk() {
+	msg := WebsocketProtocolMessage{
+		MessageType: "OK",
+	}
+
+	if ch.protocolVersion != PROTOCOL_VERSION_TEXT_HEADERS {
+		msg.Parameters = map[string]string{
+			"protocol": fmt.Sprint(ch.protocolVersion),
+		}
+	}
+
+	ch.Send(&msg)
 }
 
 // Sends a close message and closes the connection
@@ -334,18 +502,84 @@ func (ch *ConnectionHandler) SendClose() {
 		ch.logger.Trace(">>> " + msg.Serialize())
 	}
 
-	_ = ch.connection.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+	_ = ch.connection.WriteTextMessage(msg.Serialize())
 	_ = ch.connection.Close()
 }
 
+// Sends cues
+func (ch *ConnectionHandler) SendCues(cues []*HlsCue) {
+	for _, cue := range cues {
+		ch.Send(&WebsocketProtocolMessage{
+			MessageType: "CUE",
+			Parameters:  cue.Parameters,
+		})
+	}
+}
+
 // Sends a fragment
+// The cues of the fragment are sent before it
 func (ch *ConnectionHandler) SendFragment(frag *HlsFragment) {
+	ch.SendCues(frag.Cues)
+
+	if ch.protocolVersion >= PROTOCOL_VERSION_BINARY_FRAMES {
+		// The header and the data are written separately, to avoid copying the fragment for each viewer
+		ch.SendBinary(EncodeFragmentFrameHeader(frag), frag.Data)
+		return
+	}
+
+	params := map[string]string{
+		"duration": fmt.Sprint(frag.Duration),
+	}
+
+	if frag.Sequence > 0 {
+		params["seq"] = fmt.Sprint(frag.Sequence)
+	}
+
 	ch.SendWithBinary(&WebsocketProtocolMessage{
 		MessageType: "F",
+		Parameters:  params,
+	}, frag.Data)
+}
+
+// Sends a fragment part
+// The cues of the part are sent before it
+func (ch *ConnectionHandler) SendFragmentPart(part *HlsFragmentPart) {
+	ch.SendCues(part.Cues)
+
+	if ch.protocolVersion >= PROTOCOL_VERSION_BINARY_FRAMES {
+		ch.SendBinary(EncodeFragmentPartFrameHeader(part), part.Data)
+		return
+	}
+
+	ch.SendWithBinary(&WebsocketProtocolMessage{
+		MessageType: "P",
 		Parameters: map[string]string{
-			"duration": fmt.Sprint(frag.Duration),
+			"index":       fmt.Sprint(part.Index),
+			"independent": fmt.Sprint(part.Independent),
+			"duration":    fmt.Sprint(part.Duration),
+			"last":        fmt.Sprint(part.Last),
 		},
-	}, frag.Data)
+	}, part.Data)
+}
+
+// Sends the variants of the stream group
+func (ch *ConnectionHandler) SendVariants(variants *HlsVariants) {
+	if variants == nil {
+		ch.Send(&WebsocketProtocolMessage{
+			MessageType: "VARIANTS",
+		})
+		return
+	}
+
+	ch.Send(variants.ToMessage())
+}
+
+// Sends the stream metadata
+func (ch *ConnectionHandler) SendMetadata(metadata map[string]string) {
+	ch.Send(&WebsocketProtocolMessage{
+		MessageType: "META",
+		Parameters:  metadata,
+	})
 }
 
 // Handles the PULL message
@@ -369,12 +603,59 @@ func (ch *ConnectionHandler) HandlePull(msg *WebsocketProtocolMessage) bool {
 
 	authToken := msg.GetParameter("auth")
 
-	if !ch.server.authController.ValidatePullToken(authToken, streamId) {
-		ch.SendErrorMessage("AUTH_ERROR", "Invalid auth token")
+	var session *PullSession
+	var errCode, errMsg string
+
+	if ch.server.authController.ValidateNodeIdentity(ch.nodeIdentities) {
+		// Other node, authenticated by its TLS client certificate
+		session = &PullSession{
+			Internal: true,
+		}
+	} else {
+		session, errCode, errMsg = ch.server.authController.StartPullSession(authToken, streamId, ch.ip)
+	}
+
+	if session == nil {
+		ch.SendErrorMessage(errCode, errMsg)
+		return false
+	}
+
+	listenerErrMsg := ""
+
+	if ch.internalListener && !session.Internal {
+		listenerErrMsg = "Only other nodes can pull streams from the internal listener"
+	} else if !ch.internalListener && session.Internal && ch.server.config.InternalEnabled {
+		listenerErrMsg = "Other nodes must pull streams from the internal listener"
+	}
+
+	if listenerErrMsg != "" {
+		// Rejected sessions must always be released
+		session.Release()
+		ch.SendErrorMessage("AUTH_ERROR", listenerErrMsg)
 		return false
 	}
 
+	ch.pullSession = session
+
+	if session.Internal {
+		ch.logger.Infof("Relaying stream %v to another node (internal connection)", streamId)
+
+		ch.internal = true
+
+		if !ch.internalListener {
+			ch.server.rateLimiter.EndConnection(ch.ip)
+		}
+	}
+
+	if session.MaxDuration > 0 {
+		ch.pullSessionTimer = time.AfterFunc(session.MaxDuration, ch.onPullSessionExpired)
+	}
+
+	ch.revocationWatcherId = ch.server.authController.WatchTokenRevocation(session.Claims, ch.onTokenRevoked)
+
 	onlySource := msg.GetParameter("only_source") == "true"
+	receiveParts := msg.GetParameter("parts") == "true"
+	abr := msg.GetParameter("abr") == "true"
 	maxInitialFragments := -1
 
 	maxInitialFragmentsStr := msg.GetParameter("max_initial_fragments")
@@ -389,56 +670,84 @@ func (ch *ConnectionHandler) HandlePull(msg *WebsocketProtocolMessage) bool {
 		maxInitialFragments = n
 	}
 
+	startAt, fromSeq, errMsg := parsePullStartPosition(msg)
+
+	if errMsg != "" {
+		ch.SendErrorMessage("PROTOCOL_ERROR", errMsg)
+		return false
+	}
+
+	protocolVersion, errMsg := parseProtocolVersion(msg)
+
+	if errMsg != "" {
+		ch.SendErrorMessage("PROTOCOL_ERROR", errMsg)
+		return false
+	}
+
+	ch.protocolVersion = protocolVersion
+
 	// Create interrupt channel
 	ch.pullingInterruptChannel = make(chan bool, 1)
 
 	// PULL the stream
 
-	if ch.server.authController.IsPushAllowed() {
-		source := ch.server.sourceController.GetSource(streamId)
+	stream := ch.FindStreamToPull(streamId, onlySource)
+
+	if stream != nil {
+		// Listen before sending OK, so no fragments are lost
+		listenSuccess, listenChan, initialState := stream.AddListener(ch.id, receiveParts)
 
-		if source != nil {
+		if listenSuccess {
 			// Send OK
-			ch.Send(&WebsocketProtocolMessage{
-				MessageType: "OK",
-			})
+			ch.SendOk()
 
 			// Pull
-			go ch.PullFromHlsSource(source, ch.pullingInterruptChannel, maxInitialFragments)
+			go ch.PullStream(stream, listenChan, ch.pullingInterruptChannel, initialState, HlsPullOptions{
+				StreamId:            streamId,
+				OnlySource:          onlySource,
+				MaxInitialFragments: maxInitialFragments,
+				ReceiveParts:        receiveParts,
+				Abr:                 abr,
+				StartAt:             startAt,
+				FromSeq:             fromSeq,
+				Claims:              session.Claims,
+			})
 
 			// Switch mode
 			ch.streamId = streamId
+			ch.pullOnlySource = onlySource
 			ch.mode = CONNECTION_MODE_PULL
 
+			// Relays to other nodes are not viewers
+			if !ch.internal {
+				ch.server.sourceController.eventWebhooks.Notify(EVENT_VIEWER_JOINED, streamId, ch.getViewerEventData())
+			}
+
 			return true
 		}
 	}
 
-	if !onlySource {
-		relay := ch.server.relayController.RelayStream(streamId)
+	// If there is no live stream, play the latest recording (VOD)
+	// Not for relays, since other nodes must only receive live streams
 
-		if relay != nil {
-			// Send OK
-			ch.Send(&WebsocketProtocolMessage{
-				MessageType: "OK",
-			})
+	if !onlySource && !session.Internal && ch.server.sourceController.recordingController.IsVodEnabled() {
+		ch.SendOk()
 
-			// Pull
-			go ch.PullFromHlsRelay(relay, ch.pullingInterruptChannel, maxInitialFragments)
+		go ch.PullVod(streamId, ch.pullingInterruptChannel, msg.GetParameter("vod_fast") == "true")
 
-			// Switch mode
-			ch.streamId = streamId
-			ch.mode = CONNECTION_MODE_PULL
+		// Switch mode
+		ch.streamId = streamId
+		ch.pullOnlySource = onlySource
+		ch.mode = CONNECTION_MODE_PULL
 
-			return true
-		}
+		ch.server.sourceController.eventWebhooks.Notify(EVENT_VIEWER_JOINED, streamId, ch.getViewerEventData())
+
+		return true
 	}
 
 	// If not found in any place, send OK and CLOSE (Empty stream)
 
-	ch.Send(&WebsocketProtocolMessage{
-		MessageType: "OK",
-	})
+	ch.SendOk()
 
 	ch.Send(&WebsocketProtocolMessage{
 		MessageType: "CLOSE",
@@ -466,12 +775,38 @@ func (ch *ConnectionHandler) HandlePush(msg *WebsocketProtocolMessage) bool {
 		return false
 	}
 
+	protocolVersion, errMsg := parseProtocolVersion(msg)
+
+	if errMsg != "" {
+		ch.SendErrorMessage("PROTOCOL_ERROR", errMsg)
+		return false
+	}
+
+	if ch.internalListener {
+		ch.SendErrorMessage("AUTH_ERROR", "Publishers must connect to the public listeners")
+		return false
+	}
+
 	// Check auth
 
 	authToken := msg.GetParameter("auth")
 
-	if !ch.server.authController.ValidatePushToken(authToken, streamId) {
+	validToken, claims := ch.server.authController.ValidatePushTokenClaims(authToken, streamId, ch.ip)
+
+	if !validToken {
 		ch.SendErrorMessage("AUTH_ERROR", "Invalid auth token")
+		ch.server.sourceController.eventWebhooks.NotifyPublisherAuthError(streamId, "Invalid auth token")
+		return false
+	}
+
+	// The stream group must be allowed by the token, or declared by the admin API
+
+	groupId := msg.GetParameter("group")
+	groupAllowedByToken := groupId != "" && isGroupAllowedByClaims(claims, groupId)
+
+	if groupId != "" && !groupAllowedByToken && !ch.server.sourceController.IsDeclaredInGroup(groupId, streamId) {
+		ch.SendErrorMessage("AUTH_ERROR", "The auth token is not valid for the stream group")
+		ch.server.sourceController.eventWebhooks.NotifyPublisherAuthError(streamId, "The auth token is not valid for the stream group")
 		return false
 	}
 
@@ -488,14 +823,34 @@ func (ch *ConnectionHandler) HandlePush(msg *WebsocketProtocolMessage) bool {
 
 	go hlsSource.PeriodicallyAnnounce()
 
+	ch.revocationWatcherId = ch.server.authController.WatchTokenRevocation(claims, ch.onTokenRevoked)
+
+	// Join stream group
+	// (streams declared by the admin API are already in the group)
+
+	if groupAllowedByToken {
+		bandwidth, _ := strconv.Atoi(msg.GetParameter("bandwidth"))
+
+		ch.server.sourceController.JoinGroup(groupId, HlsRendition{
+			StreamId:   streamId,
+			Bandwidth:  bandwidth,
+			Resolution: msg.GetParameter("resolution"),
+			Codecs:     msg.GetParameter("codecs"),
+			Name:       msg.GetParameter("name"),
+		})
+	}
+
+	// Start recording (requested by the publisher or by the auth token)
+
+	ch.server.sourceController.StartRecordingIfRequested(hlsSource, msg.GetParameter("record") == "true" || getBoolClaim(claims, "record"), ch.logger)
+
 	// Switch mode
 	ch.streamId = streamId
 	ch.mode = CONNECTION_MODE_PUSH
+	ch.protocolVersion = protocolVersion
 
 	// Send OK
-	ch.Send(&WebsocketProtocolMessage{
-		MessageType: "OK",
-	})
+	ch.SendOk()
 
 	return true
 }
@@ -506,6 +861,11 @@ func (ch *ConnectionHandler) HandleFragmentMetadata(msg *WebsocketProtocolMessag
 		return false
 	}
 
+	if ch.protocolVersion >= PROTOCOL_VERSION_BINARY_FRAMES {
+		ch.SendErrorMessage("PROTOCOL_ERROR", "Fragments must be sent as binary frames in the negotiated protocol version")
+		return false
+	}
+
 	durationStr := msg.GetParameter("duration")
 
 	if durationStr == "" {
@@ -534,6 +894,210 @@ func (ch *ConnectionHandler) HandleFragmentMetadata(msg *WebsocketProtocolMessag
 	return true
 }
 
+func (ch *ConnectionHandler) HandleFragmentPartMetadata(msg *WebsocketProtocolMessage) bool {
+	if ch.mode != CONNECTION_MODE_PUSH {
+		ch.SendErrorMessage("PROTOCOL_ERROR", "A fragment part message can only be sent in PUSH mode")
+		return false
+	}
+
+	if ch.protocolVersion >= PROTOCOL_VERSION_BINARY_FRAMES {
+		ch.SendErrorMessage("PROTOCOL_ERROR", "Fragment parts must be sent as binary frames in the negotiated protocol version")
+		return false
+	}
+
+	part, errMsg := ParseFragmentPartMetadata(msg)
+
+	if part == nil {
+		ch.SendErrorMessage("FRAGMENT_METADATA_ERROR", errMsg)
+		return false
+	}
+
+	ch.currentPartToPush = part
+
+	ch.expectedBinary = true
+
+	return true
+}
+
+// Handles a binary fragment frame (protocol version 2)
+func (ch *ConnectionHandler) HandleFragmentFrame(frame []byte) bool {
+	if ch.logger.Config.TraceEnabled {
+		ch.logger.Trace("<<< [BINARY] " + fmt.Sprint(len(frame)) + " bytes")
+	}
+
+	frag, part, errMsg := ParseFragmentFrame(frame)
+
+	if errMsg != "" {
+		ch.SendErrorMessage("FRAGMENT_METADATA_ERROR", errMsg)
+		return false
+	}
+
+	if part != nil {
+		if ch.sourceToPush.AddFragmentPart(part) != nil {
+			ch.SendErrorMessage("PROTOCOL_ERROR", "The fragment parts exceed the max fragment size or number of parts")
+			return false
+		}
+	} else {
+		ch.sourceToPush.AddFragment(frag)
+	}
+
+	return true
+}
+
+func (ch *ConnectionHandler) HandleMetadata(msg *WebsocketProtocolMessage) bool {
+	if ch.mode != CONNECTION_MODE_PUSH {
+		ch.SendErrorMessage("PROTOCOL_ERROR", "A metadata message can only be sent in PUSH mode")
+		return false
+	}
+
+	metadata := msg.Parameters
+
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+
+	ch.sourceToPush.SetMetadata(metadata)
+
+	return true
+}
+
+func (ch *ConnectionHandler) HandleCue(msg *WebsocketProtocolMessage) bool {
+	if ch.mode != CONNECTION_MODE_PUSH {
+		ch.SendErrorMessage("PROTOCOL_ERROR", "A cue message can only be sent in PUSH mode")
+		return false
+	}
+
+	if len(msg.Parameters) == 0 {
+		ch.SendErrorMessage("CUE_ERROR", "A cue message must have at least one parameter")
+		return false
+	}
+
+	if !ch.sourceToPush.AddCue(&HlsCue{
+		Parameters: msg.Parameters,
+	}) {
+		ch.SendErrorMessage("PROTOCOL_ERROR", "Too many pending cues. Send a fragment before more cues")
+		return false
+	}
+
+	return true
+}
+
+func (ch *ConnectionHandler) HandleSwitch(msg *WebsocketProtocolMessage) bool {
+	if ch.mode != CONNECTION_MODE_PULL {
+		ch.SendErrorMessage("PROTOCOL_ERROR", "A switch message can only be sent in PULL mode")
+		return false
+	}
+
+	streamId := msg.GetParameter("stream")
+
+	if streamId == "" {
+		ch.SendErrorMessage("PROTOCOL_ERROR", "Stream ID cannot be empty")
+		return false
+	}
+
+	if len(streamId) > 255 {
+		ch.SendErrorMessage("PROTOCOL_ERROR", "Stream ID cannot be larger than 255 characters")
+		return false
+	}
+
+	authToken := msg.GetParameter("auth")
+
+	claims, errMsg := ch.server.authController.ValidatePullTokenForClient(authToken, streamId, ch.ip)
+
+	if errMsg != "" {
+		ch.SendErrorMessage("AUTH_ERROR", errMsg)
+		return false
+	}
+
+	stream := ch.FindStreamToPull(streamId, ch.pullOnlySource)
+
+	if stream == nil {
+		ch.Send(&WebsocketProtocolMessage{
+			MessageType: "SWITCH_ERROR",
+			Parameters: map[string]string{
+				"stream":  streamId,
+				"message": "Stream not found",
+			},
+		})
+		return true
+	}
+
+	// Replace any previous request not yet taken by the pulling thread
+
+	select {
+	case <-ch.pullingSwitchChannel:
+	default:
+	}
+
+	ch.pullingSwitchChannel <- &HlsPullSwitchRequest{
+		StreamId: streamId,
+		Stream:   stream,
+		Reason:   HLS_SWITCH_REASON_CLIENT,
+		Claims:   claims,
+	}
+
+	return true
+}
+
+// Parses the start position parameters (start_at, from_seq) of PULL and SEEK messages
+// Returns an error message if they are not valid
+func parsePullStartPosition(msg *WebsocketProtocolMessage) (startAt float64, fromSeq int64, errMsg string) {
+	startAtStr := msg.GetParameter("start_at")
+
+	if startAtStr != "" {
+		n, err := strconv.ParseFloat(startAtStr, 64)
+
+		if err != nil || n < 0 {
+			return 0, 0, "start_at must be a valid positive number"
+		}
+
+		startAt = n
+	}
+
+	fromSeqStr := msg.GetParameter("from_seq")
+
+	if fromSeqStr != "" {
+		n, err := strconv.ParseInt(fromSeqStr, 10, 64)
+
+		if err != nil || n < 0 {
+			return 0, 0, "from_seq must be a valid positive integer number"
+		}
+
+		fromSeq = n
+	}
+
+	return startAt, fromSeq, ""
+}
+
+func (ch *ConnectionHandler) HandleSeek(msg *WebsocketProtocolMessage) bool {
+	if ch.mode != CONNECTION_MODE_PULL {
+		ch.SendErrorMessage("PROTOCOL_ERROR", "A seek message can only be sent in PULL mode")
+		return false
+	}
+
+	startAt, fromSeq, errMsg := parsePullStartPosition(msg)
+
+	if errMsg != "" {
+		ch.SendErrorMessage("PROTOCOL_ERROR", errMsg)
+		return false
+	}
+
+	// Replace any previous request not yet taken by the pulling thread
+
+	select {
+	case <-ch.pullingSeekChannel:
+	default:
+	}
+
+	ch.pullingSeekChannel <- &HlsPullSeekRequest{
+		Live:    startAt == 0 && fromSeq == 0,
+		StartAt: startAt,
+		FromSeq: fromSeq,
+	}
+
+	return true
+}
+
 func (ch *ConnectionHandler) HandleClose() bool {
 	if ch.mode != CONNECTION_MODE_PUSH {
 		ch.SendErrorMessage("PROTOCOL_ERROR", "A close message can only be sent in PUSH mode")
@@ -0,0 +1,105 @@
+// Transport of the protocol messages
+
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport of the protocol messages of a connection (websocket or QUIC)
+type ConnectionTransport interface {
+	// Sets the deadline to read the next message
+	SetReadDeadline(deadline time.Time) error
+
+	// Reads a message
+	// limit - Max size of the message (bytes)
+	// Returns the message, and true if it is binary
+	ReadMessage(limit int64) (message []byte, binary bool, err error)
+
+	// Writes a text message
+	WriteTextMessage(msg string) error
+
+	// Writes a text message with attached binary data
+	WriteMessageWithBinary(msg string, binaryData []byte) error
+
+	// Writes a binary message, made of the concatenation of the parts
+	// The parts are written without copying them into a single buffer
+	WriteBinaryMessage(parts ...[]byte) error
+
+	// Closes the connection
+	Close() error
+}
+
+// Transport of the protocol messages using a websocket connection
+type WebsocketConnectionTransport struct {
+	// Websocket connection
+	conn *websocket.Conn
+}
+
+// Creates new instance of WebsocketConnectionTransport
+func NewWebsocketConnectionTransport(conn *websocket.Conn) *WebsocketConnectionTransport {
+	return &WebsocketConnectionTransport{
+		conn: conn,
+	}
+}
+
+// Sets the deadline to read the next message
+func (transport *WebsocketConnectionTransport) SetReadDeadline(deadline time.Time) error {
+	return transport.conn.SetReadDeadline(deadline)
+}
+
+// Reads a message
+func (transport *WebsocketConnectionTransport) ReadMessage(limit int64) ([]byte, bool, error) {
+	transport.conn.SetReadLimit(limit)
+
+	mt, message, err := transport.conn.ReadMessage()
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return message, mt == websocket.BinaryMessage, nil
+}
+
+// Writes a text message
+func (transport *WebsocketConnectionTransport) WriteTextMessage(msg string) error {
+	return transport.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+// Writes a text message, followed by a binary message
+func (transport *WebsocketConnectionTransport) WriteMessageWithBinary(msg string, binaryData []byte) error {
+	err := transport.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+
+	if err != nil {
+		return err
+	}
+
+	return transport.conn.WriteMessage(websocket.BinaryMessage, binaryData)
+}
+
+// Writes a binary message, made of the concatenation of the parts
+func (transport *WebsocketConnectionTransport) WriteBinaryMessage(parts ...[]byte) error {
+	writer, err := transport.conn.NextWriter(websocket.BinaryMessage)
+
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		_, err = writer.Write(part)
+
+		if err != nil {
+			_ = writer.Close()
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+// Closes the connection
+func (transport *WebsocketConnectionTransport) Close() error {
+	return transport.conn.Close()
+}
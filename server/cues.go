@@ -0,0 +1,46 @@
+// Timed cues (metadata synchronized with the fragments)
+
+package main
+
+// Max number of cues waiting for a fragment
+const MAX_PENDING_CUES = 32
+
+// Timed cue, attached to a fragment
+type HlsCue struct {
+	// Cue parameters (arbitrary key/value pairs)
+	Parameters map[string]string
+}
+
+// List of cues waiting for the next fragment or fragment part
+type HlsPendingCues struct {
+	// Cues
+	cues []*HlsCue
+}
+
+// Adds a cue to the list
+// Returns false if the limit of pending cues was reached
+func (pending *HlsPendingCues) Add(cue *HlsCue) bool {
+	if len(pending.cues) >= MAX_PENDING_CUES {
+		return false
+	}
+
+	pending.cues = append(pending.cues, cue)
+
+	return true
+}
+
+// Takes the pending cues, emptying the list
+func (pending *HlsPendingCues) Take() []*HlsCue {
+	cues := pending.cues
+	pending.cues = nil
+	return cues
+}
+
+// Restores cues that could not be attached, keeping the order
+func (pending *HlsPendingCues) Restore(cues []*HlsCue) {
+	if len(cues) == 0 {
+		return
+	}
+
+	pending.cues = append(cues, pending.cues...)
+}
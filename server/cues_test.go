@@ -0,0 +1,218 @@
+// Tests for timed cues
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Sends an admin API request to a test server
+func sendTestAdminApiRequest(ts *TestServer, method string, path string, body string, t *testing.T) int {
+	httpUrl := "http" + strings.TrimPrefix(ts.url, "ws") + "admin/" + path
+
+	req, err := http.NewRequest(method, httpUrl, strings.NewReader(body))
+
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+
+	req.Header.Set("Authorization", "Bearer "+TEST_ADMIN_API_SECRET)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+
+	defer res.Body.Close()
+
+	return res.StatusCode
+}
+
+// Expects a cue message, followed by the fragment with the expected data
+func expectTestCueAndFragment(socket *websocket.Conn, expectedCue map[string]string, expectedData []byte, t *testing.T) {
+	msg, _ := readTestMessage(socket, t)
+
+	if msg == nil || msg.MessageType != "CUE" {
+		t.Errorf("Expected CUE message, but received: %v", msg)
+		return
+	}
+
+	if !compareMessages(msg, &WebsocketProtocolMessage{MessageType: "CUE", Parameters: expectedCue}) {
+		t.Errorf("Cue does not match. Expected: %v, Actual: %v", expectedCue, msg.Parameters)
+	}
+
+	msg, _ = readTestMessage(socket, t)
+
+	if msg == nil || msg.MessageType != "F" {
+		t.Errorf("Expected F message, but received: %v", msg)
+		return
+	}
+
+	_, data := readTestMessage(socket, t)
+
+	if !bytes.Equal(data, expectedData) {
+		t.Errorf("Fragment data does not match. Expected: %v, Actual: %v", expectedData, data)
+	}
+}
+
+func TestTimedCues(t *testing.T) {
+	logger := testMain()
+
+	mockPublishRegistry := NewMockPublishRegistry()
+
+	server1 := makeTestServerWithOptions(logger.CreateChildLogger("[Server 1] "), mockPublishRegistry, true, "", TestServerOptions{AdminApi: true})
+	defer server1.Close()
+
+	server2 := makeTestServer(logger.CreateChildLogger("[Server 2] "), mockPublishRegistry, true, "")
+	defer server2.Close()
+
+	publisher := connectTestClient(server1.url, "PUSH", TEST_STREAM_ID_1, nil, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	spectator1 := connectTestClient(server1.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator1 == nil {
+		return
+	}
+
+	defer spectator1.Close()
+
+	spectator2 := connectTestClient(server2.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator2 == nil {
+		return
+	}
+
+	defer spectator2.Close()
+
+	// Cue sent by the publisher
+
+	publisherCue := map[string]string{
+		"type": "poll",
+		"id":   "1",
+	}
+
+	cueMessage := WebsocketProtocolMessage{
+		MessageType: "CUE",
+		Parameters:  publisherCue,
+	}
+
+	fragmentMessage := WebsocketProtocolMessage{
+		MessageType: "F",
+		Parameters: map[string]string{
+			"duration": "1",
+		},
+	}
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte(cueMessage.Serialize()))
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte(fragmentMessage.Serialize()))
+	_ = publisher.WriteMessage(websocket.BinaryMessage, TEST_STREAM_DATA_1[0].Data)
+
+	expectTestCueAndFragment(spectator1, publisherCue, TEST_STREAM_DATA_1[0].Data, t)
+	expectTestCueAndFragment(spectator2, publisherCue, TEST_STREAM_DATA_1[0].Data, t)
+
+	// Cue injected by the admin API
+
+	status := sendTestAdminApiRequest(server1, "POST", "cue?stream="+TEST_STREAM_ID_1, `{"type":"ad","duration":"30"}`, t)
+
+	if status != 200 {
+		t.Errorf("Admin API returned status %v", status)
+	}
+
+	status = sendTestAdminApiRequest(server1, "POST", "cue?stream=not-found", `{"type":"ad"}`, t)
+
+	if status != 404 {
+		t.Errorf("Expected status 404 for a missing stream, but received %v", status)
+	}
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte(fragmentMessage.Serialize()))
+	_ = publisher.WriteMessage(websocket.BinaryMessage, TEST_STREAM_DATA_1[1].Data)
+
+	adminCue := map[string]string{
+		"type":     "ad",
+		"duration": "30",
+	}
+
+	expectTestCueAndFragment(spectator1, adminCue, TEST_STREAM_DATA_1[1].Data, t)
+	expectTestCueAndFragment(spectator2, adminCue, TEST_STREAM_DATA_1[1].Data, t)
+
+	// New spectators receive the cues with the buffered fragments
+
+	spectator3 := connectTestClient(server1.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator3 == nil {
+		return
+	}
+
+	defer spectator3.Close()
+
+	expectTestCueAndFragment(spectator3, publisherCue, TEST_STREAM_DATA_1[0].Data, t)
+	expectTestCueAndFragment(spectator3, adminCue, TEST_STREAM_DATA_1[1].Data, t)
+
+	// Too many pending cues
+
+	for i := 0; i <= MAX_PENDING_CUES; i++ {
+		_ = publisher.WriteMessage(websocket.TextMessage, []byte(cueMessage.Serialize()))
+	}
+
+	msg, _ := readTestMessage(publisher, t)
+
+	if msg == nil || msg.MessageType != "E" || msg.GetParameter("code") != "PROTOCOL_ERROR" {
+		t.Errorf("Expected PROTOCOL_ERROR for too many pending cues, but received: %v", msg)
+	}
+}
+
+func TestAdminApiAuth(t *testing.T) {
+	logger := testMain()
+
+	server := makeTestServerWithOptions(logger.CreateChildLogger("[Server] "), nil, true, "", TestServerOptions{AdminApi: true})
+	defer server.Close()
+
+	httpUrl := "http" + strings.TrimPrefix(server.url, "ws") + "admin/cue?stream=test"
+
+	res, err := http.Post(httpUrl, "application/json", strings.NewReader(`{"type":"ad"}`))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != 401 {
+		t.Errorf("Expected status 401 without credentials, but received %v", res.StatusCode)
+	}
+}
+
+func TestAdminApiRequiresSecret(t *testing.T) {
+	logger := testMain()
+
+	server := CreateHttpServer(HttpServerConfig{
+		AdminApiEnabled: true,
+		AdminApiPrefix:  "/admin/",
+		AdminApiSecret:  "",
+	}, logger.CreateChildLogger("[Server] "), nil, nil, nil, nil, nil)
+
+	if server.config.AdminApiEnabled {
+		t.Errorf("Expected the admin API to be disabled without a secret")
+	}
+
+	req, _ := http.NewRequest("POST", "/admin/cue?stream=test", nil)
+
+	if server.checkAdminApiAuth(req) {
+		t.Errorf("Expected requests to be rejected without a secret")
+	}
+}
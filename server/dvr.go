@@ -0,0 +1,528 @@
+// DVR (disk-backed rewind window for live sources)
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/AgustinSRG/glog"
+)
+
+// Prefix for the DVR window directories
+const DVR_WINDOW_DIRECTORY_PREFIX = "dvr-"
+
+// Max media duration (seconds) to send ahead of real time when playing from the DVR window
+const DVR_PLAYBACK_MAX_AHEAD_SECONDS = 20
+
+// Max number of fragments waiting to be written to a DVR window
+// If the limit is reached, fragments are discarded
+const DVR_QUEUE_SIZE = 64
+
+// Max size (bytes) of the fragments waiting to be written to a DVR window
+// If the limit is reached, fragments are discarded
+// The pending fragments also count towards the fragment buffer memory limit
+const DVR_MAX_PENDING_SIZE = 64 * 1024 * 1024
+
+// Configuration for the DVR
+type DvrConfig struct {
+	// True if enabled
+	Enabled bool
+
+	// Directory to store the DVR windows
+	Directory string
+
+	// Max duration (seconds) of each DVR window
+	RetentionSeconds int
+
+	// Max size (bytes) of each DVR window. 0 for unlimited.
+	MaxSizePerStream int64
+
+	// Max size (bytes) of all the DVR windows. 0 for unlimited.
+	MaxTotalSize int64
+}
+
+// DVR controller
+type DvrController struct {
+	// Configuration
+	config DvrConfig
+
+	// Logger
+	logger *glog.Logger
+
+	// Memory limiter (for the fragments waiting to be written)
+	memoryLimiter *FragmentBufferMemoryLimiter
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Disk usage (bytes)
+	usage int64
+}
+
+// Creates new instance of DvrController
+func NewDvrController(config DvrConfig, memoryLimiter *FragmentBufferMemoryLimiter, logger *glog.Logger) *DvrController {
+	dc := &DvrController{
+		config:        config,
+		logger:        logger,
+		memoryLimiter: memoryLimiter,
+		mu:            &sync.Mutex{},
+		usage:         0,
+	}
+
+	if config.Enabled {
+		dc.cleanup()
+	}
+
+	return dc
+}
+
+// Removes the DVR windows left by previous executions
+func (dc *DvrController) cleanup() {
+	entries, err := os.ReadDir(dc.config.Directory)
+
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), DVR_WINDOW_DIRECTORY_PREFIX) {
+			continue
+		}
+
+		err = os.RemoveAll(filepath.Join(dc.config.Directory, entry.Name()))
+
+		if err != nil {
+			dc.logger.Errorf("Could not remove old DVR window: %v", err)
+		}
+	}
+}
+
+// Reserves disk space for a fragment
+// Returns false if the total size limit would be exceeded
+func (dc *DvrController) reserve(size int64) bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if dc.config.MaxTotalSize > 0 && dc.usage+size > dc.config.MaxTotalSize {
+		return false
+	}
+
+	dc.usage += size
+
+	return true
+}
+
+// Releases disk space
+func (dc *DvrController) release(size int64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	dc.usage -= size
+}
+
+// Creates a DVR window for a source
+// Returns nil if the DVR is disabled or the window could not be created
+func (dc *DvrController) CreateWindow(sourceId uint64, streamId string) *HlsDvrWindow {
+	if !dc.config.Enabled {
+		return nil
+	}
+
+	streamHash := sha256.Sum256([]byte(streamId))
+
+	directory := filepath.Join(dc.config.Directory, DVR_WINDOW_DIRECTORY_PREFIX+fmt.Sprint(sourceId)+"-"+hex.EncodeToString(streamHash[:8]))
+
+	err := os.MkdirAll(directory, 0700)
+
+	if err != nil {
+		dc.logger.Errorf("Could not create DVR window directory: %v", err)
+		return nil
+	}
+
+	window := &HlsDvrWindow{
+		controller: dc,
+		mu:         &sync.Mutex{},
+		directory:  directory,
+		entries:    make([]*HlsDvrEntry, 0),
+		queue:      make(chan *HlsFragment, DVR_QUEUE_SIZE),
+		pending:    make([]*HlsFragment, 0),
+		closed:     false,
+		done:       make(chan bool),
+	}
+
+	go window.run()
+
+	return window
+}
+
+// Entry of the DVR window
+type HlsDvrEntry struct {
+	// Sequence number of the fragment
+	Sequence int64
+
+	// Duration of the fragment
+	Duration float32
+
+	// Size of the fragment data
+	Size int64
+
+	// Cues of the fragment
+	Cues []*HlsCue
+}
+
+// DVR window of a source
+type HlsDvrWindow struct {
+	// Controller
+	controller *DvrController
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Directory to store the fragments
+	directory string
+
+	// Stored fragments, sorted by sequence number
+	entries []*HlsDvrEntry
+
+	// Total size of the stored fragments
+	size int64
+
+	// Total duration of the stored fragments
+	duration float64
+
+	// Queue of fragments to write
+	queue chan *HlsFragment
+
+	// Fragments in the queue, served from memory until they are stored
+	pending []*HlsFragment
+
+	// Size of the fragments in the queue
+	pendingSize int64
+
+	// True if closed
+	closed bool
+
+	// Channel closed when the window finishes writing and its directory is removed
+	done chan bool
+}
+
+// Gets the path of the file to store a fragment
+func (window *HlsDvrWindow) fragmentPath(sequence int64) string {
+	return filepath.Join(window.directory, fmt.Sprint(sequence)+".frag")
+}
+
+// Removes the oldest fragment (must be called with the mutex locked)
+// Returns the path of the fragment file, to be removed after releasing the mutex
+func (window *HlsDvrWindow) removeOldest() string {
+	entry := window.entries[0]
+
+	window.entries = window.entries[1:]
+	window.size -= entry.Size
+	window.duration -= float64(entry.Duration)
+
+	window.controller.release(entry.Size)
+
+	return window.fragmentPath(entry.Sequence)
+}
+
+// Removes fragment files from the disk
+func removeDvrFiles(paths []string) {
+	for _, path := range paths {
+		_ = os.Remove(path)
+	}
+}
+
+// Adds a fragment to the window
+// Never blocks. The fragment is written to the disk by the writing thread.
+// Fragments bigger than the window size limit are not stored.
+func (window *HlsDvrWindow) AddFragment(frag *HlsFragment) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	if window.closed {
+		return
+	}
+
+	size := int64(len(frag.Data))
+	config := window.controller.config
+
+	if config.MaxSizePerStream > 0 && size > config.MaxSizePerStream {
+		window.controller.logger.Warningf("Could not store fragment in the DVR window: The fragment size (%v) exceeds the window size limit", size)
+		return
+	}
+
+	if window.pendingSize+size > DVR_MAX_PENDING_SIZE {
+		window.controller.logger.Warning("Fragment discarded from the DVR window: Too many pending bytes")
+		return
+	}
+
+	if !window.controller.memoryLimiter.TryReserve(size) {
+		window.controller.logger.Warning("Fragment discarded from the DVR window: Memory limit reached")
+		return
+	}
+
+	select {
+	case window.queue <- frag:
+		window.pending = append(window.pending, frag)
+		window.pendingSize += size
+	default:
+		window.controller.memoryLimiter.Release(size)
+		window.controller.logger.Warning("Fragment discarded from the DVR window: The writing queue is full")
+	}
+}
+
+// Called when the writing thread is done with a fragment of the queue
+func (window *HlsDvrWindow) onFragmentProcessed(frag *HlsFragment) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	if len(window.pending) > 0 && window.pending[0] == frag {
+		window.pending = window.pending[1:]
+		window.pendingSize -= int64(len(frag.Data))
+		window.controller.memoryLimiter.Release(int64(len(frag.Data)))
+	}
+}
+
+// Stores a fragment in the window, removing the oldest ones if the limits are exceeded
+// Called by the writing thread. The disk is never accessed with the mutex locked.
+func (window *HlsDvrWindow) storeFragment(frag *HlsFragment) {
+	size := int64(len(frag.Data))
+	config := window.controller.config
+
+	// Make space for the fragment
+
+	window.mu.Lock()
+
+	if window.closed {
+		window.mu.Unlock()
+		return
+	}
+
+	removedFiles := make([]string, 0)
+
+	for len(window.entries) > 0 && config.MaxSizePerStream > 0 && window.size+size > config.MaxSizePerStream {
+		removedFiles = append(removedFiles, window.removeOldest())
+	}
+
+	reserved := true
+
+	for !window.controller.reserve(size) {
+		if len(window.entries) == 0 {
+			reserved = false
+			break
+		}
+
+		removedFiles = append(removedFiles, window.removeOldest())
+	}
+
+	window.mu.Unlock()
+
+	removeDvrFiles(removedFiles)
+
+	if !reserved {
+		window.controller.logger.Warning("Could not store fragment in the DVR window: Total size limit reached")
+		return
+	}
+
+	// Write the fragment
+
+	err := os.WriteFile(window.fragmentPath(frag.Sequence), frag.Data, 0600)
+
+	if err != nil {
+		window.controller.release(size)
+		window.controller.logger.Errorf("Could not store fragment in the DVR window: %v", err)
+		return
+	}
+
+	window.mu.Lock()
+
+	if window.closed {
+		// The directory is removed when the writing thread ends
+		window.mu.Unlock()
+		window.controller.release(size)
+		return
+	}
+
+	window.entries = append(window.entries, &HlsDvrEntry{
+		Sequence: frag.Sequence,
+		Duration: frag.Duration,
+		Size:     size,
+		Cues:     frag.Cues,
+	})
+
+	window.size += size
+	window.duration += float64(frag.Duration)
+
+	// Apply retention
+
+	removedFiles = removedFiles[:0]
+
+	for len(window.entries) > 1 && window.duration-float64(window.entries[0].Duration) >= float64(config.RetentionSeconds) {
+		removedFiles = append(removedFiles, window.removeOldest())
+	}
+
+	window.mu.Unlock()
+
+	removeDvrFiles(removedFiles)
+}
+
+// Writing thread
+func (window *HlsDvrWindow) run() {
+	defer close(window.done)
+
+	for frag := range window.queue {
+		window.storeFragment(frag)
+		window.onFragmentProcessed(frag)
+	}
+
+	err := os.RemoveAll(window.directory)
+
+	if err != nil {
+		window.controller.logger.Errorf("Could not remove DVR window: %v", err)
+	}
+}
+
+// Finds the sequence number of the fragment being played the specified seconds ago
+// Returns -1 if the window is empty
+func (window *HlsDvrWindow) FindSequenceByTimeAgo(secondsAgo float64) int64 {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	elapsed := float64(0)
+
+	for i := len(window.pending) - 1; i >= 0; i-- {
+		elapsed += float64(window.pending[i].Duration)
+
+		if elapsed >= secondsAgo {
+			return window.pending[i].Sequence
+		}
+	}
+
+	for i := len(window.entries) - 1; i >= 0; i-- {
+		elapsed += float64(window.entries[i].Duration)
+
+		if elapsed >= secondsAgo {
+			return window.entries[i].Sequence
+		}
+	}
+
+	return window.firstSequenceInternal()
+}
+
+// Gets the sequence number of the oldest fragment in the window
+// Returns -1 if the window is empty
+func (window *HlsDvrWindow) FirstSequence() int64 {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	return window.firstSequenceInternal()
+}
+
+// Gets the sequence number of the oldest fragment (internal, must be called with the mutex locked)
+func (window *HlsDvrWindow) firstSequenceInternal() int64 {
+	if len(window.entries) > 0 {
+		return window.entries[0].Sequence
+	}
+
+	if len(window.pending) > 0 {
+		return window.pending[0].Sequence
+	}
+
+	return -1
+}
+
+// Finds the first fragment with a sequence number greater or equal than the specified one
+// Returns the entry if the fragment is stored, or the fragment if it is waiting to be written
+// Returns nil, nil if not found
+func (window *HlsDvrWindow) findFragment(sequence int64) (*HlsDvrEntry, *HlsFragment) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	if window.closed {
+		return nil, nil
+	}
+
+	for _, entry := range window.entries {
+		if entry.Sequence >= sequence {
+			return entry, nil
+		}
+	}
+
+	for _, frag := range window.pending {
+		if frag.Sequence >= sequence {
+			return nil, frag
+		}
+	}
+
+	return nil, nil
+}
+
+// Reads a fragment from the window
+// If the fragment is no longer in the window, the next available one is returned
+// Returns nil if there are no fragments with a sequence number greater or equal than the specified one
+func (window *HlsDvrWindow) ReadFragment(sequence int64) *HlsFragment {
+	for {
+		entry, pendingFragment := window.findFragment(sequence)
+
+		if pendingFragment != nil {
+			return pendingFragment
+		}
+
+		if entry == nil {
+			return nil
+		}
+
+		data, err := os.ReadFile(window.fragmentPath(entry.Sequence))
+
+		if err != nil {
+			if window.FirstSequence() <= entry.Sequence {
+				window.controller.logger.Errorf("Could not read fragment from the DVR window: %v", err)
+			}
+
+			// Removed while reading, or unreadable: try the next one
+			sequence = entry.Sequence + 1
+			continue
+		}
+
+		return &HlsFragment{
+			Sequence: entry.Sequence,
+			Duration: entry.Duration,
+			Data:     data,
+			Cues:     entry.Cues,
+		}
+	}
+}
+
+// Closes the window
+// The stored fragments are removed by the writing thread
+func (window *HlsDvrWindow) Close() {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	if window.closed {
+		return
+	}
+
+	window.closed = true
+
+	window.controller.release(window.size)
+	window.controller.memoryLimiter.Release(window.pendingSize)
+
+	window.entries = nil
+	window.pending = nil
+	window.pendingSize = 0
+	window.size = 0
+	window.duration = 0
+
+	close(window.queue)
+}
+
+// Waits for the window directory to be removed (after closing it)
+func (window *HlsDvrWindow) Wait() {
+	<-window.done
+}
@@ -0,0 +1,290 @@
+// Tests for the DVR window
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Waits for the DVR window writing thread to store a fragment
+func waitTestDvrFragment(window *HlsDvrWindow, sequence int64, t *testing.T) {
+	for i := 0; i < 100; i++ {
+		window.mu.Lock()
+		stored := len(window.entries) > 0 && window.entries[len(window.entries)-1].Sequence >= sequence
+		window.mu.Unlock()
+
+		if stored {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("Timed out waiting for fragment %v to be stored in the DVR window", sequence)
+}
+
+func TestDvrWindow(t *testing.T) {
+	logger := testMain()
+
+	directory, err := os.MkdirTemp("", "hls-websocket-cdn-dvr-")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer os.RemoveAll(directory)
+
+	controller := NewDvrController(DvrConfig{
+		Enabled:          true,
+		Directory:        directory,
+		RetentionSeconds: 3,
+		MaxSizePerStream: 0,
+		MaxTotalSize:     0,
+	}, NewFragmentBufferMemoryLimiter(FragmentBufferMemoryLimiterConfig{}), logger.CreateChildLogger("[DVR] "))
+
+	window := controller.CreateWindow(0, "test")
+
+	if window == nil {
+		t.Errorf("Could not create DVR window")
+		return
+	}
+
+	for i := 1; i <= 5; i++ {
+		window.AddFragment(&HlsFragment{
+			Sequence: int64(i),
+			Duration: 1,
+			Data:     []byte{byte(i), byte(i), byte(i)},
+		})
+	}
+
+	waitTestDvrFragment(window, 5, t)
+
+	// Retention
+
+	if window.FirstSequence() != 3 {
+		t.Errorf("Expected first sequence to be 3, but got %v", window.FirstSequence())
+	}
+
+	if seq := window.FindSequenceByTimeAgo(2); seq != 4 {
+		t.Errorf("Expected sequence 4 for 2 seconds ago, but got %v", seq)
+	}
+
+	if seq := window.FindSequenceByTimeAgo(100); seq != 3 {
+		t.Errorf("Expected sequence 3 for 100 seconds ago, but got %v", seq)
+	}
+
+	// Reading expired fragments returns the next available one
+
+	frag := window.ReadFragment(1)
+
+	if frag == nil || frag.Sequence != 3 || !bytes.Equal(frag.Data, []byte{3, 3, 3}) {
+		t.Errorf("Unexpected fragment read: %v", frag)
+	}
+
+	if window.ReadFragment(6) != nil {
+		t.Errorf("Expected no fragment after the last one")
+	}
+
+	// Close removes the fragments
+
+	window.Close()
+	window.Wait()
+
+	if controller.usage != 0 {
+		t.Errorf("Expected disk usage to be 0, but got %v", controller.usage)
+	}
+
+	if _, err := os.Stat(window.directory); !os.IsNotExist(err) {
+		t.Errorf("Expected the DVR window directory to be removed")
+	}
+
+	// Size limits
+
+	controller = NewDvrController(DvrConfig{
+		Enabled:          true,
+		Directory:        directory,
+		RetentionSeconds: 100,
+		MaxSizePerStream: 6,
+		MaxTotalSize:     0,
+	}, NewFragmentBufferMemoryLimiter(FragmentBufferMemoryLimiterConfig{}), logger.CreateChildLogger("[DVR] "))
+
+	window = controller.CreateWindow(1, "test")
+
+	if window == nil {
+		t.Errorf("Could not create DVR window")
+		return
+	}
+
+	defer window.Close()
+
+	for i := 1; i <= 5; i++ {
+		window.AddFragment(&HlsFragment{
+			Sequence: int64(i),
+			Duration: 1,
+			Data:     []byte{byte(i), byte(i), byte(i)},
+		})
+	}
+
+	waitTestDvrFragment(window, 5, t)
+
+	if window.FirstSequence() != 4 {
+		t.Errorf("Expected first sequence to be 4, but got %v", window.FirstSequence())
+	}
+
+	// Fragments bigger than the window are rejected, keeping the stored ones
+
+	window.AddFragment(&HlsFragment{
+		Sequence: 6,
+		Duration: 1,
+		Data:     []byte{6, 6, 6, 6, 6, 6, 6},
+	})
+
+	window.AddFragment(&HlsFragment{
+		Sequence: 7,
+		Duration: 1,
+		Data:     []byte{7, 7, 7},
+	})
+
+	waitTestDvrFragment(window, 7, t)
+
+	if window.FirstSequence() != 5 {
+		t.Errorf("Expected first sequence to be 5, but got %v", window.FirstSequence())
+	}
+
+	if frag := window.ReadFragment(6); frag == nil || frag.Sequence != 7 {
+		t.Errorf("Expected the oversized fragment to be skipped, but read: %v", frag)
+	}
+}
+
+// Reads a fragment from a test client socket, checking its sequence number and data
+func expectTestFragmentWithSequence(socket *websocket.Conn, sequence int64, data []byte, t *testing.T) {
+	msg, _ := readTestMessage(socket, t)
+
+	if msg == nil || msg.MessageType != "F" {
+		t.Errorf("Expected F message, but received: %v", msg)
+		return
+	}
+
+	if msg.GetParameter("seq") != fmt.Sprint(sequence) {
+		t.Errorf("Expected sequence %v, but received: %v", sequence, msg.Serialize())
+	}
+
+	_, receivedData := readTestMessage(socket, t)
+
+	if !bytes.Equal(receivedData, data) {
+		t.Errorf("Fragment data does not match. Expected: %v, Actual: %v", data, receivedData)
+	}
+}
+
+func TestDvrPullAndSeek(t *testing.T) {
+	logger := testMain()
+
+	server := makeTestServerWithOptions(logger.CreateChildLogger("[Server] "), nil, true, "", TestServerOptions{Dvr: true})
+	defer server.Close()
+
+	publisher := connectTestClient(server.url, "PUSH", TEST_STREAM_ID_1, nil, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	fragmentMessage := WebsocketProtocolMessage{
+		MessageType: "F",
+		Parameters: map[string]string{
+			"duration": "1",
+		},
+	}
+
+	fragmentsCount := DEFAULT_FRAGMENT_BUFFER_MAX_LENGTH + 5
+
+	fragmentData := func(seq int) []byte {
+		return []byte{byte(seq), 0x01, 0x02}
+	}
+
+	for i := 1; i <= fragmentsCount; i++ {
+		_ = publisher.WriteMessage(websocket.TextMessage, []byte(fragmentMessage.Serialize()))
+		_ = publisher.WriteMessage(websocket.BinaryMessage, fragmentData(i))
+	}
+
+	// Wait for the fragments to be received by the server (a spectator is used to sync)
+
+	liveSpectator := connectTestClient(server.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if liveSpectator == nil {
+		return
+	}
+
+	defer liveSpectator.Close()
+
+	for i := fragmentsCount - DEFAULT_FRAGMENT_BUFFER_MAX_LENGTH + 1; i <= fragmentsCount; i++ {
+		expectTestFragmentWithSequence(liveSpectator, int64(i), fragmentData(i), t)
+	}
+
+	// Pull from the start of the DVR window (older than the fragment buffer)
+
+	spectator := connectTestClient(server.url, "PULL", TEST_STREAM_ID_1, map[string]string{
+		"from_seq": "1",
+	}, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	for i := 1; i <= fragmentsCount; i++ {
+		expectTestFragmentWithSequence(spectator, int64(i), fragmentData(i), t)
+	}
+
+	// After the DVR window, the live stream continues
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte(fragmentMessage.Serialize()))
+	_ = publisher.WriteMessage(websocket.BinaryMessage, fragmentData(fragmentsCount+1))
+
+	expectTestFragmentWithSequence(spectator, int64(fragmentsCount+1), fragmentData(fragmentsCount+1), t)
+
+	// Seek to 3 seconds ago
+
+	seekMessage := WebsocketProtocolMessage{
+		MessageType: "SEEK",
+		Parameters: map[string]string{
+			"start_at": "3",
+		},
+	}
+
+	_ = spectator.WriteMessage(websocket.TextMessage, []byte(seekMessage.Serialize()))
+
+	msg, _ := readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "SEEKED" || msg.GetParameter("seq") != fmt.Sprint(fragmentsCount-1) {
+		t.Errorf("Expected SEEKED message, but received: %v", msg)
+		return
+	}
+
+	for i := fragmentsCount - 1; i <= fragmentsCount+1; i++ {
+		expectTestFragmentWithSequence(spectator, int64(i), fragmentData(i), t)
+	}
+
+	// Seek back to live
+
+	seekMessage = WebsocketProtocolMessage{
+		MessageType: "SEEK",
+	}
+
+	_ = spectator.WriteMessage(websocket.TextMessage, []byte(seekMessage.Serialize()))
+
+	msg, _ = readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "SEEKED" || msg.GetParameter("live") != "true" {
+		t.Errorf("Expected SEEKED message, but received: %v", msg)
+	}
+}
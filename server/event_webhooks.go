@@ -0,0 +1,322 @@
+// Lifecycle event webhooks
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+)
+
+// Lifecycle events
+const (
+	EVENT_SOURCE_CREATED  = "source_created"
+	EVENT_SOURCE_CLOSED   = "source_closed"
+	EVENT_RELAY_OPENED    = "relay_opened"
+	EVENT_RELAY_CLOSED    = "relay_closed"
+	EVENT_VIEWER_JOINED   = "viewer_joined"
+	EVENT_VIEWER_LEFT     = "viewer_left"
+	EVENT_PUBLISHER_ERROR = "publisher_error"
+)
+
+// Name of the header with the signature of the event webhook requests
+const EVENT_WEBHOOK_SIGNATURE_HEADER = "X-Webhook-Signature"
+
+// Max number of auth failure events sent per minute
+// The rest are discarded, so failed attempts cannot flood the webhook
+const EVENT_AUTH_ERROR_MAX_PER_MINUTE = 30
+
+// Configuration of the event webhooks
+type EventWebhooksConfig struct {
+	// URL of the webhook. If empty, the webhooks are disabled.
+	Url string
+
+	// Secret to sign the payloads (HMAC-SHA256). If empty, the payloads are not signed.
+	Secret string
+
+	// List of events to send, separated by commas. If empty, all the events are sent.
+	Events string
+
+	// ID of the node, sent in the payloads
+	Node string
+
+	// Timeout for the webhook requests (milliseconds)
+	TimeoutMilliseconds int
+
+	// Max number of retries for a failed request
+	MaxRetries int
+
+	// Delay before the first retry (milliseconds). It is doubled for each retry.
+	RetryDelayMilliseconds int
+
+	// Max number of events waiting to be sent. If reached, new events are discarded.
+	QueueSize int
+}
+
+// Payload of the event webhook requests
+type EventWebhookPayload struct {
+	// Event name
+	Event string `json:"event"`
+
+	// Time of the event (UNIX milliseconds)
+	Timestamp int64 `json:"timestamp"`
+
+	// ID of the node
+	Node string `json:"node,omitempty"`
+
+	// Stream ID
+	Stream string `json:"stream"`
+
+	// Additional data of the event
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// Event webhooks
+// The events are sent asynchronously, in order, by a single thread
+type EventWebhooks struct {
+	// Configuration
+	config EventWebhooksConfig
+
+	// Logger
+	logger *glog.Logger
+
+	// HTTP client
+	client *http.Client
+
+	// Enabled events (nil if all the events are enabled)
+	events map[string]bool
+
+	// Queue of events to send
+	queue chan *EventWebhookPayload
+
+	// Channel to interrupt the sending thread
+	interruptChannel chan bool
+
+	// Mutex for the auth failure rate limit
+	mu *sync.Mutex
+
+	// Start of the current auth failure rate limit window
+	authErrorWindowStart time.Time
+
+	// Auth failure events sent in the current window
+	authErrorCount int
+}
+
+// Creates new instance of EventWebhooks
+// If enabled, the sending thread is started
+func NewEventWebhooks(config EventWebhooksConfig, logger *glog.Logger) *EventWebhooks {
+	var events map[string]bool
+
+	if config.Events != "" {
+		events = make(map[string]bool)
+
+		for _, event := range strings.Split(config.Events, ",") {
+			events[strings.TrimSpace(event)] = true
+		}
+	}
+
+	queueSize := config.QueueSize
+
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+
+	ew := &EventWebhooks{
+		config: config,
+		logger: logger,
+		client: &http.Client{
+			Timeout: time.Duration(config.TimeoutMilliseconds) * time.Millisecond,
+		},
+		events:           events,
+		queue:            make(chan *EventWebhookPayload, queueSize),
+		interruptChannel: make(chan bool, 1),
+		mu:               &sync.Mutex{},
+	}
+
+	if config.Url != "" {
+		if config.Secret == "" {
+			logger.Warning("EVENT_WEBHOOK_SECRET is empty. The event payloads will not be signed, so the receiver cannot verify them.")
+		}
+
+		go ew.run()
+	}
+
+	return ew
+}
+
+// Stops the sending thread
+func (ew *EventWebhooks) Close() {
+	select {
+	case ew.interruptChannel <- true:
+	default:
+	}
+}
+
+// Checks if an event must be sent
+func (ew *EventWebhooks) IsEnabled(event string) bool {
+	if ew.config.Url == "" {
+		return false
+	}
+
+	return ew.events == nil || ew.events[event]
+}
+
+// Queues an event to be sent
+// event - Event name
+// streamId - Stream ID
+// data - Additional data (can be nil)
+func (ew *EventWebhooks) Notify(event string, streamId string, data map[string]string) {
+	if !ew.IsEnabled(event) {
+		return
+	}
+
+	payload := &EventWebhookPayload{
+		Event:     event,
+		Timestamp: time.Now().UnixMilli(),
+		Node:      ew.config.Node,
+		Stream:    streamId,
+		Data:      data,
+	}
+
+	select {
+	case ew.queue <- payload:
+	default:
+		ew.logger.Warningf("Event queue is full. Discarded event %v for stream %v", event, streamId)
+	}
+}
+
+// Queues a publisher error event
+func (ew *EventWebhooks) NotifyPublisherError(streamId string, code string, message string) {
+	ew.Notify(EVENT_PUBLISHER_ERROR, streamId, map[string]string{
+		"code":    code,
+		"message": message,
+	})
+}
+
+// Queues a publisher auth failure event
+// Rate limited to EVENT_AUTH_ERROR_MAX_PER_MINUTE. The rest are discarded.
+func (ew *EventWebhooks) NotifyPublisherAuthError(streamId string, message string) {
+	if !ew.IsEnabled(EVENT_PUBLISHER_ERROR) {
+		return
+	}
+
+	ew.mu.Lock()
+
+	now := time.Now()
+
+	if now.Sub(ew.authErrorWindowStart) >= time.Minute {
+		ew.authErrorWindowStart = now
+		ew.authErrorCount = 0
+	}
+
+	allowed := ew.authErrorCount < EVENT_AUTH_ERROR_MAX_PER_MINUTE
+
+	if allowed {
+		ew.authErrorCount++
+	}
+
+	ew.mu.Unlock()
+
+	if !allowed {
+		ew.logger.Debugf("Too many auth failures. Discarded event %v for stream %v", EVENT_PUBLISHER_ERROR, streamId)
+		return
+	}
+
+	ew.NotifyPublisherError(streamId, "AUTH_ERROR", message)
+}
+
+// Sends the queued events
+// (run in a sub-routine)
+func (ew *EventWebhooks) run() {
+	for {
+		select {
+		case <-ew.interruptChannel:
+			return
+		case payload := <-ew.queue:
+			if !ew.sendWithRetries(payload) {
+				return
+			}
+		}
+	}
+}
+
+// Sends an event, retrying if it fails
+// Returns false if interrupted
+func (ew *EventWebhooks) sendWithRetries(payload *EventWebhookPayload) bool {
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		ew.logger.Errorf("Could not encode event %v: %v", payload.Event, err)
+		return true
+	}
+
+	retryDelay := time.Duration(ew.config.RetryDelayMilliseconds) * time.Millisecond
+
+	for attempt := 0; ; attempt++ {
+		err = ew.send(body)
+
+		if err == nil {
+			return true
+		}
+
+		if attempt >= ew.config.MaxRetries {
+			ew.logger.Errorf("Could not send event %v for stream %v: %v", payload.Event, payload.Stream, err)
+			return true
+		}
+
+		ew.logger.Debugf("Could not send event %v for stream %v (retrying in %v): %v", payload.Event, payload.Stream, retryDelay, err)
+
+		select {
+		case <-ew.interruptChannel:
+			return false
+		case <-time.After(retryDelay):
+		}
+
+		retryDelay *= 2
+	}
+}
+
+// Computes the signature of a payload
+func computeEventWebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sends a request to the webhook
+func (ew *EventWebhooks) send(body []byte) error {
+	req, err := http.NewRequest("POST", ew.config.Url, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if ew.config.Secret != "" {
+		req.Header.Set(EVENT_WEBHOOK_SIGNATURE_HEADER, computeEventWebhookSignature(ew.config.Secret, body))
+	}
+
+	res, err := ew.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %v", res.StatusCode)
+	}
+
+	return nil
+}
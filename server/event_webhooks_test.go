@@ -0,0 +1,287 @@
+// Tests for the lifecycle event webhooks
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+	"github.com/gorilla/websocket"
+)
+
+// Test event webhook receiver
+type testEventWebhookReceiver struct {
+	mu *sync.Mutex
+
+	// Secret to verify the signatures
+	secret string
+
+	// Number of requests to fail before accepting them
+	failures int
+
+	// Number of received requests
+	requests int
+
+	// Received events, with valid signatures
+	events []EventWebhookPayload
+
+	// Channel to notify received events
+	received chan bool
+}
+
+func newTestEventWebhookReceiver(secret string, failures int) *testEventWebhookReceiver {
+	return &testEventWebhookReceiver{
+		mu:       &sync.Mutex{},
+		secret:   secret,
+		failures: failures,
+		events:   make([]EventWebhookPayload, 0),
+		received: make(chan bool, 100),
+	}
+}
+
+func (r *testEventWebhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests++
+
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(503)
+		return
+	}
+
+	if req.Header.Get(EVENT_WEBHOOK_SIGNATURE_HEADER) != computeEventWebhookSignature(r.secret, body) {
+		w.WriteHeader(401)
+		return
+	}
+
+	payload := EventWebhookPayload{}
+
+	if json.Unmarshal(body, &payload) != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	r.events = append(r.events, payload)
+	r.received <- true
+
+	w.WriteHeader(200)
+}
+
+// Waits until an event is received
+func (r *testEventWebhookReceiver) waitForEvent(event string, streamId string, t *testing.T) *EventWebhookPayload {
+	timeout := time.After(5 * time.Second)
+
+	for {
+		r.mu.Lock()
+
+		for _, e := range r.events {
+			if e.Event == event && e.Stream == streamId {
+				r.mu.Unlock()
+				return &e
+			}
+		}
+
+		r.mu.Unlock()
+
+		select {
+		case <-r.received:
+		case <-timeout:
+			t.Errorf("Event %v for stream %v not received", event, streamId)
+			return nil
+		}
+	}
+}
+
+func TestEventWebhooks(t *testing.T) {
+	receiver := newTestEventWebhookReceiver("secret", 2)
+
+	receiverServer := httptest.NewServer(receiver)
+	defer receiverServer.Close()
+
+	eventWebhooks := NewEventWebhooks(EventWebhooksConfig{
+		Url:                    receiverServer.URL,
+		Secret:                 "secret",
+		Events:                 EVENT_SOURCE_CREATED + "," + EVENT_SOURCE_CLOSED,
+		Node:                   "node1",
+		TimeoutMilliseconds:    1000,
+		MaxRetries:             2,
+		RetryDelayMilliseconds: 10,
+		QueueSize:              10,
+	}, glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction))
+	defer eventWebhooks.Close()
+
+	if eventWebhooks.IsEnabled(EVENT_VIEWER_JOINED) {
+		t.Errorf("Expected the viewer events to be disabled")
+	}
+
+	eventWebhooks.Notify(EVENT_VIEWER_JOINED, "stream1", nil)
+	eventWebhooks.Notify(EVENT_SOURCE_CREATED, "stream1", nil)
+	eventWebhooks.Notify(EVENT_SOURCE_CLOSED, "stream1", nil)
+
+	// The first event is retried twice before being accepted
+
+	created := receiver.waitForEvent(EVENT_SOURCE_CREATED, "stream1", t)
+	receiver.waitForEvent(EVENT_SOURCE_CLOSED, "stream1", t)
+
+	if created != nil && (created.Node != "node1" || created.Timestamp <= 0) {
+		t.Errorf("Unexpected payload: %v", created)
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	if receiver.requests != 4 {
+		t.Errorf("Expected 4 requests (2 failures and 2 events), but got %v", receiver.requests)
+	}
+
+	if len(receiver.events) != 2 || receiver.events[0].Event != EVENT_SOURCE_CREATED || receiver.events[1].Event != EVENT_SOURCE_CLOSED {
+		t.Errorf("Expected the events to be received in order, but got: %v", receiver.events)
+	}
+}
+
+// Counts the received events
+func (r *testEventWebhookReceiver) countEvents(event string, streamId string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+
+	for _, e := range r.events {
+		if e.Event == event && e.Stream == streamId {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestEventWebhooksAuthErrorRateLimit(t *testing.T) {
+	receiver := newTestEventWebhookReceiver("secret", 0)
+
+	receiverServer := httptest.NewServer(receiver)
+	defer receiverServer.Close()
+
+	eventWebhooks := NewEventWebhooks(EventWebhooksConfig{
+		Url:                    receiverServer.URL,
+		Secret:                 "secret",
+		TimeoutMilliseconds:    1000,
+		MaxRetries:             0,
+		RetryDelayMilliseconds: 10,
+		QueueSize:              100,
+	}, glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction))
+	defer eventWebhooks.Close()
+
+	for i := 0; i < EVENT_AUTH_ERROR_MAX_PER_MINUTE+10; i++ {
+		eventWebhooks.NotifyPublisherAuthError("stream1", "Invalid auth token")
+	}
+
+	// Other events are not limited
+
+	eventWebhooks.NotifyPublisherError("stream1", "PROTOCOL_ERROR", "Invalid message")
+	eventWebhooks.Notify(EVENT_SOURCE_CLOSED, "stream1", nil)
+
+	receiver.waitForEvent(EVENT_SOURCE_CLOSED, "stream1", t)
+
+	if count := receiver.countEvents(EVENT_PUBLISHER_ERROR, "stream1"); count != EVENT_AUTH_ERROR_MAX_PER_MINUTE+1 {
+		t.Errorf("Expected %v publisher error events, but got %v", EVENT_AUTH_ERROR_MAX_PER_MINUTE+1, count)
+	}
+}
+
+func TestEventWebhooksLifecycle(t *testing.T) {
+	logger := testMain()
+
+	receiver := newTestEventWebhookReceiver("secret", 0)
+
+	receiverServer := httptest.NewServer(receiver)
+	defer receiverServer.Close()
+
+	eventWebhooks := NewEventWebhooks(EventWebhooksConfig{
+		Url:                    receiverServer.URL,
+		Secret:                 "secret",
+		TimeoutMilliseconds:    1000,
+		RetryDelayMilliseconds: 10,
+		QueueSize:              100,
+	}, logger.CreateChildLogger("[Events] "))
+	defer eventWebhooks.Close()
+
+	mockPublishRegistry := NewMockPublishRegistry()
+
+	server1 := makeTestServer(logger.CreateChildLogger("[Server 1] "), mockPublishRegistry, true, "")
+	defer server1.Close()
+
+	server2 := makeTestServer(logger.CreateChildLogger("[Server 2] "), mockPublishRegistry, true, "")
+	defer server2.Close()
+
+	for _, ts := range []*TestServer{server1, server2} {
+		ts.server.sourceController.eventWebhooks = eventWebhooks
+		ts.server.relayController.eventWebhooks = eventWebhooks
+		ts.server.authController.config.RelaySecret = "relay-secret"
+	}
+
+	// Source
+
+	publisher := connectTestClient(server1.url, "PUSH", TEST_STREAM_ID_1, nil, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	receiver.waitForEvent(EVENT_SOURCE_CREATED, TEST_STREAM_ID_1, t)
+
+	// Viewer (relayed by the second server)
+
+	spectator := connectTestClient(server2.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator == nil {
+		return
+	}
+
+	relayOpened := receiver.waitForEvent(EVENT_RELAY_OPENED, TEST_STREAM_ID_1, t)
+
+	if relayOpened != nil && relayOpened.Data["url"] == "" {
+		t.Errorf("Expected the relay URL in the event data")
+	}
+
+	viewerJoined := receiver.waitForEvent(EVENT_VIEWER_JOINED, TEST_STREAM_ID_1, t)
+
+	if viewerJoined != nil && (viewerJoined.Data["connection"] == "" || viewerJoined.Data["ip"] == "") {
+		t.Errorf("Expected the connection and IP in the event data: %v", viewerJoined.Data)
+	}
+
+	spectator.Close()
+
+	receiver.waitForEvent(EVENT_VIEWER_LEFT, TEST_STREAM_ID_1, t)
+
+	// The relay connection to the first server (internal) is not a viewer
+
+	if count := receiver.countEvents(EVENT_VIEWER_JOINED, TEST_STREAM_ID_1); count != 1 {
+		t.Errorf("Expected a single viewer_joined event, but received %v", count)
+	}
+
+	// Publisher error
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte("F:duration=-1"))
+
+	publisherError := receiver.waitForEvent(EVENT_PUBLISHER_ERROR, TEST_STREAM_ID_1, t)
+
+	if publisherError != nil && publisherError.Data["code"] != "FRAGMENT_METADATA_ERROR" {
+		t.Errorf("Unexpected publisher error: %v", publisherError.Data)
+	}
+
+	// Close (the relay is closed after the source)
+
+	receiver.waitForEvent(EVENT_SOURCE_CLOSED, TEST_STREAM_ID_1, t)
+	receiver.waitForEvent(EVENT_RELAY_CLOSED, TEST_STREAM_ID_1, t)
+}
@@ -36,6 +36,23 @@ func FigureOutExternalServerWebsocketUrl(logger *glog.Logger) string {
 		port = genv.GetEnvInt("TLS_PORT", 443)
 	}
 
+	if genv.GetEnvBool("INTERNAL_ENABLED", false) {
+		// Other nodes connect to the internal listener
+		if genv.GetEnvBool("INTERNAL_TLS_ENABLED", false) {
+			proto = "wss"
+		} else {
+			proto = "ws"
+		}
+
+		port = genv.GetEnvInt("INTERNAL_PORT", 8080)
+	}
+
+	if genv.GetEnvBool("NODE_TLS_ENABLED", false) {
+		// Other nodes connect to the mutual TLS listener
+		proto = "wss"
+		port = genv.GetEnvInt("NODE_TLS_PORT", 8443)
+	}
+
 	prefix := genv.GetEnvString("WEBSOCKET_PREFIX", "/")
 
 	networkInterfaces, err := net.Interfaces()
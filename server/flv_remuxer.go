@@ -0,0 +1,372 @@
+// Remuxer of FLV tags (H.264 / AAC) into MPEG-TS fragments
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// FLV video codec ID for H.264 (AVC)
+const FLV_VIDEO_CODEC_AVC = 7
+
+// FLV audio format for AAC
+const FLV_AUDIO_FORMAT_AAC = 10
+
+// FLV video frame type for keyframes
+const FLV_VIDEO_FRAME_KEYFRAME = 1
+
+// H.264 NAL unit types
+const (
+	H264_NAL_TYPE_SPS = 7
+	H264_NAL_TYPE_PPS = 8
+	H264_NAL_TYPE_AUD = 9
+)
+
+// Access unit delimiter (Annex B), prepended to each video frame
+var H264_ANNEXB_AUD = []byte{0x00, 0x00, 0x00, 0x01, H264_NAL_TYPE_AUD, 0xF0}
+
+// Start code (Annex B)
+var H264_ANNEXB_START_CODE = []byte{0x00, 0x00, 0x00, 0x01}
+
+// Error for invalid FLV data
+var ErrFlvInvalid = errors.New("invalid FLV data")
+
+// Error for unsupported codecs
+var ErrFlvUnsupportedCodec = errors.New("unsupported codec. Only H.264 and AAC are supported")
+
+// Remuxer of FLV tags into MPEG-TS fragments, cut at keyframes
+type FlvRemuxer struct {
+	// Min duration of the fragments (milliseconds)
+	fragmentDuration int64
+
+	// Max size of the fragments (bytes)
+	// If reached, the fragment is cut even if there is no keyframe
+	maxFragmentSize int
+
+	// Function called for each complete fragment
+	onFragment func(duration float32, data []byte)
+
+	// Size (bytes) of the NAL unit lengths (AVC)
+	nalLengthSize int
+
+	// SPS and PPS NAL units (AVC)
+	parameterSets [][]byte
+
+	// True if the video configuration was received
+	hasVideo bool
+
+	// AAC audio specific config (object type, frequency index, channel config)
+	aacObjectType     byte
+	aacFrequencyIndex byte
+	aacChannelConfig  byte
+
+	// True if the audio configuration was received
+	hasAudio bool
+
+	// Muxer for the current fragment (nil if no fragment was started)
+	muxer *TsMuxer
+
+	// Timestamp of the start of the current fragment (milliseconds)
+	fragmentStart int64
+
+	// Timestamp of the last frame (milliseconds)
+	lastTimestamp int64
+}
+
+// Creates new instance of FlvRemuxer
+// fragmentDuration - Min duration of the fragments (milliseconds)
+// maxFragmentSize - Max size of the fragments (bytes)
+// onFragment - Function called for each complete fragment
+func NewFlvRemuxer(fragmentDuration int64, maxFragmentSize int, onFragment func(duration float32, data []byte)) *FlvRemuxer {
+	return &FlvRemuxer{
+		fragmentDuration: fragmentDuration,
+		maxFragmentSize:  maxFragmentSize,
+		onFragment:       onFragment,
+		parameterSets:    make([][]byte, 0),
+	}
+}
+
+// Starts a new fragment, ending the current one
+func (remuxer *FlvRemuxer) startFragment(timestamp int64) {
+	remuxer.Flush(timestamp)
+
+	remuxer.muxer = NewTsMuxer(remuxer.hasVideo, remuxer.hasAudio)
+	remuxer.muxer.WriteTables()
+	remuxer.fragmentStart = timestamp
+}
+
+// Ends the current fragment
+// timestamp - Timestamp of the end of the fragment (milliseconds)
+func (remuxer *FlvRemuxer) Flush(timestamp int64) {
+	if remuxer.muxer == nil {
+		return
+	}
+
+	data := remuxer.muxer.TakeData()
+	remuxer.muxer = nil
+
+	duration := timestamp - remuxer.fragmentStart
+
+	if duration < 0 {
+		duration = 0
+	}
+
+	remuxer.onFragment(float32(duration)/1000, data)
+}
+
+// Ends the current fragment, at the timestamp of the last frame
+func (remuxer *FlvRemuxer) End() {
+	remuxer.Flush(remuxer.lastTimestamp)
+}
+
+// Checks if a new fragment must start at a timestamp
+// randomAccess - True if the frame is a valid fragment start
+func (remuxer *FlvRemuxer) shouldStartFragment(timestamp int64, randomAccess bool) bool {
+	if remuxer.muxer != nil && len(remuxer.muxer.buffer) >= remuxer.maxFragmentSize {
+		return true
+	}
+
+	if !randomAccess {
+		return false
+	}
+
+	return remuxer.muxer == nil || timestamp-remuxer.fragmentStart >= remuxer.fragmentDuration
+}
+
+// Parses the AVC decoder configuration record
+func (remuxer *FlvRemuxer) parseAvcConfig(data []byte) error {
+	if len(data) < 6 {
+		return ErrFlvInvalid
+	}
+
+	nalLengthSize := int(data[4]&0x03) + 1
+
+	if nalLengthSize == 3 {
+		return ErrFlvInvalid
+	}
+
+	parameterSets := make([][]byte, 0)
+
+	pos := 5
+
+	for setType := 0; setType < 2; setType++ {
+		if pos >= len(data) {
+			return ErrFlvInvalid
+		}
+
+		count := int(data[pos])
+		pos++
+
+		if setType == 0 {
+			count = count & 0x1F
+		}
+
+		for i := 0; i < count; i++ {
+			if pos+2 > len(data) {
+				return ErrFlvInvalid
+			}
+
+			l := int(binary.BigEndian.Uint16(data[pos:]))
+			pos += 2
+
+			if pos+l > len(data) {
+				return ErrFlvInvalid
+			}
+
+			parameterSets = append(parameterSets, data[pos:pos+l])
+			pos += l
+		}
+	}
+
+	remuxer.nalLengthSize = nalLengthSize
+	remuxer.parameterSets = parameterSets
+	remuxer.hasVideo = true
+
+	return nil
+}
+
+// Converts an AVC frame (length prefixed NAL units) to Annex B
+func (remuxer *FlvRemuxer) toAnnexB(data []byte, keyframe bool) ([]byte, error) {
+	result := make([]byte, 0, len(data)+64)
+	result = append(result, H264_ANNEXB_AUD...)
+
+	nalUnits := make([][]byte, 0)
+	hasParameterSets := false
+
+	for pos := 0; pos < len(data); {
+		if pos+remuxer.nalLengthSize > len(data) {
+			return nil, ErrFlvInvalid
+		}
+
+		l := 0
+
+		for i := 0; i < remuxer.nalLengthSize; i++ {
+			l = (l << 8) | int(data[pos+i])
+		}
+
+		pos += remuxer.nalLengthSize
+
+		if l > len(data)-pos {
+			return nil, ErrFlvInvalid
+		}
+
+		nal := data[pos : pos+l]
+		pos += l
+
+		if len(nal) == 0 {
+			continue
+		}
+
+		nalType := nal[0] & 0x1F
+
+		if nalType == H264_NAL_TYPE_AUD {
+			continue
+		}
+
+		if nalType == H264_NAL_TYPE_SPS || nalType == H264_NAL_TYPE_PPS {
+			hasParameterSets = true
+		}
+
+		nalUnits = append(nalUnits, nal)
+	}
+
+	if keyframe && !hasParameterSets {
+		for _, ps := range remuxer.parameterSets {
+			result = append(result, H264_ANNEXB_START_CODE...)
+			result = append(result, ps...)
+		}
+	}
+
+	for _, nal := range nalUnits {
+		result = append(result, H264_ANNEXB_START_CODE...)
+		result = append(result, nal...)
+	}
+
+	return result, nil
+}
+
+// Handles a video tag
+// timestamp - Timestamp (milliseconds)
+// data - Body of the tag
+func (remuxer *FlvRemuxer) OnVideo(timestamp int64, data []byte) error {
+	if len(data) < 5 {
+		return ErrFlvInvalid
+	}
+
+	frameType := data[0] >> 4
+	codecId := data[0] & 0x0F
+
+	if codecId != FLV_VIDEO_CODEC_AVC {
+		return ErrFlvUnsupportedCodec
+	}
+
+	packetType := data[1]
+
+	switch packetType {
+	case 0:
+		// Sequence header
+		return remuxer.parseAvcConfig(data[5:])
+	case 1:
+		// NAL units
+		if !remuxer.hasVideo {
+			return nil // Waiting for the configuration
+		}
+
+		compositionTime := int64(uint32(data[2])<<16 | uint32(data[3])<<8 | uint32(data[4]))
+
+		if compositionTime&0x800000 != 0 {
+			compositionTime -= 0x1000000
+		}
+
+		keyframe := frameType == FLV_VIDEO_FRAME_KEYFRAME
+
+		if remuxer.shouldStartFragment(timestamp, keyframe) {
+			remuxer.startFragment(timestamp)
+		}
+
+		remuxer.lastTimestamp = timestamp
+
+		if remuxer.muxer == nil {
+			return nil // Waiting for a keyframe
+		}
+
+		frame, err := remuxer.toAnnexB(data[5:], keyframe)
+
+		if err != nil {
+			return err
+		}
+
+		remuxer.muxer.WriteVideoFrame(frame, (timestamp+compositionTime)*90, timestamp*90, keyframe)
+	}
+
+	return nil
+}
+
+// Handles an audio tag
+// timestamp - Timestamp (milliseconds)
+// data - Body of the tag
+func (remuxer *FlvRemuxer) OnAudio(timestamp int64, data []byte) error {
+	if len(data) < 2 {
+		return ErrFlvInvalid
+	}
+
+	if data[0]>>4 != FLV_AUDIO_FORMAT_AAC {
+		return ErrFlvUnsupportedCodec
+	}
+
+	switch data[1] {
+	case 0:
+		// Audio specific config
+		if len(data) < 4 {
+			return ErrFlvInvalid
+		}
+
+		remuxer.aacObjectType = data[2] >> 3
+		remuxer.aacFrequencyIndex = ((data[2] & 0x07) << 1) | (data[3] >> 7)
+		remuxer.aacChannelConfig = (data[3] >> 3) & 0x0F
+
+		if remuxer.aacObjectType == 0 || remuxer.aacObjectType > 4 {
+			return ErrFlvUnsupportedCodec
+		}
+
+		remuxer.hasAudio = true
+	case 1:
+		// Raw frame
+		if !remuxer.hasAudio {
+			return nil // Waiting for the configuration
+		}
+
+		if !remuxer.hasVideo && remuxer.shouldStartFragment(timestamp, true) {
+			// Audio only, fragments can start at any frame
+			remuxer.startFragment(timestamp)
+		}
+
+		remuxer.lastTimestamp = timestamp
+
+		if remuxer.muxer == nil {
+			return nil // Waiting for a keyframe
+		}
+
+		remuxer.muxer.WriteAudioFrame(remuxer.toAdts(data[2:]), timestamp*90)
+	}
+
+	return nil
+}
+
+// Prepends the ADTS header to an AAC frame
+func (remuxer *FlvRemuxer) toAdts(frame []byte) []byte {
+	frameLength := len(frame) + 7
+
+	result := make([]byte, 7, frameLength)
+
+	result[0] = 0xFF
+	result[1] = 0xF1 // MPEG-4, no CRC
+	result[2] = ((remuxer.aacObjectType - 1) << 6) | (remuxer.aacFrequencyIndex << 2) | (remuxer.aacChannelConfig >> 2)
+	result[3] = ((remuxer.aacChannelConfig & 0x03) << 6) | byte(frameLength>>11)
+	result[4] = byte(frameLength >> 3)
+	result[5] = byte((frameLength&0x07)<<5) | 0x1F
+	result[6] = 0xFC
+
+	return append(result, frame...)
+}
@@ -0,0 +1,150 @@
+// Binary fragment frames (protocol version 2)
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// Protocol versions
+const (
+	PROTOCOL_VERSION_TEXT_HEADERS  = 1 // Fragment metadata sent in a text message, before the binary message
+	PROTOCOL_VERSION_BINARY_FRAMES = 2 // Fragment metadata packed in the binary message
+)
+
+// Max protocol version supported by the server
+const PROTOCOL_VERSION_MAX = PROTOCOL_VERSION_BINARY_FRAMES
+
+// Size of the header of the binary fragment frames
+const FRAGMENT_FRAME_HEADER_SIZE = 20
+
+// Frame types
+const (
+	FRAGMENT_FRAME_TYPE_FRAGMENT = 1
+	FRAGMENT_FRAME_TYPE_PART     = 2
+)
+
+// Frame flags (parts)
+const (
+	FRAGMENT_FRAME_FLAG_INDEPENDENT = 0x01
+	FRAGMENT_FRAME_FLAG_LAST        = 0x02
+)
+
+// Parses the protocol version requested by the client in a PULL or PUSH message
+// If the client requests a version higher than the supported one, the max supported version is used
+// Returns the version, or 0 and an error message if the parameter is not valid
+func parseProtocolVersion(msg *WebsocketProtocolMessage) (int, string) {
+	versionStr := msg.GetParameter("protocol")
+
+	if versionStr == "" {
+		return PROTOCOL_VERSION_TEXT_HEADERS, ""
+	}
+
+	version, err := strconv.Atoi(versionStr)
+
+	if err != nil || version < PROTOCOL_VERSION_TEXT_HEADERS {
+		return 0, "protocol must be a valid positive integer"
+	}
+
+	return min(version, PROTOCOL_VERSION_MAX), ""
+}
+
+// Encodes the header of a fragment frame
+func encodeFragmentFrameHeader(frameType byte, flags byte, index int, duration float32, sequence int64) []byte {
+	header := make([]byte, FRAGMENT_FRAME_HEADER_SIZE)
+
+	header[0] = frameType
+	header[1] = flags
+	binary.BigEndian.PutUint32(header[4:8], uint32(index))
+	binary.BigEndian.PutUint32(header[8:12], math.Float32bits(duration))
+	binary.BigEndian.PutUint64(header[12:20], uint64(sequence))
+
+	return header
+}
+
+// Encodes the header of the binary frame of a fragment
+// The frame is the header followed by the fragment data
+func EncodeFragmentFrameHeader(frag *HlsFragment) []byte {
+	return encodeFragmentFrameHeader(FRAGMENT_FRAME_TYPE_FRAGMENT, 0, 0, frag.Duration, frag.Sequence)
+}
+
+// Encodes a fragment as a binary frame
+// This copies the fragment data. To send it, write the header and the data instead.
+func EncodeFragmentFrame(frag *HlsFragment) []byte {
+	return append(EncodeFragmentFrameHeader(frag), frag.Data...)
+}
+
+// Encodes the header of the binary frame of a fragment part
+// The frame is the header followed by the part data
+func EncodeFragmentPartFrameHeader(part *HlsFragmentPart) []byte {
+	flags := byte(0)
+
+	if part.Independent {
+		flags |= FRAGMENT_FRAME_FLAG_INDEPENDENT
+	}
+
+	if part.Last {
+		flags |= FRAGMENT_FRAME_FLAG_LAST
+	}
+
+	return encodeFragmentFrameHeader(FRAGMENT_FRAME_TYPE_PART, flags, part.Index, part.Duration, 0)
+}
+
+// Encodes a fragment part as a binary frame
+// This copies the part data. To send it, write the header and the data instead.
+func EncodeFragmentPartFrame(part *HlsFragmentPart) []byte {
+	return append(EncodeFragmentPartFrameHeader(part), part.Data...)
+}
+
+// Parses a binary fragment frame
+// Returns the fragment or the part (only one of them is set),
+// or nil and an error message if the frame is not valid
+func ParseFragmentFrame(frame []byte) (*HlsFragment, *HlsFragmentPart, string) {
+	if len(frame) < FRAGMENT_FRAME_HEADER_SIZE {
+		return nil, nil, "The fragment frame is too short"
+	}
+
+	frameType := frame[0]
+	flags := frame[1]
+	index := binary.BigEndian.Uint32(frame[4:8])
+	duration := math.Float32frombits(binary.BigEndian.Uint32(frame[8:12]))
+	sequence := int64(binary.BigEndian.Uint64(frame[12:20]))
+	data := frame[FRAGMENT_FRAME_HEADER_SIZE:]
+
+	if math.IsNaN(float64(duration)) || math.IsInf(float64(duration), 0) || duration <= 0 {
+		return nil, nil, "The fragment duration must be a positive number"
+	}
+
+	if len(data) == 0 {
+		return nil, nil, "The fragment data cannot be empty"
+	}
+
+	switch frameType {
+	case FRAGMENT_FRAME_TYPE_FRAGMENT:
+		if sequence < 0 {
+			return nil, nil, "The fragment sequence number cannot be negative"
+		}
+
+		return &HlsFragment{
+			Sequence: sequence,
+			Duration: duration,
+			Data:     data,
+		}, nil, ""
+	case FRAGMENT_FRAME_TYPE_PART:
+		if index > math.MaxInt32 {
+			return nil, nil, "The part index is too large"
+		}
+
+		return nil, &HlsFragmentPart{
+			Index:       int(index),
+			Independent: flags&FRAGMENT_FRAME_FLAG_INDEPENDENT != 0,
+			Duration:    duration,
+			Last:        flags&FRAGMENT_FRAME_FLAG_LAST != 0,
+			Data:        data,
+		}, ""
+	default:
+		return nil, nil, "Unknown fragment frame type"
+	}
+}
@@ -0,0 +1,219 @@
+// Tests for binary fragment frames (protocol version 2)
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFragmentFrame(t *testing.T) {
+	// Fragment
+
+	frag, part, errMsg := ParseFragmentFrame(EncodeFragmentFrame(&HlsFragment{
+		Sequence: 12,
+		Duration: 1.5,
+		Data:     TEST_STREAM_DATA_1[0].Data,
+	}))
+
+	if errMsg != "" || frag == nil || part != nil {
+		t.Fatalf("Could not parse fragment frame: %v", errMsg)
+	}
+
+	if frag.Sequence != 12 || frag.Duration != 1.5 || !bytes.Equal(frag.Data, TEST_STREAM_DATA_1[0].Data) {
+		t.Errorf("Fragment does not match: %v", frag)
+	}
+
+	// Part
+
+	frag, part, errMsg = ParseFragmentFrame(EncodeFragmentPartFrame(&HlsFragmentPart{
+		Index:       3,
+		Independent: true,
+		Duration:    0.25,
+		Last:        true,
+		Data:        TEST_STREAM_DATA_1[1].Data,
+	}))
+
+	if errMsg != "" || frag != nil || part == nil {
+		t.Fatalf("Could not parse part frame: %v", errMsg)
+	}
+
+	if part.Index != 3 || !part.Independent || part.Duration != 0.25 || !part.Last || !bytes.Equal(part.Data, TEST_STREAM_DATA_1[1].Data) {
+		t.Errorf("Part does not match: %v", part)
+	}
+
+	// Invalid frames
+
+	validFrame := EncodeFragmentFrame(&HlsFragment{
+		Duration: 1,
+		Data:     []byte{0x47},
+	})
+
+	invalidFrames := map[string][]byte{
+		"short":         validFrame[:FRAGMENT_FRAME_HEADER_SIZE-1],
+		"empty data":    validFrame[:FRAGMENT_FRAME_HEADER_SIZE],
+		"unknown type":  append([]byte{9}, validFrame[1:]...),
+		"zero duration": EncodeFragmentFrame(&HlsFragment{Duration: 0, Data: []byte{0x47}}),
+	}
+
+	for name, frame := range invalidFrames {
+		frag, part, errMsg = ParseFragmentFrame(frame)
+
+		if errMsg == "" || frag != nil || part != nil {
+			t.Errorf("[%v] Expected the frame to be rejected", name)
+		}
+	}
+}
+
+func TestParseProtocolVersion(t *testing.T) {
+	testCases := map[string]int{
+		"":   PROTOCOL_VERSION_TEXT_HEADERS,
+		"1":  PROTOCOL_VERSION_TEXT_HEADERS,
+		"2":  PROTOCOL_VERSION_BINARY_FRAMES,
+		"99": PROTOCOL_VERSION_MAX,
+		"0":  0,
+		"x":  0,
+	}
+
+	for param, expectedVersion := range testCases {
+		msg := &WebsocketProtocolMessage{
+			MessageType: "PULL",
+			Parameters:  map[string]string{},
+		}
+
+		if param != "" {
+			msg.Parameters["protocol"] = param
+		}
+
+		version, errMsg := parseProtocolVersion(msg)
+
+		if version != expectedVersion {
+			t.Errorf("[protocol=%v] Expected version %v, but got %v", param, expectedVersion, version)
+		}
+
+		if (expectedVersion == 0) != (errMsg != "") {
+			t.Errorf("[protocol=%v] Unexpected error message: %v", param, errMsg)
+		}
+	}
+}
+
+// Reads a binary fragment frame, ignoring heartbeat messages
+func readTestFragmentFrame(socket *websocket.Conn, t *testing.T) (*HlsFragment, *HlsFragmentPart) {
+	msg, data := readTestMessage(socket, t)
+
+	if msg != nil {
+		t.Errorf("Expected binary fragment frame, but received: %v", msg.Serialize())
+		return nil, nil
+	}
+
+	frag, part, errMsg := ParseFragmentFrame(data)
+
+	if errMsg != "" {
+		t.Errorf("Invalid fragment frame: %v", errMsg)
+	}
+
+	return frag, part
+}
+
+// Test a scenario mixing clients with both protocol versions
+// Publisher (v2) -> Server 1 -> Spectator (v2, parts), Relay (v2) -> Server 2 -> Spectator (v1)
+func TestProtocolVersion2(t *testing.T) {
+	logger := testMain()
+
+	mockPublishRegistry := NewMockPublishRegistry()
+
+	server1 := makeTestServer(logger.CreateChildLogger("[Server 1] "), mockPublishRegistry, true, "")
+	defer server1.Close()
+
+	server2 := makeTestServer(logger.CreateChildLogger("[Server 2] "), mockPublishRegistry, true, "")
+	defer server2.Close()
+
+	publisher := connectTestClient(server1.url, "PUSH", TEST_STREAM_ID_1, map[string]string{"protocol": "2"}, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	spectatorV2 := connectTestClient(server1.url, "PULL", TEST_STREAM_ID_1, map[string]string{"protocol": "2", "parts": "true"}, t)
+
+	if spectatorV2 == nil {
+		return
+	}
+
+	defer spectatorV2.Close()
+
+	spectatorV1 := connectTestClient(server2.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectatorV1 == nil {
+		return
+	}
+
+	defer spectatorV1.Close()
+
+	// Push a complete fragment, and a fragment in parts
+
+	fragmentData := TEST_STREAM_DATA_1[0].Data
+	partsData := [][]byte{TEST_STREAM_DATA_1[1].Data, TEST_STREAM_DATA_1[2].Data}
+
+	_ = publisher.WriteMessage(websocket.BinaryMessage, EncodeFragmentFrame(&HlsFragment{
+		Duration: 1,
+		Data:     fragmentData,
+	}))
+
+	for i, data := range partsData {
+		_ = publisher.WriteMessage(websocket.BinaryMessage, EncodeFragmentPartFrame(&HlsFragmentPart{
+			Index:       i,
+			Independent: i == 0,
+			Duration:    0.5,
+			Last:        i == len(partsData)-1,
+			Data:        data,
+		}))
+	}
+
+	// Spectator (v2)
+
+	frag, _ := readTestFragmentFrame(spectatorV2, t)
+
+	if frag == nil || frag.Sequence != 1 || frag.Duration != 1 || !bytes.Equal(frag.Data, fragmentData) {
+		t.Errorf("[Spectator v2] Fragment does not match: %v", frag)
+	}
+
+	for i, data := range partsData {
+		_, part := readTestFragmentFrame(spectatorV2, t)
+
+		if part == nil || part.Index != i || part.Independent != (i == 0) || part.Last != (i == len(partsData)-1) || !bytes.Equal(part.Data, data) {
+			t.Errorf("[Spectator v2] Part %v does not match: %v", i, part)
+		}
+	}
+
+	// Spectator (v1)
+
+	expectTestFragmentWithSequence(spectatorV1, 1, fragmentData, t)
+
+	msg, _ := readTestMessage(spectatorV1, t)
+
+	if msg == nil || msg.MessageType != "F" || msg.GetParameter("duration") != "1" {
+		t.Errorf("[Spectator v1] Expected F message, but received: %v", msg)
+		return
+	}
+
+	_, data := readTestMessage(spectatorV1, t)
+
+	if !bytes.Equal(data, bytes.Join(partsData, nil)) {
+		t.Errorf("[Spectator v1] Assembled fragment data does not match")
+	}
+
+	// Text fragment messages are rejected in version 2
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte("F:duration=1"))
+
+	msg, _ = readTestMessage(publisher, t)
+
+	if msg == nil || msg.MessageType != "E" || msg.GetParameter("code") != "PROTOCOL_ERROR" {
+		t.Errorf("Expected PROTOCOL_ERROR, but received: %v", msg)
+	}
+}
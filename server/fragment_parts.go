@@ -0,0 +1,157 @@
+// Partial fragments (chunks)
+
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Max number of parts of a fragment
+const HLS_FRAGMENT_MAX_PARTS = 1024
+
+// Error returned when a part is received out of order. The part is discarded.
+var ErrFragmentPartOutOfOrder = errors.New("fragment part received out of order")
+
+// Error returned when a fragment has too many parts, or its parts are too large. The fragment is discarded.
+var ErrFragmentPartsLimit = errors.New("fragment parts limit exceeded")
+
+// HLS fragment part (chunk of a fragment being generated)
+type HlsFragmentPart struct {
+	// Index of the part inside the fragment (starting at 0)
+	Index int
+
+	// True if the part can be decoded independently (starts with a keyframe)
+	Independent bool
+
+	// Duration of the part in seconds
+	Duration float32
+
+	// True if this is the last part of the fragment
+	Last bool
+
+	// Data
+	Data []byte
+
+	// Cues to be delivered along with the part
+	Cues []*HlsCue
+}
+
+// Assembles complete fragments from their parts
+type HlsFragmentAssembler struct {
+	// Max size (bytes) of a fragment. 0 for unlimited.
+	maxSize int64
+
+	// Parts received for the current fragment
+	parts []*HlsFragmentPart
+
+	// Size of the parts received for the current fragment
+	size int64
+}
+
+// Creates new instance of HlsFragmentAssembler
+// maxSize - Max size (bytes) of a fragment. 0 for unlimited.
+func NewHlsFragmentAssembler(maxSize int64) *HlsFragmentAssembler {
+	return &HlsFragmentAssembler{
+		maxSize: maxSize,
+		parts:   make([]*HlsFragmentPart, 0),
+		size:    0,
+	}
+}
+
+// Resets the assembler, discarding any pending parts
+func (assembler *HlsFragmentAssembler) Reset() {
+	assembler.parts = make([]*HlsFragmentPart, 0)
+	assembler.size = 0
+}
+
+// Adds a part to the assembler
+// Returns the complete fragment, if the part was the last one. Nil otherwise.
+// Returns ErrFragmentPartOutOfOrder if the part does not follow the expected order,
+// or ErrFragmentPartsLimit if the fragment exceeds the limits. In both cases, the pending parts are discarded.
+func (assembler *HlsFragmentAssembler) AddPart(part *HlsFragmentPart) (*HlsFragment, error) {
+	if part.Index == 0 {
+		assembler.Reset()
+	} else if part.Index != len(assembler.parts) {
+		// Parts were lost, discard the fragment
+		assembler.Reset()
+		return nil, ErrFragmentPartOutOfOrder
+	}
+
+	if len(assembler.parts) >= HLS_FRAGMENT_MAX_PARTS || (assembler.maxSize > 0 && assembler.size+int64(len(part.Data)) > assembler.maxSize) {
+		assembler.Reset()
+		return nil, ErrFragmentPartsLimit
+	}
+
+	assembler.parts = append(assembler.parts, part)
+	assembler.size += int64(len(part.Data))
+
+	if !part.Last {
+		return nil, nil
+	}
+
+	// Build the complete fragment
+
+	totalDuration := float32(0)
+	totalSize := 0
+
+	for _, p := range assembler.parts {
+		totalDuration += p.Duration
+		totalSize += len(p.Data)
+	}
+
+	data := make([]byte, 0, totalSize)
+	var cues []*HlsCue
+
+	for _, p := range assembler.parts {
+		data = append(data, p.Data...)
+		cues = append(cues, p.Cues...)
+	}
+
+	assembler.Reset()
+
+	return &HlsFragment{
+		Duration: totalDuration,
+		Data:     data,
+		Cues:     cues,
+	}, nil
+}
+
+// Parses the metadata of a fragment part from a P message
+// Returns the part (without data), or nil and an error message if the metadata is not valid
+func ParseFragmentPartMetadata(msg *WebsocketProtocolMessage) (*HlsFragmentPart, string) {
+	indexStr := msg.GetParameter("index")
+
+	if indexStr == "" {
+		return nil, "The part index must be provided"
+	}
+
+	index, err := strconv.Atoi(indexStr)
+
+	if err != nil || index < 0 {
+		return nil, "The part index must be a valid non-negative integer"
+	}
+
+	durationStr := msg.GetParameter("duration")
+
+	if durationStr == "" {
+		return nil, "The part duration must be provided"
+	}
+
+	duration, err := strconv.ParseFloat(durationStr, 32)
+
+	if err != nil {
+		return nil, "The part duration is not a valid floating point number"
+	}
+
+	if duration <= 0 {
+		return nil, "The part duration must be positive"
+	}
+
+	return &HlsFragmentPart{
+		Index:       index,
+		Independent: msg.GetParameter("independent") == "true",
+		Duration:    float32(duration),
+		Last:        msg.GetParameter("last") == "true",
+	}, ""
+}
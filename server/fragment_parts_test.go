@@ -0,0 +1,381 @@
+// Tests for partial fragments
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Splits a fragment in parts of the specified size
+func splitFragmentInParts(frag HlsFragment, partSize int) []*HlsFragmentPart {
+	parts := make([]*HlsFragmentPart, 0)
+
+	partCount := (len(frag.Data) + partSize - 1) / partSize
+	remainingDuration := frag.Duration
+
+	for i := 0; i < partCount; i++ {
+		end := (i + 1) * partSize
+
+		if end > len(frag.Data) {
+			end = len(frag.Data)
+		}
+
+		duration := frag.Duration / float32(partCount)
+
+		if i == partCount-1 {
+			// Last part takes the remaining duration, so the sum is exact
+			duration = remainingDuration
+		}
+
+		remainingDuration -= duration
+
+		parts = append(parts, &HlsFragmentPart{
+			Index:       i,
+			Independent: i == 0,
+			Duration:    duration,
+			Last:        i == partCount-1,
+			Data:        frag.Data[i*partSize : end],
+		})
+	}
+
+	return parts
+}
+
+func TestHlsFragmentAssembler(t *testing.T) {
+	assembler := NewHlsFragmentAssembler(0)
+
+	for _, frag := range TEST_STREAM_DATA_2 {
+		parts := splitFragmentInParts(frag, 3)
+
+		for i, part := range parts {
+			result, err := assembler.AddPart(part)
+
+			if err != nil {
+				t.Errorf("Part %v was considered invalid: %v", i, err)
+				continue
+			}
+
+			if i < len(parts)-1 {
+				if result != nil {
+					t.Errorf("Fragment completed before the last part")
+				}
+				continue
+			}
+
+			if result == nil {
+				t.Errorf("Fragment not completed after the last part")
+				continue
+			}
+
+			if !bytes.Equal(result.Data, frag.Data) {
+				t.Errorf("Data does not match. Expected %v, Actual: %v", frag.Data, result.Data)
+			}
+
+			if result.Duration != frag.Duration {
+				t.Errorf("Duration does not match. Expected %v, Actual: %v", frag.Duration, result.Duration)
+			}
+		}
+	}
+
+	// Out of order parts must be discarded
+
+	parts := splitFragmentInParts(TEST_STREAM_DATA_2[1], 2)
+
+	_, err := assembler.AddPart(parts[0])
+
+	if err != nil {
+		t.Errorf("First part was considered invalid: %v", err)
+	}
+
+	_, err = assembler.AddPart(parts[2])
+
+	if err != ErrFragmentPartOutOfOrder {
+		t.Errorf("Out of order part was considered valid")
+	}
+
+	result, err := assembler.AddPart(parts[3])
+
+	if err == nil || result != nil {
+		t.Errorf("Part after a lost one was considered valid")
+	}
+}
+
+func TestHlsFragmentAssemblerLimits(t *testing.T) {
+	// Size limit
+
+	assembler := NewHlsFragmentAssembler(4)
+
+	if _, err := assembler.AddPart(&HlsFragmentPart{Index: 0, Duration: 1, Data: []byte{1, 2, 3}}); err != nil {
+		t.Errorf("First part was considered invalid: %v", err)
+	}
+
+	if _, err := assembler.AddPart(&HlsFragmentPart{Index: 1, Duration: 1, Data: []byte{4, 5}}); err != ErrFragmentPartsLimit {
+		t.Errorf("Expected ErrFragmentPartsLimit, but got: %v", err)
+	}
+
+	// The assembler must be reset after exceeding the limit
+
+	result, err := assembler.AddPart(&HlsFragmentPart{Index: 0, Duration: 1, Last: true, Data: []byte{1, 2, 3, 4}})
+
+	if err != nil || result == nil || len(result.Data) != 4 {
+		t.Errorf("Expected a complete fragment after the reset. Error: %v", err)
+	}
+
+	// Parts limit
+
+	assembler = NewHlsFragmentAssembler(0)
+
+	for i := 0; i < HLS_FRAGMENT_MAX_PARTS; i++ {
+		if _, err := assembler.AddPart(&HlsFragmentPart{Index: i, Duration: 0.01, Data: []byte{1}}); err != nil {
+			t.Fatalf("Part %v was considered invalid: %v", i, err)
+		}
+	}
+
+	if _, err := assembler.AddPart(&HlsFragmentPart{Index: HLS_FRAGMENT_MAX_PARTS, Duration: 0.01, Last: true, Data: []byte{1}}); err != ErrFragmentPartsLimit {
+		t.Errorf("Expected ErrFragmentPartsLimit, but got: %v", err)
+	}
+}
+
+func runTestPartsPublisher(serverUrl string, streamId string, dataToPublish []HlsFragment, wg *sync.WaitGroup, groupSync *PublisherSpectatorsSync, t *testing.T) {
+	defer wg.Done()
+
+	socket, _, err := websocket.DefaultDialer.Dial(serverUrl, nil)
+
+	if err != nil {
+		t.Error(err)
+		groupSync.wgPublisher.Done()
+		return
+	}
+
+	defer socket.Close()
+
+	authToken, err := signAuthToken(TEST_JWT_SECRET, "PUSH", streamId)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	msg := WebsocketProtocolMessage{
+		MessageType: "PUSH",
+		Parameters: map[string]string{
+			"stream": streamId,
+			"auth":   authToken,
+		},
+	}
+
+	_ = socket.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+
+	_ = socket.SetReadDeadline(time.Now().Add(HEARTBEAT_MSG_PERIOD_SECONDS * time.Second))
+
+	_, message, err := socket.ReadMessage()
+
+	if err != nil || ParseWebsocketProtocolMessage(string(message)).MessageType != "OK" {
+		t.Errorf("[Parts Publisher] Expected OK message. Error: %v", err)
+		groupSync.wgPublisher.Done()
+		return
+	}
+
+	groupSync.wgPublisher.Done()
+
+	// Wait for the spectators, so they receive the parts
+
+	groupSync.wgSpectators.Wait()
+
+	for _, f := range dataToPublish {
+		for _, part := range splitFragmentInParts(f, 3) {
+			partMessage := WebsocketProtocolMessage{
+				MessageType: "P",
+				Parameters: map[string]string{
+					"index":       fmt.Sprint(part.Index),
+					"independent": fmt.Sprint(part.Independent),
+					"duration":    fmt.Sprint(part.Duration),
+					"last":        fmt.Sprint(part.Last),
+				},
+			}
+
+			_ = socket.WriteMessage(websocket.TextMessage, []byte(partMessage.Serialize()))
+			_ = socket.WriteMessage(websocket.BinaryMessage, part.Data)
+		}
+	}
+
+	// Give time for the fragments to be delivered before closing
+
+	time.Sleep(100 * time.Millisecond)
+
+	closeMessage := WebsocketProtocolMessage{
+		MessageType: "CLOSE",
+	}
+
+	_ = socket.WriteMessage(websocket.TextMessage, []byte(closeMessage.Serialize()))
+}
+
+func runTestPartsSpectator(serverUrl string, streamId string, dataToExpect []HlsFragment, wg *sync.WaitGroup, groupSync *PublisherSpectatorsSync, t *testing.T) {
+	defer wg.Done()
+
+	groupSync.wgPublisher.Wait()
+
+	socket, _, err := websocket.DefaultDialer.Dial(serverUrl, nil)
+
+	if err != nil {
+		groupSync.wgSpectators.Done()
+		t.Error(err)
+		return
+	}
+
+	defer socket.Close()
+
+	authToken, err := signAuthToken(TEST_JWT_SECRET, "PULL", streamId)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	msg := WebsocketProtocolMessage{
+		MessageType: "PULL",
+		Parameters: map[string]string{
+			"stream": streamId,
+			"auth":   authToken,
+			"parts":  "true",
+		},
+	}
+
+	_ = socket.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+
+	_ = socket.SetReadDeadline(time.Now().Add(HEARTBEAT_MSG_PERIOD_SECONDS * time.Second))
+
+	_, message, err := socket.ReadMessage()
+
+	if err != nil || ParseWebsocketProtocolMessage(string(message)).MessageType != "OK" {
+		t.Errorf("[Parts Spectator] Expected OK message. Error: %v", err)
+		groupSync.wgSpectators.Done()
+		return
+	}
+
+	groupSync.wgSpectators.Done()
+
+	assembler := NewHlsFragmentAssembler(0)
+	received := make([]*HlsFragment, 0)
+	partsReceived := 0
+
+	var currentPart *HlsFragmentPart = nil
+	var currentFragment *HlsFragment = nil
+
+	for {
+		_ = socket.SetReadDeadline(time.Now().Add(HEARTBEAT_MSG_PERIOD_SECONDS * time.Second))
+
+		mt, message, err := socket.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if mt == websocket.BinaryMessage {
+			if currentPart != nil {
+				currentPart.Data = message
+				frag, _ := assembler.AddPart(currentPart)
+				if frag != nil {
+					received = append(received, frag)
+				}
+				partsReceived++
+			} else if currentFragment != nil {
+				currentFragment.Data = message
+				received = append(received, currentFragment)
+			} else {
+				t.Errorf("[Parts Spectator] Unexpected binary message")
+				return
+			}
+
+			currentPart = nil
+			currentFragment = nil
+
+			continue
+		}
+
+		parsedMessage := ParseWebsocketProtocolMessage(string(message))
+
+		switch parsedMessage.MessageType {
+		case "P":
+			part, errMsg := ParseFragmentPartMetadata(parsedMessage)
+
+			if part == nil {
+				t.Errorf("[Parts Spectator] Invalid part metadata: %v", errMsg)
+				return
+			}
+
+			currentPart = part
+		case "F":
+			duration, err := strconv.ParseFloat(parsedMessage.GetParameter("duration"), 32)
+
+			if err != nil {
+				t.Errorf("[Parts Spectator] Invalid fragment metadata: %v", parsedMessage.Serialize())
+				return
+			}
+
+			assembler.Reset()
+
+			currentFragment = &HlsFragment{
+				Duration: float32(duration),
+			}
+		case "CLOSE":
+			if len(received) != len(dataToExpect) {
+				t.Errorf("[Parts Spectator] Expected %v fragments, but received %v", len(dataToExpect), len(received))
+				return
+			}
+
+			for i, frag := range received {
+				if !bytes.Equal(frag.Data, dataToExpect[i].Data) {
+					t.Errorf("[Parts Spectator] [F: %v] Data does not match. Expected %v, Actual: %v", i, dataToExpect[i].Data, frag.Data)
+				}
+			}
+
+			if partsReceived == 0 {
+				t.Errorf("[Parts Spectator] No parts were received")
+			}
+
+			return
+		case "E":
+			t.Errorf("[Parts Spectator] Received error message from server: %v", parsedMessage.Serialize())
+			return
+		}
+	}
+}
+
+// Test a direct scenario with fragments pushed in parts
+// Parts Publisher -> Server -> Spectator (parts), Spectator (legacy)
+func TestFragmentPartsScenario(t *testing.T) {
+	logger := testMain()
+
+	mockPublishRegistry := NewMockPublishRegistry()
+
+	server1 := makeTestServer(logger.CreateChildLogger("[Server 1] "), mockPublishRegistry, true, "")
+	defer server1.Close()
+
+	server2 := makeTestServer(logger.CreateChildLogger("[Server 2] "), mockPublishRegistry, true, "")
+	defer server2.Close()
+
+	wg := &sync.WaitGroup{}
+
+	group := MakePublisherSpectatorsSync(3)
+
+	wg.Add(1)
+	go runTestPartsPublisher(server1.url, TEST_STREAM_ID_2, TEST_STREAM_DATA_2, wg, group, t)
+
+	wg.Add(1)
+	go runTestPartsSpectator(server1.url, TEST_STREAM_ID_2, TEST_STREAM_DATA_2, wg, group, t)
+
+	wg.Add(1)
+	go runTestPartsSpectator(server2.url, TEST_STREAM_ID_2, TEST_STREAM_DATA_2, wg, group, t)
+
+	wg.Add(1)
+	go runTestSpectator("S-Legacy", server1.url, TEST_STREAM_ID_2, TEST_STREAM_DATA_2, wg, group, t)
+
+	wg.Wait()
+}
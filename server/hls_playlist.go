@@ -0,0 +1,142 @@
+// HLS playlist parsing
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Default target duration of HLS playlists (seconds)
+const HLS_DEFAULT_TARGET_DURATION = 3
+
+// HLS playlist (m3u8)
+type HlsPlaylist struct {
+	// Max duration of the fragments (seconds)
+	TargetDuration int
+
+	// Index of the first fragment
+	MediaSequence int
+
+	// True if the playlist is ended (#EXT-X-ENDLIST)
+	IsEnded bool
+
+	// Fragments
+	Fragments []*HlsPlaylistFragment
+
+	// URIs of the variant playlists (only for master playlists)
+	Variants []string
+}
+
+// Fragment of an HLS playlist
+type HlsPlaylistFragment struct {
+	// Index of the fragment (media sequence)
+	Index int
+
+	// Duration (seconds)
+	Duration float64
+
+	// URI of the fragment, relative to the playlist
+	Uri string
+
+	// True if there is a discontinuity before the fragment (#EXT-X-DISCONTINUITY)
+	Discontinuity bool
+}
+
+// Decodes an HLS playlist
+// m3u8 - Content of the .m3u8 file
+func DecodeHlsPlaylist(m3u8 string) *HlsPlaylist {
+	result := &HlsPlaylist{
+		TargetDuration: HLS_DEFAULT_TARGET_DURATION,
+		MediaSequence:  0,
+		IsEnded:        false,
+		Fragments:      make([]*HlsPlaylistFragment, 0),
+		Variants:       make([]string, 0),
+	}
+
+	lines := strings.Split(m3u8, "\n")
+	discontinuity := false
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+
+		if !strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if line == "#EXT-X-ENDLIST" {
+			result.IsEnded = true
+			continue
+		}
+
+		if line == "#EXT-X-DISCONTINUITY" {
+			discontinuity = true
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch strings.ToUpper(parts[0]) {
+		case "#EXT-X-TARGETDURATION":
+			td, err := strconv.Atoi(parts[1])
+			if err == nil && td > 0 {
+				result.TargetDuration = td
+			}
+		case "#EXT-X-MEDIA-SEQUENCE":
+			ms, err := strconv.Atoi(parts[1])
+			if err == nil && ms >= 0 {
+				result.MediaSequence = ms
+			}
+		case "#EXTINF":
+			d, err := strconv.ParseFloat(strings.SplitN(parts[1], ",", 2)[0], 64)
+			uri := getNextHlsPlaylistUri(lines, i)
+
+			if err == nil && d > 0 && uri != "" {
+				result.Fragments = append(result.Fragments, &HlsPlaylistFragment{
+					Index:         len(result.Fragments) + result.MediaSequence,
+					Duration:      d,
+					Uri:           uri,
+					Discontinuity: discontinuity,
+				})
+
+				discontinuity = false
+			}
+		case "#EXT-X-STREAM-INF":
+			uri := getNextHlsPlaylistUri(lines, i)
+
+			if uri != "" {
+				result.Variants = append(result.Variants, uri)
+			}
+		}
+	}
+
+	return result
+}
+
+// Gets the URI following a tag of an HLS playlist
+// Returns an empty string if there is no URI before the next fragment or variant
+func getNextHlsPlaylistUri(lines []string, tagLine int) string {
+	for i := tagLine + 1; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#EXTINF:") || strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			return ""
+		}
+
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		return line
+	}
+
+	return ""
+}
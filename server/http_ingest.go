@@ -0,0 +1,430 @@
+// HTTP PUT ingest (compatible with the HLS muxer of FFmpeg)
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+)
+
+// Time without requests after which an HTTP ingest session is closed
+const HTTP_INGEST_INACTIVITY_TIMEOUT = 30 * time.Second
+
+// Max number of fragments waiting for the previous ones
+// If the limit is reached, the missing fragments are skipped.
+// Before the first fragment is pushed, the oldest ones are discarded.
+// Fragments listed too far ahead of the next one are ignored.
+const HTTP_INGEST_MAX_PENDING_FRAGMENTS = 16
+
+// Controller of the HTTP ingest sessions
+type HttpIngestController struct {
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Logger
+	logger *glog.Logger
+
+	// Sources controller
+	sourceController *SourcesController
+
+	// Sessions (Stream ID -> Session)
+	sessions map[string]*HttpIngestSession
+}
+
+// Creates new instance of HttpIngestController
+func NewHttpIngestController(sourceController *SourcesController, logger *glog.Logger) *HttpIngestController {
+	return &HttpIngestController{
+		mu:               &sync.Mutex{},
+		logger:           logger,
+		sourceController: sourceController,
+		sessions:         make(map[string]*HttpIngestSession),
+	}
+}
+
+// Gets the session for a stream, creating it if it does not exist
+// record - True to start recording the stream if the session is created
+func (hic *HttpIngestController) GetSession(streamId string, record bool) *HttpIngestSession {
+	hic.mu.Lock()
+	defer hic.mu.Unlock()
+
+	session := hic.sessions[streamId]
+
+	if session != nil && !session.source.IsClosed() {
+		return session
+	}
+
+	source := hic.sourceController.CreateSource(streamId)
+
+	go source.PeriodicallyAnnounce()
+
+	hic.sourceController.StartRecordingIfRequested(source, record, hic.logger)
+
+	session = &HttpIngestSession{
+		controller:    hic,
+		mu:            &sync.Mutex{},
+		logger:        hic.logger.CreateChildLogger("[" + streamId + "] "),
+		streamId:      streamId,
+		source:        source,
+		nextIndex:     -1,
+		fragments:     make(map[int]*HlsPlaylistFragment),
+		fragmentsData: make(map[int][]byte),
+	}
+
+	session.inactivityTimer = time.AfterFunc(HTTP_INGEST_INACTIVITY_TIMEOUT, func() {
+		session.logger.Info("Session closed due to inactivity")
+		session.Close()
+	})
+
+	hic.sessions[streamId] = session
+
+	session.logger.Info("HTTP ingest session started")
+
+	return session
+}
+
+// Removes a session after it is closed
+func (hic *HttpIngestController) onSessionClosed(session *HttpIngestSession) {
+	hic.mu.Lock()
+	defer hic.mu.Unlock()
+
+	if hic.sessions[session.streamId] == session {
+		delete(hic.sessions, session.streamId)
+	}
+}
+
+// HTTP ingest session
+// Assembles the fragments received by HTTP PUT requests, in order, into a source
+type HttpIngestSession struct {
+	// Controller
+	controller *HttpIngestController
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Logger
+	logger *glog.Logger
+
+	// Stream ID
+	streamId string
+
+	// Source to push to
+	source *HlsSource
+
+	// Index of the next fragment to push (-1 if unknown)
+	nextIndex int
+
+	// Fragments received in the playlist, not yet pushed (Index -> Fragment)
+	fragments map[int]*HlsPlaylistFragment
+
+	// Data of the fragments received, not yet pushed (Index -> Data)
+	fragmentsData map[int][]byte
+
+	// Timer to close the session due to inactivity
+	inactivityTimer *time.Timer
+
+	// True if closed
+	closed bool
+}
+
+// Updates the playlist
+func (session *HttpIngestSession) OnPlaylistUpdate(playlist *HlsPlaylist) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.closed {
+		return
+	}
+
+	session.inactivityTimer.Reset(HTTP_INGEST_INACTIVITY_TIMEOUT)
+
+	fragments := playlist.Fragments
+
+	if session.nextIndex < 0 && len(fragments) > HTTP_INGEST_MAX_PENDING_FRAGMENTS {
+		// Before the first fragment is pushed, only the most recent ones are kept
+		fragments = fragments[len(fragments)-HTTP_INGEST_MAX_PENDING_FRAGMENTS:]
+	}
+
+	for _, fragment := range fragments {
+		if session.nextIndex >= 0 && fragment.Index < session.nextIndex {
+			continue // Already pushed or skipped
+		}
+
+		if session.nextIndex >= 0 && fragment.Index > session.nextIndex+HTTP_INGEST_MAX_PENDING_FRAGMENTS {
+			continue // Too far ahead
+		}
+
+		session.fragments[fragment.Index] = fragment
+	}
+
+	session.pushReadyFragments()
+
+	if playlist.IsEnded {
+		session.logger.Info("HTTP ingest session ended")
+		session.closeInternal()
+	}
+}
+
+// Receives the data of a fragment
+func (session *HttpIngestSession) OnFragmentData(index int, data []byte) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.closed {
+		return
+	}
+
+	session.inactivityTimer.Reset(HTTP_INGEST_INACTIVITY_TIMEOUT)
+
+	if session.nextIndex >= 0 && index < session.nextIndex {
+		return // Already pushed or skipped
+	}
+
+	session.fragmentsData[index] = data
+
+	session.pushReadyFragments()
+}
+
+// Pushes the fragments ready to the source, in order
+func (session *HttpIngestSession) pushReadyFragments() {
+	if session.nextIndex < 0 {
+		// The first fragment is the first one with both data and metadata
+		for index := range session.fragments {
+			if session.fragmentsData[index] != nil && (session.nextIndex < 0 || index < session.nextIndex) {
+				session.nextIndex = index
+			}
+		}
+
+		if session.nextIndex < 0 {
+			session.discardOldestPendingFragments()
+			return
+		}
+
+		// Discard the incomplete fragments before the first one
+		for index := range session.fragments {
+			if index < session.nextIndex {
+				delete(session.fragments, index)
+			}
+		}
+
+		for index := range session.fragmentsData {
+			if index < session.nextIndex {
+				delete(session.fragmentsData, index)
+			}
+		}
+	}
+
+	for {
+		fragment := session.fragments[session.nextIndex]
+		data := session.fragmentsData[session.nextIndex]
+
+		if fragment == nil || data == nil {
+			if len(session.fragmentsData) <= HTTP_INGEST_MAX_PENDING_FRAGMENTS {
+				return
+			}
+
+			// Too many pending fragments, skip the missing ones
+			delete(session.fragments, session.nextIndex)
+			delete(session.fragmentsData, session.nextIndex)
+
+			nextPendingIndex := session.lowestPendingIndex()
+
+			if nextPendingIndex-1 > session.nextIndex {
+				session.logger.Warningf("Fragments %v to %v skipped: Not received", session.nextIndex, nextPendingIndex-1)
+			} else {
+				session.logger.Warningf("Fragment %v skipped: Not received", session.nextIndex)
+			}
+
+			session.nextIndex = nextPendingIndex
+
+			continue
+		}
+
+		session.source.AddFragment(&HlsFragment{
+			Duration: float32(fragment.Duration),
+			Data:     data,
+		})
+
+		delete(session.fragments, session.nextIndex)
+		delete(session.fragmentsData, session.nextIndex)
+
+		session.nextIndex++
+	}
+}
+
+// Gets the lowest index of the pending fragments, with data or metadata
+// Must be called with pending fragments
+func (session *HttpIngestSession) lowestPendingIndex() int {
+	lowest := -1
+
+	for index := range session.fragmentsData {
+		if lowest < 0 || index < lowest {
+			lowest = index
+		}
+	}
+
+	for index := range session.fragments {
+		if lowest < 0 || index < lowest {
+			lowest = index
+		}
+	}
+
+	return lowest
+}
+
+// Discards the oldest pending fragments over the limit (before the first fragment is pushed)
+func (session *HttpIngestSession) discardOldestPendingFragments() {
+	if len(session.fragmentsData) > HTTP_INGEST_MAX_PENDING_FRAGMENTS {
+		indexes := make([]int, 0, len(session.fragmentsData))
+
+		for index := range session.fragmentsData {
+			indexes = append(indexes, index)
+		}
+
+		sort.Ints(indexes)
+
+		for _, index := range indexes[:len(indexes)-HTTP_INGEST_MAX_PENDING_FRAGMENTS] {
+			delete(session.fragmentsData, index)
+		}
+	}
+
+	if len(session.fragments) > HTTP_INGEST_MAX_PENDING_FRAGMENTS {
+		indexes := make([]int, 0, len(session.fragments))
+
+		for index := range session.fragments {
+			indexes = append(indexes, index)
+		}
+
+		sort.Ints(indexes)
+
+		for _, index := range indexes[:len(indexes)-HTTP_INGEST_MAX_PENDING_FRAGMENTS] {
+			delete(session.fragments, index)
+		}
+	}
+}
+
+// Closes the session
+func (session *HttpIngestSession) Close() {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	session.closeInternal()
+}
+
+// Closes the session (internal, the mutex must be locked)
+func (session *HttpIngestSession) closeInternal() {
+	if session.closed {
+		return
+	}
+
+	session.closed = true
+
+	session.inactivityTimer.Stop()
+
+	session.source.Close()
+	session.controller.sourceController.RemoveSource(session.streamId, session.source)
+
+	go session.controller.onSessionClosed(session)
+}
+
+// Serves an HTTP ingest request
+// PUT {prefix}{streamId}/index.m3u8 - Playlist
+// PUT {prefix}{streamId}/{n}.ts - Fragment
+// The push auth token can be set in the Authorization header (Bearer) or the auth query parameter
+func (server *HttpServer) ServeHttpIngest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "PUT" && req.Method != "POST" && req.Method != "DELETE" {
+		w.WriteHeader(405)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, server.config.HttpIngestPrefix)
+
+	lastSlash := strings.LastIndex(path, "/")
+
+	if lastSlash <= 0 {
+		w.WriteHeader(404)
+		return
+	}
+
+	streamId, err := url.PathUnescape(path[:lastSlash])
+	fileName := path[lastSlash+1:]
+
+	if err != nil || len(streamId) > 255 {
+		w.WriteHeader(400)
+		return
+	}
+
+	// Check auth
+
+	if !server.authController.IsPushAllowed() {
+		w.WriteHeader(403)
+		return
+	}
+
+	authToken := req.URL.Query().Get("auth")
+
+	if authHeader := req.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		authToken = strings.TrimPrefix(authHeader, "Bearer ")
+	}
+
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+
+	validToken, claims := server.authController.ValidatePushTokenClaims(authToken, streamId, ip)
+
+	if !validToken {
+		w.WriteHeader(401)
+		return
+	}
+
+	if req.Method == "DELETE" {
+		// Old fragments deleted by the muxer, nothing to do
+		w.WriteHeader(200)
+		return
+	}
+
+	// Read the file
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, server.config.MaxBinaryMessageSize+1))
+
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	if int64(len(data)) > server.config.MaxBinaryMessageSize {
+		w.WriteHeader(413)
+		return
+	}
+
+	record := req.URL.Query().Get("record") == "true" || getBoolClaim(claims, "record")
+
+	if strings.HasSuffix(fileName, ".m3u8") {
+		session := server.httpIngestController.GetSession(streamId, record)
+
+		session.OnPlaylistUpdate(DecodeHlsPlaylist(string(data)))
+	} else if strings.HasSuffix(fileName, ".ts") {
+		index, err := strconv.Atoi(strings.TrimSuffix(fileName, ".ts"))
+
+		if err != nil || index < 0 || len(data) == 0 {
+			w.WriteHeader(400)
+			return
+		}
+
+		session := server.httpIngestController.GetSession(streamId, record)
+
+		session.OnFragmentData(index, data)
+	} else {
+		w.WriteHeader(404)
+		return
+	}
+
+	w.WriteHeader(200)
+}
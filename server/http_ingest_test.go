@@ -0,0 +1,202 @@
+// Tests for the HTTP PUT ingest
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Sends an HTTP ingest request to the test server
+// Returns the status code
+func sendTestIngestRequest(ts *TestServer, streamId string, fileName string, authToken string, body []byte, t *testing.T) int {
+	httpUrl := "http" + strings.TrimPrefix(ts.url, "ws") + "ingest/" + url.PathEscape(streamId) + "/" + fileName
+
+	req, err := http.NewRequest("PUT", httpUrl, strings.NewReader(string(body)))
+
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+
+	defer res.Body.Close()
+
+	return res.StatusCode
+}
+
+// Makes a test playlist for the HTTP ingest
+func makeTestIngestPlaylist(fragmentCount int, ended bool) []byte {
+	playlist := strings.Builder{}
+
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:3\n#EXT-X-MEDIA-SEQUENCE:0\n")
+
+	for i := 0; i < fragmentCount; i++ {
+		playlist.WriteString("#EXTINF:" + fmt.Sprint(TEST_STREAM_DATA_1[i].Duration) + ",\n" + fmt.Sprint(i) + ".ts\n")
+	}
+
+	if ended {
+		playlist.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	return []byte(playlist.String())
+}
+
+func TestHttpIngest(t *testing.T) {
+	logger := testMain()
+
+	server := makeTestServerWithOptions(logger.CreateChildLogger("[Server] "), nil, true, "", TestServerOptions{HttpIngest: true})
+	defer server.Close()
+
+	authToken, err := signAuthToken(TEST_JWT_SECRET, "PUSH", TEST_STREAM_ID_1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Auth is required
+
+	status := sendTestIngestRequest(server, TEST_STREAM_ID_1, "0.ts", "", TEST_STREAM_DATA_1[0].Data, t)
+
+	if status != 401 {
+		t.Errorf("Expected status 401 without auth token, but received %v", status)
+	}
+
+	deleteReq, _ := http.NewRequest("DELETE", "http"+strings.TrimPrefix(server.url, "ws")+"ingest/"+url.PathEscape(TEST_STREAM_ID_1)+"/0.ts", nil)
+
+	if res, err := http.DefaultClient.Do(deleteReq); err != nil {
+		t.Error(err)
+	} else {
+		res.Body.Close()
+
+		if res.StatusCode != 401 {
+			t.Errorf("Expected status 401 for DELETE without auth token, but received %v", res.StatusCode)
+		}
+	}
+
+	// Fragments out of order are pushed in order
+
+	status = sendTestIngestRequest(server, TEST_STREAM_ID_1, "1.ts", authToken, TEST_STREAM_DATA_1[1].Data, t)
+
+	if status != 200 {
+		t.Errorf("Ingest request returned status %v", status)
+	}
+
+	status = sendTestIngestRequest(server, TEST_STREAM_ID_1, "0.ts", authToken, TEST_STREAM_DATA_1[0].Data, t)
+
+	if status != 200 {
+		t.Errorf("Ingest request returned status %v", status)
+	}
+
+	spectator := connectTestClient(server.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	status = sendTestIngestRequest(server, TEST_STREAM_ID_1, "index.m3u8", authToken, makeTestIngestPlaylist(2, false), t)
+
+	if status != 200 {
+		t.Errorf("Ingest request returned status %v", status)
+	}
+
+	expectTestFragmentWithSequence(spectator, 1, TEST_STREAM_DATA_1[0].Data, t)
+	expectTestFragmentWithSequence(spectator, 2, TEST_STREAM_DATA_1[1].Data, t)
+
+	// Ended playlist closes the stream
+
+	_ = sendTestIngestRequest(server, TEST_STREAM_ID_1, "2.ts", authToken, TEST_STREAM_DATA_1[2].Data, t)
+	_ = sendTestIngestRequest(server, TEST_STREAM_ID_1, "index.m3u8", authToken, makeTestIngestPlaylist(3, true), t)
+
+	expectTestFragmentWithSequence(spectator, 3, TEST_STREAM_DATA_1[2].Data, t)
+
+	msg, _ := readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "CLOSE" {
+		t.Errorf("Expected CLOSE message, but received: %v", msg)
+	}
+}
+
+func TestHttpIngestPendingFragments(t *testing.T) {
+	logger := testMain()
+
+	server := makeTestServer(logger.CreateChildLogger("[Server] "), nil, true, "")
+	defer server.Close()
+
+	session := server.server.httpIngestController.GetSession(TEST_STREAM_ID_1, false)
+	defer session.Close()
+
+	// Before the first fragment is pushed, the pending fragments are limited
+
+	for i := 0; i < HTTP_INGEST_MAX_PENDING_FRAGMENTS*4; i++ {
+		session.OnFragmentData(1000+i, TEST_STREAM_DATA_1[0].Data)
+	}
+
+	session.mu.Lock()
+	pendingCount := len(session.fragmentsData)
+	_, newestKept := session.fragmentsData[1000+HTTP_INGEST_MAX_PENDING_FRAGMENTS*4-1]
+	session.mu.Unlock()
+
+	if pendingCount != HTTP_INGEST_MAX_PENDING_FRAGMENTS || !newestKept {
+		t.Errorf("Expected the newest %v pending fragments to be kept, but got %v", HTTP_INGEST_MAX_PENDING_FRAGMENTS, pendingCount)
+	}
+
+	// Start the stream at the first fragment with data and metadata
+
+	firstIndex := 1000 + HTTP_INGEST_MAX_PENDING_FRAGMENTS*3
+
+	session.OnPlaylistUpdate(DecodeHlsPlaylist("#EXTM3U\n#EXT-X-TARGETDURATION:3\n#EXT-X-MEDIA-SEQUENCE:" + fmt.Sprint(firstIndex) + "\n#EXTINF:1,\n" + fmt.Sprint(firstIndex) + ".ts\n"))
+
+	session.mu.Lock()
+	nextIndex := session.nextIndex
+	session.mu.Unlock()
+
+	if nextIndex != firstIndex+1 {
+		t.Errorf("Unexpected next index after starting the stream: %v", nextIndex)
+	}
+
+	// A sparse index jumps to the lowest pending fragment, instead of skipping one by one
+
+	for i := 0; i <= HTTP_INGEST_MAX_PENDING_FRAGMENTS; i++ {
+		session.OnFragmentData(1000000000+i, TEST_STREAM_DATA_1[0].Data)
+	}
+
+	session.mu.Lock()
+	nextIndex = session.nextIndex
+	session.mu.Unlock()
+
+	if nextIndex != 1000000001 {
+		t.Errorf("Expected next index to be 1000000001, but got %v", nextIndex)
+	}
+
+	// Fragments too far ahead of the next index are ignored
+
+	farIndex := nextIndex + HTTP_INGEST_MAX_PENDING_FRAGMENTS + 1
+
+	session.OnPlaylistUpdate(DecodeHlsPlaylist("#EXTM3U\n#EXT-X-TARGETDURATION:3\n#EXT-X-MEDIA-SEQUENCE:" + fmt.Sprint(farIndex) + "\n#EXTINF:1,\n" + fmt.Sprint(farIndex) + ".ts\n#EXTINF:1,\n" + fmt.Sprint(farIndex+1) + ".ts\n"))
+
+	session.mu.Lock()
+	_, farKept := session.fragments[farIndex]
+	fragmentsCount := len(session.fragments)
+	session.mu.Unlock()
+
+	if farKept || fragmentsCount > HTTP_INGEST_MAX_PENDING_FRAGMENTS+1 {
+		t.Errorf("Expected the fragments too far ahead to be ignored. Pending fragments: %v", fragmentsCount)
+	}
+}
@@ -48,6 +48,46 @@ type HttpServerConfig struct {
 	// Number of second to reload TLS config
 	TlsCheckReloadSeconds int
 
+	// Node TLS listener enabled? (mutual TLS for other nodes)
+	NodeTlsEnabled bool
+
+	// Node TLS port
+	NodeTlsPort int
+
+	// Server bind address for the node TLS listener
+	NodeTlsBindAddress string
+
+	// CA bundle to verify the client certificates of the other nodes
+	NodeTlsCaFile string
+
+	// Internal listener enabled? (relays from other nodes and admin API)
+	// If enabled, the public listeners only accept viewers and publishers
+	InternalEnabled bool
+
+	// Internal listener port
+	InternalPort int
+
+	// Server bind address for the internal listener
+	InternalBindAddress string
+
+	// True to use TLS for the internal listener
+	InternalTlsEnabled bool
+
+	// Certificate file for the internal listener (if empty, the TLS certificate is used)
+	InternalTlsCertificateFile string
+
+	// Key file for the internal listener (if empty, the TLS key is used)
+	InternalTlsPrivateKeyFile string
+
+	// QUIC enabled?
+	QuicEnabled bool
+
+	// QUIC port (UDP)
+	QuicPort int
+
+	// Server bind address for QUIC
+	QuicBindAddress string
+
 	// Websocket prefix
 	WebsocketPrefix string
 
@@ -56,6 +96,21 @@ type HttpServerConfig struct {
 
 	// True to log requests
 	LogRequests bool
+
+	// True to enable the HTTP PUT ingest
+	HttpIngestEnabled bool
+
+	// Path prefix for the HTTP PUT ingest
+	HttpIngestPrefix string
+
+	// True to enable the admin API
+	AdminApiEnabled bool
+
+	// Path prefix for the admin API
+	AdminApiPrefix string
+
+	// Secret to authenticate admin API requests
+	AdminApiSecret string
 }
 
 // HTTP websocket server
@@ -84,24 +139,37 @@ type HttpServer struct {
 	// Relay controller
 	relayController *RelayController
 
+	// Controller of the streams pulled from HTTP origins
+	originPullController *OriginPullController
+
+	// Controller of the HTTP ingest sessions
+	httpIngestController *HttpIngestController
+
 	// Rate limiter
 	rateLimiter *RateLimiter
 }
 
 // Creates HTTP server
-func CreateHttpServer(config HttpServerConfig, logger *glog.Logger, authController *AuthController, sourceController *SourcesController, relayController *RelayController, rateLimiter *RateLimiter) *HttpServer {
+func CreateHttpServer(config HttpServerConfig, logger *glog.Logger, authController *AuthController, sourceController *SourcesController, relayController *RelayController, originPullController *OriginPullController, rateLimiter *RateLimiter) *HttpServer {
+	if config.AdminApiEnabled && config.AdminApiSecret == "" {
+		logger.Error("ADMIN_API_SECRET is empty. The admin API will not be enabled.")
+		config.AdminApiEnabled = false
+	}
+
 	return &HttpServer{
 		config: config,
 		logger: logger,
 		upgrader: &websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
-		mu:               &sync.Mutex{},
-		nextConnectionId: 0,
-		authController:   authController,
-		sourceController: sourceController,
-		relayController:  relayController,
-		rateLimiter:      rateLimiter,
+		mu:                   &sync.Mutex{},
+		nextConnectionId:     0,
+		authController:       authController,
+		sourceController:     sourceController,
+		relayController:      relayController,
+		originPullController: originPullController,
+		httpIngestController: NewHttpIngestController(sourceController, logger.CreateChildLogger("[HttpIngest] ")),
+		rateLimiter:          rateLimiter,
 	}
 }
 
@@ -117,8 +185,34 @@ func (server *HttpServer) GetConnectionId() uint64 {
 	return id
 }
 
-// Serves HTTP request
+// Serves HTTP request (public listeners)
 func (server *HttpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	server.serveHttp(w, req, false)
+}
+
+// HTTP handler for the internal listeners
+// Only accepts relays from other nodes and the admin API
+type InternalHttpHandler struct {
+	// Server
+	server *HttpServer
+}
+
+// Serves HTTP request (internal listeners)
+func (h *InternalHttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.server.serveHttp(w, req, true)
+}
+
+// Gets the HTTP handler for the internal listeners
+func (server *HttpServer) InternalHandler() http.Handler {
+	return &InternalHttpHandler{
+		server: server,
+	}
+}
+
+// Serves HTTP request
+// internal - True if the request was received by an internal listener
+// The internal listeners are not limited by the rate limiter
+func (server *HttpServer) serveHttp(w http.ResponseWriter, req *http.Request, internal bool) {
 	ip, _, err := net.SplitHostPort(req.RemoteAddr)
 
 	if err != nil {
@@ -128,21 +222,33 @@ func (server *HttpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if !server.rateLimiter.CountRequest(ip) {
+	if !internal && !server.rateLimiter.CountRequest(ip) {
 		w.WriteHeader(429)
 		server.logger.Debugf("Request rejected from %v due to too many requests", ip)
 		return
 	}
 
 	if server.config.LogRequests {
-		server.logger.Infof("[HTTP] [FROM: %v] %v %v", ip, req.Method, req.URL.Path)
+		if internal {
+			server.logger.Infof("[HTTP] [INTERNAL] [FROM: %v] %v %v", ip, req.Method, req.URL.Path)
+		} else {
+			server.logger.Infof("[HTTP] [FROM: %v] %v %v", ip, req.Method, req.URL.Path)
+		}
 	}
 
-	if strings.HasPrefix(req.URL.Path, server.config.WebsocketPrefix) {
-		// Check rate limiter
-		shouldAccept := server.rateLimiter.StartConnection(ip)
+	if server.config.AdminApiEnabled && strings.HasPrefix(req.URL.Path, server.config.AdminApiPrefix) {
+		if !internal && server.config.InternalEnabled {
+			// The admin API is only available in the internal listener
+			w.WriteHeader(404)
+			return
+		}
 
-		if !shouldAccept {
+		server.ServeAdminApi(w, req)
+	} else if !internal && server.config.HttpIngestEnabled && strings.HasPrefix(req.URL.Path, server.config.HttpIngestPrefix) {
+		server.ServeHttpIngest(w, req)
+	} else if strings.HasPrefix(req.URL.Path, server.config.WebsocketPrefix) {
+		// Check rate limiter
+		if !internal && !server.rateLimiter.StartConnection(ip) {
 			w.WriteHeader(429)
 			server.logger.Debugf("Connection rejected from %v does to too many connections", ip)
 			return
@@ -153,12 +259,16 @@ func (server *HttpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		c, err := server.upgrader.Upgrade(w, req, nil)
 		if err != nil {
 			server.logger.Errorf("Error upgrading connection: %v", err)
-			server.rateLimiter.EndConnection(ip)
+			if !internal {
+				server.rateLimiter.EndConnection(ip)
+			}
 			return
 		}
 
 		// Handle connection
-		ch := CreateConnectionHandler(c, ip, server)
+		ch := CreateConnectionHandler(NewWebsocketConnectionTransport(c), ip, server)
+		ch.internalListener = internal
+		ch.nodeIdentities = GetTlsPeerIdentities(req.TLS)
 		go ch.Run()
 	} else {
 		w.WriteHeader(200)
@@ -185,11 +295,54 @@ func (server *HttpServer) RunInsecure(wg *sync.WaitGroup) {
 func (server *HttpServer) RunTls(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	port := server.config.TlsPort
-	bind_addr := server.config.TlsBindAddress
-	certFile := server.config.TlsCertificateFile
-	keyFile := server.config.TlsPrivateKeyFile
+	server.runTlsListener("HTTPS", server.config.TlsBindAddress, server.config.TlsPort, server.config.TlsCertificateFile, server.config.TlsPrivateKeyFile, "", server)
+}
+
+// Runs the TLS listener for other nodes
+// Clients must send a certificate signed by the node CA
+func (server *HttpServer) RunNodeTls(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	server.runTlsListener("NODE-TLS", server.config.NodeTlsBindAddress, server.config.NodeTlsPort, server.config.TlsCertificateFile, server.config.TlsPrivateKeyFile, server.config.NodeTlsCaFile, server.InternalHandler())
+}
+
+// Runs the internal listener
+func (server *HttpServer) RunInternal(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	port := server.config.InternalPort
+	bind_addr := server.config.InternalBindAddress
+
+	if server.config.InternalTlsEnabled {
+		certFile := server.config.InternalTlsCertificateFile
+		keyFile := server.config.InternalTlsPrivateKeyFile
+
+		if certFile == "" {
+			certFile = server.config.TlsCertificateFile
+			keyFile = server.config.TlsPrivateKeyFile
+		}
+
+		server.runTlsListener("INTERNAL", bind_addr, port, certFile, keyFile, "", server.InternalHandler())
+		return
+	}
+
+	server.logger.Infof("[INTERNAL] Listening on %v:%v", bind_addr, port)
+	errHTTP := http.ListenAndServe(bind_addr+":"+strconv.Itoa(port), server.InternalHandler())
+
+	if errHTTP != nil {
+		server.logger.Errorf("Error starting INTERNAL server: %v", errHTTP)
+	}
+}
 
+// Runs a TLS listener
+// name - Name of the listener, for the logs
+// bind_addr - Bind address
+// port - Port
+// certFile - Certificate file
+// keyFile - Key file
+// clientCaFile - CA bundle to require and verify client certificates (empty to not request them)
+// handler - HTTP handler
+func (server *HttpServer) runTlsListener(name string, bind_addr string, port int, certFile string, keyFile string, clientCaFile string, handler http.Handler) {
 	certificateLoader, err := tls_certificate_loader.NewTlsCertificateLoader(tls_certificate_loader.TlsCertificateLoaderConfig{
 		CertificatePath:   certFile,
 		KeyPath:           keyFile,
@@ -203,26 +356,37 @@ func (server *HttpServer) RunTls(wg *sync.WaitGroup) {
 	})
 
 	if err != nil {
-		server.logger.Errorf("Error starting HTTPS server: %v", err)
+		server.logger.Errorf("Error starting %v server: %v", name, err)
 		return
 	}
 
 	defer certificateLoader.Close()
 
+	tlsConfig := &tls.Config{
+		GetCertificate: certificateLoader.GetCertificate,
+	}
+
+	if clientCaFile != "" {
+		tlsConfig, err = NewNodeTlsServerConfig(clientCaFile, certificateLoader.GetCertificate)
+
+		if err != nil {
+			server.logger.Errorf("Error starting %v server: %v", name, err)
+			return
+		}
+	}
+
 	tlsServer := http.Server{
-		Addr:    bind_addr + ":" + strconv.Itoa(port),
-		Handler: server,
-		TLSConfig: &tls.Config{
-			GetCertificate: certificateLoader.GetCertificate,
-		},
+		Addr:      bind_addr + ":" + strconv.Itoa(port),
+		Handler:   handler,
+		TLSConfig: tlsConfig,
 	}
 
-	server.logger.Infof("[HTTPS] Listening on %v:%v", bind_addr, port)
+	server.logger.Infof("[%v] Listening on %v:%v", name, bind_addr, port)
 
 	errSSL := tlsServer.ListenAndServeTLS("", "")
 
 	if errSSL != nil {
-		server.logger.Errorf("Error starting HTTPS server: %v", errSSL)
+		server.logger.Errorf("Error starting %v server: %v", name, errSSL)
 	}
 }
 
@@ -240,11 +404,26 @@ func (server *HttpServer) Run(wg *sync.WaitGroup) {
 		go server.RunTls(wgInternal)
 	}
 
+	if server.config.NodeTlsEnabled {
+		wgInternal.Add(1)
+		go server.RunNodeTls(wgInternal)
+	}
+
+	if server.config.InternalEnabled {
+		wgInternal.Add(1)
+		go server.RunInternal(wgInternal)
+	}
+
 	if server.config.HttpEnabled {
 		wgInternal.Add(1)
 		go server.RunInsecure(wgInternal)
 	}
 
+	if server.config.QuicEnabled {
+		wgInternal.Add(1)
+		go server.RunQuic(wgInternal)
+	}
+
 	// Wait for all threads to finish
 
 	wgInternal.Wait()
@@ -0,0 +1,130 @@
+// Tests for the internal listener
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Runs the internal listener of a test server
+// Returns the websocket URL and the listener
+func (server *HttpServer) RunTestInternalListener() (string, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		_ = http.Serve(listener, server.InternalHandler())
+	}()
+
+	return "ws://" + listener.Addr().String() + "/", listener
+}
+
+// Sends a message from a new connection, expecting an error message
+func expectTestConnectionError(serverUrl string, message string, expectedCode string, t *testing.T) {
+	socket, _, err := websocket.DefaultDialer.Dial(serverUrl, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer socket.Close()
+
+	_ = socket.WriteMessage(websocket.TextMessage, []byte(message))
+
+	msg, _ := readTestMessage(socket, t)
+
+	if msg == nil || msg.MessageType != "E" || msg.GetParameter("code") != expectedCode {
+		t.Errorf("Expected %v error for %v, but received: %v", expectedCode, strings.Split(message, ":")[0], msg)
+	}
+}
+
+func TestInternalListener(t *testing.T) {
+	logger := testMain()
+
+	mockPublishRegistry := NewMockPublishRegistry()
+
+	server1 := makeTestServerWithOptions(logger.CreateChildLogger("[Server 1] "), mockPublishRegistry, true, "", TestServerOptions{AdminApi: true})
+	defer server1.Close()
+
+	server2 := makeTestServer(logger.CreateChildLogger("[Server 2] "), mockPublishRegistry, true, "")
+	defer server2.Close()
+
+	for _, ts := range []*TestServer{server1, server2} {
+		ts.server.authController.config.RelaySecret = "relay-secret"
+		ts.server.config.InternalEnabled = true
+	}
+
+	internalUrl, internalListener := server1.server.RunTestInternalListener()
+	defer internalListener.Close()
+
+	// The other nodes connect to the internal listener
+
+	server1.server.sourceController.config.ExternalWebsocketUrl = internalUrl
+
+	// Publishers and viewers are not accepted by the internal listener
+
+	pushToken, _ := signAuthToken(TEST_JWT_SECRET, "PUSH", TEST_STREAM_ID_1)
+	pullToken, _ := signAuthToken(TEST_JWT_SECRET, "PULL", TEST_STREAM_ID_1)
+
+	expectTestConnectionError(internalUrl, "PUSH:stream="+TEST_STREAM_ID_1+"&auth="+pushToken, "AUTH_ERROR", t)
+	expectTestConnectionError(internalUrl, "PULL:stream="+TEST_STREAM_ID_1+"&auth="+pullToken, "AUTH_ERROR", t)
+
+	// Relays are not accepted by the public listener
+
+	relayToken := server1.server.authController.CreateRelayToken(TEST_STREAM_ID_1)
+
+	expectTestConnectionError(server1.url, "PULL:stream="+TEST_STREAM_ID_1+"&auth="+relayToken, "AUTH_ERROR", t)
+
+	// The admin API is only available in the internal listener
+
+	if status := sendTestAdminApiRequest(server1, "POST", "revoke", `{"jti":"test","ttl":60}`, t); status != 404 {
+		t.Errorf("Expected status 404 for the admin API in the public listener, but got %v", status)
+	}
+
+	if status := sendTestAdminApiRequest(&TestServer{url: internalUrl}, "POST", "revoke", `{"jti":"test","ttl":60}`, t); status != 200 {
+		t.Errorf("Expected status 200 for the admin API in the internal listener, but got %v", status)
+	}
+
+	// Relay through the internal listener
+
+	publisher := connectTestClient(server1.url, "PUSH", TEST_STREAM_ID_1, nil, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	spectator := connectTestClient(server2.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte("F:duration=1"))
+	_ = publisher.WriteMessage(websocket.BinaryMessage, TEST_STREAM_DATA_1[0].Data)
+
+	expectTestFragmentWithSequence(spectator, 1, TEST_STREAM_DATA_1[0].Data, t)
+
+	// Only the publisher is counted by the rate limiter of the first node
+
+	rateLimiter := server1.server.rateLimiter
+
+	rateLimiter.mu.Lock()
+	connections := rateLimiter.connectionsCount["127.0.0.1"]
+	rateLimiter.mu.Unlock()
+
+	if connections != 1 {
+		t.Errorf("Expected only the publisher connection to be counted, but got %v connections", connections)
+	}
+}
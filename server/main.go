@@ -19,6 +19,9 @@ const DEFAULT_FRAGMENT_BUFFER_MAX_LENGTH = 10
 // Default inactivity period for relays
 const RELAY_DEFAULT_INACTIVITY_PERIOD = 30
 
+// Default duration (seconds) of the DVR window
+const DEFAULT_DVR_RETENTION_SECONDS = 2 * 60 * 60
+
 // Main
 func main() {
 	_ = godotenv.Load() // Load env vars
@@ -51,6 +54,7 @@ func main() {
 			Password:                      genv.GetEnvString("PUB_REG_REDIS_PASSWORD", ""),
 			UseTls:                        genv.GetEnvBool("PUB_REG_REDIS_USE_TLS", false),
 			PublishRefreshIntervalSeconds: genv.GetEnvInt("PUB_REG_REFRESH_INTERVAL_SECONDS", 60),
+			RevokedTokensKey:              genv.GetEnvString("PUB_REG_REDIS_REVOKED_TOKENS_KEY", "hls_cdn_revoked_tokens"),
 		})
 
 		if err != nil {
@@ -65,11 +69,42 @@ func main() {
 	}
 
 	// Auth
+	var revocationStore TokenRevocationStore = nil
+
+	if publishRegistry != nil {
+		revocationStore = publishRegistry
+	}
+
 	authController := NewAuthController(AuthConfiguration{
-		PullSecret: genv.GetEnvString("PULL_SECRET", ""),
-		PushSecret: genv.GetEnvString("PUSH_SECRET", ""),
-		AllowPush:  genv.GetEnvBool("PUSH_ALLOWED", true),
-	}, logger.CreateChildLogger("[Auth] "))
+		PullSecret:           genv.GetEnvString("PULL_SECRET", ""),
+		PushSecret:           genv.GetEnvString("PUSH_SECRET", ""),
+		RelaySecret:          genv.GetEnvString("RELAY_SECRET", ""),
+		NodeIdentities:       genv.GetEnvString("NODE_TLS_ALLOWED_IDENTITIES", ""),
+		PullSecretsFile:      genv.GetEnvString("PULL_SECRETS_FILE", ""),
+		PushSecretsFile:      genv.GetEnvString("PUSH_SECRETS_FILE", ""),
+		SecretsReloadSeconds: genv.GetEnvInt("SECRETS_RELOAD_SECONDS", 60),
+		PullKeys: JwtKeySetConfig{
+			PublicKeyFiles:       genv.GetEnvString("PULL_PUBLIC_KEYS", ""),
+			Jwks:                 genv.GetEnvString("PULL_JWKS", ""),
+			RefreshPeriodSeconds: genv.GetEnvInt("JWKS_REFRESH_SECONDS", 300),
+		},
+		PushKeys: JwtKeySetConfig{
+			PublicKeyFiles:       genv.GetEnvString("PUSH_PUBLIC_KEYS", ""),
+			Jwks:                 genv.GetEnvString("PUSH_JWKS", ""),
+			RefreshPeriodSeconds: genv.GetEnvInt("JWKS_REFRESH_SECONDS", 300),
+		},
+		AllowPush: genv.GetEnvBool("PUSH_ALLOWED", true),
+		Revocations: TokenRevocationListConfig{
+			SyncPeriodSeconds: genv.GetEnvInt("REVOCATIONS_SYNC_SECONDS", 10),
+		},
+		RevocationTtlSeconds: genv.GetEnvInt("REVOCATION_TTL_SECONDS", DEFAULT_REVOCATION_TTL_SECONDS),
+		Webhook: AuthWebhookConfig{
+			Url:                 genv.GetEnvString("AUTH_WEBHOOK_URL", ""),
+			TimeoutMilliseconds: genv.GetEnvInt("AUTH_WEBHOOK_TIMEOUT_MS", 2000),
+			CacheTtlSeconds:     genv.GetEnvInt("AUTH_WEBHOOK_CACHE_SECONDS", 30),
+			FailOpen:            genv.GetEnvBool("AUTH_WEBHOOK_FAIL_OPEN", false),
+		},
+	}, revocationStore, logger.CreateChildLogger("[Auth] "))
 
 	// Memory limiter
 	memoryLimiter := NewFragmentBufferMemoryLimiter(FragmentBufferMemoryLimiterConfig{
@@ -77,12 +112,77 @@ func main() {
 		Limit:   genv.GetEnvInt64("BUFFER_MEMORY_LIMIT_MB", 256) * 1024 * 1024,
 	})
 
+	// DVR
+	dvrController := NewDvrController(DvrConfig{
+		Enabled:          genv.GetEnvBool("DVR_ENABLED", false),
+		Directory:        genv.GetEnvString("DVR_DIRECTORY", "./dvr"),
+		RetentionSeconds: genv.GetEnvInt("DVR_RETENTION_SECONDS", DEFAULT_DVR_RETENTION_SECONDS),
+		MaxSizePerStream: genv.GetEnvInt64("DVR_MAX_SIZE_PER_STREAM_MB", 1024) * 1024 * 1024,
+		MaxTotalSize:     genv.GetEnvInt64("DVR_MAX_TOTAL_SIZE_MB", 0) * 1024 * 1024,
+	}, memoryLimiter, logger.CreateChildLogger("[DVR] "))
+
+	// Recordings
+	var recordingStorage RecordingStorage = nil
+
+	switch genv.GetEnvString("RECORDING_STORAGE", "local") {
+	case "s3":
+		s3Storage, err := NewS3RecordingStorage(S3RecordingStorageConfig{
+			Endpoint:     genv.GetEnvString("RECORDING_S3_ENDPOINT", "https://s3.amazonaws.com"),
+			Region:       genv.GetEnvString("RECORDING_S3_REGION", "us-east-1"),
+			Bucket:       genv.GetEnvString("RECORDING_S3_BUCKET", ""),
+			AccessKey:    genv.GetEnvString("RECORDING_S3_ACCESS_KEY", ""),
+			SecretKey:    genv.GetEnvString("RECORDING_S3_SECRET_KEY", ""),
+			Prefix:       genv.GetEnvString("RECORDING_S3_PREFIX", ""),
+			UsePathStyle: genv.GetEnvBool("RECORDING_S3_PATH_STYLE", true),
+		})
+
+		if err != nil {
+			logger.Errorf("Could not initialize S3 recording storage: %v", err)
+		} else {
+			recordingStorage = s3Storage
+		}
+	default:
+		recordingStorage = NewLocalRecordingStorage(genv.GetEnvString("RECORDING_DIRECTORY", "./recordings"))
+	}
+
+	recordingController := NewRecordingController(RecordingConfig{
+		Enabled:    genv.GetEnvBool("RECORDING_ENABLED", false) && recordingStorage != nil,
+		VodEnabled: genv.GetEnvBool("VOD_ENABLED", false) && recordingStorage != nil,
+
+		PlaylistCheckpointSeconds: genv.GetEnvInt("RECORDING_PLAYLIST_CHECKPOINT_SECONDS", 30),
+	}, recordingStorage, logger.CreateChildLogger("[Recordings] "))
+
+	// Lifecycle event webhooks
+	eventWebhooks := NewEventWebhooks(EventWebhooksConfig{
+		Url:                    genv.GetEnvString("EVENT_WEBHOOK_URL", ""),
+		Secret:                 genv.GetEnvString("EVENT_WEBHOOK_SECRET", ""),
+		Events:                 genv.GetEnvString("EVENT_WEBHOOK_EVENTS", ""),
+		Node:                   externalWebsocketUrl,
+		TimeoutMilliseconds:    genv.GetEnvInt("EVENT_WEBHOOK_TIMEOUT_MS", 5000),
+		MaxRetries:             genv.GetEnvInt("EVENT_WEBHOOK_MAX_RETRIES", 3),
+		RetryDelayMilliseconds: genv.GetEnvInt("EVENT_WEBHOOK_RETRY_DELAY_MS", 1000),
+		QueueSize:              genv.GetEnvInt("EVENT_WEBHOOK_QUEUE_SIZE", 1000),
+	}, logger.CreateChildLogger("[Events] "))
+
 	// Sources controller
 	sourcesController := NewSourcesController(SourcesControllerConfig{
 		FragmentBufferMaxLength: genv.GetEnvInt("FRAGMENT_BUFFER_MAX_LENGTH", DEFAULT_FRAGMENT_BUFFER_MAX_LENGTH),
+		MaxFragmentSize:         genv.GetEnvInt64("MAX_BINARY_MESSAGE_SIZE", DEFAULT_MAX_BINARY_MSG_SIZE),
 		ExternalWebsocketUrl:    externalWebsocketUrl,
 		HasPublishRegistry:      publishRegistry != nil,
-	}, publishRegistry, memoryLimiter, logger.CreateChildLogger("[Sources] "))
+	}, publishRegistry, memoryLimiter, dvrController, recordingController, eventWebhooks, logger.CreateChildLogger("[Sources] "))
+
+	// TLS client to relay streams from other nodes
+	nodeTlsClientConfig, err := NewNodeTlsClientConfig(NodeTlsClientConfig{
+		CaFile:             genv.GetEnvString("NODE_TLS_CA", ""),
+		CertificateFile:    genv.GetEnvString("NODE_TLS_CLIENT_CERTIFICATE", ""),
+		PrivateKeyFile:     genv.GetEnvString("NODE_TLS_CLIENT_PRIVATE_KEY", ""),
+		CheckReloadSeconds: genv.GetEnvInt("TLS_CHECK_RELOAD_SECONDS", 60),
+	}, logger.CreateChildLogger("[NodeTls] "))
+
+	if err != nil {
+		logger.Errorf("Could not load the node TLS client configuration: %v", err)
+	}
 
 	// Relay controller
 	relayController := NewRelayController(RelayControllerConfig{
@@ -92,7 +192,21 @@ func main() {
 		MaxBinaryMessageSize:    genv.GetEnvInt64("MAX_BINARY_MESSAGE_SIZE", DEFAULT_MAX_BINARY_MSG_SIZE),
 		InactivityPeriodSeconds: genv.GetEnvInt("RELAY_INACTIVITY_PERIOD_SEC", RELAY_DEFAULT_INACTIVITY_PERIOD),
 		HasPublishRegistry:      publishRegistry != nil,
-	}, authController, publishRegistry, memoryLimiter, logger.CreateChildLogger("[Relays] "))
+		TlsClientConfig:         nodeTlsClientConfig,
+	}, authController, publishRegistry, memoryLimiter, eventWebhooks, logger.CreateChildLogger("[Relays] "))
+
+	// Streams pulled from HTTP origins
+	originPullController := NewOriginPullController(OriginPullConfig{
+		MaxFragmentSize: genv.GetEnvInt64("MAX_BINARY_MESSAGE_SIZE", DEFAULT_MAX_BINARY_MSG_SIZE),
+	}, sourcesController, logger.CreateChildLogger("[OriginPull] "))
+
+	for streamId, playlistUrl := range parseOriginPullStreams(genv.GetEnvString("ORIGIN_PULL_STREAMS", "")) {
+		err := originPullController.Start(streamId, playlistUrl)
+
+		if err != nil {
+			logger.Errorf("Could not pull %v from the origin: %v", streamId, err)
+		}
+	}
 
 	rateLimiter := NewRateLimiter(RateLimiterConfig{
 		Enabled:                genv.GetEnvBool("RATE_LIMIT_ENABLED", false),
@@ -116,11 +230,34 @@ func main() {
 		TlsCertificateFile:    genv.GetEnvString("TLS_CERTIFICATE", ""),
 		TlsPrivateKeyFile:     genv.GetEnvString("TLS_PRIVATE_KEY", ""),
 		TlsCheckReloadSeconds: genv.GetEnvInt("TLS_CHECK_RELOAD_SECONDS", 60),
+		// Node TLS (mutual TLS for other nodes)
+		NodeTlsEnabled:     genv.GetEnvBool("NODE_TLS_ENABLED", false),
+		NodeTlsPort:        genv.GetEnvInt("NODE_TLS_PORT", 8443),
+		NodeTlsBindAddress: genv.GetEnvString("NODE_TLS_BIND_ADDRESS", ""),
+		NodeTlsCaFile:      genv.GetEnvString("NODE_TLS_CA", ""),
+		// Internal listener
+		InternalEnabled:            genv.GetEnvBool("INTERNAL_ENABLED", false),
+		InternalPort:               genv.GetEnvInt("INTERNAL_PORT", 8080),
+		InternalBindAddress:        genv.GetEnvString("INTERNAL_BIND_ADDRESS", ""),
+		InternalTlsEnabled:         genv.GetEnvBool("INTERNAL_TLS_ENABLED", false),
+		InternalTlsCertificateFile: genv.GetEnvString("INTERNAL_TLS_CERTIFICATE", ""),
+		InternalTlsPrivateKeyFile:  genv.GetEnvString("INTERNAL_TLS_PRIVATE_KEY", ""),
+		// QUIC
+		QuicEnabled:     genv.GetEnvBool("QUIC_ENABLED", false),
+		QuicPort:        genv.GetEnvInt("QUIC_PORT", 443),
+		QuicBindAddress: genv.GetEnvString("QUIC_BIND_ADDRESS", ""),
 		// Other config
 		WebsocketPrefix:      genv.GetEnvString("WEBSOCKET_PREFIX", "/"),
 		MaxBinaryMessageSize: genv.GetEnvInt64("MAX_BINARY_MESSAGE_SIZE", DEFAULT_MAX_BINARY_MSG_SIZE),
 		LogRequests:          genv.GetEnvBool("LOG_REQUESTS", true),
-	}, logger.CreateChildLogger("[Server] "), authController, sourcesController, relayController, rateLimiter)
+		// HTTP ingest
+		HttpIngestEnabled: genv.GetEnvBool("HTTP_INGEST_ENABLED", false),
+		HttpIngestPrefix:  genv.GetEnvString("HTTP_INGEST_PREFIX", "/ingest/"),
+		// Admin API
+		AdminApiEnabled: genv.GetEnvBool("ADMIN_API_ENABLED", false),
+		AdminApiPrefix:  genv.GetEnvString("ADMIN_API_PREFIX", "/admin/"),
+		AdminApiSecret:  genv.GetEnvString("ADMIN_API_SECRET", ""),
+	}, logger.CreateChildLogger("[Server] "), authController, sourcesController, relayController, originPullController, rateLimiter)
 
 	// Run server
 
@@ -129,6 +266,33 @@ func main() {
 	wg.Add(1)
 	go server.Run(wg)
 
+	// RTMP server
+
+	rtmpServer := NewRtmpServer(RtmpConfig{
+		Enabled:          genv.GetEnvBool("RTMP_ENABLED", false),
+		Port:             genv.GetEnvInt("RTMP_PORT", 1935),
+		BindAddress:      genv.GetEnvString("RTMP_BIND_ADDRESS", ""),
+		FragmentDuration: genv.GetEnvInt64("RTMP_FRAGMENT_DURATION", 3) * 1000,
+		MaxMessageSize:   genv.GetEnvInt64("MAX_BINARY_MESSAGE_SIZE", DEFAULT_MAX_BINARY_MSG_SIZE),
+	}, authController, sourcesController, logger.CreateChildLogger("[RTMP] "))
+
+	wg.Add(1)
+	go rtmpServer.Run(wg)
+
+	// SRT server
+
+	srtServer := NewSrtServer(SrtConfig{
+		Enabled:          genv.GetEnvBool("SRT_ENABLED", false),
+		Port:             genv.GetEnvInt("SRT_PORT", 9000),
+		BindAddress:      genv.GetEnvString("SRT_BIND_ADDRESS", ""),
+		FragmentDuration: genv.GetEnvInt64("SRT_FRAGMENT_DURATION", 3) * 1000,
+		MaxFragmentSize:  genv.GetEnvInt64("MAX_BINARY_MESSAGE_SIZE", DEFAULT_MAX_BINARY_MSG_SIZE),
+		Latency:          genv.GetEnvInt("SRT_LATENCY", 120),
+	}, authController, sourcesController, logger.CreateChildLogger("[SRT] "))
+
+	wg.Add(1)
+	go srtServer.Run(wg)
+
 	// Wait for all threads to finish
 
 	wg.Wait()
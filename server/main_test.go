@@ -6,6 +6,8 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
@@ -19,6 +21,10 @@ import (
 
 const TEST_JWT_SECRET = "test-secret"
 
+const TEST_ADMIN_API_SECRET = "test-admin-secret"
+
+const TEST_DVR_RETENTION_SECONDS = 60
+
 const TEST_STREAM_ID_1 = "test1"
 
 var TEST_STREAM_DATA_1 = []HlsFragment{
@@ -388,18 +394,46 @@ func runTestSpectator(name string, serverUrl string, streamId string, dataToExpe
 }
 
 type TestServer struct {
-	server   *HttpServer
-	listener net.Listener
-	url      string
+	server        *HttpServer
+	listener      net.Listener
+	url           string
+	dataDirectory string
 }
 
+// Optional features of the test server (all disabled by default)
+type TestServerOptions struct {
+	// Enables the DVR
+	Dvr bool
+
+	// Enables the recordings and the VOD playback
+	Recording bool
+
+	// Enables the HTTP ingest
+	HttpIngest bool
+
+	// Enables the admin API
+	AdminApi bool
+}
+
+// Creates a test server with the default configuration
 func makeTestServer(logger *glog.Logger, publishRegistry *MockPublishRegistry, allowPush bool, relayFrom string) *TestServer {
+	return makeTestServerWithOptions(logger, publishRegistry, allowPush, relayFrom, TestServerOptions{})
+}
+
+// Creates a test server, enabling the optional features
+func makeTestServerWithOptions(logger *glog.Logger, publishRegistry *MockPublishRegistry, allowPush bool, relayFrom string, options TestServerOptions) *TestServer {
 	// Auth
+	var revocationStore TokenRevocationStore = nil
+
+	if publishRegistry != nil {
+		revocationStore = publishRegistry
+	}
+
 	authController := NewAuthController(AuthConfiguration{
 		PullSecret: TEST_JWT_SECRET,
 		PushSecret: TEST_JWT_SECRET,
 		AllowPush:  allowPush,
-	}, logger.CreateChildLogger("[Auth] "))
+	}, revocationStore, logger.CreateChildLogger("[Auth] "))
 
 	// Memory limiter
 	memoryLimiter := NewFragmentBufferMemoryLimiter(FragmentBufferMemoryLimiterConfig{
@@ -407,12 +441,38 @@ func makeTestServer(logger *glog.Logger, publishRegistry *MockPublishRegistry, a
 		Limit:   0,
 	})
 
+	// Temporary directory for the stored data (DVR, recordings)
+	dataDirectory, err := os.MkdirTemp("", "hls-websocket-cdn-test-")
+
+	if err != nil {
+		panic(err)
+	}
+
+	// DVR
+	dvrController := NewDvrController(DvrConfig{
+		Enabled:          options.Dvr,
+		Directory:        filepath.Join(dataDirectory, "dvr"),
+		RetentionSeconds: TEST_DVR_RETENTION_SECONDS,
+		MaxSizePerStream: 1024 * 1024,
+		MaxTotalSize:     0,
+	}, memoryLimiter, logger.CreateChildLogger("[DVR] "))
+
+	// Recordings
+	recordingController := NewRecordingController(RecordingConfig{
+		Enabled:    options.Recording,
+		VodEnabled: options.Recording,
+	}, NewLocalRecordingStorage(filepath.Join(dataDirectory, "recordings")), logger.CreateChildLogger("[Recordings] "))
+
+	// Lifecycle event webhooks (disabled)
+	eventWebhooks := NewEventWebhooks(EventWebhooksConfig{}, logger.CreateChildLogger("[Events] "))
+
 	// Sources controller
 	sourcesController := NewSourcesController(SourcesControllerConfig{
 		FragmentBufferMaxLength: DEFAULT_FRAGMENT_BUFFER_MAX_LENGTH,
+		MaxFragmentSize:         DEFAULT_MAX_BINARY_MSG_SIZE,
 		ExternalWebsocketUrl:    "",
 		HasPublishRegistry:      publishRegistry != nil,
-	}, publishRegistry, memoryLimiter, logger.CreateChildLogger("[Sources] "))
+	}, publishRegistry, memoryLimiter, dvrController, recordingController, eventWebhooks, logger.CreateChildLogger("[Sources] "))
 
 	// Relay controller
 	relayController := NewRelayController(RelayControllerConfig{
@@ -422,7 +482,12 @@ func makeTestServer(logger *glog.Logger, publishRegistry *MockPublishRegistry, a
 		MaxBinaryMessageSize:    DEFAULT_MAX_BINARY_MSG_SIZE,
 		InactivityPeriodSeconds: RELAY_DEFAULT_INACTIVITY_PERIOD,
 		HasPublishRegistry:      publishRegistry != nil,
-	}, authController, publishRegistry, memoryLimiter, logger.CreateChildLogger("[Relays] "))
+	}, authController, publishRegistry, memoryLimiter, eventWebhooks, logger.CreateChildLogger("[Relays] "))
+
+	// Origin pull controller
+	originPullController := NewOriginPullController(OriginPullConfig{
+		MaxFragmentSize: DEFAULT_MAX_BINARY_MSG_SIZE,
+	}, sourcesController, logger.CreateChildLogger("[OriginPull] "))
 
 	// Rate limiter
 	rateLimiter := NewRateLimiter(RateLimiterConfig{
@@ -437,21 +502,57 @@ func makeTestServer(logger *glog.Logger, publishRegistry *MockPublishRegistry, a
 		WebsocketPrefix:      "/",
 		MaxBinaryMessageSize: DEFAULT_MAX_BINARY_MSG_SIZE,
 		LogRequests:          true,
-	}, logger.CreateChildLogger("[Server] "), authController, sourcesController, relayController, rateLimiter)
+		// HTTP ingest
+		HttpIngestEnabled: options.HttpIngest,
+		HttpIngestPrefix:  "/ingest/",
+		// Admin API
+		AdminApiEnabled: options.AdminApi,
+		AdminApiPrefix:  "/admin/",
+		AdminApiSecret:  TEST_ADMIN_API_SECRET,
+	}, logger.CreateChildLogger("[Server] "), authController, sourcesController, relayController, originPullController, rateLimiter)
 
 	// Run test server
 
 	url, listener := server.RunTestServer()
 
 	return &TestServer{
-		server:   server,
-		listener: listener,
-		url:      url,
+		server:        server,
+		listener:      listener,
+		url:           url,
+		dataDirectory: dataDirectory,
 	}
 }
 
 func (ts *TestServer) Close() {
 	ts.listener.Close()
+	_ = os.RemoveAll(ts.dataDirectory)
+}
+
+// Reads the next message from a test client socket, ignoring heartbeat messages
+// Returns the parsed message, or nil if the message was binary (data is returned in this case)
+func readTestMessage(socket *websocket.Conn, t *testing.T) (*WebsocketProtocolMessage, []byte) {
+	for {
+		_ = socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		mt, message, err := socket.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+			return nil, nil
+		}
+
+		if mt == websocket.BinaryMessage {
+			return nil, message
+		}
+
+		parsedMessage := ParseWebsocketProtocolMessage(string(message))
+
+		if parsedMessage.MessageType == "H" {
+			continue
+		}
+
+		return parsedMessage, nil
+	}
 }
 
 // Test a direct scenario
@@ -53,6 +53,38 @@ func (ml *FragmentBufferMemoryLimiter) OnBufferRelease(buffer []*HlsFragment) {
 	ml.mu.Unlock()
 }
 
+// Reserves memory for data held outside the fragment buffers
+// Returns false if the limit would be exceeded. In that case, nothing is reserved.
+func (ml *FragmentBufferMemoryLimiter) TryReserve(size int64) bool {
+	if !ml.config.Enabled || size == 0 {
+		return true
+	}
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if ml.usage+size > ml.config.Limit {
+		return false
+	}
+
+	ml.usage += size
+
+	return true
+}
+
+// Releases memory reserved with TryReserve
+func (ml *FragmentBufferMemoryLimiter) Release(size int64) {
+	if !ml.config.Enabled || size == 0 {
+		return
+	}
+
+	ml.mu.Lock()
+
+	ml.usage -= size
+
+	ml.mu.Unlock()
+}
+
 // Checks the memory limit before adding a fragment
 // Returns the new buffer (may change to make space) and
 // a boolean to indicate if the new fragment can be added to the buffer
@@ -146,3 +146,36 @@ func TestFragmentBufferMemoryLimiter(t *testing.T) {
 		t.Errorf("memoryLimiter.usage does not match. Expected %v, Actual: %v", memoryLimiter.usage, 0)
 	}
 }
+
+func TestFragmentBufferMemoryLimiterReserve(t *testing.T) {
+	memoryLimiter := NewFragmentBufferMemoryLimiter(FragmentBufferMemoryLimiterConfig{
+		Enabled: true,
+		Limit:   10,
+	})
+
+	if !memoryLimiter.TryReserve(6) {
+		t.Errorf("Expected the reservation to succeed")
+	}
+
+	if memoryLimiter.TryReserve(5) {
+		t.Errorf("Expected the reservation to fail, since it exceeds the limit")
+	}
+
+	if memoryLimiter.usage != 6 {
+		t.Errorf("memoryLimiter.usage does not match. Expected %v, Actual: %v", 6, memoryLimiter.usage)
+	}
+
+	// Reserved memory counts for the fragment buffers
+
+	buffer := make([]*HlsFragment, 0)
+
+	buffer = testFragmentAppend(t, buffer, memoryLimiter, []byte{0x00, 0x00, 0x00, 0x00, 0x00}, false)
+
+	memoryLimiter.Release(6)
+
+	testFragmentAppend(t, buffer, memoryLimiter, []byte{0x00, 0x00, 0x00, 0x00, 0x00}, true)
+
+	if memoryLimiter.usage != 5 {
+		t.Errorf("memoryLimiter.usage does not match. Expected %v, Actual: %v", 5, memoryLimiter.usage)
+	}
+}
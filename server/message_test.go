@@ -87,6 +87,24 @@ func TestWebsocketProtocolMessage(t *testing.T) {
 		},
 	})
 
+	testMessageIntegrity(t, &WebsocketProtocolMessage{
+		MessageType: "P",
+		Parameters: map[string]string{
+			"index":       "0",
+			"independent": "true",
+			"duration":    "0.5",
+			"last":        "false",
+		},
+	})
+
+	testMessageIntegrity(t, &WebsocketProtocolMessage{
+		MessageType: "META",
+		Parameters: map[string]string{
+			"codecs":     "avc1.64001f,mp4a.40.2",
+			"resolution": "1280x720",
+		},
+	})
+
 	testMessageIntegrity(t, &WebsocketProtocolMessage{
 		MessageType: "CLOSE",
 	})
@@ -0,0 +1,143 @@
+// Tests for stream metadata
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Connects to a test server and sends an action message (PUSH or PULL)
+// Waits for the OK message. If a protocol version is requested, checks it was accepted.
+func connectTestClient(serverUrl string, action string, streamId string, extraParams map[string]string, t *testing.T) *websocket.Conn {
+	socket, _, err := websocket.DefaultDialer.Dial(serverUrl, nil)
+
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	authToken, err := signAuthToken(TEST_JWT_SECRET, action, streamId)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	params := map[string]string{
+		"stream": streamId,
+		"auth":   authToken,
+	}
+
+	for k, v := range extraParams {
+		params[k] = v
+	}
+
+	msg := WebsocketProtocolMessage{
+		MessageType: action,
+		Parameters:  params,
+	}
+
+	_ = socket.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+
+	okMessage, _ := readTestMessage(socket, t)
+
+	if okMessage == nil || okMessage.MessageType != "OK" {
+		t.Errorf("[%v] Expected OK message, but received: %v", action, okMessage)
+		socket.Close()
+		return nil
+	}
+
+	// The protocol version 1 is not included in the OK message
+	if protocol := extraParams["protocol"]; protocol != "" && protocol != "1" && okMessage.GetParameter("protocol") != protocol {
+		t.Errorf("[%v] Expected OK message with protocol=%v, but received: %v", action, protocol, okMessage)
+		socket.Close()
+		return nil
+	}
+
+	return socket
+}
+
+func TestStreamMetadata(t *testing.T) {
+	logger := testMain()
+
+	mockPublishRegistry := NewMockPublishRegistry()
+
+	server1 := makeTestServer(logger.CreateChildLogger("[Server 1] "), mockPublishRegistry, true, "")
+	defer server1.Close()
+
+	server2 := makeTestServer(logger.CreateChildLogger("[Server 2] "), mockPublishRegistry, true, "")
+	defer server2.Close()
+
+	publisher := connectTestClient(server1.url, "PUSH", TEST_STREAM_ID_1, nil, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	// Send initial metadata
+
+	initialMetadata := WebsocketProtocolMessage{
+		MessageType: "META",
+		Parameters: map[string]string{
+			"codecs":     "avc1.64001f,mp4a.40.2",
+			"resolution": "1280x720",
+		},
+	}
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte(initialMetadata.Serialize()))
+
+	// Wait for the metadata to be set
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Spectators must receive the metadata right after the OK
+
+	spectator1 := connectTestClient(server1.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator1 == nil {
+		return
+	}
+
+	defer spectator1.Close()
+
+	spectator2 := connectTestClient(server2.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator2 == nil {
+		return
+	}
+
+	defer spectator2.Close()
+
+	for _, spectator := range []*websocket.Conn{spectator1, spectator2} {
+		msg, _ := readTestMessage(spectator, t)
+
+		if msg == nil || !compareMessages(msg, &initialMetadata) {
+			t.Errorf("Initial metadata does not match. Expected: %v, Actual: %v", initialMetadata.Serialize(), msg)
+		}
+	}
+
+	// Updates must be broadcast
+
+	updatedMetadata := WebsocketProtocolMessage{
+		MessageType: "META",
+		Parameters: map[string]string{
+			"codecs":     "avc1.64001f,mp4a.40.2",
+			"resolution": "1920x1080",
+			"title":      "Test stream",
+		},
+	}
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte(updatedMetadata.Serialize()))
+
+	for _, spectator := range []*websocket.Conn{spectator1, spectator2} {
+		msg, _ := readTestMessage(spectator, t)
+
+		if msg == nil || !compareMessages(msg, &updatedMetadata) {
+			t.Errorf("Updated metadata does not match. Expected: %v, Actual: %v", updatedMetadata.Serialize(), msg)
+		}
+	}
+}
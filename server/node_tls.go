@@ -0,0 +1,142 @@
+// Mutual TLS between nodes
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+	tls_certificate_loader "github.com/AgustinSRG/go-tls-certificate-loader"
+)
+
+// Configuration of the TLS client used to relay streams from other nodes
+type NodeTlsClientConfig struct {
+	// File with the CA bundle to verify the certificates of the other nodes
+	// If empty, the system roots are used
+	CaFile string
+
+	// Client certificate file. If empty, no client certificate is sent.
+	CertificateFile string
+
+	// Client private key file
+	PrivateKeyFile string
+
+	// Number of seconds to reload the client certificate
+	CheckReloadSeconds int
+}
+
+// Checks if the configuration is empty
+func (config NodeTlsClientConfig) IsEmpty() bool {
+	return config.CaFile == "" && config.CertificateFile == ""
+}
+
+// Loads a pool of CA certificates from a PEM file
+func LoadCertificatePool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no valid certificates found in " + file)
+	}
+
+	return pool, nil
+}
+
+// Creates the TLS configuration to connect to other nodes
+// Returns nil if the configuration is empty (default TLS settings)
+func NewNodeTlsClientConfig(config NodeTlsClientConfig, logger *glog.Logger) (*tls.Config, error) {
+	if config.IsEmpty() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if config.CaFile != "" {
+		pool, err := LoadCertificatePool(config.CaFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertificateFile != "" {
+		certificateLoader, err := tls_certificate_loader.NewTlsCertificateLoader(tls_certificate_loader.TlsCertificateLoaderConfig{
+			CertificatePath:   config.CertificateFile,
+			KeyPath:           config.PrivateKeyFile,
+			CheckReloadPeriod: time.Duration(config.CheckReloadSeconds) * time.Second,
+			OnReload: func() {
+				logger.Info("[CertificateLoader] Reloaded client certificate")
+			},
+			OnError: func(err error) {
+				logger.Errorf("Error loading client key pair: %v", err)
+			},
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.GetClientCertificate = func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certificateLoader.GetCertificate(nil)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// Creates the TLS configuration of the listener for other nodes
+// Client certificates signed by the CA are required
+// caFile - File with the CA bundle to verify the client certificates
+// getCertificate - Function to get the server certificate
+func NewNodeTlsServerConfig(caFile string, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Config, error) {
+	pool, err := LoadCertificatePool(caFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      pool,
+	}, nil
+}
+
+// Gets the identities of a node certificate:
+// The subject common name, and the DNS and URI subject alternative names
+func GetCertificateIdentities(cert *x509.Certificate) []string {
+	identities := make([]string, 0, 1+len(cert.DNSNames)+len(cert.URIs))
+
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+
+	identities = append(identities, cert.DNSNames...)
+
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+
+	return identities
+}
+
+// Gets the identities of the verified client certificate of a TLS connection
+// Returns nil if the client did not send a verified certificate
+func GetTlsPeerIdentities(state *tls.ConnectionState) []string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return GetCertificateIdentities(state.VerifiedChains[0][0])
+}
@@ -0,0 +1,266 @@
+// Tests for the mutual TLS between nodes
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+	"github.com/gorilla/websocket"
+)
+
+// Generates a certificate and saves it, along with its private key
+// Returns the certificate and the key, to sign other certificates
+func generateTestCertificate(template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, certFile string, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+
+	if err != nil {
+		panic(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	if err != nil {
+		panic(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return cert, key
+}
+
+// Generates a CA, a server certificate for 127.0.0.1 and a client certificate for node-2
+func generateTestNodeCertificates(dir string) {
+	caCert, caKey := generateTestCertificate(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test node CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+
+	generateTestCertificate(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node-1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+
+	generateTestCertificate(&x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "node-2"},
+		DNSNames:     []string{"node-2.cdn.internal"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, caKey, filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+}
+
+func TestNodeIdentities(t *testing.T) {
+	logger := glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction)
+
+	anyNodeController := NewAuthController(AuthConfiguration{}, nil, logger)
+	defer anyNodeController.Close()
+
+	if !anyNodeController.ValidateNodeIdentity([]string{"node-2"}) {
+		t.Errorf("Expected any verified node to be allowed")
+	}
+
+	if anyNodeController.ValidateNodeIdentity(nil) {
+		t.Errorf("Expected connections without client certificate to be rejected")
+	}
+
+	authController := NewAuthController(AuthConfiguration{
+		NodeIdentities: "node-1, *.cdn.internal",
+	}, nil, logger)
+	defer authController.Close()
+
+	if !authController.ValidateNodeIdentity([]string{"node-1"}) {
+		t.Errorf("Expected node-1 to be allowed")
+	}
+
+	if !authController.ValidateNodeIdentity([]string{"node-2", "node-2.cdn.internal"}) {
+		t.Errorf("Expected node-2.cdn.internal to be allowed")
+	}
+
+	if authController.ValidateNodeIdentity([]string{"node-3", "node-3.example.com"}) {
+		t.Errorf("Expected node-3 to be rejected")
+	}
+}
+
+func TestNodeTls(t *testing.T) {
+	logger := testMain()
+
+	certDirectory, err := os.MkdirTemp("", "hls-websocket-cdn-test-certs-")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer os.RemoveAll(certDirectory)
+
+	generateTestNodeCertificates(certDirectory)
+
+	mockPublishRegistry := NewMockPublishRegistry()
+
+	server1 := makeTestServer(logger.CreateChildLogger("[Server 1] "), mockPublishRegistry, true, "")
+	defer server1.Close()
+
+	server2 := makeTestServer(logger.CreateChildLogger("[Server 2] "), mockPublishRegistry, true, "")
+	defer server2.Close()
+
+	// The relay tokens of the second node are not valid,
+	// so it can only relay the stream with its client certificate
+
+	server1.server.authController.config.RelaySecret = "relay-secret"
+	server2.server.authController.config.RelaySecret = "wrong-relay-secret"
+
+	// Run the node TLS listener of the first node
+
+	serverCertificate, err := tls.LoadX509KeyPair(filepath.Join(certDirectory, "server.pem"), filepath.Join(certDirectory, "server.key"))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	serverTlsConfig, err := NewNodeTlsServerConfig(filepath.Join(certDirectory, "ca.pem"), func(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &serverCertificate, nil
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverTlsConfig)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer listener.Close()
+
+	go func() {
+		_ = http.Serve(listener, server1.server.InternalHandler())
+	}()
+
+	nodeUrl := "wss://127.0.0.1:" + fmt.Sprint(listener.Addr().(*net.TCPAddr).Port) + "/"
+
+	server1.server.sourceController.config.ExternalWebsocketUrl = nodeUrl
+
+	// Connections without client certificate are rejected
+
+	noCertTlsConfig, err := NewNodeTlsClientConfig(NodeTlsClientConfig{
+		CaFile: filepath.Join(certDirectory, "ca.pem"),
+	}, logger)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	noCertDialer := &websocket.Dialer{TLSClientConfig: noCertTlsConfig}
+
+	if socket, _, err := noCertDialer.Dial(nodeUrl, nil); err == nil {
+		socket.Close()
+		t.Errorf("Expected the connection without client certificate to be rejected")
+	}
+
+	// The second node relays with its client certificate
+
+	clientTlsConfig, err := NewNodeTlsClientConfig(NodeTlsClientConfig{
+		CaFile:          filepath.Join(certDirectory, "ca.pem"),
+		CertificateFile: filepath.Join(certDirectory, "client.pem"),
+		PrivateKeyFile:  filepath.Join(certDirectory, "client.key"),
+	}, logger)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	server2.server.relayController.dialer = &websocket.Dialer{TLSClientConfig: clientTlsConfig}
+
+	publisher := connectTestClient(server1.url, "PUSH", TEST_STREAM_ID_1, nil, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	spectator := connectTestClient(server2.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte("F:duration=1"))
+	_ = publisher.WriteMessage(websocket.BinaryMessage, TEST_STREAM_DATA_1[0].Data)
+
+	expectTestFragmentWithSequence(spectator, 1, TEST_STREAM_DATA_1[0].Data, t)
+
+	// The relay connection is internal
+
+	rateLimiter := server1.server.rateLimiter
+
+	rateLimiter.mu.Lock()
+	connections := rateLimiter.connectionsCount["127.0.0.1"]
+	rateLimiter.mu.Unlock()
+
+	if connections != 1 {
+		t.Errorf("Expected only the publisher connection to be counted, but got %v connections", connections)
+	}
+}
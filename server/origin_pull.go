@@ -0,0 +1,379 @@
+// Pulls HLS streams from HTTP origins
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+)
+
+// Timeout for the HTTP requests to the origin
+const ORIGIN_PULL_REQUEST_TIMEOUT = 20 * time.Second
+
+// Max size (bytes) of an HLS playlist
+const ORIGIN_PULL_MAX_PLAYLIST_SIZE = 1024 * 1024
+
+// Number of fragments to take from the playlist when the pulling starts
+const ORIGIN_PULL_INITIAL_FRAGMENTS = 3
+
+// Max number of consecutive errors before giving up
+const ORIGIN_PULL_MAX_ERRORS = 10
+
+// Delay before retrying after an error
+const ORIGIN_PULL_RETRY_DELAY = 2 * time.Second
+
+// Max number of master playlists to follow before reaching a media playlist
+const ORIGIN_PULL_MAX_MASTER_PLAYLISTS = 3
+
+// Error returned when the origin has too many nested master playlists
+var errOriginPullTooManyMasterPlaylists = errors.New("too many nested master playlists")
+
+// Configuration for pulling streams from HTTP origins
+type OriginPullConfig struct {
+	// Max size (bytes) of a fragment
+	MaxFragmentSize int64
+}
+
+// Controller of the streams pulled from HTTP origins
+type OriginPullController struct {
+	// Configuration
+	config OriginPullConfig
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Logger
+	logger *glog.Logger
+
+	// Sources controller
+	sourceController *SourcesController
+
+	// HTTP client
+	client *http.Client
+
+	// Pullers (Stream ID -> Puller)
+	pullers map[string]*HlsOriginPuller
+}
+
+// Creates new instance of OriginPullController
+func NewOriginPullController(config OriginPullConfig, sourceController *SourcesController, logger *glog.Logger) *OriginPullController {
+	return &OriginPullController{
+		config:           config,
+		mu:               &sync.Mutex{},
+		logger:           logger,
+		sourceController: sourceController,
+		client: &http.Client{
+			Timeout: ORIGIN_PULL_REQUEST_TIMEOUT,
+		},
+		pullers: make(map[string]*HlsOriginPuller),
+	}
+}
+
+// Starts pulling a stream from an HTTP origin
+// If the stream was already being pulled, the previous puller is stopped
+func (opc *OriginPullController) Start(streamId string, playlistUrl string) error {
+	parsedUrl, err := url.Parse(playlistUrl)
+
+	if err != nil {
+		return err
+	}
+
+	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+		return fmt.Errorf("invalid playlist URL: %v", playlistUrl)
+	}
+
+	puller := &HlsOriginPuller{
+		controller:       opc,
+		logger:           opc.logger.CreateChildLogger("[" + streamId + "] "),
+		streamId:         streamId,
+		playlistUrl:      parsedUrl,
+		lastIndex:        -1,
+		interruptChannel: make(chan bool, 1),
+	}
+
+	opc.mu.Lock()
+
+	existingPuller := opc.pullers[streamId]
+	opc.pullers[streamId] = puller
+
+	opc.mu.Unlock()
+
+	if existingPuller != nil {
+		existingPuller.Stop()
+	}
+
+	go puller.run()
+
+	return nil
+}
+
+// Stops pulling a stream
+// Returns false if the stream was not being pulled
+func (opc *OriginPullController) Stop(streamId string) bool {
+	opc.mu.Lock()
+
+	puller := opc.pullers[streamId]
+	delete(opc.pullers, streamId)
+
+	opc.mu.Unlock()
+
+	if puller == nil {
+		return false
+	}
+
+	puller.Stop()
+
+	return true
+}
+
+// Removes a puller after it finishes
+func (opc *OriginPullController) onPullerFinished(puller *HlsOriginPuller) {
+	opc.mu.Lock()
+	defer opc.mu.Unlock()
+
+	if opc.pullers[puller.streamId] == puller {
+		delete(opc.pullers, puller.streamId)
+	}
+}
+
+// Pulls an HLS stream from an HTTP origin, feeding a source
+type HlsOriginPuller struct {
+	// Controller
+	controller *OriginPullController
+
+	// Logger
+	logger *glog.Logger
+
+	// Stream ID
+	streamId string
+
+	// URL of the media playlist
+	playlistUrl *url.URL
+
+	// Index of the last fragment taken from the playlist (-1 if none)
+	lastIndex int
+
+	// Number of master playlists followed
+	masterPlaylists int
+
+	// Channel to interrupt the pulling thread
+	interruptChannel chan bool
+}
+
+// Stops the puller
+func (puller *HlsOriginPuller) Stop() {
+	select {
+	case puller.interruptChannel <- true:
+	default:
+	}
+}
+
+// Downloads a file from the origin
+func (puller *HlsOriginPuller) download(fileUrl *url.URL, maxSize int64) ([]byte, error) {
+	res, err := puller.controller.client.Get(fileUrl.String())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status code %v for %v", res.StatusCode, fileUrl.String())
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxSize+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("file too large: %v", fileUrl.String())
+	}
+
+	return data, nil
+}
+
+// Loads the playlist and adds the new fragments to the source
+// Returns the playlist and the number of fragments added
+func (puller *HlsOriginPuller) poll(source *HlsSource) (*HlsPlaylist, int, error) {
+	playlistData, err := puller.download(puller.playlistUrl, ORIGIN_PULL_MAX_PLAYLIST_SIZE)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	playlist := DecodeHlsPlaylist(string(playlistData))
+
+	if len(playlist.Variants) > 0 {
+		// Master playlist, pull the first variant
+		puller.masterPlaylists++
+
+		if puller.masterPlaylists > ORIGIN_PULL_MAX_MASTER_PLAYLISTS {
+			return nil, 0, errOriginPullTooManyMasterPlaylists
+		}
+
+		variantUrl, err := puller.playlistUrl.Parse(playlist.Variants[0])
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		puller.logger.Infof("Master playlist found. Pulling variant: %v", variantUrl.String())
+
+		puller.playlistUrl = variantUrl
+
+		return playlist, 0, nil
+	}
+
+	if len(playlist.Fragments) == 0 {
+		return playlist, 0, nil
+	}
+
+	if playlist.Fragments[len(playlist.Fragments)-1].Index < puller.lastIndex {
+		// The media sequence went back, so the origin restarted the stream
+		puller.logger.Info("The origin restarted the stream")
+		puller.lastIndex = -1
+	}
+
+	firstFragment := 0
+
+	if puller.lastIndex < 0 && !playlist.IsEnded && len(playlist.Fragments) > ORIGIN_PULL_INITIAL_FRAGMENTS {
+		// Start near the live edge
+		firstFragment = len(playlist.Fragments) - ORIGIN_PULL_INITIAL_FRAGMENTS
+	}
+
+	added := 0
+
+	for _, fragment := range playlist.Fragments[firstFragment:] {
+		if fragment.Index <= puller.lastIndex {
+			continue
+		}
+
+		fragmentUrl, err := puller.playlistUrl.Parse(fragment.Uri)
+
+		if err != nil {
+			return nil, added, err
+		}
+
+		data, err := puller.download(fragmentUrl, puller.controller.config.MaxFragmentSize)
+
+		if err != nil {
+			return nil, added, err
+		}
+
+		source.AddFragment(&HlsFragment{
+			Duration: float32(fragment.Duration),
+			Data:     data,
+		})
+
+		puller.lastIndex = fragment.Index
+		added++
+	}
+
+	return playlist, added, nil
+}
+
+// Pulling thread
+func (puller *HlsOriginPuller) run() {
+	sourceController := puller.controller.sourceController
+
+	source := sourceController.CreateSource(puller.streamId)
+
+	go source.PeriodicallyAnnounce()
+
+	defer func() {
+		// Unregister before closing the source, so once the spectators receive the close,
+		// the admin API no longer finds this puller and a new one can be started.
+		// If this puller was already replaced, the new one is kept.
+		puller.controller.onPullerFinished(puller)
+
+		source.Close()
+		sourceController.RemoveSource(puller.streamId, source)
+	}()
+
+	puller.logger.Infof("Started pulling from %v", puller.playlistUrl.String())
+
+	errorCount := 0
+
+	for {
+		var wait time.Duration
+
+		playlist, added, err := puller.poll(source)
+
+		if errors.Is(err, errOriginPullTooManyMasterPlaylists) {
+			puller.logger.Errorf("Stopped pulling from the origin: %v", err)
+			return
+		}
+
+		if err != nil {
+			errorCount++
+
+			puller.logger.Warningf("Error pulling from the origin (%v/%v): %v", errorCount, ORIGIN_PULL_MAX_ERRORS, err)
+
+			if errorCount >= ORIGIN_PULL_MAX_ERRORS {
+				puller.logger.Error("Too many errors. Stopped pulling from the origin")
+				return
+			}
+
+			wait = ORIGIN_PULL_RETRY_DELAY
+		} else {
+			errorCount = 0
+
+			if playlist.IsEnded {
+				puller.logger.Info("The stream ended in the origin")
+				return
+			}
+
+			// Reload interval (RFC 8216, section 6.3.4)
+			if len(playlist.Variants) > 0 {
+				wait = 0 // Load the variant playlist
+			} else if added > 0 {
+				wait = time.Duration(playlist.TargetDuration) * time.Second
+			} else {
+				wait = time.Duration(playlist.TargetDuration) * time.Second / 2
+			}
+		}
+
+		if source.IsClosed() {
+			// Replaced by another publisher
+			puller.logger.Info("The source was closed. Stopped pulling from the origin")
+			return
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-puller.interruptChannel:
+			puller.logger.Info("Stopped pulling from the origin")
+			return
+		}
+	}
+}
+
+// Parses a list of streams to pull from HTTP origins
+// Format: {STREAM_ID}={PLAYLIST_URL}, separated by commas
+// Returns a map (Stream ID -> Playlist URL)
+func parseOriginPullStreams(list string) map[string]string {
+	result := make(map[string]string)
+
+	for _, entry := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+
+		result[parts[0]] = parts[1]
+	}
+
+	return result
+}
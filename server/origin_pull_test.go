@@ -0,0 +1,252 @@
+// Tests for the streams pulled from HTTP origins
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDecodeHlsPlaylist(t *testing.T) {
+	playlist := DecodeHlsPlaylist("#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-TARGETDURATION:4\n" +
+		"#EXT-X-MEDIA-SEQUENCE:10\n" +
+		"#EXTINF:3.5,\n" +
+		"10.ts\n" +
+		"#EXT-X-DISCONTINUITY\n" +
+		"#EXTINF:4.0,Title\n" +
+		"https://cdn.example.com/11.ts?token=a:b\n")
+
+	if playlist.TargetDuration != 4 || playlist.MediaSequence != 10 || playlist.IsEnded {
+		t.Errorf("Unexpected playlist: %v", playlist)
+	}
+
+	if len(playlist.Fragments) != 2 {
+		t.Errorf("Expected 2 fragments, but got %v", len(playlist.Fragments))
+		return
+	}
+
+	if playlist.Fragments[0].Index != 10 || playlist.Fragments[0].Duration != 3.5 || playlist.Fragments[0].Uri != "10.ts" || playlist.Fragments[0].Discontinuity {
+		t.Errorf("Unexpected fragment: %v", playlist.Fragments[0])
+	}
+
+	if playlist.Fragments[1].Index != 11 || playlist.Fragments[1].Duration != 4 || playlist.Fragments[1].Uri != "https://cdn.example.com/11.ts?token=a:b" || !playlist.Fragments[1].Discontinuity {
+		t.Errorf("Unexpected fragment: %v", playlist.Fragments[1])
+	}
+
+	master := DecodeHlsPlaylist("#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720\n" +
+		"720p/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=640000,RESOLUTION=640x360\n" +
+		"360p/index.m3u8\n" +
+		"#EXT-X-ENDLIST\n")
+
+	if len(master.Variants) != 2 || master.Variants[0] != "720p/index.m3u8" || !master.IsEnded {
+		t.Errorf("Unexpected master playlist: %v", master)
+	}
+}
+
+// Fake HTTP origin, for testing
+type FakeHlsOrigin struct {
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Number of fragments published
+	fragmentCount int
+
+	// True if the stream ended
+	ended bool
+}
+
+// Gets the data of a fragment of the fake origin
+func getFakeHlsOriginFragmentData(index int) []byte {
+	return []byte{0x47, byte(index), 0x01, 0x02}
+}
+
+func (origin *FakeHlsOrigin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	origin.mu.Lock()
+	defer origin.mu.Unlock()
+
+	switch {
+	case req.URL.Path == "/master.m3u8":
+		_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1280000\nlive/index.m3u8\n"))
+	case req.URL.Path == "/loop.m3u8":
+		_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1280000\nloop.m3u8\n"))
+	case req.URL.Path == "/live/index.m3u8":
+		playlist := strings.Builder{}
+
+		playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n")
+
+		for i := 0; i < origin.fragmentCount; i++ {
+			playlist.WriteString("#EXTINF:1.000,\n" + fmt.Sprint(i) + ".ts\n")
+		}
+
+		if origin.ended {
+			playlist.WriteString("#EXT-X-ENDLIST\n")
+		}
+
+		_, _ = w.Write([]byte(playlist.String()))
+	case strings.HasPrefix(req.URL.Path, "/live/") && strings.HasSuffix(req.URL.Path, ".ts"):
+		var index int
+
+		_, err := fmt.Sscanf(req.URL.Path, "/live/%d.ts", &index)
+
+		if err != nil || index >= origin.fragmentCount {
+			w.WriteHeader(404)
+			return
+		}
+
+		_, _ = w.Write(getFakeHlsOriginFragmentData(index))
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// Publishes a fragment in the fake origin
+func (origin *FakeHlsOrigin) AddFragment() {
+	origin.mu.Lock()
+	defer origin.mu.Unlock()
+
+	origin.fragmentCount++
+}
+
+// Ends the stream in the fake origin
+func (origin *FakeHlsOrigin) End() {
+	origin.mu.Lock()
+	defer origin.mu.Unlock()
+
+	origin.ended = true
+}
+
+func TestOriginPull(t *testing.T) {
+	logger := testMain()
+
+	origin := &FakeHlsOrigin{
+		mu:            &sync.Mutex{},
+		fragmentCount: ORIGIN_PULL_INITIAL_FRAGMENTS + 2,
+	}
+
+	originServer := httptest.NewServer(origin)
+	defer originServer.Close()
+
+	server := makeTestServerWithOptions(logger.CreateChildLogger("[Server] "), nil, true, "", TestServerOptions{AdminApi: true})
+	defer server.Close()
+
+	status := sendTestAdminApiRequest(server, "POST", "origin?stream="+TEST_STREAM_ID_1, `{"url":"ftp://example.com/index.m3u8"}`, t)
+
+	if status != 400 {
+		t.Errorf("Expected status 400 for an invalid URL, but received %v", status)
+	}
+
+	status = sendTestAdminApiRequest(server, "POST", "origin?stream="+TEST_STREAM_ID_1, `{"url":"`+originServer.URL+`/master.m3u8"}`, t)
+
+	if status != 200 {
+		t.Errorf("Admin API returned status %v", status)
+		return
+	}
+
+	// Wait for the source to be created, with the initial fragments
+
+	for i := 0; i < 100; i++ {
+		source := server.server.sourceController.GetSource(TEST_STREAM_ID_1)
+
+		if source != nil {
+			_, _, initialState := source.AddListener(math.MaxUint64, false)
+			source.RemoveListener(math.MaxUint64)
+
+			if initialState != nil && len(initialState.Fragments) == ORIGIN_PULL_INITIAL_FRAGMENTS {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	spectator := connectTestClient(server.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	// Only the fragments near the live edge are taken
+
+	for i := 2; i < ORIGIN_PULL_INITIAL_FRAGMENTS+2; i++ {
+		expectTestFragmentWithSequence(spectator, int64(i-1), getFakeHlsOriginFragmentData(i), t)
+	}
+
+	// New fragments
+
+	origin.AddFragment()
+
+	expectTestFragmentWithSequence(spectator, ORIGIN_PULL_INITIAL_FRAGMENTS+1, getFakeHlsOriginFragmentData(ORIGIN_PULL_INITIAL_FRAGMENTS+2), t)
+
+	// End of the stream
+
+	origin.End()
+
+	msg, _ := readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "CLOSE" {
+		t.Errorf("Expected CLOSE message, but received: %v", msg)
+	}
+
+	status = sendTestAdminApiRequest(server, "DELETE", "origin?stream="+TEST_STREAM_ID_1, "", t)
+
+	if status != 404 {
+		t.Errorf("Expected status 404 for a stream not being pulled, but received %v", status)
+	}
+}
+
+func TestOriginPullMasterPlaylistLoop(t *testing.T) {
+	logger := testMain()
+
+	origin := &FakeHlsOrigin{
+		mu: &sync.Mutex{},
+	}
+
+	originServer := httptest.NewServer(origin)
+	defer originServer.Close()
+
+	server := makeTestServerWithOptions(logger.CreateChildLogger("[Server] "), nil, true, "", TestServerOptions{AdminApi: true})
+	defer server.Close()
+
+	status := sendTestAdminApiRequest(server, "POST", "origin?stream="+TEST_STREAM_ID_1, `{"url":"`+originServer.URL+`/loop.m3u8"}`, t)
+
+	if status != 200 {
+		t.Errorf("Admin API returned status %v", status)
+		return
+	}
+
+	// The puller gives up instead of following the master playlist forever
+
+	for i := 0; i < 50; i++ {
+		server.server.originPullController.mu.Lock()
+		puller := server.server.originPullController.pullers[TEST_STREAM_ID_1]
+		server.server.originPullController.mu.Unlock()
+
+		if puller == nil {
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Errorf("Expected the puller to stop after too many nested master playlists")
+}
+
+func TestParseOriginPullStreams(t *testing.T) {
+	streams := parseOriginPullStreams("live1=http://origin/live1.m3u8?a=b, live2=https://origin/live2.m3u8,invalid")
+
+	if len(streams) != 2 || streams["live1"] != "http://origin/live1.m3u8?a=b" || streams["live2"] != "https://origin/live2.m3u8" {
+		t.Errorf("Unexpected streams: %v", streams)
+	}
+}
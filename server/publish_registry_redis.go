@@ -6,6 +6,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -27,6 +28,9 @@ type RedisPublishRegistryConfig struct {
 
 	// Number of seconds for the publish registry to be refreshed
 	PublishRefreshIntervalSeconds int
+
+	// Key of the sorted set of revoked tokens
+	RevokedTokensKey string
 }
 
 // Creates new instance of RedisPublishRegistry
@@ -84,3 +88,48 @@ func (pr *RedisPublishRegistry) AnnouncePublishedStream(streamId string, url str
 	status := pr.redisClient.Set(context.Background(), streamId, url, time.Duration(pr.config.PublishRefreshIntervalSeconds)*2*time.Second)
 	return status.Err()
 }
+
+// Revokes a token ID until the expiration time
+// The revoked IDs are stored in a sorted set, with the expiration timestamp as the score
+func (pr *RedisPublishRegistry) RevokeToken(id string, expiration time.Time) error {
+	ctx := context.Background()
+
+	err := pr.redisClient.ZAdd(ctx, pr.config.RevokedTokensKey, redis.Z{
+		Score:  float64(expiration.Unix()),
+		Member: id,
+	}).Err()
+
+	if err != nil {
+		return err
+	}
+
+	// Remove the expired revocations
+
+	return pr.redisClient.ZRemRangeByScore(ctx, pr.config.RevokedTokensKey, "-inf", strconv.FormatInt(time.Now().Unix(), 10)).Err()
+}
+
+// Gets the revoked token IDs (ID -> Expiration time)
+func (pr *RedisPublishRegistry) GetRevokedTokens() (map[string]time.Time, error) {
+	res := pr.redisClient.ZRangeByScoreWithScores(context.Background(), pr.config.RevokedTokensKey, &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(time.Now().Unix(), 10),
+		Max: "+inf",
+	})
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	revoked := make(map[string]time.Time)
+
+	for _, z := range res.Val() {
+		id, ok := z.Member.(string)
+
+		if !ok {
+			continue
+		}
+
+		revoked[id] = time.Unix(int64(z.Score), 0)
+	}
+
+	return revoked, nil
+}
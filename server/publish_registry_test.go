@@ -14,12 +14,16 @@ type MockPublishRegistry struct {
 
 	// Internal registry
 	registry map[string]string
+
+	// Revoked tokens
+	revokedTokens map[string]time.Time
 }
 
 func NewMockPublishRegistry() *MockPublishRegistry {
 	return &MockPublishRegistry{
-		mu:       &sync.Mutex{},
-		registry: make(map[string]string),
+		mu:            &sync.Mutex{},
+		registry:      make(map[string]string),
+		revokedTokens: make(map[string]time.Time),
 	}
 }
 
@@ -44,3 +48,25 @@ func (pr *MockPublishRegistry) AnnouncePublishedStream(streamId string, url stri
 
 	return nil
 }
+
+func (pr *MockPublishRegistry) RevokeToken(id string, expiration time.Time) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pr.revokedTokens[id] = expiration
+
+	return nil
+}
+
+func (pr *MockPublishRegistry) GetRevokedTokens() (map[string]time.Time, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	revoked := make(map[string]time.Time)
+
+	for id, expiration := range pr.revokedTokens {
+		revoked[id] = expiration
+	}
+
+	return revoked, nil
+}
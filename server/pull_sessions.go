@@ -0,0 +1,97 @@
+// Pull sessions (limits set by the claims of the pull tokens)
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Tracker of the pull sessions of the node
+// Counts the connections of each token or user, to enforce the max_conn claim
+type PullSessionTracker struct {
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Number of connections (Key -> Count)
+	connections map[string]int
+}
+
+// Creates new instance of PullSessionTracker
+func NewPullSessionTracker() *PullSessionTracker {
+	return &PullSessionTracker{
+		mu:          &sync.Mutex{},
+		connections: make(map[string]int),
+	}
+}
+
+// Counts a new connection
+// key - Identifier of the token or user
+// maxConnections - Max number of connections for the key
+// Returns false if the limit was reached
+func (tracker *PullSessionTracker) Acquire(key string, maxConnections int) bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if tracker.connections[key] >= maxConnections {
+		return false
+	}
+
+	tracker.connections[key]++
+
+	return true
+}
+
+// Discounts a connection
+func (tracker *PullSessionTracker) Release(key string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if tracker.connections[key] <= 1 {
+		delete(tracker.connections, key)
+	} else {
+		tracker.connections[key]--
+	}
+}
+
+// Gets the number of connections of a key
+func (tracker *PullSessionTracker) GetConnections(key string) int {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	return tracker.connections[key]
+}
+
+// Pull session
+type PullSession struct {
+	// Claims of the token (nil if authentication is disabled)
+	Claims jwt.MapClaims
+
+	// True if the session is of another node relaying the stream (RELAY token)
+	Internal bool
+
+	// Max duration of the session (0 for unlimited)
+	MaxDuration time.Duration
+
+	// Tracker (nil if the connections are not limited)
+	tracker *PullSessionTracker
+
+	// Key in the tracker
+	key string
+
+	// True if released
+	released bool
+}
+
+// Releases the session, so it is no longer counted
+// Must be called once the connection is closed
+func (session *PullSession) Release() {
+	if session.released || session.tracker == nil {
+		return
+	}
+
+	session.released = true
+	session.tracker.Release(session.key)
+}
@@ -0,0 +1,173 @@
+// Tests for pull sessions
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestPullSessionClaims(t *testing.T) {
+	secret := "secret"
+	streamId := "stream1"
+
+	authController := NewAuthController(AuthConfiguration{
+		PullSecret: secret,
+		PushSecret: secret,
+		AllowPush:  true,
+	}, nil, glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction))
+
+	// Max connections per user
+
+	userToken := signTestAuthTokenWithClaims(secret, jwt.MapClaims{
+		"sub":      "PULL:" + streamId,
+		"uid":      "user1",
+		"max_conn": 2,
+	})
+
+	// Another token of the same user
+	userToken2 := signTestAuthTokenWithClaims(secret, jwt.MapClaims{
+		"sub":      "PULL:" + streamId,
+		"uid":      "user1",
+		"jti":      "token2",
+		"max_conn": 2,
+	})
+
+	session1, _, _ := authController.StartPullSession(userToken, streamId, "10.0.0.1")
+	session2, _, _ := authController.StartPullSession(userToken2, streamId, "10.0.0.2")
+
+	if session1 == nil || session2 == nil {
+		t.Fatalf("Could not start the sessions")
+	}
+
+	session3, errCode, _ := authController.StartPullSession(userToken, streamId, "10.0.0.3")
+
+	if session3 != nil || errCode != "CONNECTION_LIMIT" {
+		t.Errorf("Expected CONNECTION_LIMIT error, but got: %v", errCode)
+	}
+
+	session1.Release()
+	session1.Release() // Releasing twice must not discount other sessions
+
+	session3, _, _ = authController.StartPullSession(userToken, streamId, "10.0.0.3")
+
+	if session3 == nil {
+		t.Errorf("Could not start a session after releasing another one")
+	}
+
+	session2.Release()
+	session3.Release()
+
+	if authController.sessions.GetConnections("uid:user1") != 0 {
+		t.Errorf("Expected no connections after releasing all the sessions")
+	}
+
+	// Max connections per token ID
+
+	jtiToken := signTestAuthTokenWithClaims(secret, jwt.MapClaims{
+		"sub":      "PULL:" + streamId,
+		"jti":      "token3",
+		"max_conn": 1,
+	})
+
+	session, _, _ := authController.StartPullSession(jtiToken, streamId, "10.0.0.1")
+
+	if session == nil {
+		t.Fatalf("Could not start the session")
+	}
+
+	if s, _, _ := authController.StartPullSession(jtiToken, streamId, "10.0.0.1"); s != nil {
+		t.Errorf("Expected the second session for the token to be rejected")
+	}
+
+	session.Release()
+
+	// IP binding
+
+	ipToken := signTestAuthTokenWithClaims(secret, jwt.MapClaims{
+		"sub": "PULL:" + streamId,
+		"ip":  []string{"10.0.0.1", "::1"},
+	})
+
+	for ip, valid := range map[string]bool{"10.0.0.1": true, "::1": true, "10.0.0.2": false, "": false} {
+		s, errCode, _ := authController.StartPullSession(ipToken, streamId, ip)
+
+		if (s != nil) != valid {
+			t.Errorf("[IP %v] Expected valid=%v, but got error: %v", ip, valid, errCode)
+		}
+
+		if !valid && errCode != "AUTH_ERROR" {
+			t.Errorf("[IP %v] Expected AUTH_ERROR, but got: %v", ip, errCode)
+		}
+	}
+
+	if authController.ValidatePullToken(ipToken, streamId) {
+		t.Errorf("Token bound to an IP address passed validation without a client IP address")
+	}
+
+	// Not before
+
+	futureToken := signTestAuthTokenWithClaims(secret, jwt.MapClaims{
+		"sub": "PULL:" + streamId,
+		"nbf": time.Now().Add(10 * time.Minute).Unix(),
+	})
+
+	if s, _, _ := authController.StartPullSession(futureToken, streamId, "10.0.0.1"); s != nil {
+		t.Errorf("Token not valid yet started a session")
+	}
+
+	// Max duration
+
+	durationToken := signTestAuthTokenWithClaims(secret, jwt.MapClaims{
+		"sub":          "PULL:" + streamId,
+		"max_duration": 1.5,
+	})
+
+	if s, _, _ := authController.StartPullSession(durationToken, streamId, "10.0.0.1"); s == nil || s.MaxDuration != 1500*time.Millisecond {
+		t.Errorf("Expected session with max duration of 1.5 seconds, but got: %v", s)
+	}
+}
+
+func TestPullSessionExpired(t *testing.T) {
+	logger := testMain()
+
+	server := makeTestServer(logger.CreateChildLogger("[Server] "), nil, true, "")
+	defer server.Close()
+
+	publisher := connectTestClient(server.url, "PUSH", TEST_STREAM_ID_1, nil, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	spectator := connectTestClient(server.url, "PULL", TEST_STREAM_ID_1, map[string]string{
+		"auth": signTestAuthTokenWithClaims(TEST_JWT_SECRET, jwt.MapClaims{
+			"sub":          "PULL:" + TEST_STREAM_ID_1,
+			"max_duration": 0.2,
+		}),
+	}, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	msg, _ := readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "E" || msg.GetParameter("code") != "SESSION_EXPIRED" {
+		t.Errorf("Expected SESSION_EXPIRED error, but received: %v", msg)
+		return
+	}
+
+	_ = spectator.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, _, err := spectator.ReadMessage(); err == nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
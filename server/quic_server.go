@@ -0,0 +1,313 @@
+// QUIC server (raw QUIC, native clients only. Not WebTransport)
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	tls_certificate_loader "github.com/AgustinSRG/go-tls-certificate-loader"
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN protocol identifier for the QUIC connections
+const QUIC_ALPN_PROTOCOL = "hls-websocket-cdn"
+
+// Max time to wait for the client to open the control stream
+const QUIC_CONTROL_STREAM_TIMEOUT = HEARTBEAT_MSG_PERIOD_SECONDS * time.Second
+
+// Max time to wait for the client to accept a fragment stream
+const QUIC_OPEN_STREAM_TIMEOUT = HEARTBEAT_MSG_PERIOD_SECONDS * time.Second
+
+// Max time to wait for the client to close the connection, after the server closes the control stream
+const QUIC_CLOSE_TIMEOUT = 5 * time.Second
+
+// Frame types
+const (
+	QUIC_FRAME_TEXT   = 0
+	QUIC_FRAME_BINARY = 1
+)
+
+// Size of the frame header (type + length)
+const QUIC_FRAME_HEADER_SIZE = 5
+
+// Error for messages exceeding the size limit
+var ErrQuicMessageTooLarge = errors.New("message too large")
+
+// Error for invalid frames
+var ErrQuicInvalidFrame = errors.New("invalid frame")
+
+// Gets the configuration for QUIC
+func getQuicConfig() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:        HEARTBEAT_MSG_PERIOD_SECONDS * 2 * time.Second,
+		KeepAlivePeriod:       HEARTBEAT_MSG_PERIOD_SECONDS / 2 * time.Second,
+		MaxIncomingStreams:    1,  // Control stream
+		MaxIncomingUniStreams: -1, // The clients do not open unidirectional streams
+	}
+}
+
+// Runs the QUIC server
+func (server *HttpServer) RunQuic(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	port := server.config.QuicPort
+	bind_addr := server.config.QuicBindAddress
+
+	certificateLoader, err := tls_certificate_loader.NewTlsCertificateLoader(tls_certificate_loader.TlsCertificateLoaderConfig{
+		CertificatePath:   server.config.TlsCertificateFile,
+		KeyPath:           server.config.TlsPrivateKeyFile,
+		CheckReloadPeriod: time.Duration(server.config.TlsCheckReloadSeconds) * time.Second,
+		OnReload: func() {
+			server.logger.Info("[CertificateLoader] Reloaded SSL certificates")
+		},
+		OnError: func(err error) {
+			server.logger.Errorf("Error loading SSL key pair: %v", err)
+		},
+	})
+
+	if err != nil {
+		server.logger.Errorf("Error starting QUIC server: %v", err)
+		return
+	}
+
+	defer certificateLoader.Close()
+
+	listener, err := quic.ListenAddr(bind_addr+":"+strconv.Itoa(port), &tls.Config{
+		GetCertificate: certificateLoader.GetCertificate,
+		NextProtos:     []string{QUIC_ALPN_PROTOCOL},
+	}, getQuicConfig())
+
+	if err != nil {
+		server.logger.Errorf("Error starting QUIC server: %v", err)
+		return
+	}
+
+	server.logger.Infof("[QUIC] Listening on %v:%v", bind_addr, port)
+
+	server.ServeQuic(listener)
+}
+
+// Accepts QUIC connections from a listener, until it is closed
+func (server *HttpServer) ServeQuic(listener *quic.Listener) {
+	for {
+		conn, err := listener.Accept(context.Background())
+
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return
+			}
+
+			server.logger.Errorf("Error accepting QUIC connection: %v", err)
+			continue
+		}
+
+		go server.handleQuicConnection(conn)
+	}
+}
+
+// Handles a QUIC connection
+func (server *HttpServer) handleQuicConnection(conn quic.Connection) {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if err != nil {
+		server.logger.Errorf("Error parsing connection IP: %v", err)
+		_ = conn.CloseWithError(0, "")
+		return
+	}
+
+	if !server.rateLimiter.CountRequest(ip) || !server.rateLimiter.StartConnection(ip) {
+		server.logger.Debugf("QUIC connection rejected from %v due to rate limit", ip)
+		_ = conn.CloseWithError(0, "rate limit")
+		return
+	}
+
+	if server.config.LogRequests {
+		server.logger.Infof("[QUIC] [FROM: %v] New connection", ip)
+	}
+
+	ctx, cancel := context.WithTimeout(conn.Context(), QUIC_CONTROL_STREAM_TIMEOUT)
+	defer cancel()
+
+	controlStream, err := conn.AcceptStream(ctx)
+
+	if err != nil {
+		server.logger.Debugf("Could not accept QUIC control stream: %v", err)
+		_ = conn.CloseWithError(0, "")
+		server.rateLimiter.EndConnection(ip)
+		return
+	}
+
+	ch := CreateConnectionHandler(NewQuicConnectionTransport(conn, controlStream), ip, server)
+	go ch.Run()
+}
+
+// Reads a frame
+// limit - Max size of the frame data
+// Returns the data, and true if binary
+func readQuicFrame(reader io.Reader, limit int64) ([]byte, bool, error) {
+	header := make([]byte, QUIC_FRAME_HEADER_SIZE)
+
+	_, err := io.ReadFull(reader, header)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	frameType := header[0]
+	length := binary.BigEndian.Uint32(header[1:])
+
+	if frameType != QUIC_FRAME_TEXT && frameType != QUIC_FRAME_BINARY {
+		return nil, false, ErrQuicInvalidFrame
+	}
+
+	if int64(length) > limit {
+		return nil, false, ErrQuicMessageTooLarge
+	}
+
+	data := make([]byte, length)
+
+	_, err = io.ReadFull(reader, data)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return data, frameType == QUIC_FRAME_BINARY, nil
+}
+
+// Encodes the header of a frame
+func encodeQuicFrameHeader(frameType byte, length int) []byte {
+	header := make([]byte, QUIC_FRAME_HEADER_SIZE)
+
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], uint32(length))
+
+	return header
+}
+
+// Encodes a frame
+func encodeQuicFrame(frameType byte, data []byte) []byte {
+	return append(encodeQuicFrameHeader(frameType, len(data)), data...)
+}
+
+// Transport of the protocol messages using a QUIC connection
+// The messages are sent as frames in a bidirectional control stream, opened by the client.
+// The server sends each message with binary data (fragments) in its own unidirectional stream,
+// so a lost packet only delays that fragment.
+type QuicConnectionTransport struct {
+	// Connection
+	conn quic.Connection
+
+	// Control stream
+	controlStream quic.Stream
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// True if closed
+	closed bool
+}
+
+// Creates new instance of QuicConnectionTransport
+func NewQuicConnectionTransport(conn quic.Connection, controlStream quic.Stream) *QuicConnectionTransport {
+	return &QuicConnectionTransport{
+		conn:          conn,
+		controlStream: controlStream,
+		mu:            &sync.Mutex{},
+		closed:        false,
+	}
+}
+
+// Sets the deadline to read the next message
+func (transport *QuicConnectionTransport) SetReadDeadline(deadline time.Time) error {
+	return transport.controlStream.SetReadDeadline(deadline)
+}
+
+// Reads a message from the control stream
+func (transport *QuicConnectionTransport) ReadMessage(limit int64) ([]byte, bool, error) {
+	return readQuicFrame(transport.controlStream, limit)
+}
+
+// Writes a text message to the control stream
+func (transport *QuicConnectionTransport) WriteTextMessage(msg string) error {
+	_, err := transport.controlStream.Write(encodeQuicFrame(QUIC_FRAME_TEXT, []byte(msg)))
+	return err
+}
+
+// Writes a text message with binary data, in a new unidirectional stream
+func (transport *QuicConnectionTransport) WriteMessageWithBinary(msg string, binaryData []byte) error {
+	return transport.writeUniStream(encodeQuicFrame(QUIC_FRAME_TEXT, []byte(msg)), encodeQuicFrameHeader(QUIC_FRAME_BINARY, len(binaryData)), binaryData)
+}
+
+// Writes a binary message, made of the concatenation of the parts, in a new unidirectional stream
+func (transport *QuicConnectionTransport) WriteBinaryMessage(parts ...[]byte) error {
+	length := 0
+
+	for _, part := range parts {
+		length += len(part)
+	}
+
+	return transport.writeUniStream(append([][]byte{encodeQuicFrameHeader(QUIC_FRAME_BINARY, length)}, parts...)...)
+}
+
+// Opens a new unidirectional stream, writes the buffers and closes it
+func (transport *QuicConnectionTransport) writeUniStream(frames ...[]byte) error {
+	ctx, cancel := context.WithTimeout(transport.conn.Context(), QUIC_OPEN_STREAM_TIMEOUT)
+	defer cancel()
+
+	stream, err := transport.conn.OpenUniStreamSync(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	for _, frame := range frames {
+		_, err = stream.Write(frame)
+
+		if err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		stream.CancelWrite(0)
+		return err
+	}
+
+	return stream.Close()
+}
+
+// Closes the connection
+// The control stream is closed, and the client is expected to close the connection,
+// so the pending data of the fragment streams is delivered.
+func (transport *QuicConnectionTransport) Close() error {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+
+	if transport.closed {
+		return nil
+	}
+
+	transport.closed = true
+
+	err := transport.controlStream.Close()
+
+	go func() {
+		select {
+		case <-transport.conn.Context().Done():
+		case <-time.After(QUIC_CLOSE_TIMEOUT):
+		}
+
+		_ = transport.conn.CloseWithError(0, "")
+	}()
+
+	return err
+}
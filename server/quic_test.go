@@ -0,0 +1,294 @@
+// Tests for the QUIC server
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+)
+
+// Makes a self-signed TLS certificate for testing
+func makeTestTlsCertificate(t *testing.T) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{certificate},
+		PrivateKey:  key,
+	}
+}
+
+// Test QUIC client
+type TestQuicClient struct {
+	// Connection
+	conn quic.Connection
+
+	// Control stream
+	controlStream quic.Stream
+}
+
+// Sends a message to the control stream
+func (client *TestQuicClient) send(msg *WebsocketProtocolMessage) {
+	_, _ = client.controlStream.Write(encodeQuicFrame(QUIC_FRAME_TEXT, []byte(msg.Serialize())))
+}
+
+// Sends binary data to the control stream
+func (client *TestQuicClient) sendBinary(data []byte) {
+	_, _ = client.controlStream.Write(encodeQuicFrame(QUIC_FRAME_BINARY, data))
+}
+
+// Reads the next message from the control stream, ignoring heartbeat messages
+func (client *TestQuicClient) readMessage(t *testing.T) *WebsocketProtocolMessage {
+	for {
+		_ = client.controlStream.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		data, binary, err := readQuicFrame(client.controlStream, TEXT_MSG_READ_LIMIT)
+
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+
+		if binary {
+			t.Errorf("Unexpected binary frame in the control stream")
+			return nil
+		}
+
+		msg := ParseWebsocketProtocolMessage(string(data))
+
+		if msg.MessageType == "H" {
+			continue
+		}
+
+		return msg
+	}
+}
+
+// Reads the next fragment stream
+// Returns the message and the binary data
+func (client *TestQuicClient) readFragmentStream(t *testing.T) (*WebsocketProtocolMessage, []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.conn.AcceptUniStream(ctx)
+
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+
+	msgData, binary, err := readQuicFrame(stream, TEXT_MSG_READ_LIMIT)
+
+	if err != nil || binary {
+		t.Errorf("Expected text frame in the fragment stream: %v", err)
+		return nil, nil
+	}
+
+	data, binary, err := readQuicFrame(stream, DEFAULT_MAX_BINARY_MSG_SIZE)
+
+	if err != nil || !binary {
+		t.Errorf("Expected binary frame in the fragment stream: %v", err)
+		return nil, nil
+	}
+
+	return ParseWebsocketProtocolMessage(string(msgData)), data
+}
+
+// Connects a test QUIC client and sends an action message (PUSH or PULL)
+// Waits for the OK message
+func connectTestQuicClient(address string, action string, streamId string, t *testing.T) *TestQuicClient {
+	conn, err := quic.DialAddr(context.Background(), address, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{QUIC_ALPN_PROTOCOL},
+	}, nil)
+
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	controlStream, err := conn.OpenStreamSync(context.Background())
+
+	if err != nil {
+		t.Error(err)
+		_ = conn.CloseWithError(0, "")
+		return nil
+	}
+
+	client := &TestQuicClient{
+		conn:          conn,
+		controlStream: controlStream,
+	}
+
+	authToken, err := signAuthToken(TEST_JWT_SECRET, action, streamId)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	client.send(&WebsocketProtocolMessage{
+		MessageType: action,
+		Parameters: map[string]string{
+			"stream": streamId,
+			"auth":   authToken,
+		},
+	})
+
+	okMessage := client.readMessage(t)
+
+	if okMessage == nil || okMessage.MessageType != "OK" {
+		t.Errorf("[%v] Expected OK message, but received: %v", action, okMessage)
+		_ = conn.CloseWithError(0, "")
+		return nil
+	}
+
+	return client
+}
+
+func TestQuicPullAndPush(t *testing.T) {
+	logger := testMain()
+
+	server := makeTestServer(logger.CreateChildLogger("[Server] "), nil, true, "")
+	defer server.Close()
+
+	certificate := makeTestTlsCertificate(t)
+
+	if certificate == nil {
+		return
+	}
+
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{*certificate},
+		NextProtos:   []string{QUIC_ALPN_PROTOCOL},
+	}, getQuicConfig())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer listener.Close()
+
+	go server.server.ServeQuic(listener)
+
+	fragmentMessage := WebsocketProtocolMessage{
+		MessageType: "F",
+		Parameters: map[string]string{
+			"duration": "1",
+		},
+	}
+
+	closeMessage := WebsocketProtocolMessage{
+		MessageType: "CLOSE",
+	}
+
+	// Pull with QUIC, from a websocket publisher
+
+	publisher := connectTestClient(server.url, "PUSH", TEST_STREAM_ID_1, nil, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	spectator := connectTestQuicClient(listener.Addr().String(), "PULL", TEST_STREAM_ID_1, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.conn.CloseWithError(0, "")
+
+	for _, frag := range TEST_STREAM_DATA_1 {
+		_ = publisher.WriteMessage(websocket.TextMessage, []byte(fragmentMessage.Serialize()))
+		_ = publisher.WriteMessage(websocket.BinaryMessage, frag.Data)
+	}
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte(closeMessage.Serialize()))
+
+	for i, frag := range TEST_STREAM_DATA_1 {
+		msg, data := spectator.readFragmentStream(t)
+
+		if msg == nil || msg.MessageType != "F" || msg.GetParameter("seq") != fmt.Sprint(i+1) {
+			t.Errorf("Expected F message, but received: %v", msg)
+			return
+		}
+
+		if !bytes.Equal(data, frag.Data) {
+			t.Errorf("Fragment data does not match. Expected: %v, Actual: %v", frag.Data, data)
+		}
+	}
+
+	msg := spectator.readMessage(t)
+
+	if msg == nil || msg.MessageType != "CLOSE" {
+		t.Errorf("Expected CLOSE message, but received: %v", msg)
+	}
+
+	// Push with QUIC, to a websocket spectator
+
+	quicPublisher := connectTestQuicClient(listener.Addr().String(), "PUSH", TEST_STREAM_ID_2, t)
+
+	if quicPublisher == nil {
+		return
+	}
+
+	defer quicPublisher.conn.CloseWithError(0, "")
+
+	wsSpectator := connectTestClient(server.url, "PULL", TEST_STREAM_ID_2, nil, t)
+
+	if wsSpectator == nil {
+		return
+	}
+
+	defer wsSpectator.Close()
+
+	for _, frag := range TEST_STREAM_DATA_2 {
+		quicPublisher.send(&fragmentMessage)
+		quicPublisher.sendBinary(frag.Data)
+	}
+
+	quicPublisher.send(&closeMessage)
+
+	for i, frag := range TEST_STREAM_DATA_2 {
+		expectTestFragmentWithSequence(wsSpectator, int64(i+1), frag.Data, t)
+	}
+
+	wsMsg, _ := readTestMessage(wsSpectator, t)
+
+	if wsMsg == nil || wsMsg.MessageType != "CLOSE" {
+		t.Errorf("Expected CLOSE message, but received: %v", wsMsg)
+	}
+}
@@ -0,0 +1,372 @@
+// Stream recorder (VOD)
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+)
+
+// Max number of fragments waiting to be written by a recorder
+// If the limit is reached, fragments are discarded
+const RECORDER_QUEUE_SIZE = 64
+
+// Max size (bytes) of the fragments waiting to be written by a recorder
+// If the limit is reached, fragments are discarded
+const RECORDER_MAX_PENDING_SIZE = 64 * 1024 * 1024
+
+// Max number of retries to write a file of a recording
+const RECORDER_WRITE_MAX_RETRIES = 3
+
+// Delay before retrying to write a file of a recording (multiplied by the retry number)
+const RECORDER_WRITE_RETRY_DELAY = 200 * time.Millisecond
+
+// Name of the playlist file of a recording
+const RECORDING_PLAYLIST_FILE = "index.m3u8"
+
+// Name of the file pointing to the latest recording of a stream
+// It is stored in the directory of the stream, and contains the path of the recording
+const RECORDING_LATEST_FILE = "latest"
+
+// Configuration for the recordings
+type RecordingConfig struct {
+	// True if recording is allowed
+	Enabled bool
+
+	// True to allow playing the recordings (VOD) when the live stream is not available
+	VodEnabled bool
+
+	// Min interval (seconds) between writes of the playlist while recording
+	// The playlist is always written after the first segment and when the recording ends.
+	// 0 to only write it in those cases.
+	PlaylistCheckpointSeconds int
+}
+
+// Recording controller
+type RecordingController struct {
+	// Configuration
+	config RecordingConfig
+
+	// Storage for the recordings
+	storage RecordingStorage
+
+	// Logger
+	logger *glog.Logger
+}
+
+// Creates new instance of RecordingController
+func NewRecordingController(config RecordingConfig, storage RecordingStorage, logger *glog.Logger) *RecordingController {
+	return &RecordingController{
+		config:  config,
+		storage: storage,
+		logger:  logger,
+	}
+}
+
+// Checks if recording is enabled
+func (rc *RecordingController) IsEnabled() bool {
+	return rc.config.Enabled
+}
+
+// Checks if VOD playback is enabled
+func (rc *RecordingController) IsVodEnabled() bool {
+	return rc.config.VodEnabled && rc.storage != nil
+}
+
+// Gets a safe directory name for a stream ID
+func getRecordingStreamDirectoryName(streamId string) string {
+	safeName := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+
+		return '_'
+	}, streamId)
+
+	streamHash := sha256.Sum256([]byte(streamId))
+
+	return safeName + "-" + hex.EncodeToString(streamHash[:4])
+}
+
+// Creates a recorder for a source
+// Returns nil if recording is disabled
+func (rc *RecordingController) CreateRecorder(sourceId uint64, streamId string) *HlsRecorder {
+	if !rc.config.Enabled || rc.storage == nil {
+		return nil
+	}
+
+	streamDirectory := getRecordingStreamDirectoryName(streamId)
+	path := streamDirectory + "/" + time.Now().UTC().Format("20060102-150405") + "-" + fmt.Sprint(sourceId)
+
+	recorder := &HlsRecorder{
+		logger:          rc.logger.CreateChildLogger("[" + streamId + "] "),
+		mu:              &sync.Mutex{},
+		storage:         rc.storage,
+		streamDirectory: streamDirectory,
+		path:            path,
+		queue:           make(chan *HlsRecorderQueueEntry, RECORDER_QUEUE_SIZE),
+		checkpoint:      time.Duration(rc.config.PlaylistCheckpointSeconds) * time.Second,
+		closed:          false,
+		done:            make(chan bool),
+		segments:        make([]*HlsRecordedSegment, 0),
+	}
+
+	go recorder.run()
+
+	return recorder
+}
+
+// Segment of a recording
+type HlsRecordedSegment struct {
+	// File name
+	FileName string
+
+	// Duration (seconds)
+	Duration float32
+
+	// True if there is a discontinuity before the segment
+	Discontinuity bool
+}
+
+// Entry of the writing queue of a recorder
+type HlsRecorderQueueEntry struct {
+	// Fragment to write
+	Fragment *HlsFragment
+
+	// True if fragments were discarded before this one
+	Discontinuity bool
+}
+
+// Stream recorder
+// Writes the fragments of a source to a directory, along with a playlist
+type HlsRecorder struct {
+	// Logger
+	logger *glog.Logger
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Storage
+	storage RecordingStorage
+
+	// Path of the directory of the stream in the storage
+	streamDirectory string
+
+	// Path of the recording in the storage
+	path string
+
+	// Queue of fragments to write
+	queue chan *HlsRecorderQueueEntry
+
+	// Size of the fragments in the queue
+	pendingSize int64
+
+	// Min interval between writes of the playlist while recording
+	checkpoint time.Duration
+
+	// True if closed
+	closed bool
+
+	// True if fragments were discarded since the last queued one
+	discarded bool
+
+	// Channel closed when the recorder finishes writing
+	done chan bool
+
+	// Written segments (only accessed by the writing thread)
+	segments []*HlsRecordedSegment
+}
+
+// Gets the location of the recording
+func (recorder *HlsRecorder) GetLocation() string {
+	return recorder.storage.GetLocation(recorder.path)
+}
+
+// Adds a fragment to the recording
+// Never blocks. If the writing thread cannot keep up, the fragment is discarded.
+func (recorder *HlsRecorder) AddFragment(frag *HlsFragment) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	if recorder.closed {
+		return
+	}
+
+	size := int64(len(frag.Data))
+
+	if recorder.pendingSize+size > RECORDER_MAX_PENDING_SIZE {
+		recorder.discarded = true
+		recorder.logger.Warning("Fragment discarded from the recording: Too many pending bytes")
+		return
+	}
+
+	entry := &HlsRecorderQueueEntry{
+		Fragment:      frag,
+		Discontinuity: recorder.discarded,
+	}
+
+	select {
+	case recorder.queue <- entry:
+		recorder.pendingSize += size
+		recorder.discarded = false
+	default:
+		recorder.discarded = true
+		recorder.logger.Warning("Fragment discarded from the recording: The writing queue is full")
+	}
+}
+
+// Called when a fragment is taken from the queue
+func (recorder *HlsRecorder) onFragmentTaken(frag *HlsFragment) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	recorder.pendingSize -= int64(len(frag.Data))
+}
+
+// Writes a file to the storage, retrying on failure
+// The path is relative to the root of the storage
+func (recorder *HlsRecorder) writeFile(path string, data []byte) error {
+	var err error
+
+	for i := 0; i <= RECORDER_WRITE_MAX_RETRIES; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * RECORDER_WRITE_RETRY_DELAY)
+		}
+
+		err = recorder.storage.WriteFile(path, data)
+
+		if err == nil {
+			return nil
+		}
+
+		recorder.logger.Warningf("Could not write %v (attempt %v): %v", path, i+1, err)
+	}
+
+	return err
+}
+
+// Closes the recorder
+// The pending fragments are written, and the playlist is ended
+func (recorder *HlsRecorder) Close() {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	if recorder.closed {
+		return
+	}
+
+	recorder.closed = true
+
+	close(recorder.queue)
+}
+
+// Waits for the recorder to finish writing (after closing it)
+func (recorder *HlsRecorder) Wait() {
+	<-recorder.done
+}
+
+// Writing thread
+func (recorder *HlsRecorder) run() {
+	defer close(recorder.done)
+
+	discontinuity := false
+
+	var lastPlaylistWrite time.Time
+
+	for entry := range recorder.queue {
+		frag := entry.Fragment
+
+		recorder.onFragmentTaken(frag)
+
+		if entry.Discontinuity {
+			discontinuity = true
+		}
+
+		fileName := fmt.Sprint(frag.Sequence) + ".ts"
+
+		err := recorder.writeFile(recorder.path+"/"+fileName, frag.Data)
+
+		if err != nil {
+			recorder.logger.Errorf("Could not write fragment to the recording: %v", err)
+			discontinuity = true
+			continue
+		}
+
+		recorder.segments = append(recorder.segments, &HlsRecordedSegment{
+			FileName:      fileName,
+			Duration:      frag.Duration,
+			Discontinuity: discontinuity && len(recorder.segments) > 0,
+		})
+
+		discontinuity = false
+
+		// Rewriting the playlist after every segment is too expensive for object storages,
+		// so it is only written periodically, to keep the recording playable after a crash
+
+		if len(recorder.segments) == 1 || (recorder.checkpoint > 0 && time.Since(lastPlaylistWrite) >= recorder.checkpoint) {
+			recorder.writePlaylist(false)
+			lastPlaylistWrite = time.Now()
+		}
+
+		if len(recorder.segments) == 1 {
+			// First segment, the recording can now be played
+			err = recorder.writeFile(recorder.streamDirectory+"/"+RECORDING_LATEST_FILE, []byte(recorder.path))
+
+			if err != nil {
+				recorder.logger.Errorf("Could not update the latest recording of the stream: %v", err)
+			}
+		}
+	}
+
+	recorder.writePlaylist(true)
+
+	recorder.logger.Infof("Recording finished: %v", recorder.GetLocation())
+}
+
+// Writes the playlist
+// ended - True to end the playlist (#EXT-X-ENDLIST)
+func (recorder *HlsRecorder) writePlaylist(ended bool) {
+	targetDuration := 1
+
+	for _, segment := range recorder.segments {
+		d := int(math.Ceil(float64(segment.Duration)))
+
+		if d > targetDuration {
+			targetDuration = d
+		}
+	}
+
+	playlist := strings.Builder{}
+
+	playlist.WriteString("#EXTM3U\n")
+	playlist.WriteString("#EXT-X-VERSION:3\n")
+	playlist.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	playlist.WriteString("#EXT-X-TARGETDURATION:" + fmt.Sprint(targetDuration) + "\n")
+	playlist.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+
+	for _, segment := range recorder.segments {
+		if segment.Discontinuity {
+			playlist.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+
+		playlist.WriteString("#EXTINF:" + fmt.Sprintf("%.6f", segment.Duration) + ",\n")
+		playlist.WriteString(segment.FileName + "\n")
+	}
+
+	if ended {
+		playlist.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	err := recorder.writeFile(recorder.path+"/"+RECORDING_PLAYLIST_FILE, []byte(playlist.String()))
+
+	if err != nil {
+		recorder.logger.Errorf("Could not write recording playlist: %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+// Tests for the stream recorder
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHlsRecorder(t *testing.T) {
+	logger := testMain()
+
+	directory, err := os.MkdirTemp("", "hls-websocket-cdn-recordings-")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer os.RemoveAll(directory)
+
+	storage := NewLocalRecordingStorage(directory)
+
+	controller := NewRecordingController(RecordingConfig{
+		Enabled: true,
+	}, storage, logger.CreateChildLogger("[Recordings] "))
+
+	recorder := controller.CreateRecorder(0, "room/../stream")
+
+	if recorder == nil {
+		t.Errorf("Could not create recorder")
+		return
+	}
+
+	if !strings.HasPrefix(storage.GetLocation(recorder.path), directory) || strings.Contains(storage.GetLocation(recorder.path), "..") {
+		t.Errorf("Unsafe recording directory: %v", storage.GetLocation(recorder.path))
+	}
+
+	for i, frag := range TEST_STREAM_DATA_1 {
+		recorder.AddFragment(&HlsFragment{
+			Sequence: int64(i + 1),
+			Duration: frag.Duration,
+			Data:     frag.Data,
+		})
+	}
+
+	recorder.Close()
+	recorder.Wait()
+
+	// Adding fragments after closing is ignored
+	recorder.AddFragment(&TEST_STREAM_DATA_1[0])
+
+	for i, frag := range TEST_STREAM_DATA_1 {
+		data, err := os.ReadFile(filepath.Join(storage.GetLocation(recorder.path), []string{"1.ts", "2.ts", "3.ts"}[i]))
+
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if !bytes.Equal(data, frag.Data) {
+			t.Errorf("Fragment data does not match. Expected: %v, Actual: %v", frag.Data, data)
+		}
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(storage.GetLocation(recorder.path), RECORDING_PLAYLIST_FILE))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expectedPlaylist := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-PLAYLIST-TYPE:EVENT\n" +
+		"#EXT-X-TARGETDURATION:3\n" +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXTINF:1.000000,\n" +
+		"1.ts\n" +
+		"#EXTINF:2.500000,\n" +
+		"2.ts\n" +
+		"#EXTINF:2.000000,\n" +
+		"3.ts\n" +
+		"#EXT-X-ENDLIST\n"
+
+	if string(playlist) != expectedPlaylist {
+		t.Errorf("Playlist does not match. Expected:\n%v\nActual:\n%v", expectedPlaylist, string(playlist))
+	}
+}
+
+// Waits for a recording playlist to be ended, returning its content
+func waitTestRecordingEnded(directory string, t *testing.T) string {
+	for i := 0; i < 50; i++ {
+		playlists, _ := filepath.Glob(filepath.Join(directory, "*", RECORDING_PLAYLIST_FILE))
+
+		if len(playlists) > 0 {
+			playlist, _ := os.ReadFile(playlists[0])
+
+			if strings.Contains(string(playlist), "#EXT-X-ENDLIST") {
+				return string(playlist)
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Errorf("The recording was not ended")
+
+	return ""
+}
+
+func TestStreamRecording(t *testing.T) {
+	logger := testMain()
+
+	server := makeTestServerWithOptions(logger.CreateChildLogger("[Server] "), nil, true, "", TestServerOptions{Recording: true, AdminApi: true})
+	defer server.Close()
+
+	recordingsDirectory := filepath.Join(server.dataDirectory, "recordings")
+
+	// Recording requested by the publisher
+
+	publisher := connectTestClient(server.url, "PUSH", TEST_STREAM_ID_1, map[string]string{
+		"record": "true",
+	}, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	fragmentMessage := WebsocketProtocolMessage{
+		MessageType: "F",
+		Parameters: map[string]string{
+			"duration": "1",
+		},
+	}
+
+	closeMessage := WebsocketProtocolMessage{
+		MessageType: "CLOSE",
+	}
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte(fragmentMessage.Serialize()))
+	_ = publisher.WriteMessage(websocket.BinaryMessage, TEST_STREAM_DATA_1[0].Data)
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte(closeMessage.Serialize()))
+
+	playlist := waitTestRecordingEnded(filepath.Join(recordingsDirectory, getRecordingStreamDirectoryName(TEST_STREAM_ID_1)), t)
+
+	if !strings.Contains(playlist, "1.ts") {
+		t.Errorf("Expected the playlist to contain the fragment: %v", playlist)
+	}
+
+	// Recording started and stopped by the admin API
+
+	publisher2 := connectTestClient(server.url, "PUSH", TEST_STREAM_ID_2, nil, t)
+
+	if publisher2 == nil {
+		return
+	}
+
+	defer publisher2.Close()
+
+	status := sendTestAdminApiRequest(server, "DELETE", "record?stream="+TEST_STREAM_ID_2, "", t)
+
+	if status != 409 {
+		t.Errorf("Expected status 409 for a stream not being recorded, but received %v", status)
+	}
+
+	status = sendTestAdminApiRequest(server, "POST", "record?stream="+TEST_STREAM_ID_2, "", t)
+
+	if status != 200 {
+		t.Errorf("Admin API returned status %v", status)
+	}
+
+	_ = publisher2.WriteMessage(websocket.TextMessage, []byte(fragmentMessage.Serialize()))
+	_ = publisher2.WriteMessage(websocket.BinaryMessage, TEST_STREAM_DATA_2[0].Data)
+
+	// Sync with a spectator, to make sure the fragment was added
+
+	spectator := connectTestClient(server.url, "PULL", TEST_STREAM_ID_2, nil, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	_, _ = readTestMessage(spectator, t)
+	_, _ = readTestMessage(spectator, t)
+
+	status = sendTestAdminApiRequest(server, "DELETE", "record?stream="+TEST_STREAM_ID_2, "", t)
+
+	if status != 200 {
+		t.Errorf("Admin API returned status %v", status)
+	}
+
+	playlist = waitTestRecordingEnded(filepath.Join(recordingsDirectory, getRecordingStreamDirectoryName(TEST_STREAM_ID_2)), t)
+
+	if !strings.Contains(playlist, "1.ts") {
+		t.Errorf("Expected the playlist to contain the fragment: %v", playlist)
+	}
+}
+
+// Recording storage counting the writes of each file, for testing
+type CountingRecordingStorage struct {
+	RecordingStorage
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Number of writes (path -> count)
+	writes map[string]int
+}
+
+func (storage *CountingRecordingStorage) WriteFile(path string, data []byte) error {
+	storage.mu.Lock()
+	storage.writes[path]++
+	storage.mu.Unlock()
+
+	return storage.RecordingStorage.WriteFile(path, data)
+}
+
+func TestHlsRecorderPlaylistCheckpoint(t *testing.T) {
+	logger := testMain()
+
+	directory, err := os.MkdirTemp("", "hls-websocket-cdn-recordings-")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer os.RemoveAll(directory)
+
+	storage := &CountingRecordingStorage{
+		RecordingStorage: NewLocalRecordingStorage(directory),
+		mu:               &sync.Mutex{},
+		writes:           make(map[string]int),
+	}
+
+	controller := NewRecordingController(RecordingConfig{
+		Enabled:                   true,
+		PlaylistCheckpointSeconds: 3600,
+	}, storage, logger.CreateChildLogger("[Recordings] "))
+
+	recorder := controller.CreateRecorder(0, TEST_STREAM_ID_1)
+
+	if recorder == nil {
+		t.Errorf("Could not create recorder")
+		return
+	}
+
+	for i := 1; i <= 10; i++ {
+		recorder.AddFragment(&HlsFragment{
+			Sequence: int64(i),
+			Duration: 1,
+			Data:     TEST_STREAM_DATA_1[0].Data,
+		})
+	}
+
+	recorder.Close()
+	recorder.Wait()
+
+	// The playlist is only written after the first segment and at the end
+
+	playlistWrites := storage.writes[recorder.path+"/"+RECORDING_PLAYLIST_FILE]
+
+	if playlistWrites != 2 {
+		t.Errorf("Expected the playlist to be written 2 times, but it was written %v times", playlistWrites)
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(storage.GetLocation(recorder.path), RECORDING_PLAYLIST_FILE))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.HasSuffix(string(playlist), "10.ts\n#EXT-X-ENDLIST\n") {
+		t.Errorf("Unexpected playlist: %v", string(playlist))
+	}
+}
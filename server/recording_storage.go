@@ -0,0 +1,16 @@
+// Recording storage
+
+package main
+
+type RecordingStorage interface {
+	// Writes a file, replacing it if it already exists
+	// The path is relative to the root of the storage, using slashes as separators
+	WriteFile(path string, data []byte) error
+
+	// Reads a file
+	// The path is relative to the root of the storage, using slashes as separators
+	ReadFile(path string) ([]byte, error)
+
+	// Gets a human readable location for a path (to be displayed in logs or API responses)
+	GetLocation(path string) string
+}
@@ -0,0 +1,53 @@
+// Recording storage in the local filesystem
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Recording storage in the local filesystem
+type LocalRecordingStorage struct {
+	// Root directory
+	directory string
+}
+
+// Creates new instance of LocalRecordingStorage
+func NewLocalRecordingStorage(directory string) *LocalRecordingStorage {
+	return &LocalRecordingStorage{
+		directory: directory,
+	}
+}
+
+// Writes a file, replacing it if it already exists
+// The file is written to a temporary file and renamed, so readers never see partial files
+func (storage *LocalRecordingStorage) WriteFile(path string, data []byte) error {
+	filePath := filepath.Join(storage.directory, filepath.FromSlash(path))
+
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filePath + ".tmp"
+
+	err = os.WriteFile(tmpPath, data, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filePath)
+}
+
+// Reads a file
+func (storage *LocalRecordingStorage) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(storage.directory, filepath.FromSlash(path)))
+}
+
+// Gets the path in the filesystem
+func (storage *LocalRecordingStorage) GetLocation(path string) string {
+	return filepath.Join(storage.directory, filepath.FromSlash(path))
+}
@@ -0,0 +1,292 @@
+// Recording storage in a S3-compatible object storage
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Timeout for S3 requests
+const S3_REQUEST_TIMEOUT = 60 * time.Second
+
+// Max size (bytes) of a downloaded file (playlist or segment)
+const S3_MAX_DOWNLOAD_SIZE = 64 * 1024 * 1024
+
+// S3 recording storage configuration
+type S3RecordingStorageConfig struct {
+	// Endpoint URL (Example: https://s3.us-east-1.amazonaws.com)
+	Endpoint string
+
+	// Region
+	Region string
+
+	// Bucket name
+	Bucket string
+
+	// Access key ID
+	AccessKey string
+
+	// Secret access key
+	SecretKey string
+
+	// Prefix for the object keys
+	Prefix string
+
+	// True to use path-style URLs ({endpoint}/{bucket}/{key}), instead of virtual-hosted-style URLs ({bucket}.{endpoint}/{key})
+	UsePathStyle bool
+}
+
+// Recording storage in a S3-compatible object storage
+type S3RecordingStorage struct {
+	// Configuration
+	config S3RecordingStorageConfig
+
+	// Parsed endpoint URL
+	endpoint *url.URL
+
+	// HTTP client
+	client *http.Client
+}
+
+// Creates new instance of S3RecordingStorage
+func NewS3RecordingStorage(config S3RecordingStorageConfig) (*S3RecordingStorage, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint: %v", config.Endpoint)
+	}
+
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("the S3 bucket cannot be empty")
+	}
+
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	return &S3RecordingStorage{
+		config:   config,
+		endpoint: endpoint,
+		client: &http.Client{
+			Timeout: S3_REQUEST_TIMEOUT,
+		},
+	}, nil
+}
+
+// Gets the object key for a path
+func (storage *S3RecordingStorage) getObjectKey(path string) string {
+	if storage.config.Prefix == "" {
+		return path
+	}
+
+	return strings.TrimSuffix(storage.config.Prefix, "/") + "/" + path
+}
+
+// Gets the URL of an object
+func (storage *S3RecordingStorage) getObjectUrl(key string) *url.URL {
+	objectUrl := *storage.endpoint
+
+	if storage.config.UsePathStyle {
+		objectUrl.Path = strings.TrimSuffix(objectUrl.Path, "/") + "/" + storage.config.Bucket + "/" + key
+	} else {
+		objectUrl.Host = storage.config.Bucket + "." + objectUrl.Host
+		objectUrl.Path = strings.TrimSuffix(objectUrl.Path, "/") + "/" + key
+	}
+
+	objectUrl.RawPath = s3EncodePath(objectUrl.Path)
+
+	return &objectUrl
+}
+
+// Uploads a file, replacing it if it already exists
+func (storage *S3RecordingStorage) WriteFile(path string, data []byte) error {
+	objectUrl := storage.getObjectUrl(storage.getObjectKey(path))
+
+	req, err := http.NewRequest("PUT", objectUrl.String(), bytes.NewReader(data))
+
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(path, ".m3u8") {
+		req.Header.Set("Content-Type", "application/vnd.apple.mpegurl")
+	} else if strings.HasSuffix(path, ".ts") {
+		req.Header.Set("Content-Type", "video/MP2T")
+	}
+
+	signS3Request(req, data, storage.config.AccessKey, storage.config.SecretKey, storage.config.Region, time.Now())
+
+	res, err := storage.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("S3 upload failed with status %v: %v", res.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// Downloads a file
+func (storage *S3RecordingStorage) ReadFile(path string) ([]byte, error) {
+	objectUrl := storage.getObjectUrl(storage.getObjectKey(path))
+
+	req, err := http.NewRequest("GET", objectUrl.String(), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signS3Request(req, []byte{}, storage.config.AccessKey, storage.config.SecretKey, storage.config.Region, time.Now())
+
+	res, err := storage.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("S3 download failed with status %v: %v", res.StatusCode, string(body))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, S3_MAX_DOWNLOAD_SIZE+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > S3_MAX_DOWNLOAD_SIZE {
+		return nil, fmt.Errorf("S3 download exceeds the max size of %v bytes", S3_MAX_DOWNLOAD_SIZE)
+	}
+
+	return data, nil
+}
+
+// Gets the S3 URL of an object
+func (storage *S3RecordingStorage) GetLocation(path string) string {
+	return "s3://" + storage.config.Bucket + "/" + storage.getObjectKey(path)
+}
+
+// Encodes a path for S3 (RFC 3986, keeping the slashes)
+func s3EncodePath(path string) string {
+	segments := strings.Split(path, "/")
+
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.QueryEscape(segment), "+", "%20")
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// Computes HMAC-SHA256
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Computes hex encoded SHA256
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// Derives the AWS Signature Version 4 signing key
+func getS3SigningKey(secretKey string, date string, region string, service string) []byte {
+	kDate := hmacSha256([]byte("AWS4"+secretKey), date)
+	kRegion := hmacSha256(kDate, region)
+	kService := hmacSha256(kRegion, service)
+	return hmacSha256(kService, "aws4_request")
+}
+
+// Builds the AWS Signature Version 4 canonical request
+// Returns the canonical request and the list of signed headers
+func getS3CanonicalRequest(req *http.Request) (canonicalRequest string, signedHeaders string) {
+	// Canonical headers
+
+	headerNames := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	sort.Strings(headerNames)
+
+	canonicalHeaders := strings.Builder{}
+
+	for _, name := range headerNames {
+		value := req.Header.Get(name)
+
+		if name == "host" {
+			value = req.Host
+
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	signedHeaders = strings.Join(headerNames, ";")
+
+	canonicalRequest = req.Method + "\n" +
+		req.URL.EscapedPath() + "\n" +
+		req.URL.Query().Encode() + "\n" +
+		canonicalHeaders.String() + "\n" +
+		signedHeaders + "\n" +
+		req.Header.Get("X-Amz-Content-Sha256")
+
+	return canonicalRequest, signedHeaders
+}
+
+// Computes the AWS Signature Version 4 of a request
+// The request must have the headers x-amz-date and x-amz-content-sha256
+// Returns the signature, the list of signed headers and the credential scope
+func computeS3RequestSignature(req *http.Request, secretKey string, region string) (signature string, signedHeaders string, scope string) {
+	amzDate := req.Header.Get("X-Amz-Date")
+	date := amzDate
+
+	if len(date) > 8 {
+		date = date[:8]
+	}
+
+	canonicalRequest, signedHeaders := getS3CanonicalRequest(req)
+
+	// String to sign
+
+	scope = date + "/" + region + "/s3/aws4_request"
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signature = hex.EncodeToString(hmacSha256(getS3SigningKey(secretKey, date, region, "s3"), stringToSign))
+
+	return signature, signedHeaders, scope
+}
+
+// Signs a request with AWS Signature Version 4
+func signS3Request(req *http.Request, payload []byte, accessKey string, secretKey string, region string, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.UTC().Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", sha256Hex(payload))
+
+	signature, signedHeaders, scope := computeS3RequestSignature(req, secretKey, region)
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
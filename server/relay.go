@@ -44,6 +44,18 @@ type HlsRelay struct {
 	// Max length of the fragment buffer
 	fragmentBufferMaxLength int
 
+	// Latest stream metadata
+	metadata map[string]string
+
+	// Variants of the stream group
+	variants *HlsVariants
+
+	// Cues waiting for the next fragment
+	pendingCues *HlsPendingCues
+
+	// Assembler for fragments received in parts
+	fragmentAssembler *HlsFragmentAssembler
+
 	// True if closed
 	closed bool
 
@@ -56,9 +68,15 @@ type HlsRelay struct {
 	// Current fragment being received
 	currentFragment *HlsFragment
 
+	// Current fragment part being received
+	currentPart *HlsFragmentPart
+
 	// True if expected binary message
 	expectedBinary bool
 
+	// Protocol version negotiated with the server
+	protocolVersion int
+
 	// Inactivity warning
 	inactivityWarning bool
 
@@ -91,11 +109,16 @@ func NewHlsRelay(controller *RelayController, id uint64, url string, streamId st
 		listeners:                       make(map[uint64]*HlsSourceListener),
 		fragmentBuffer:                  make([]*HlsFragment, 0),
 		fragmentBufferMaxLength:         fragmentBufferMaxLength,
+		metadata:                        make(map[string]string),
+		pendingCues:                     &HlsPendingCues{},
+		fragmentAssembler:               NewHlsFragmentAssembler(controller.config.MaxBinaryMessageSize),
 		closed:                          false,
 		connected:                       false,
 		socket:                          nil,
 		currentFragment:                 nil,
+		currentPart:                     nil,
 		expectedBinary:                  false,
+		protocolVersion:                 PROTOCOL_VERSION_TEXT_HEADERS,
 		inactivityWarning:               false,
 		heartbeatInterruptChannel:       make(chan bool, 1),
 		inactivityCheckInterruptChannel: make(chan bool, 1),
@@ -139,14 +162,13 @@ func (relay *HlsRelay) SetReady() {
 
 // Adds a listener
 // id - Connection ID
+// receiveParts - True to receive fragment parts
 // Returns
 // - success: True if the listener was added. If the source is closed, it will be false
 // - channel: The channel to receive the events
-// - initialFragments: List of fragments to be sent as initial (they were in the buffer)
-func (relay *HlsRelay) AddListener(id uint64) (success bool, channel chan HlsEvent, initialFragments []*HlsFragment) {
-	lis := &HlsSourceListener{
-		Channel: make(chan HlsEvent, relay.fragmentBufferMaxLength),
-	}
+// - initialState: Initial state to send (buffered fragments, metadata, variants)
+func (relay *HlsRelay) AddListener(id uint64, receiveParts bool) (success bool, channel chan HlsEvent, initialState *HlsListenerInitialState) {
+	lis := NewHlsSourceListener(relay.fragmentBufferMaxLength, receiveParts)
 
 	relay.mu.Lock()
 	defer relay.mu.Unlock()
@@ -160,7 +182,11 @@ func (relay *HlsRelay) AddListener(id uint64) (success bool, channel chan HlsEve
 	initialFragmentsBuffer := make([]*HlsFragment, len(relay.fragmentBuffer))
 	copy(initialFragmentsBuffer, relay.fragmentBuffer)
 
-	return true, lis.Channel, initialFragmentsBuffer
+	return true, lis.Channel, &HlsListenerInitialState{
+		Fragments: initialFragmentsBuffer,
+		Metadata:  relay.metadata,
+		Variants:  relay.variants,
+	}
 }
 
 // Removes a listener
@@ -215,6 +241,147 @@ func (relay *HlsRelay) AddFragment(frag *HlsFragment) {
 		return
 	}
 
+	// A complete fragment discards any incomplete one
+	relay.fragmentAssembler.Reset()
+
+	// Attach pending cues
+	frag.Cues = append(frag.Cues, relay.pendingCues.Take()...)
+
+	relay.addFragmentInternal(frag)
+}
+
+// Sets the stream metadata, replacing the previous one
+// The metadata is sent to the listeners
+func (relay *HlsRelay) SetMetadata(metadata map[string]string) {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	if relay.closed {
+		return
+	}
+
+	if relay.logger.Config.DebugEnabled {
+		relay.logger.Debugf("Metadata updated: %v", metadata)
+	}
+
+	relay.metadata = metadata
+
+	// Send metadata to the listeners
+
+	metadataEvent := HlsEvent{
+		EventType: HLS_EVENT_TYPE_METADATA,
+		Metadata:  metadata,
+	}
+
+	for _, lis := range relay.listeners {
+		select {
+		case lis.Channel <- metadataEvent:
+		default:
+		}
+	}
+}
+
+// Sets the variants of the stream group (nil if the stream is not in a group)
+// The variants are sent to the listeners
+func (relay *HlsRelay) SetVariants(variants *HlsVariants) {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	if relay.closed {
+		return
+	}
+
+	relay.variants = variants
+
+	// Send variants to the listeners
+
+	variantsEvent := HlsEvent{
+		EventType: HLS_EVENT_TYPE_VARIANTS,
+		Variants:  variants,
+	}
+
+	for _, lis := range relay.listeners {
+		select {
+		case lis.Channel <- variantsEvent:
+		default:
+		}
+	}
+}
+
+// Adds a cue, to be delivered with the next fragment
+func (relay *HlsRelay) AddCue(cue *HlsCue) bool {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	if relay.closed {
+		return false
+	}
+
+	if !relay.pendingCues.Add(cue) {
+		relay.logger.Warning("Cue discarded: Too many pending cues")
+		return false
+	}
+
+	if relay.logger.Config.DebugEnabled {
+		relay.logger.Debugf("Cue added: %v", cue.Parameters)
+	}
+
+	return true
+}
+
+// Adds a fragment part
+// The part is sent to the listeners immediately
+// Once the last part is received, the complete fragment is added
+func (relay *HlsRelay) AddFragmentPart(part *HlsFragmentPart) {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	if relay.closed {
+		return
+	}
+
+	// Attach pending cues
+	part.Cues = append(part.Cues, relay.pendingCues.Take()...)
+
+	frag, err := relay.fragmentAssembler.AddPart(part)
+
+	if err != nil {
+		relay.pendingCues.Restore(part.Cues)
+		relay.logger.Warningf("Fragment part discarded: %v. Index: %v", err, part.Index)
+		return
+	}
+
+	if relay.logger.Config.TraceEnabled {
+		relay.logger.Tracef("Fragment part relayed. Index: %v, Duration: %v, Size: %v", part.Index, part.Duration, len(part.Data))
+	}
+
+	// Send part to the listeners
+
+	partEvent := HlsEvent{
+		EventType: HLS_EVENT_TYPE_PART,
+		Part:      part,
+	}
+
+	for _, lis := range relay.listeners {
+		if !lis.ReceiveParts {
+			continue
+		}
+
+		select {
+		case lis.Channel <- partEvent:
+		default:
+		}
+	}
+
+	// Add the complete fragment
+
+	if frag != nil {
+		relay.addFragmentInternal(frag)
+	}
+}
+
+// Adds fragment (internal, must be called with the mutex locked)
+func (relay *HlsRelay) addFragmentInternal(frag *HlsFragment) {
 	// Append the fragment to the buffer
 
 	newFragmentBuffer, canAdd := relay.controller.memoryLimiter.CheckBeforeAddingFragment(relay.fragmentBuffer, frag)
@@ -294,7 +461,7 @@ func (relay *HlsRelay) Run() {
 
 	relay.logger.Infof("Relay created. Url: %v | Stream: %v", relay.url, relay.streamId)
 
-	socket, _, err := websocket.DefaultDialer.Dial(relay.url, nil)
+	socket, _, err := relay.controller.dialer.Dial(relay.url, nil)
 
 	if err != nil {
 		relay.logger.Errorf("Could not connect to the server: %v", err)
@@ -321,6 +488,9 @@ func (relay *HlsRelay) Run() {
 		return
 	}
 
+	relay.controller.eventWebhooks.Notify(EVENT_RELAY_OPENED, relay.streamId, map[string]string{"url": relay.url})
+	defer relay.controller.eventWebhooks.Notify(EVENT_RELAY_CLOSED, relay.streamId, map[string]string{"url": relay.url})
+
 	// Send heartbeat messages periodically
 	go relay.sendHeartbeatMessages(socket)
 	go relay.periodicallyCheckInactivity()
@@ -371,8 +541,15 @@ func (relay *HlsRelay) SendErrorMessage(socket *websocket.Conn, errorCode string
 }
 
 // Reads text message
+// If the protocol version 2 was negotiated, binary fragment frames are also accepted
 func (relay *HlsRelay) ReadTextMessage(socket *websocket.Conn) bool {
-	socket.SetReadLimit(TEXT_MSG_READ_LIMIT)
+	acceptFrames := relay.protocolVersion >= PROTOCOL_VERSION_BINARY_FRAMES
+
+	if acceptFrames {
+		socket.SetReadLimit(relay.controller.config.MaxBinaryMessageSize + FRAGMENT_FRAME_HEADER_SIZE)
+	} else {
+		socket.SetReadLimit(TEXT_MSG_READ_LIMIT)
+	}
 
 	mt, message, err := socket.ReadMessage()
 
@@ -384,6 +561,10 @@ func (relay *HlsRelay) ReadTextMessage(socket *websocket.Conn) bool {
 	}
 
 	if mt != websocket.TextMessage {
+		if acceptFrames {
+			return relay.HandleFragmentFrame(socket, message)
+		}
+
 		relay.SendErrorMessage(socket, "PROTOCOL_ERROR", "Expected text message, but received a binary one")
 		return false
 	}
@@ -400,9 +581,17 @@ func (relay *HlsRelay) ReadTextMessage(socket *websocket.Conn) bool {
 		return false
 	case "OK":
 		relay.logger.Debug("OK received. Waiting for fragments...")
-		relay.SetReady()
+		relay.HandleOk(parsedMessage)
 	case "F":
 		return relay.HandleFragmentMetadata(socket, parsedMessage)
+	case "P":
+		return relay.HandleFragmentPartMetadata(socket, parsedMessage)
+	case "META":
+		return relay.HandleMetadata(parsedMessage)
+	case "CUE":
+		return relay.HandleCue(parsedMessage)
+	case "VARIANTS":
+		relay.SetVariants(ParseVariantsMessage(parsedMessage))
 	case "CLOSE":
 		return relay.HandleClose()
 	}
@@ -410,6 +599,18 @@ func (relay *HlsRelay) ReadTextMessage(socket *websocket.Conn) bool {
 	return true
 }
 
+// Handles the OK message
+// Servers not supporting the protocol version 2 do not include the protocol parameter
+func (relay *HlsRelay) HandleOk(msg *WebsocketProtocolMessage) {
+	protocolVersion, errMsg := parseProtocolVersion(msg)
+
+	if errMsg == "" {
+		relay.protocolVersion = protocolVersion
+	}
+
+	relay.SetReady()
+}
+
 // Handles fragment metadata message
 func (relay *HlsRelay) HandleFragmentMetadata(socket *websocket.Conn, msg *WebsocketProtocolMessage) bool {
 	durationStr := msg.GetParameter("duration")
@@ -431,7 +632,11 @@ func (relay *HlsRelay) HandleFragmentMetadata(socket *websocket.Conn, msg *Webso
 		return false
 	}
 
+	// Sequence number is optional (kept to be sent to the listeners)
+	sequence, _ := strconv.ParseInt(msg.GetParameter("seq"), 10, 64)
+
 	relay.currentFragment = &HlsFragment{
+		Sequence: sequence,
 		Duration: float32(duration),
 	}
 
@@ -440,6 +645,70 @@ func (relay *HlsRelay) HandleFragmentMetadata(socket *websocket.Conn, msg *Webso
 	return true
 }
 
+// Handles fragment part metadata message
+func (relay *HlsRelay) HandleFragmentPartMetadata(socket *websocket.Conn, msg *WebsocketProtocolMessage) bool {
+	part, errMsg := ParseFragmentPartMetadata(msg)
+
+	if part == nil {
+		relay.SendErrorMessage(socket, "FRAGMENT_METADATA_ERROR", errMsg)
+		return false
+	}
+
+	relay.currentPart = part
+
+	relay.expectedBinary = true
+
+	return true
+}
+
+// Handles a binary fragment frame (protocol version 2)
+func (relay *HlsRelay) HandleFragmentFrame(socket *websocket.Conn, frame []byte) bool {
+	if relay.logger.Config.TraceEnabled {
+		relay.logger.Trace("<<< [BINARY] " + fmt.Sprint(len(frame)) + " bytes")
+	}
+
+	frag, part, errMsg := ParseFragmentFrame(frame)
+
+	if errMsg != "" {
+		relay.SendErrorMessage(socket, "FRAGMENT_METADATA_ERROR", errMsg)
+		return false
+	}
+
+	if part != nil {
+		relay.AddFragmentPart(part)
+	} else {
+		relay.AddFragment(frag)
+	}
+
+	return true
+}
+
+// Handles stream metadata message
+func (relay *HlsRelay) HandleMetadata(msg *WebsocketProtocolMessage) bool {
+	metadata := msg.Parameters
+
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+
+	relay.SetMetadata(metadata)
+
+	return true
+}
+
+// Handles cue message
+func (relay *HlsRelay) HandleCue(msg *WebsocketProtocolMessage) bool {
+	if len(msg.Parameters) == 0 {
+		return true
+	}
+
+	relay.AddCue(&HlsCue{
+		Parameters: msg.Parameters,
+	})
+
+	return true
+}
+
 // Handles close message
 func (relay *HlsRelay) HandleClose() bool {
 	relay.Close()
@@ -448,7 +717,7 @@ func (relay *HlsRelay) HandleClose() bool {
 
 // Reads binary message
 func (relay *HlsRelay) ReadBinaryMessage(socket *websocket.Conn) bool {
-	if relay.currentFragment == nil {
+	if relay.currentFragment == nil && relay.currentPart == nil {
 		relay.SendErrorMessage(socket, "PROTOCOL_ERROR", "Unexpected binary message")
 		return false
 	}
@@ -478,12 +747,19 @@ func (relay *HlsRelay) ReadBinaryMessage(socket *websocket.Conn) bool {
 		relay.logger.Trace("<<< [BINARY] " + fmt.Sprint(len(message)) + " bytes")
 	}
 
-	relay.currentFragment.Data = message
+	if relay.currentPart != nil {
+		relay.currentPart.Data = message
+
+		relay.AddFragmentPart(relay.currentPart)
+	} else {
+		relay.currentFragment.Data = message
 
-	relay.AddFragment(relay.currentFragment)
+		relay.AddFragment(relay.currentFragment)
+	}
 
 	relay.expectedBinary = false
 	relay.currentFragment = nil
+	relay.currentPart = nil
 
 	return true
 }
@@ -500,8 +776,10 @@ func (relay *HlsRelay) SendPullMessage(socket *websocket.Conn) error {
 		MessageType: "PULL",
 		Parameters: map[string]string{
 			"stream":      relay.streamId,
-			"auth":        relay.controller.authController.CreatePullToken(relay.streamId),
+			"auth":        relay.controller.authController.CreateRelayToken(relay.streamId),
 			"only_source": onlySourceStr,
+			"parts":       "true",
+			"protocol":    fmt.Sprint(PROTOCOL_VERSION_MAX),
 		},
 	}
 
@@ -0,0 +1,121 @@
+// Tests for the authentication of the relays between nodes
+
+package main
+
+import (
+	"testing"
+
+	"github.com/AgustinSRG/glog"
+	"github.com/gorilla/websocket"
+)
+
+func TestRelayTokens(t *testing.T) {
+	streamId := "stream1"
+
+	logger := glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction)
+
+	authController := NewAuthController(AuthConfiguration{
+		PullSecret:  "pull-secret",
+		PushSecret:  "push-secret",
+		RelaySecret: "relay-secret",
+	}, nil, logger)
+	defer authController.Close()
+
+	// Relay tokens start internal sessions
+
+	relayToken := authController.CreateRelayToken(streamId)
+
+	session, _, errMsg := authController.StartPullSession(relayToken, streamId, "10.0.0.1")
+
+	if session == nil || !session.Internal {
+		t.Errorf("Expected internal session for the relay token: %v", errMsg)
+	}
+
+	if authController.ValidateRelayToken(relayToken, "stream2") {
+		t.Errorf("Relay token accepted for another stream")
+	}
+
+	// Pull tokens are not relay tokens
+
+	pullToken := authController.CreatePullToken(streamId)
+
+	if authController.ValidateRelayToken(pullToken, streamId) {
+		t.Errorf("Pull token accepted as relay token")
+	}
+
+	session, _, _ = authController.StartPullSession(pullToken, streamId, "10.0.0.1")
+
+	if session == nil || session.Internal {
+		t.Errorf("Expected non-internal session for the pull token")
+	}
+
+	// Relay tokens signed with the pull secret are rejected
+
+	fakeRelayToken, _ := signAuthToken("pull-secret", "RELAY", streamId)
+
+	if session, errCode, _ := authController.StartPullSession(fakeRelayToken, streamId, "10.0.0.1"); session != nil || errCode != "AUTH_ERROR" {
+		t.Errorf("Expected relay token signed with the pull secret to be rejected")
+	}
+
+	// Without relay secret, the relays use pull tokens
+
+	legacyController := NewAuthController(AuthConfiguration{
+		PullSecret: "pull-secret",
+	}, nil, logger)
+	defer legacyController.Close()
+
+	legacyToken := legacyController.CreateRelayToken(streamId)
+
+	if legacyController.ValidateRelayToken(legacyToken, streamId) || !legacyController.ValidatePullToken(legacyToken, streamId) {
+		t.Errorf("Expected a pull token to relay without relay secret")
+	}
+}
+
+func TestRelaySecret(t *testing.T) {
+	logger := testMain()
+
+	mockPublishRegistry := NewMockPublishRegistry()
+
+	server1 := makeTestServer(logger.CreateChildLogger("[Server 1] "), mockPublishRegistry, true, "")
+	defer server1.Close()
+
+	server2 := makeTestServer(logger.CreateChildLogger("[Server 2] "), mockPublishRegistry, true, "")
+	defer server2.Close()
+
+	for _, ts := range []*TestServer{server1, server2} {
+		ts.server.authController.config.RelaySecret = "relay-secret"
+	}
+
+	publisher := connectTestClient(server1.url, "PUSH", TEST_STREAM_ID_1, nil, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	spectator := connectTestClient(server2.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte("F:duration=1"))
+	_ = publisher.WriteMessage(websocket.BinaryMessage, TEST_STREAM_DATA_1[0].Data)
+
+	expectTestFragmentWithSequence(spectator, 1, TEST_STREAM_DATA_1[0].Data, t)
+
+	// The relay connection is not counted by the rate limiter of the first node
+
+	rateLimiter := server1.server.rateLimiter
+
+	rateLimiter.mu.Lock()
+	connections := rateLimiter.connectionsCount["127.0.0.1"]
+	rateLimiter.mu.Unlock()
+
+	if connections != 1 {
+		t.Errorf("Expected only the publisher connection to be counted, but got %v connections", connections)
+	}
+}
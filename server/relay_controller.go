@@ -3,9 +3,13 @@
 package main
 
 import (
+	"crypto/tls"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/AgustinSRG/glog"
+	"github.com/gorilla/websocket"
 )
 
 // Relay controller configuration
@@ -27,6 +31,9 @@ type RelayControllerConfig struct {
 
 	// True if it has a publish registry
 	HasPublishRegistry bool
+
+	// TLS configuration to connect to other nodes (nil for the default)
+	TlsClientConfig *tls.Config
 }
 
 // Relay controller
@@ -54,10 +61,16 @@ type RelayController struct {
 
 	// Memory limiter for fragment buffers
 	memoryLimiter *FragmentBufferMemoryLimiter
+
+	// Lifecycle event webhooks
+	eventWebhooks *EventWebhooks
+
+	// Websocket dialer to connect to other nodes
+	dialer *websocket.Dialer
 }
 
 // Creates an instance RelayController
-func NewRelayController(config RelayControllerConfig, authController *AuthController, publishRegistry PublishRegistry, memoryLimiter *FragmentBufferMemoryLimiter, logger *glog.Logger) *RelayController {
+func NewRelayController(config RelayControllerConfig, authController *AuthController, publishRegistry PublishRegistry, memoryLimiter *FragmentBufferMemoryLimiter, eventWebhooks *EventWebhooks, logger *glog.Logger) *RelayController {
 	return &RelayController{
 		config:          config,
 		logger:          logger,
@@ -66,6 +79,12 @@ func NewRelayController(config RelayControllerConfig, authController *AuthContro
 		authController:  authController,
 		publishRegistry: publishRegistry,
 		memoryLimiter:   memoryLimiter,
+		eventWebhooks:   eventWebhooks,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: 45 * time.Second,
+			TLSClientConfig:  config.TlsClientConfig,
+		},
 	}
 }
 
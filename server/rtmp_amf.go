@@ -0,0 +1,279 @@
+// AMF0 encoding (Action Message Format), used by RTMP commands
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// AMF0 type markers
+const (
+	AMF0_NUMBER       = 0x00
+	AMF0_BOOLEAN      = 0x01
+	AMF0_STRING       = 0x02
+	AMF0_OBJECT       = 0x03
+	AMF0_NULL         = 0x05
+	AMF0_UNDEFINED    = 0x06
+	AMF0_ECMA_ARRAY   = 0x08
+	AMF0_OBJECT_END   = 0x09
+	AMF0_STRICT_ARRAY = 0x0A
+	AMF0_DATE         = 0x0B
+	AMF0_LONG_STRING  = 0x0C
+)
+
+// Max nesting depth of AMF0 values
+const AMF0_MAX_DEPTH = 16
+
+// AMF0 object
+type AmfObject map[string]interface{}
+
+// Error decoding AMF0 data
+var ErrAmfInvalid = errors.New("invalid AMF0 data")
+
+// AMF0 decoder
+type AmfDecoder struct {
+	// Data to decode
+	data []byte
+
+	// Current position
+	pos int
+}
+
+// Decodes all the AMF0 values of a buffer
+func amfDecodeAll(data []byte) ([]interface{}, error) {
+	decoder := &AmfDecoder{data: data}
+	values := make([]interface{}, 0)
+
+	for decoder.pos < len(decoder.data) {
+		v, err := decoder.readValue(0)
+
+		if err != nil {
+			return values, err
+		}
+
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+// Reads n bytes
+func (decoder *AmfDecoder) read(n int) ([]byte, error) {
+	if n < 0 || decoder.pos+n > len(decoder.data) {
+		return nil, ErrAmfInvalid
+	}
+
+	b := decoder.data[decoder.pos : decoder.pos+n]
+	decoder.pos += n
+
+	return b, nil
+}
+
+// Reads a string with a 16 bit length
+func (decoder *AmfDecoder) readShortString() (string, error) {
+	l, err := decoder.read(2)
+
+	if err != nil {
+		return "", err
+	}
+
+	s, err := decoder.read(int(binary.BigEndian.Uint16(l)))
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(s), nil
+}
+
+// Reads the properties of an object, until the object end marker
+func (decoder *AmfDecoder) readObjectProperties(depth int) (AmfObject, error) {
+	obj := make(AmfObject)
+
+	for {
+		key, err := decoder.readShortString()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if key == "" && decoder.pos < len(decoder.data) && decoder.data[decoder.pos] == AMF0_OBJECT_END {
+			decoder.pos++
+			return obj, nil
+		}
+
+		v, err := decoder.readValue(depth + 1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		obj[key] = v
+	}
+}
+
+// Reads a value
+func (decoder *AmfDecoder) readValue(depth int) (interface{}, error) {
+	if depth > AMF0_MAX_DEPTH {
+		return nil, ErrAmfInvalid
+	}
+
+	marker, err := decoder.read(1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch marker[0] {
+	case AMF0_NUMBER:
+		b, err := decoder.read(8)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case AMF0_BOOLEAN:
+		b, err := decoder.read(1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return b[0] != 0, nil
+	case AMF0_STRING:
+		return decoder.readShortString()
+	case AMF0_LONG_STRING:
+		l, err := decoder.read(4)
+
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := decoder.read(int(binary.BigEndian.Uint32(l)))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return string(s), nil
+	case AMF0_OBJECT:
+		return decoder.readObjectProperties(depth)
+	case AMF0_ECMA_ARRAY:
+		_, err := decoder.read(4) // Approximate count, ignored
+
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.readObjectProperties(depth)
+	case AMF0_STRICT_ARRAY:
+		l, err := decoder.read(4)
+
+		if err != nil {
+			return nil, err
+		}
+
+		count := int(binary.BigEndian.Uint32(l))
+
+		if count > len(decoder.data)-decoder.pos {
+			return nil, ErrAmfInvalid
+		}
+
+		arr := make([]interface{}, 0, count)
+
+		for i := 0; i < count; i++ {
+			v, err := decoder.readValue(depth + 1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			arr = append(arr, v)
+		}
+
+		return arr, nil
+	case AMF0_DATE:
+		b, err := decoder.read(10)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(b[:8])), nil
+	case AMF0_NULL, AMF0_UNDEFINED:
+		return nil, nil
+	default:
+		return nil, ErrAmfInvalid
+	}
+}
+
+// Encodes AMF0 values
+// Supported types: float64, int, bool, string, AmfObject, nil
+func amfEncode(values ...interface{}) []byte {
+	buf := make([]byte, 0)
+
+	for _, v := range values {
+		buf = amfAppendValue(buf, v)
+	}
+
+	return buf
+}
+
+// Appends a string with a 16 bit length
+func amfAppendShortString(buf []byte, s string) []byte {
+	if len(s) > math.MaxUint16 {
+		s = s[:math.MaxUint16]
+	}
+
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// Appends an encoded AMF0 value
+func amfAppendValue(buf []byte, v interface{}) []byte {
+	switch x := v.(type) {
+	case float64:
+		buf = append(buf, AMF0_NUMBER)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(x))
+	case int:
+		return amfAppendValue(buf, float64(x))
+	case bool:
+		if x {
+			return append(buf, AMF0_BOOLEAN, 1)
+		}
+
+		return append(buf, AMF0_BOOLEAN, 0)
+	case string:
+		if len(x) > math.MaxUint16 {
+			buf = append(buf, AMF0_LONG_STRING)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(x)))
+			return append(buf, x...)
+		}
+
+		buf = append(buf, AMF0_STRING)
+		return amfAppendShortString(buf, x)
+	case AmfObject:
+		buf = append(buf, AMF0_OBJECT)
+
+		keys := make([]string, 0, len(x))
+
+		for k := range x {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			buf = amfAppendShortString(buf, k)
+			buf = amfAppendValue(buf, x[k])
+		}
+
+		return append(buf, 0x00, 0x00, AMF0_OBJECT_END)
+	default:
+		return append(buf, AMF0_NULL)
+	}
+}
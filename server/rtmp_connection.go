@@ -0,0 +1,569 @@
+// RTMP connection (handshake and chunk stream)
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"net"
+	"slices"
+	"time"
+)
+
+// RTMP version
+const RTMP_VERSION = 3
+
+// Size of the handshake packets (C1, C2, S1, S2)
+const RTMP_HANDSHAKE_SIZE = 1536
+
+// Default chunk size
+const RTMP_DEFAULT_CHUNK_SIZE = 128
+
+// Max chunk size accepted from the peer
+const RTMP_MAX_CHUNK_SIZE = 16 * 1024 * 1024
+
+// Max number of chunk streams per connection
+const RTMP_MAX_CHUNK_STREAMS = 64
+
+// Max message size (bytes) before publishing is authorized
+const RTMP_PRE_AUTH_MAX_MESSAGE_SIZE = 4096
+
+// Max number of chunk streams per connection before publishing is authorized
+const RTMP_PRE_AUTH_MAX_CHUNK_STREAMS = 8
+
+// Max number of bytes allocated at once when reading a chunk
+const RTMP_READ_BLOCK_SIZE = 64 * 1024
+
+// Timeout for reading from the connection
+const RTMP_READ_TIMEOUT = 60 * time.Second
+
+// RTMP message types
+const (
+	RTMP_MSG_SET_CHUNK_SIZE     = 1
+	RTMP_MSG_ABORT              = 2
+	RTMP_MSG_ACK                = 3
+	RTMP_MSG_USER_CONTROL       = 4
+	RTMP_MSG_WINDOW_ACK_SIZE    = 5
+	RTMP_MSG_SET_PEER_BANDWIDTH = 6
+	RTMP_MSG_AUDIO              = 8
+	RTMP_MSG_VIDEO              = 9
+	RTMP_MSG_DATA_AMF3          = 15
+	RTMP_MSG_COMMAND_AMF3       = 17
+	RTMP_MSG_DATA_AMF0          = 18
+	RTMP_MSG_COMMAND_AMF0       = 20
+)
+
+// Chunk stream IDs used to send messages
+const (
+	RTMP_CSID_PROTOCOL_CONTROL = 2
+	RTMP_CSID_COMMAND          = 3
+)
+
+// Error for RTMP protocol violations
+var ErrRtmpProtocol = errors.New("RTMP protocol error")
+
+// RTMP message
+type RtmpMessage struct {
+	// Message type
+	Type byte
+
+	// Message stream ID
+	StreamId uint32
+
+	// Timestamp (milliseconds)
+	Timestamp uint32
+
+	// Payload
+	Payload []byte
+}
+
+// State of a chunk stream (receiving)
+type RtmpChunkStreamState struct {
+	// Timestamp of the current message
+	timestamp uint32
+
+	// Timestamp field of the last header (delta, or absolute for type 0 headers)
+	timestampField uint32
+
+	// True if the last header had an extended timestamp
+	extendedTimestamp bool
+
+	// Length of the current message
+	length uint32
+
+	// Type of the current message
+	typeId byte
+
+	// Message stream ID of the current message
+	streamId uint32
+
+	// True if a header was received
+	initialized bool
+
+	// Payload of the current message (partial)
+	buffer []byte
+}
+
+// RTMP connection
+type RtmpConnection struct {
+	// Network connection
+	conn net.Conn
+
+	// Buffered reader
+	reader *bufio.Reader
+
+	// Buffered writer
+	writer *bufio.Writer
+
+	// Max message size (bytes) once publishing is authorized
+	maxMessageSize uint32
+
+	// Current max message size (bytes)
+	messageSizeLimit uint32
+
+	// Current max number of chunk streams
+	chunkStreamsLimit int
+
+	// Chunk size for receiving
+	inChunkSize uint32
+
+	// Chunk size for sending
+	outChunkSize uint32
+
+	// State of the chunk streams (receiving)
+	chunkStreams map[uint32]*RtmpChunkStreamState
+
+	// Number of bytes received
+	bytesReceived uint32
+
+	// Number of bytes received when the last acknowledgement was sent
+	lastAck uint32
+
+	// Window size to send acknowledgements (set by the peer)
+	windowAckSize uint32
+}
+
+// Creates new instance of RtmpConnection
+func NewRtmpConnection(conn net.Conn, maxMessageSize uint32) *RtmpConnection {
+	return &RtmpConnection{
+		conn:              conn,
+		reader:            bufio.NewReader(conn),
+		writer:            bufio.NewWriter(conn),
+		maxMessageSize:    maxMessageSize,
+		messageSizeLimit:  min(maxMessageSize, RTMP_PRE_AUTH_MAX_MESSAGE_SIZE),
+		chunkStreamsLimit: RTMP_PRE_AUTH_MAX_CHUNK_STREAMS,
+		inChunkSize:       RTMP_DEFAULT_CHUNK_SIZE,
+		outChunkSize:      RTMP_DEFAULT_CHUNK_SIZE,
+		chunkStreams:      make(map[uint32]*RtmpChunkStreamState),
+	}
+}
+
+// Lifts the pre-authorization limits, allowing
+// messages up to the max message size.
+// Call once publishing is authorized.
+func (rc *RtmpConnection) SetPublishAuthorized() {
+	rc.messageSizeLimit = rc.maxMessageSize
+	rc.chunkStreamsLimit = RTMP_MAX_CHUNK_STREAMS
+}
+
+// Reads exactly len(buf) bytes
+func (rc *RtmpConnection) readFull(buf []byte) error {
+	_ = rc.conn.SetReadDeadline(time.Now().Add(RTMP_READ_TIMEOUT))
+
+	n, err := io.ReadFull(rc.reader, buf)
+
+	rc.bytesReceived += uint32(n)
+
+	return err
+}
+
+// Reads an unsigned integer (big endian) of n bytes
+func (rc *RtmpConnection) readUint(n int) (uint32, error) {
+	buf := make([]byte, n)
+
+	err := rc.readFull(buf)
+
+	if err != nil {
+		return 0, err
+	}
+
+	v := uint32(0)
+
+	for _, b := range buf {
+		v = (v << 8) | uint32(b)
+	}
+
+	return v, nil
+}
+
+// Performs the server side of the handshake
+func (rc *RtmpConnection) ServerHandshake() error {
+	// C0 + C1
+
+	c0c1 := make([]byte, 1+RTMP_HANDSHAKE_SIZE)
+
+	err := rc.readFull(c0c1)
+
+	if err != nil {
+		return err
+	}
+
+	if c0c1[0] != RTMP_VERSION {
+		return ErrRtmpProtocol
+	}
+
+	// S0 + S1 + S2
+
+	s1 := make([]byte, RTMP_HANDSHAKE_SIZE)
+	_, _ = rand.Read(s1[8:])
+
+	_ = rc.writer.WriteByte(RTMP_VERSION)
+	_, _ = rc.writer.Write(s1)
+	_, _ = rc.writer.Write(c0c1[1:]) // S2 echoes C1
+
+	err = rc.writer.Flush()
+
+	if err != nil {
+		return err
+	}
+
+	// C2
+
+	c2 := make([]byte, RTMP_HANDSHAKE_SIZE)
+
+	return rc.readFull(c2)
+}
+
+// Performs the client side of the handshake
+func (rc *RtmpConnection) ClientHandshake() error {
+	c1 := make([]byte, RTMP_HANDSHAKE_SIZE)
+	_, _ = rand.Read(c1[8:])
+
+	_ = rc.writer.WriteByte(RTMP_VERSION)
+	_, _ = rc.writer.Write(c1)
+
+	err := rc.writer.Flush()
+
+	if err != nil {
+		return err
+	}
+
+	s0s1s2 := make([]byte, 1+2*RTMP_HANDSHAKE_SIZE)
+
+	err = rc.readFull(s0s1s2)
+
+	if err != nil {
+		return err
+	}
+
+	if s0s1s2[0] != RTMP_VERSION {
+		return ErrRtmpProtocol
+	}
+
+	_, _ = rc.writer.Write(s0s1s2[1 : 1+RTMP_HANDSHAKE_SIZE]) // C2 echoes S1
+
+	return rc.writer.Flush()
+}
+
+// Reads a message
+// Protocol control messages to set the chunk size and the acknowledgement window are applied, and returned as well
+func (rc *RtmpConnection) ReadMessage() (*RtmpMessage, error) {
+	for {
+		msg, err := rc.readChunk()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if rc.windowAckSize > 0 && rc.bytesReceived-rc.lastAck >= rc.windowAckSize {
+			rc.lastAck = rc.bytesReceived
+
+			err = rc.WriteMessage(RTMP_CSID_PROTOCOL_CONTROL, RTMP_MSG_ACK, 0, 0, binary.BigEndian.AppendUint32(nil, rc.bytesReceived))
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if msg == nil {
+			continue // Incomplete message
+		}
+
+		switch msg.Type {
+		case RTMP_MSG_SET_CHUNK_SIZE:
+			if len(msg.Payload) < 4 {
+				return nil, ErrRtmpProtocol
+			}
+
+			chunkSize := binary.BigEndian.Uint32(msg.Payload) & 0x7FFFFFFF
+
+			if chunkSize < 1 || chunkSize > RTMP_MAX_CHUNK_SIZE {
+				return nil, ErrRtmpProtocol
+			}
+
+			rc.inChunkSize = chunkSize
+		case RTMP_MSG_WINDOW_ACK_SIZE:
+			if len(msg.Payload) < 4 {
+				return nil, ErrRtmpProtocol
+			}
+
+			rc.windowAckSize = binary.BigEndian.Uint32(msg.Payload)
+		case RTMP_MSG_ABORT:
+			if len(msg.Payload) < 4 {
+				return nil, ErrRtmpProtocol
+			}
+
+			cs := rc.chunkStreams[binary.BigEndian.Uint32(msg.Payload)]
+
+			if cs != nil {
+				cs.buffer = nil
+			}
+		}
+
+		return msg, nil
+	}
+}
+
+// Reads a chunk
+// Returns the message if it is complete, or nil otherwise
+func (rc *RtmpConnection) readChunk() (*RtmpMessage, error) {
+	// Basic header
+
+	b0, err := rc.readUint(1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	format := b0 >> 6
+	csid := b0 & 0x3F
+
+	switch csid {
+	case 0:
+		b, err := rc.readUint(1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		csid = 64 + b
+	case 1:
+		b, err := rc.readUint(2)
+
+		if err != nil {
+			return nil, err
+		}
+
+		csid = 64 + (b >> 8) + (b&0xFF)*256
+	}
+
+	cs := rc.chunkStreams[csid]
+
+	if cs == nil {
+		if len(rc.chunkStreams) >= rc.chunkStreamsLimit {
+			return nil, ErrRtmpProtocol
+		}
+
+		cs = &RtmpChunkStreamState{}
+		rc.chunkStreams[csid] = cs
+	}
+
+	if format != 0 && !cs.initialized {
+		return nil, ErrRtmpProtocol
+	}
+
+	newMessage := cs.buffer == nil
+
+	// Message header
+
+	switch format {
+	case 0, 1, 2:
+		timestampField, err := rc.readUint(3)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if format <= 1 {
+			length, err := rc.readUint(3)
+
+			if err != nil {
+				return nil, err
+			}
+
+			typeId, err := rc.readUint(1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			cs.length = length
+			cs.typeId = byte(typeId)
+		}
+
+		if format == 0 {
+			streamId, err := rc.readUint(4)
+
+			if err != nil {
+				return nil, err
+			}
+
+			cs.streamId = bits.ReverseBytes32(streamId) // Little endian
+		}
+
+		cs.extendedTimestamp = timestampField == 0xFFFFFF
+
+		if cs.extendedTimestamp {
+			timestampField, err = rc.readUint(4)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		cs.timestampField = timestampField
+
+		if format == 0 {
+			cs.timestamp = timestampField
+		} else if newMessage {
+			cs.timestamp += timestampField
+		}
+
+		cs.initialized = true
+	case 3:
+		if cs.extendedTimestamp {
+			_, err := rc.readUint(4)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if newMessage {
+			cs.timestamp += cs.timestampField
+		}
+	}
+
+	if cs.length > rc.messageSizeLimit {
+		return nil, ErrRtmpProtocol
+	}
+
+	// Payload
+
+	if newMessage {
+		cs.buffer = make([]byte, 0)
+	}
+
+	toRead := cs.length - uint32(len(cs.buffer))
+
+	if toRead > rc.inChunkSize {
+		toRead = rc.inChunkSize
+	}
+
+	// Grow the buffer in blocks, as the data arrives,
+	// so the declared length is never allocated upfront
+
+	for toRead > 0 {
+		blockSize := int(min(toRead, RTMP_READ_BLOCK_SIZE))
+		start := len(cs.buffer)
+
+		cs.buffer = slices.Grow(cs.buffer, blockSize)[:start+blockSize]
+
+		err = rc.readFull(cs.buffer[start:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		toRead -= uint32(blockSize)
+	}
+
+	if uint32(len(cs.buffer)) < cs.length {
+		return nil, nil
+	}
+
+	msg := &RtmpMessage{
+		Type:      cs.typeId,
+		StreamId:  cs.streamId,
+		Timestamp: cs.timestamp,
+		Payload:   cs.buffer,
+	}
+
+	cs.buffer = nil
+
+	return msg, nil
+}
+
+// Writes a message
+func (rc *RtmpConnection) WriteMessage(csid byte, typeId byte, streamId uint32, timestamp uint32, payload []byte) error {
+	extendedTimestamp := timestamp >= 0xFFFFFF
+
+	timestampField := timestamp
+
+	if extendedTimestamp {
+		timestampField = 0xFFFFFF
+	}
+
+	header := []byte{
+		csid & 0x3F,
+		byte(timestampField >> 16), byte(timestampField >> 8), byte(timestampField),
+		byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)),
+		typeId,
+	}
+
+	header = binary.LittleEndian.AppendUint32(header, streamId)
+
+	if extendedTimestamp {
+		header = binary.BigEndian.AppendUint32(header, timestamp)
+	}
+
+	_, _ = rc.writer.Write(header)
+
+	for first := true; first || len(payload) > 0; first = false {
+		if !first {
+			_ = rc.writer.WriteByte(0xC0 | (csid & 0x3F))
+
+			if extendedTimestamp {
+				_, _ = rc.writer.Write(binary.BigEndian.AppendUint32(nil, timestamp))
+			}
+		}
+
+		n := len(payload)
+
+		if n > int(rc.outChunkSize) {
+			n = int(rc.outChunkSize)
+		}
+
+		_, _ = rc.writer.Write(payload[:n])
+		payload = payload[n:]
+	}
+
+	return rc.writer.Flush()
+}
+
+// Sets the chunk size for sending, notifying the peer
+func (rc *RtmpConnection) SetOutChunkSize(chunkSize uint32) error {
+	err := rc.WriteMessage(RTMP_CSID_PROTOCOL_CONTROL, RTMP_MSG_SET_CHUNK_SIZE, 0, 0, binary.BigEndian.AppendUint32(nil, chunkSize))
+
+	if err != nil {
+		return err
+	}
+
+	rc.outChunkSize = chunkSize
+
+	return nil
+}
+
+// Writes a command message (AMF0)
+func (rc *RtmpConnection) WriteCommand(streamId uint32, values ...interface{}) error {
+	return rc.WriteMessage(RTMP_CSID_COMMAND, RTMP_MSG_COMMAND_AMF0, streamId, 0, amfEncode(values...))
+}
+
+// Closes the connection
+func (rc *RtmpConnection) Close() {
+	_ = rc.conn.Close()
+}
@@ -0,0 +1,413 @@
+// RTMP ingest server
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AgustinSRG/glog"
+)
+
+// Window acknowledgement size sent to the clients
+const RTMP_WINDOW_ACK_SIZE = 5000000
+
+// Chunk size used to send messages
+const RTMP_OUT_CHUNK_SIZE = 4096
+
+// Message stream ID created for publishing
+const RTMP_PUBLISH_STREAM_ID = 1
+
+// RTMP server configuration
+type RtmpConfig struct {
+	// True to enable the RTMP server
+	Enabled bool
+
+	// Port
+	Port int
+
+	// Bind address
+	BindAddress string
+
+	// Min duration of the fragments (milliseconds)
+	FragmentDuration int64
+
+	// Max size of a message or fragment (bytes)
+	MaxMessageSize int64
+}
+
+// RTMP server
+// Receives streams from RTMP publishers (OBS, FFmpeg, etc), and remuxes them into HLS fragments
+type RtmpServer struct {
+	// Configuration
+	config RtmpConfig
+
+	// Logger
+	logger *glog.Logger
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Next session ID
+	nextSessionId uint64
+
+	// Auth controller
+	authController *AuthController
+
+	// Sources controller
+	sourceController *SourcesController
+}
+
+// Creates new instance of RtmpServer
+func NewRtmpServer(config RtmpConfig, authController *AuthController, sourceController *SourcesController, logger *glog.Logger) *RtmpServer {
+	return &RtmpServer{
+		config:           config,
+		logger:           logger,
+		mu:               &sync.Mutex{},
+		nextSessionId:    0,
+		authController:   authController,
+		sourceController: sourceController,
+	}
+}
+
+// Runs the server
+// wg - Wait group
+func (server *RtmpServer) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if !server.config.Enabled {
+		return
+	}
+
+	listener, err := net.Listen("tcp", server.config.BindAddress+":"+strconv.Itoa(server.config.Port))
+
+	if err != nil {
+		server.logger.Errorf("Error starting RTMP server: %v", err)
+		return
+	}
+
+	server.logger.Infof("[RTMP] Listening on %v:%v", server.config.BindAddress, server.config.Port)
+
+	server.Serve(listener)
+}
+
+// Accepts connections from a listener, until it is closed
+func (server *RtmpServer) Serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			server.logger.Errorf("Error accepting RTMP connection: %v", err)
+			continue
+		}
+
+		server.mu.Lock()
+		id := server.nextSessionId
+		server.nextSessionId++
+		server.mu.Unlock()
+
+		session := &RtmpSession{
+			id:         id,
+			server:     server,
+			connection: NewRtmpConnection(conn, uint32(server.config.MaxMessageSize)),
+			logger:     server.logger.CreateChildLogger("[RTMP #" + fmt.Sprint(id) + "] "),
+		}
+
+		go session.Run()
+	}
+}
+
+// RTMP session (one per connection)
+type RtmpSession struct {
+	// Session ID
+	id uint64
+
+	// Server
+	server *RtmpServer
+
+	// Connection
+	connection *RtmpConnection
+
+	// Logger
+	logger *glog.Logger
+
+	// Application name (sent in the connect command)
+	app string
+
+	// Stream ID
+	streamId string
+
+	// Source to push to (nil if not publishing)
+	source *HlsSource
+
+	// Remuxer
+	remuxer *FlvRemuxer
+
+	// True if a warning was logged for unsupported codecs
+	unsupportedCodecWarned bool
+
+	// ID of the watcher to close the connection if the stream key is revoked
+	revocationWatcherId uint64
+}
+
+// Runs the session
+func (session *RtmpSession) Run() {
+	defer session.connection.Close()
+	defer session.closeSource()
+
+	session.logger.Debugf("Connection accepted from %v", session.connection.conn.RemoteAddr())
+
+	err := session.connection.ServerHandshake()
+
+	if err != nil {
+		session.logger.Debugf("Handshake failed: %v", err)
+		return
+	}
+
+	for {
+		msg, err := session.connection.ReadMessage()
+
+		if err != nil {
+			session.logger.Debugf("Connection closed: %v", err)
+			return
+		}
+
+		if !session.handleMessage(msg) {
+			return
+		}
+	}
+}
+
+// Handles a message
+// Returns false to close the connection
+func (session *RtmpSession) handleMessage(msg *RtmpMessage) bool {
+	switch msg.Type {
+	case RTMP_MSG_COMMAND_AMF0:
+		return session.handleCommand(msg.Payload)
+	case RTMP_MSG_COMMAND_AMF3:
+		if len(msg.Payload) < 1 {
+			return false
+		}
+
+		return session.handleCommand(msg.Payload[1:])
+	case RTMP_MSG_VIDEO:
+		if session.source != nil && session.source.IsClosed() {
+			session.logger.Infof("Stream %v was replaced by another publisher", session.streamId)
+			return false
+		}
+
+		if session.remuxer != nil {
+			session.handleMediaError(session.remuxer.OnVideo(int64(msg.Timestamp), msg.Payload))
+		}
+	case RTMP_MSG_AUDIO:
+		if session.remuxer != nil {
+			session.handleMediaError(session.remuxer.OnAudio(int64(msg.Timestamp), msg.Payload))
+		}
+	}
+
+	return true
+}
+
+// Handles an error remuxing media
+func (session *RtmpSession) handleMediaError(err error) {
+	if err == nil {
+		return
+	}
+
+	if err == ErrFlvUnsupportedCodec {
+		if !session.unsupportedCodecWarned {
+			session.unsupportedCodecWarned = true
+			session.logger.Warningf("Stream %v: %v", session.streamId, err)
+		}
+
+		return
+	}
+
+	session.logger.Debugf("Invalid media data: %v", err)
+}
+
+// Handles a command
+// Returns false to close the connection
+func (session *RtmpSession) handleCommand(payload []byte) bool {
+	values, err := amfDecodeAll(payload)
+
+	if err != nil || len(values) < 2 {
+		session.logger.Debugf("Invalid command: %v", err)
+		return false
+	}
+
+	commandName, _ := values[0].(string)
+	transactionId, _ := values[1].(float64)
+
+	switch commandName {
+	case "connect":
+		if len(values) < 3 {
+			return false
+		}
+
+		commandObject, _ := values[2].(AmfObject)
+		app, _ := commandObject["app"].(string)
+
+		session.app = strings.Trim(strings.SplitN(app, "?", 2)[0], "/")
+
+		return session.handleConnect(transactionId)
+	case "createStream":
+		return session.connection.WriteCommand(0, "_result", transactionId, nil, RTMP_PUBLISH_STREAM_ID) == nil
+	case "publish":
+		if len(values) < 4 {
+			return false
+		}
+
+		streamKey, _ := values[3].(string)
+
+		return session.handlePublish(streamKey)
+	case "FCUnpublish", "deleteStream", "closeStream":
+		if session.source != nil {
+			session.logger.Infof("Stream %v unpublished", session.streamId)
+			return false
+		}
+	}
+
+	return true
+}
+
+// Handles the connect command
+func (session *RtmpSession) handleConnect(transactionId float64) bool {
+	rc := session.connection
+
+	err := rc.WriteMessage(RTMP_CSID_PROTOCOL_CONTROL, RTMP_MSG_WINDOW_ACK_SIZE, 0, 0, binary.BigEndian.AppendUint32(nil, RTMP_WINDOW_ACK_SIZE))
+
+	if err != nil {
+		return false
+	}
+
+	err = rc.WriteMessage(RTMP_CSID_PROTOCOL_CONTROL, RTMP_MSG_SET_PEER_BANDWIDTH, 0, 0, append(binary.BigEndian.AppendUint32(nil, RTMP_WINDOW_ACK_SIZE), 2))
+
+	if err != nil {
+		return false
+	}
+
+	err = rc.SetOutChunkSize(RTMP_OUT_CHUNK_SIZE)
+
+	if err != nil {
+		return false
+	}
+
+	err = rc.WriteCommand(0, "_result", transactionId, AmfObject{
+		"fmsVer":       "FMS/3,0,1,123",
+		"capabilities": 31,
+	}, AmfObject{
+		"level":          "status",
+		"code":           "NetConnection.Connect.Success",
+		"description":    "Connection succeeded.",
+		"objectEncoding": 0,
+	})
+
+	return err == nil
+}
+
+// Sends a status message for the publishing stream
+func (session *RtmpSession) sendPublishStatus(level string, code string, description string) error {
+	return session.connection.WriteCommand(RTMP_PUBLISH_STREAM_ID, "onStatus", 0, nil, AmfObject{
+		"level":       level,
+		"code":        code,
+		"description": description,
+	})
+}
+
+// Handles the publish command
+// The stream ID is the application name, and the stream key is the push token
+func (session *RtmpSession) handlePublish(streamKey string) bool {
+	if session.source != nil {
+		_ = session.sendPublishStatus("error", "NetStream.Publish.BadName", "Already publishing.")
+		return false
+	}
+
+	streamId := session.app
+
+	if streamId == "" || len(streamId) > 255 {
+		_ = session.sendPublishStatus("error", "NetStream.Publish.BadName", "Invalid stream ID.")
+		return false
+	}
+
+	if !session.server.authController.IsPushAllowed() {
+		_ = session.sendPublishStatus("error", "NetStream.Publish.BadName", "Publishing is not allowed.")
+		return false
+	}
+
+	ip, _, _ := net.SplitHostPort(session.connection.conn.RemoteAddr().String())
+
+	validToken, claims := session.server.authController.ValidatePushTokenClaims(streamKey, streamId, ip)
+
+	if !validToken {
+		session.logger.Debugf("Invalid stream key for %v", streamId)
+		session.server.sourceController.eventWebhooks.NotifyPublisherAuthError(streamId, "Invalid stream key")
+		_ = session.sendPublishStatus("error", "NetStream.Publish.BadName", "Invalid stream key.")
+		return false
+	}
+
+	// Create source
+
+	sourceController := session.server.sourceController
+
+	source := sourceController.CreateSource(streamId)
+
+	go source.PeriodicallyAnnounce()
+
+	sourceController.StartRecordingIfRequested(source, getBoolClaim(claims, "record"), session.logger)
+
+	session.streamId = streamId
+	session.source = source
+
+	session.connection.SetPublishAuthorized()
+
+	session.remuxer = NewFlvRemuxer(session.server.config.FragmentDuration, int(session.server.config.MaxMessageSize), func(duration float32, data []byte) {
+		source.AddFragment(&HlsFragment{
+			Duration: duration,
+			Data:     data,
+		})
+	})
+
+	session.revocationWatcherId = session.server.authController.WatchTokenRevocation(claims, func() {
+		session.logger.Infof("Closing stream %v: The stream key was revoked", streamId)
+		session.connection.Close()
+	})
+
+	session.logger.Infof("Publishing stream %v", streamId)
+
+	// Stream begin
+
+	err := session.connection.WriteMessage(RTMP_CSID_PROTOCOL_CONTROL, RTMP_MSG_USER_CONTROL, 0, 0, []byte{0x00, 0x00, 0x00, 0x00, 0x00, RTMP_PUBLISH_STREAM_ID})
+
+	if err != nil {
+		return false
+	}
+
+	return session.sendPublishStatus("status", "NetStream.Publish.Start", "Publishing "+streamId+".") == nil
+}
+
+// Closes the source, after sending the last fragment
+func (session *RtmpSession) closeSource() {
+	if session.source == nil {
+		return
+	}
+
+	session.server.authController.UnwatchTokenRevocation(session.revocationWatcherId)
+
+	session.remuxer.End()
+
+	session.source.Close()
+	session.server.sourceController.RemoveSource(session.streamId, session.source)
+
+	session.source = nil
+	session.remuxer = nil
+}
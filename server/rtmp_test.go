@@ -0,0 +1,383 @@
+// Tests for the RTMP ingest
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAmf(t *testing.T) {
+	encoded := amfEncode("connect", 1, AmfObject{
+		"app":   "live/test",
+		"audio": true,
+		"video": AmfObject{"codec": 7.0},
+	}, nil, "")
+
+	values, err := amfDecodeAll(encoded)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(values) != 5 || values[0] != "connect" || values[1] != 1.0 || values[3] != nil || values[4] != "" {
+		t.Errorf("Unexpected values: %v", values)
+		return
+	}
+
+	obj, _ := values[2].(AmfObject)
+
+	if obj["app"] != "live/test" || obj["audio"] != true || obj["video"].(AmfObject)["codec"] != 7.0 {
+		t.Errorf("Unexpected object: %v", obj)
+	}
+
+	_, err = amfDecodeAll([]byte{AMF0_STRING, 0x00, 0x10, 'a'})
+
+	if err == nil {
+		t.Errorf("Expected error decoding truncated data")
+	}
+}
+
+// Test SPS and PPS
+var TEST_H264_SPS = []byte{0x67, 0x42, 0xC0, 0x1E, 0xD9, 0x00}
+var TEST_H264_PPS = []byte{0x68, 0xCE, 0x3C, 0x80}
+
+// Makes a test FLV video tag body
+func makeTestFlvVideoTag(keyframe bool, nalType byte) []byte {
+	frameType := byte(2)
+
+	if keyframe {
+		frameType = 1
+	}
+
+	nal := []byte{nalType, 0x88, 0x84, 0x00, 0x10}
+
+	tag := []byte{frameType<<4 | FLV_VIDEO_CODEC_AVC, 0x01, 0x00, 0x00, 0x00}
+	tag = append(tag, 0x00, 0x00, 0x00, byte(len(nal)))
+
+	return append(tag, nal...)
+}
+
+// Makes the test FLV video sequence header
+func makeTestFlvVideoSequenceHeader() []byte {
+	tag := []byte{0x10 | FLV_VIDEO_CODEC_AVC, 0x00, 0x00, 0x00, 0x00}
+
+	tag = append(tag, 0x01, TEST_H264_SPS[1], TEST_H264_SPS[2], TEST_H264_SPS[3], 0xFF, 0xE1)
+	tag = append(tag, 0x00, byte(len(TEST_H264_SPS)))
+	tag = append(tag, TEST_H264_SPS...)
+	tag = append(tag, 0x01, 0x00, byte(len(TEST_H264_PPS)))
+
+	return append(tag, TEST_H264_PPS...)
+}
+
+// Reads messages from a test RTMP client until a command is received
+// Returns the values of the command
+func readTestRtmpCommand(client *RtmpConnection, t *testing.T) []interface{} {
+	for {
+		msg, err := client.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+
+		if msg.Type != RTMP_MSG_COMMAND_AMF0 {
+			continue
+		}
+
+		values, err := amfDecodeAll(msg.Payload)
+
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+
+		return values
+	}
+}
+
+// Connects a test RTMP client and publishes
+// Returns the client and the status code of the publish command
+func publishTestRtmpClient(address string, app string, streamKey string, t *testing.T) (*RtmpConnection, string) {
+	conn, err := net.Dial("tcp", address)
+
+	if err != nil {
+		t.Error(err)
+		return nil, ""
+	}
+
+	client := NewRtmpConnection(conn, DEFAULT_MAX_BINARY_MSG_SIZE)
+
+	err = client.ClientHandshake()
+
+	if err != nil {
+		t.Error(err)
+		client.Close()
+		return nil, ""
+	}
+
+	_ = client.WriteCommand(0, "connect", 1, AmfObject{"app": app, "type": "nonprivate"})
+
+	result := readTestRtmpCommand(client, t)
+
+	if len(result) < 4 || result[0] != "_result" || result[3].(AmfObject)["code"] != "NetConnection.Connect.Success" {
+		t.Errorf("Unexpected connect result: %v", result)
+		client.Close()
+		return nil, ""
+	}
+
+	_ = client.WriteCommand(0, "createStream", 2, nil)
+
+	result = readTestRtmpCommand(client, t)
+
+	if len(result) < 4 || result[0] != "_result" || result[3] != float64(RTMP_PUBLISH_STREAM_ID) {
+		t.Errorf("Unexpected createStream result: %v", result)
+		client.Close()
+		return nil, ""
+	}
+
+	_ = client.WriteCommand(RTMP_PUBLISH_STREAM_ID, "publish", 0, nil, streamKey, "live")
+
+	result = readTestRtmpCommand(client, t)
+
+	if len(result) < 4 || result[0] != "onStatus" {
+		t.Errorf("Unexpected publish result: %v", result)
+		client.Close()
+		return nil, ""
+	}
+
+	code, _ := result[3].(AmfObject)["code"].(string)
+
+	return client, code
+}
+
+func TestRtmpIngest(t *testing.T) {
+	logger := testMain()
+
+	server := makeTestServer(logger.CreateChildLogger("[Server] "), nil, true, "")
+	defer server.Close()
+
+	rtmpServer := NewRtmpServer(RtmpConfig{
+		Enabled:          true,
+		FragmentDuration: 2000,
+		MaxMessageSize:   DEFAULT_MAX_BINARY_MSG_SIZE,
+	}, server.server.authController, server.server.sourceController, logger.CreateChildLogger("[RTMP] "))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer listener.Close()
+
+	go rtmpServer.Serve(listener)
+
+	// Invalid stream key
+
+	client, code := publishTestRtmpClient(listener.Addr().String(), TEST_STREAM_ID_1, "invalid", t)
+
+	if client != nil {
+		client.Close()
+	}
+
+	if code != "NetStream.Publish.BadName" {
+		t.Errorf("Expected the publishing to be rejected, but got: %v", code)
+	}
+
+	// Valid stream key
+
+	streamKey, err := signAuthToken(TEST_JWT_SECRET, "PUSH", TEST_STREAM_ID_1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client, code = publishTestRtmpClient(listener.Addr().String(), TEST_STREAM_ID_1, streamKey, t)
+
+	if client == nil {
+		return
+	}
+
+	defer client.Close()
+
+	if code != "NetStream.Publish.Start" {
+		t.Errorf("Expected the publishing to start, but got: %v", code)
+		return
+	}
+
+	for i := 0; i < 100 && server.server.sourceController.GetSource(TEST_STREAM_ID_1) == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	spectator := connectTestClient(server.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	// Send media
+
+	_ = client.WriteMessage(4, RTMP_MSG_VIDEO, RTMP_PUBLISH_STREAM_ID, 0, makeTestFlvVideoSequenceHeader())
+	_ = client.WriteMessage(5, RTMP_MSG_AUDIO, RTMP_PUBLISH_STREAM_ID, 0, []byte{0xAF, 0x00, 0x12, 0x10})
+
+	for ts := uint32(0); ts <= 4000; ts += 500 {
+		keyframe := ts%2000 == 0
+		nalType := byte(1)
+
+		if keyframe {
+			nalType = 5
+		}
+
+		_ = client.WriteMessage(4, RTMP_MSG_VIDEO, RTMP_PUBLISH_STREAM_ID, ts, makeTestFlvVideoTag(keyframe, nalType))
+		_ = client.WriteMessage(5, RTMP_MSG_AUDIO, RTMP_PUBLISH_STREAM_ID, ts, []byte{0xAF, 0x01, 0x21, 0x10, 0x04})
+	}
+
+	// Fragments are cut at keyframes
+
+	for i := 0; i < 2; i++ {
+		msg, _ := readTestMessage(spectator, t)
+
+		if msg == nil || msg.MessageType != "F" || msg.GetParameter("duration") != "2" {
+			t.Errorf("Expected F message with duration 2, but received: %v", msg)
+			return
+		}
+
+		_, data := readTestMessage(spectator, t)
+
+		videoPayloads := demuxTestTsPayloads(data, TS_PID_VIDEO, t)
+
+		if len(videoPayloads) != 4 {
+			t.Errorf("Expected 4 video frames, but got %v", len(videoPayloads))
+			continue
+		}
+
+		// The keyframe includes the SPS and PPS (Annex B)
+		expectedKeyframeStart := append(append([]byte{}, H264_ANNEXB_AUD...), H264_ANNEXB_START_CODE...)
+		expectedKeyframeStart = append(expectedKeyframeStart, TEST_H264_SPS...)
+
+		if !bytes.HasPrefix(videoPayloads[0], expectedKeyframeStart) {
+			t.Errorf("Unexpected keyframe: %v", videoPayloads[0])
+		}
+
+		audioPayloads := demuxTestTsPayloads(data, TS_PID_AUDIO, t)
+
+		if len(audioPayloads) != 4 {
+			t.Errorf("Expected 4 audio frames, but got %v", len(audioPayloads))
+			continue
+		}
+
+		// ADTS header: AAC LC, 44100 Hz, stereo, 10 bytes
+		expectedAudio := []byte{0xFF, 0xF1, 0x50, 0x80, 0x01, 0x5F, 0xFC, 0x21, 0x10, 0x04}
+
+		if !bytes.Equal(audioPayloads[0], expectedAudio) {
+			t.Errorf("Unexpected audio frame. Expected: %v, Actual: %v", expectedAudio, audioPayloads[0])
+		}
+	}
+
+	// Unpublishing sends the last fragment and closes the stream
+
+	_ = client.WriteCommand(RTMP_PUBLISH_STREAM_ID, "deleteStream", 0, nil, RTMP_PUBLISH_STREAM_ID)
+
+	msg, _ := readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "F" {
+		t.Errorf("Expected F message, but received: %v", msg)
+		return
+	}
+
+	_, _ = readTestMessage(spectator, t)
+
+	msg, _ = readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "CLOSE" {
+		t.Errorf("Expected CLOSE message, but received: %v", msg)
+	}
+}
+
+func TestRtmpPreAuthLimits(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xAB}, RTMP_PRE_AUTH_MAX_MESSAGE_SIZE+1)
+
+	// Large messages are rejected before publishing is authorized
+
+	clientConn, serverConn := net.Pipe()
+
+	client := NewRtmpConnection(clientConn, DEFAULT_MAX_BINARY_MSG_SIZE)
+	server := NewRtmpConnection(serverConn, DEFAULT_MAX_BINARY_MSG_SIZE)
+
+	go func() {
+		_ = client.WriteMessage(4, RTMP_MSG_VIDEO, RTMP_PUBLISH_STREAM_ID, 0, payload)
+	}()
+
+	_, err := server.ReadMessage()
+
+	if err != ErrRtmpProtocol {
+		t.Errorf("Expected ErrRtmpProtocol for a large message before authorization, but got: %v", err)
+	}
+
+	client.Close()
+	server.Close()
+
+	// Large messages are accepted once authorized
+
+	clientConn, serverConn = net.Pipe()
+
+	client = NewRtmpConnection(clientConn, DEFAULT_MAX_BINARY_MSG_SIZE)
+	server = NewRtmpConnection(serverConn, DEFAULT_MAX_BINARY_MSG_SIZE)
+
+	server.SetPublishAuthorized()
+
+	go func() {
+		_ = client.WriteMessage(4, RTMP_MSG_VIDEO, RTMP_PUBLISH_STREAM_ID, 0, payload)
+	}()
+
+	msg, err := server.ReadMessage()
+
+	if err != nil {
+		t.Errorf("Unexpected error after authorization: %v", err)
+	} else if !bytes.Equal(msg.Payload, payload) {
+		t.Errorf("Payload does not match")
+	}
+
+	client.Close()
+	server.Close()
+
+	// Too many chunk streams before publishing is authorized
+
+	clientConn, serverConn = net.Pipe()
+
+	client = NewRtmpConnection(clientConn, DEFAULT_MAX_BINARY_MSG_SIZE)
+	server = NewRtmpConnection(serverConn, DEFAULT_MAX_BINARY_MSG_SIZE)
+
+	go func() {
+		for i := 0; i <= RTMP_PRE_AUTH_MAX_CHUNK_STREAMS; i++ {
+			if client.WriteMessage(byte(3+i), RTMP_MSG_VIDEO, RTMP_PUBLISH_STREAM_ID, 0, []byte{0x00}) != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < RTMP_PRE_AUTH_MAX_CHUNK_STREAMS; i++ {
+		_, err = server.ReadMessage()
+
+		if err != nil {
+			t.Errorf("Unexpected error for chunk stream %v: %v", i, err)
+		}
+	}
+
+	_, err = server.ReadMessage()
+
+	if err != ErrRtmpProtocol {
+		t.Errorf("Expected ErrRtmpProtocol for too many chunk streams, but got: %v", err)
+	}
+
+	client.Close()
+	server.Close()
+}
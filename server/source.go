@@ -12,16 +12,25 @@ import (
 
 // HLS fragment
 type HlsFragment struct {
+	// Sequence number of the fragment in the stream (0 if unknown)
+	Sequence int64
+
 	// Duration of the fragment in seconds
 	Duration float32
 
 	// Data
 	Data []byte
+
+	// Cues to be delivered along with the fragment
+	Cues []*HlsCue
 }
 
 // Event types
 const HLS_EVENT_TYPE_CLOSE = 0
 const HLS_EVENT_TYPE_FRAGMENT = 1
+const HLS_EVENT_TYPE_PART = 2
+const HLS_EVENT_TYPE_METADATA = 3
+const HLS_EVENT_TYPE_VARIANTS = 4
 
 // HLS event
 type HlsEvent struct {
@@ -30,11 +39,52 @@ type HlsEvent struct {
 
 	// Fragment reference
 	Fragment *HlsFragment
+
+	// Fragment part reference
+	Part *HlsFragmentPart
+
+	// Stream metadata
+	Metadata map[string]string
+
+	// Variants of the stream group
+	Variants *HlsVariants
 }
 
+// Initial state for a new listener
+type HlsListenerInitialState struct {
+	// List of fragments to be sent as initial (they were in the buffer)
+	Fragments []*HlsFragment
+
+	// Latest stream metadata
+	Metadata map[string]string
+
+	// Variants of the stream group (nil if the stream is not in a group)
+	Variants *HlsVariants
+}
+
+// Multiplier for the channel size of listeners receiving fragment parts
+const HLS_LISTENER_PARTS_CHANNEL_MULTIPLIER = 8
+
 // HLS source listener
 type HlsSourceListener struct {
 	Channel chan HlsEvent
+
+	// True if the listener receives fragment parts
+	ReceiveParts bool
+}
+
+// Creates a new listener
+func NewHlsSourceListener(fragmentBufferMaxLength int, receiveParts bool) *HlsSourceListener {
+	channelSize := fragmentBufferMaxLength
+
+	if receiveParts {
+		channelSize = fragmentBufferMaxLength * HLS_LISTENER_PARTS_CHANNEL_MULTIPLIER
+	}
+
+	return &HlsSourceListener{
+		Channel:      make(chan HlsEvent, channelSize),
+		ReceiveParts: receiveParts,
+	}
 }
 
 // HLS source
@@ -66,6 +116,27 @@ type HlsSource struct {
 	// Max length of the fragment buffer
 	fragmentBufferMaxLength int
 
+	// Latest stream metadata
+	metadata map[string]string
+
+	// Variants of the stream group
+	variants *HlsVariants
+
+	// Cues waiting for the next fragment
+	pendingCues *HlsPendingCues
+
+	// Assembler for fragments pushed in parts
+	fragmentAssembler *HlsFragmentAssembler
+
+	// Sequence number for the next fragment
+	nextSequence int64
+
+	// DVR window (nil if DVR is disabled)
+	dvr *HlsDvrWindow
+
+	// Recorder (nil if not recording)
+	recorder *HlsRecorder
+
 	// Channel to interrupt the announcing thread
 	announceInterruptChannel chan bool
 }
@@ -86,6 +157,11 @@ func NewHlsSource(id uint64, controller *SourcesController, streamId string, fra
 		closed:                   false,
 		fragmentBuffer:           make([]*HlsFragment, 0),
 		fragmentBufferMaxLength:  fragmentBufferMaxLength,
+		metadata:                 make(map[string]string),
+		pendingCues:              &HlsPendingCues{},
+		fragmentAssembler:        NewHlsFragmentAssembler(controller.config.MaxFragmentSize),
+		nextSequence:             1,
+		dvr:                      controller.dvrController.CreateWindow(id, streamId),
 		announceInterruptChannel: make(chan bool, 1),
 	}
 }
@@ -125,14 +201,13 @@ func (source *HlsSource) Announce() {
 
 // Adds a listener
 // id - Connection ID
+// receiveParts - True to receive fragment parts
 // Returns
 // - success: True if the listener was added. If the source is closed, it will be false
 // - channel: The channel to receive the events
-// - initialFragments: List of fragments to be sent as initial (they were in the buffer)
-func (source *HlsSource) AddListener(id uint64) (success bool, channel chan HlsEvent, initialFragments []*HlsFragment) {
-	lis := &HlsSourceListener{
-		Channel: make(chan HlsEvent, source.fragmentBufferMaxLength),
-	}
+// - initialState: Initial state to send (buffered fragments, metadata, variants)
+func (source *HlsSource) AddListener(id uint64, receiveParts bool) (success bool, channel chan HlsEvent, initialState *HlsListenerInitialState) {
+	lis := NewHlsSourceListener(source.fragmentBufferMaxLength, receiveParts)
 
 	source.mu.Lock()
 	defer source.mu.Unlock()
@@ -146,7 +221,11 @@ func (source *HlsSource) AddListener(id uint64) (success bool, channel chan HlsE
 	initialFragmentsBuffer := make([]*HlsFragment, len(source.fragmentBuffer))
 	copy(initialFragmentsBuffer, source.fragmentBuffer)
 
-	return true, lis.Channel, initialFragmentsBuffer
+	return true, lis.Channel, &HlsListenerInitialState{
+		Fragments: initialFragmentsBuffer,
+		Metadata:  source.metadata,
+		Variants:  source.variants,
+	}
 }
 
 // Removes a listener
@@ -182,9 +261,26 @@ func (source *HlsSource) Close() {
 	source.listeners = nil
 	source.closed = true
 
+	if source.dvr != nil {
+		source.dvr.Close()
+	}
+
+	if source.recorder != nil {
+		source.recorder.Close()
+		source.recorder = nil
+	}
+
 	source.announceInterruptChannel <- true
 }
 
+// Checks if the source is closed
+func (source *HlsSource) IsClosed() bool {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	return source.closed
+}
+
 // Adds fragment
 func (source *HlsSource) AddFragment(frag *HlsFragment) {
 	source.mu.Lock()
@@ -194,8 +290,220 @@ func (source *HlsSource) AddFragment(frag *HlsFragment) {
 		return
 	}
 
+	// A complete fragment discards any incomplete one
+	source.fragmentAssembler.Reset()
+
+	// Attach pending cues
+	frag.Cues = append(frag.Cues, source.pendingCues.Take()...)
+
+	source.addFragmentInternal(frag)
+}
+
+// Sets the stream metadata, replacing the previous one
+// The metadata is sent to the listeners
+func (source *HlsSource) SetMetadata(metadata map[string]string) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	if source.closed {
+		return
+	}
+
+	if source.logger.Config.DebugEnabled {
+		source.logger.Debugf("Metadata updated: %v", metadata)
+	}
+
+	source.metadata = metadata
+
+	// Send metadata to the listeners
+
+	metadataEvent := HlsEvent{
+		EventType: HLS_EVENT_TYPE_METADATA,
+		Metadata:  metadata,
+	}
+
+	for _, lis := range source.listeners {
+		select {
+		case lis.Channel <- metadataEvent:
+		default:
+		}
+	}
+}
+
+// Sets the variants of the stream group (nil if the stream is not in a group)
+// The variants are sent to the listeners
+func (source *HlsSource) SetVariants(variants *HlsVariants) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	if source.closed {
+		return
+	}
+
+	source.variants = variants
+
+	// Send variants to the listeners
+
+	variantsEvent := HlsEvent{
+		EventType: HLS_EVENT_TYPE_VARIANTS,
+		Variants:  variants,
+	}
+
+	for _, lis := range source.listeners {
+		select {
+		case lis.Channel <- variantsEvent:
+		default:
+		}
+	}
+}
+
+// Adds a cue, to be delivered with the next fragment
+func (source *HlsSource) AddCue(cue *HlsCue) bool {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	if source.closed {
+		return false
+	}
+
+	if !source.pendingCues.Add(cue) {
+		source.logger.Warning("Cue discarded: Too many pending cues")
+		return false
+	}
+
 	if source.logger.Config.DebugEnabled {
-		source.logger.Debugf("Fragment added. Duration: %v, Size: %v", frag.Duration, len(frag.Data))
+		source.logger.Debugf("Cue added: %v", cue.Parameters)
+	}
+
+	return true
+}
+
+// Adds a fragment part
+// The part is sent to the listeners immediately
+// Once the last part is received, the complete fragment is added
+// Returns ErrFragmentPartsLimit if the fragment has too many parts, or they are too large
+func (source *HlsSource) AddFragmentPart(part *HlsFragmentPart) error {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	if source.closed {
+		return nil
+	}
+
+	// Attach pending cues
+	part.Cues = append(part.Cues, source.pendingCues.Take()...)
+
+	frag, err := source.fragmentAssembler.AddPart(part)
+
+	if err != nil {
+		source.pendingCues.Restore(part.Cues)
+
+		if err == ErrFragmentPartsLimit {
+			return err
+		}
+
+		source.logger.Warningf("Fragment part received out of order. Index: %v", part.Index)
+		return nil
+	}
+
+	if source.logger.Config.TraceEnabled {
+		source.logger.Tracef("Fragment part added. Index: %v, Duration: %v, Size: %v", part.Index, part.Duration, len(part.Data))
+	}
+
+	// Send part to the listeners
+
+	partEvent := HlsEvent{
+		EventType: HLS_EVENT_TYPE_PART,
+		Part:      part,
+	}
+
+	for _, lis := range source.listeners {
+		if !lis.ReceiveParts {
+			continue
+		}
+
+		select {
+		case lis.Channel <- partEvent:
+		default:
+		}
+	}
+
+	// Add the complete fragment
+
+	if frag != nil {
+		source.addFragmentInternal(frag)
+	}
+
+	return nil
+}
+
+// Starts recording the source
+// Returns the location of the recording, or an empty string if the recording could not be started
+// If the source is already being recorded, the location of the current recording is returned
+func (source *HlsSource) StartRecording() string {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	if source.closed {
+		return ""
+	}
+
+	if source.recorder != nil {
+		return source.recorder.GetLocation()
+	}
+
+	source.recorder = source.controller.recordingController.CreateRecorder(source.id, source.streamId)
+
+	if source.recorder == nil {
+		return ""
+	}
+
+	source.logger.Infof("Recording started: %v", source.recorder.GetLocation())
+
+	return source.recorder.GetLocation()
+}
+
+// Stops recording the source
+// Returns false if the source was not being recorded
+func (source *HlsSource) StopRecording() bool {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	if source.recorder == nil {
+		return false
+	}
+
+	source.recorder.Close()
+	source.recorder = nil
+
+	return true
+}
+
+// Gets the DVR window of the source
+// Returns nil if DVR is disabled
+func (source *HlsSource) GetDvrWindow() *HlsDvrWindow {
+	return source.dvr
+}
+
+// Adds fragment (internal, must be called with the mutex locked)
+func (source *HlsSource) addFragmentInternal(frag *HlsFragment) {
+	frag.Sequence = source.nextSequence
+	source.nextSequence++
+
+	if source.logger.Config.DebugEnabled {
+		source.logger.Debugf("Fragment added. Sequence: %v, Duration: %v, Size: %v", frag.Sequence, frag.Duration, len(frag.Data))
+	}
+
+	// Store the fragment in the DVR window
+
+	if source.dvr != nil {
+		source.dvr.AddFragment(frag)
+	}
+
+	// Record the fragment (never blocks)
+
+	if source.recorder != nil {
+		source.recorder.AddFragment(frag)
 	}
 
 	// Append the fragment to the buffer
@@ -13,6 +13,9 @@ type SourcesControllerConfig struct {
 	// Max length of the fragment buffer
 	FragmentBufferMaxLength int
 
+	// Max size (bytes) of a fragment pushed in parts. 0 for unlimited.
+	MaxFragmentSize int64
+
 	// External websocket URL
 	ExternalWebsocketUrl string
 
@@ -34,26 +37,46 @@ type SourcesController struct {
 	// Memory limiter for fragment buffers
 	memoryLimiter *FragmentBufferMemoryLimiter
 
+	// DVR controller
+	dvrController *DvrController
+
+	// Recording controller
+	recordingController *RecordingController
+
+	// Lifecycle event webhooks
+	eventWebhooks *EventWebhooks
+
 	// Configuration
 	config SourcesControllerConfig
 
 	// Sources
 	sources map[string]*HlsSource
 
+	// Stream groups
+	groups map[string]*HlsStreamGroup
+
+	// Map (Stream ID -> Group ID)
+	streamGroups map[string]string
+
 	// ID for the next source
 	nextSourceId uint64
 }
 
 // Creates new instance of SourcesController
-func NewSourcesController(config SourcesControllerConfig, publishRegistry PublishRegistry, memoryLimiter *FragmentBufferMemoryLimiter, logger *glog.Logger) *SourcesController {
+func NewSourcesController(config SourcesControllerConfig, publishRegistry PublishRegistry, memoryLimiter *FragmentBufferMemoryLimiter, dvrController *DvrController, recordingController *RecordingController, eventWebhooks *EventWebhooks, logger *glog.Logger) *SourcesController {
 	return &SourcesController{
-		mu:              &sync.Mutex{},
-		logger:          logger,
-		publishRegistry: publishRegistry,
-		memoryLimiter:   memoryLimiter,
-		config:          config,
-		sources:         make(map[string]*HlsSource),
-		nextSourceId:    0,
+		mu:                  &sync.Mutex{},
+		logger:              logger,
+		publishRegistry:     publishRegistry,
+		memoryLimiter:       memoryLimiter,
+		dvrController:       dvrController,
+		recordingController: recordingController,
+		eventWebhooks:       eventWebhooks,
+		config:              config,
+		sources:             make(map[string]*HlsSource),
+		groups:              make(map[string]*HlsStreamGroup),
+		streamGroups:        make(map[string]string),
+		nextSourceId:        0,
 	}
 }
 
@@ -82,6 +105,8 @@ func (sc *SourcesController) CreateSource(streamId string) *HlsSource {
 
 	sc.sources[streamId] = source
 
+	variants := sc.getVariantsForStream(streamId)
+
 	sc.mu.Unlock()
 
 	// Close existing source
@@ -90,24 +115,61 @@ func (sc *SourcesController) CreateSource(streamId string) *HlsSource {
 		existingSource.Close()
 	}
 
+	// Set the variants of the group
+
+	if variants != nil {
+		source.SetVariants(variants)
+	}
+
 	// Announce
 
 	source.Announce()
 
+	sc.eventWebhooks.Notify(EVENT_SOURCE_CREATED, streamId, nil)
+
 	return source
 }
 
+// Starts recording a source, if requested by the publisher
+// source - The source
+// record - True if the publisher requested the recording
+// logger - Logger of the publisher, to warn if recording is disabled
+func (sc *SourcesController) StartRecordingIfRequested(source *HlsSource, record bool, logger *glog.Logger) {
+	if !record {
+		return
+	}
+
+	if !sc.recordingController.IsEnabled() {
+		logger.Warningf("Could not record stream %v: Recording is disabled", source.streamId)
+		return
+	}
+
+	source.StartRecording()
+}
+
 // Removes a source
 // Must be called only after the source of closed, by the publisher
 func (sc *SourcesController) RemoveSource(streamId string, source *HlsSource) {
 	sc.mu.Lock()
-	defer sc.mu.Unlock()
 
 	existingSource := sc.sources[streamId]
 
 	if existingSource != source {
+		sc.mu.Unlock()
 		return
 	}
 
 	delete(sc.sources, streamId)
+
+	groupSources, groupVariants := sc.leaveGroup(streamId)
+
+	sc.mu.Unlock()
+
+	// Update the variants of the group
+
+	for i, s := range groupSources {
+		s.SetVariants(groupVariants[i])
+	}
+
+	sc.eventWebhooks.Notify(EVENT_SOURCE_CLOSED, streamId, nil)
 }
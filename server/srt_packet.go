@@ -0,0 +1,357 @@
+// SRT packets
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Size of the header of SRT packets
+const SRT_HEADER_SIZE = 16
+
+// Mask for the sequence numbers (31 bits)
+const SRT_SEQUENCE_MASK = 0x7FFFFFFF
+
+// Control packet types
+const (
+	SRT_CONTROL_HANDSHAKE = 0x0000
+	SRT_CONTROL_KEEPALIVE = 0x0001
+	SRT_CONTROL_ACK       = 0x0002
+	SRT_CONTROL_NAK       = 0x0003
+	SRT_CONTROL_SHUTDOWN  = 0x0005
+	SRT_CONTROL_ACKACK    = 0x0006
+)
+
+// Handshake types
+const (
+	SRT_HANDSHAKE_INDUCTION  = 0x00000001
+	SRT_HANDSHAKE_CONCLUSION = 0xFFFFFFFF
+)
+
+// Value of the extension field in the induction response (HSv5)
+const SRT_HANDSHAKE_MAGIC = 0x4A17
+
+// Size of the handshake control information field, without extensions
+const SRT_HANDSHAKE_SIZE = 48
+
+// Flags of the handshake extension field
+const (
+	SRT_HANDSHAKE_FLAG_HSREQ  = 0x1
+	SRT_HANDSHAKE_FLAG_KMREQ  = 0x2
+	SRT_HANDSHAKE_FLAG_CONFIG = 0x4
+)
+
+// Handshake extension types
+const (
+	SRT_EXTENSION_HSREQ = 1
+	SRT_EXTENSION_HSRSP = 2
+	SRT_EXTENSION_KMREQ = 3
+	SRT_EXTENSION_SID   = 5
+)
+
+// SRT flags (HSREQ and HSRSP extensions)
+const (
+	SRT_FLAG_TSBPDSND    = 0x01
+	SRT_FLAG_TSBPDRCV    = 0x02
+	SRT_FLAG_CRYPT       = 0x04
+	SRT_FLAG_TLPKTDROP   = 0x08
+	SRT_FLAG_PERIODICNAK = 0x10
+	SRT_FLAG_REXMITFLG   = 0x20
+	SRT_FLAG_STREAM      = 0x40
+)
+
+// SRT version sent in the handshake response (1.5.0)
+const SRT_VERSION = 0x010500
+
+// Rejection reasons, sent as the handshake type
+const (
+	SRT_REJECT_ROGUE        = 1004
+	SRT_REJECT_VERSION      = 1008
+	SRT_REJECT_UNSECURE     = 1011
+	SRT_REJECT_MESSAGEAPI   = 1012
+	SRT_REJECT_BAD_REQUEST  = 2400
+	SRT_REJECT_UNAUTHORIZED = 2401
+	SRT_REJECT_FORBIDDEN    = 2403
+	SRT_REJECT_BAD_MODE     = 2405
+)
+
+// Prefix of the stream IDs using the SRT access control syntax
+const SRT_STREAM_ID_PREFIX = "#!::"
+
+// Error for invalid SRT packets
+var ErrSrtInvalid = errors.New("invalid SRT packet")
+
+// SRT packet
+type SrtPacket struct {
+	// True for control packets, false for data packets
+	IsControl bool
+
+	// Sequence number (data packets)
+	SequenceNumber uint32
+
+	// Control type (control packets)
+	ControlType uint16
+
+	// Subtype (control packets)
+	Subtype uint16
+
+	// Second word of the header
+	// Message number and flags for data packets, type-specific information for control packets
+	Info uint32
+
+	// Timestamp (microseconds since the connection started)
+	Timestamp uint32
+
+	// Destination socket ID
+	DestinationSocketId uint32
+
+	// Payload (data packets) or control information field (control packets)
+	Payload []byte
+}
+
+// Parses a SRT packet
+// The payload is copied
+func parseSrtPacket(data []byte) (*SrtPacket, error) {
+	if len(data) < SRT_HEADER_SIZE {
+		return nil, ErrSrtInvalid
+	}
+
+	packet := &SrtPacket{
+		IsControl:           data[0]&0x80 != 0,
+		Info:                binary.BigEndian.Uint32(data[4:8]),
+		Timestamp:           binary.BigEndian.Uint32(data[8:12]),
+		DestinationSocketId: binary.BigEndian.Uint32(data[12:16]),
+		Payload:             append([]byte{}, data[SRT_HEADER_SIZE:]...),
+	}
+
+	if packet.IsControl {
+		packet.ControlType = binary.BigEndian.Uint16(data[0:2]) & 0x7FFF
+		packet.Subtype = binary.BigEndian.Uint16(data[2:4])
+	} else {
+		packet.SequenceNumber = binary.BigEndian.Uint32(data[0:4]) & SRT_SEQUENCE_MASK
+	}
+
+	return packet, nil
+}
+
+// Serializes the packet
+func (packet *SrtPacket) Serialize() []byte {
+	data := make([]byte, SRT_HEADER_SIZE, SRT_HEADER_SIZE+len(packet.Payload))
+
+	if packet.IsControl {
+		binary.BigEndian.PutUint16(data[0:2], 0x8000|packet.ControlType)
+		binary.BigEndian.PutUint16(data[2:4], packet.Subtype)
+	} else {
+		binary.BigEndian.PutUint32(data[0:4], packet.SequenceNumber&SRT_SEQUENCE_MASK)
+	}
+
+	binary.BigEndian.PutUint32(data[4:8], packet.Info)
+	binary.BigEndian.PutUint32(data[8:12], packet.Timestamp)
+	binary.BigEndian.PutUint32(data[12:16], packet.DestinationSocketId)
+
+	return append(data, packet.Payload...)
+}
+
+// Computes the difference between two sequence numbers (a - b), taking into account the wrap around
+func srtSequenceDiff(a uint32, b uint32) int32 {
+	return int32((a-b)<<1) >> 1
+}
+
+// Gets the next sequence number
+func srtSequenceNext(seq uint32) uint32 {
+	return (seq + 1) & SRT_SEQUENCE_MASK
+}
+
+// Extension of a SRT handshake
+type SrtHandshakeExtension struct {
+	// Extension type
+	Type uint16
+
+	// Content (length multiple of 4)
+	Content []byte
+}
+
+// SRT handshake (control information field of handshake packets)
+type SrtHandshake struct {
+	// Handshake version
+	Version uint32
+
+	// Encryption field
+	EncryptionField uint16
+
+	// Extension field (magic value in the induction, flags in the conclusion)
+	ExtensionField uint16
+
+	// Initial packet sequence number
+	InitialSequenceNumber uint32
+
+	// Maximum transmission unit size
+	Mtu uint32
+
+	// Maximum flow window size
+	FlowWindow uint32
+
+	// Handshake type (or rejection reason)
+	HandshakeType uint32
+
+	// Socket ID of the sender
+	SocketId uint32
+
+	// SYN cookie
+	SynCookie uint32
+
+	// IP address of the peer
+	PeerIp [16]byte
+
+	// Extensions
+	Extensions []SrtHandshakeExtension
+}
+
+// Parses a SRT handshake
+func parseSrtHandshake(data []byte) (*SrtHandshake, error) {
+	if len(data) < SRT_HANDSHAKE_SIZE {
+		return nil, ErrSrtInvalid
+	}
+
+	hs := &SrtHandshake{
+		Version:               binary.BigEndian.Uint32(data[0:4]),
+		EncryptionField:       binary.BigEndian.Uint16(data[4:6]),
+		ExtensionField:        binary.BigEndian.Uint16(data[6:8]),
+		InitialSequenceNumber: binary.BigEndian.Uint32(data[8:12]),
+		Mtu:                   binary.BigEndian.Uint32(data[12:16]),
+		FlowWindow:            binary.BigEndian.Uint32(data[16:20]),
+		HandshakeType:         binary.BigEndian.Uint32(data[20:24]),
+		SocketId:              binary.BigEndian.Uint32(data[24:28]),
+		SynCookie:             binary.BigEndian.Uint32(data[28:32]),
+		Extensions:            make([]SrtHandshakeExtension, 0),
+	}
+
+	copy(hs.PeerIp[:], data[32:48])
+
+	for offset := SRT_HANDSHAKE_SIZE; offset+4 <= len(data); {
+		extensionType := binary.BigEndian.Uint16(data[offset : offset+2])
+		extensionLength := int(binary.BigEndian.Uint16(data[offset+2:offset+4])) * 4
+
+		offset += 4
+
+		if offset+extensionLength > len(data) {
+			return nil, ErrSrtInvalid
+		}
+
+		hs.Extensions = append(hs.Extensions, SrtHandshakeExtension{
+			Type:    extensionType,
+			Content: data[offset : offset+extensionLength],
+		})
+
+		offset += extensionLength
+	}
+
+	return hs, nil
+}
+
+// Finds an extension of the handshake
+// Returns nil if not found
+func (hs *SrtHandshake) GetExtension(extensionType uint16) []byte {
+	for _, ext := range hs.Extensions {
+		if ext.Type == extensionType {
+			return ext.Content
+		}
+	}
+
+	return nil
+}
+
+// Serializes the handshake
+func (hs *SrtHandshake) Serialize() []byte {
+	data := make([]byte, SRT_HANDSHAKE_SIZE)
+
+	binary.BigEndian.PutUint32(data[0:4], hs.Version)
+	binary.BigEndian.PutUint16(data[4:6], hs.EncryptionField)
+	binary.BigEndian.PutUint16(data[6:8], hs.ExtensionField)
+	binary.BigEndian.PutUint32(data[8:12], hs.InitialSequenceNumber)
+	binary.BigEndian.PutUint32(data[12:16], hs.Mtu)
+	binary.BigEndian.PutUint32(data[16:20], hs.FlowWindow)
+	binary.BigEndian.PutUint32(data[20:24], hs.HandshakeType)
+	binary.BigEndian.PutUint32(data[24:28], hs.SocketId)
+	binary.BigEndian.PutUint32(data[28:32], hs.SynCookie)
+	copy(data[32:48], hs.PeerIp[:])
+
+	for _, ext := range hs.Extensions {
+		data = binary.BigEndian.AppendUint16(data, ext.Type)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(ext.Content)/4))
+		data = append(data, ext.Content...)
+	}
+
+	return data
+}
+
+// Encodes the content of a HSREQ or HSRSP extension
+// receiverDelay - TSBPD delay of the receiver (milliseconds)
+// senderDelay - TSBPD delay of the sender (milliseconds)
+func encodeSrtHandshakeOptions(flags uint32, receiverDelay uint16, senderDelay uint16) []byte {
+	content := make([]byte, 12)
+
+	binary.BigEndian.PutUint32(content[0:4], SRT_VERSION)
+	binary.BigEndian.PutUint32(content[4:8], flags)
+	binary.BigEndian.PutUint16(content[8:10], receiverDelay)
+	binary.BigEndian.PutUint16(content[10:12], senderDelay)
+
+	return content
+}
+
+// Encodes the content of a stream ID extension
+// The stream ID is padded to a multiple of 4 bytes, and each 4 byte word is reversed
+func encodeSrtStreamId(streamId string) []byte {
+	content := []byte(streamId)
+
+	for len(content)%4 != 0 {
+		content = append(content, 0)
+	}
+
+	for i := 0; i < len(content); i += 4 {
+		content[i], content[i+1], content[i+2], content[i+3] = content[i+3], content[i+2], content[i+1], content[i]
+	}
+
+	return content
+}
+
+// Decodes the content of a stream ID extension
+func decodeSrtStreamId(content []byte) string {
+	data := make([]byte, len(content))
+
+	for i := 0; i+4 <= len(content); i += 4 {
+		data[i], data[i+1], data[i+2], data[i+3] = content[i+3], content[i+2], content[i+1], content[i]
+	}
+
+	return strings.TrimRight(string(data), "\x00")
+}
+
+// Parses a SRT stream ID using the access control syntax
+// Format: #!::r={STREAM_ID},m=publish,s={TOKEN}
+// Returns the stream ID, the token, the mode and true if the format is valid
+func parseSrtStreamId(srtStreamId string) (streamId string, token string, mode string, ok bool) {
+	if !strings.HasPrefix(srtStreamId, SRT_STREAM_ID_PREFIX) {
+		return "", "", "", false
+	}
+
+	for _, pair := range strings.Split(srtStreamId[len(SRT_STREAM_ID_PREFIX):], ",") {
+		key, value, found := strings.Cut(pair, "=")
+
+		if !found {
+			continue
+		}
+
+		switch key {
+		case "r":
+			streamId = value
+		case "s":
+			token = value
+		case "m":
+			mode = value
+		}
+	}
+
+	return streamId, token, mode, streamId != ""
+}
@@ -0,0 +1,873 @@
+// SRT ingest server
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+)
+
+// Max size of the UDP datagrams
+const SRT_MAX_DATAGRAM_SIZE = 1500
+
+// Max size of the receive window (packets)
+const SRT_RECEIVE_WINDOW = 8192
+
+// Size of the queue of received packets for each session
+const SRT_SESSION_QUEUE_SIZE = 1024
+
+// Interval to send acknowledgements and to check for lost packets
+const SRT_TICK_INTERVAL = 10 * time.Millisecond
+
+// Min interval to repeat the loss reports (NAK)
+const SRT_NAK_MIN_INTERVAL = 20 * time.Millisecond
+
+// Interval to send keep-alive packets
+const SRT_KEEPALIVE_INTERVAL = 1 * time.Second
+
+// Time without receiving packets to consider the connection lost
+const SRT_PEER_IDLE_TIMEOUT = 5 * time.Second
+
+// Max number of sequence numbers in a loss report
+const SRT_MAX_NAK_LENGTH = 256
+
+// Max number of handshakes being authorized at the same time
+const SRT_MAX_PENDING_HANDSHAKES = 64
+
+// SRT server configuration
+type SrtConfig struct {
+	// True to enable the SRT server
+	Enabled bool
+
+	// Port (UDP)
+	Port int
+
+	// Bind address
+	BindAddress string
+
+	// Min duration of the fragments (milliseconds)
+	FragmentDuration int64
+
+	// Max size of a fragment (bytes)
+	MaxFragmentSize int64
+
+	// Min latency (milliseconds)
+	// Lost packets not recovered in this time are skipped
+	Latency int
+}
+
+// SRT server
+// Receives MPEG-TS streams from SRT callers, and splits them into HLS fragments
+type SrtServer struct {
+	// Configuration
+	config SrtConfig
+
+	// Logger
+	logger *glog.Logger
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Packet connection
+	conn net.PacketConn
+
+	// Secret to generate the SYN cookies
+	cookieSecret []byte
+
+	// Next socket ID
+	nextSocketId uint32
+
+	// Sessions (Socket ID -> Session)
+	sessions map[uint32]*SrtSession
+
+	// Sessions by peer (Address + Peer socket ID -> Session)
+	sessionsByPeer map[string]*SrtSession
+
+	// Handshakes being authorized (Address + Peer socket ID)
+	pendingHandshakes map[string]bool
+
+	// True if the server was closed
+	closed bool
+
+	// Auth controller
+	authController *AuthController
+
+	// Sources controller
+	sourceController *SourcesController
+}
+
+// Creates new instance of SrtServer
+func NewSrtServer(config SrtConfig, authController *AuthController, sourceController *SourcesController, logger *glog.Logger) *SrtServer {
+	cookieSecret := make([]byte, 32)
+	_, _ = rand.Read(cookieSecret)
+
+	randomId := make([]byte, 4)
+	_, _ = rand.Read(randomId)
+
+	return &SrtServer{
+		config:            config,
+		logger:            logger,
+		mu:                &sync.Mutex{},
+		cookieSecret:      cookieSecret,
+		nextSocketId:      binary.BigEndian.Uint32(randomId)&0x3FFFFFFF | 1,
+		sessions:          make(map[uint32]*SrtSession),
+		sessionsByPeer:    make(map[string]*SrtSession),
+		pendingHandshakes: make(map[string]bool),
+		authController:    authController,
+		sourceController:  sourceController,
+	}
+}
+
+// Runs the server
+// wg - Wait group
+func (server *SrtServer) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if !server.config.Enabled {
+		return
+	}
+
+	conn, err := net.ListenPacket("udp", server.config.BindAddress+":"+strconv.Itoa(server.config.Port))
+
+	if err != nil {
+		server.logger.Errorf("Error starting SRT server: %v", err)
+		return
+	}
+
+	server.logger.Infof("[SRT] Listening on %v:%v", server.config.BindAddress, server.config.Port)
+
+	server.Serve(conn)
+}
+
+// Receives packets from a connection, until it is closed
+func (server *SrtServer) Serve(conn net.PacketConn) {
+	server.mu.Lock()
+	server.conn = conn
+	server.mu.Unlock()
+
+	defer server.closeSessions()
+
+	buf := make([]byte, SRT_MAX_DATAGRAM_SIZE)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			server.logger.Errorf("Error receiving SRT packet: %v", err)
+			continue
+		}
+
+		packet, err := parseSrtPacket(buf[:n])
+
+		if err != nil {
+			continue
+		}
+
+		if packet.DestinationSocketId == 0 {
+			if packet.IsControl && packet.ControlType == SRT_CONTROL_HANDSHAKE {
+				server.handleHandshake(addr, packet)
+			}
+
+			continue
+		}
+
+		server.mu.Lock()
+		session := server.sessions[packet.DestinationSocketId]
+		server.mu.Unlock()
+
+		if session == nil || session.addr.String() != addr.String() {
+			continue
+		}
+
+		session.Receive(packet)
+	}
+}
+
+// Closes all the sessions
+func (server *SrtServer) closeSessions() {
+	server.mu.Lock()
+
+	server.closed = true
+
+	sessions := make([]*SrtSession, 0, len(server.sessions))
+
+	for _, session := range server.sessions {
+		sessions = append(sessions, session)
+	}
+
+	server.mu.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+}
+
+// Removes a session
+func (server *SrtServer) removeSession(session *SrtSession) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	delete(server.sessions, session.socketId)
+	delete(server.sessionsByPeer, session.peerKey)
+}
+
+// Sends a control packet
+func (server *SrtServer) sendControl(addr net.Addr, controlType uint16, info uint32, timestamp uint32, destinationSocketId uint32, payload []byte) {
+	packet := &SrtPacket{
+		IsControl:           true,
+		ControlType:         controlType,
+		Info:                info,
+		Timestamp:           timestamp,
+		DestinationSocketId: destinationSocketId,
+		Payload:             payload,
+	}
+
+	_, _ = server.conn.WriteTo(packet.Serialize(), addr)
+}
+
+// Computes the SYN cookie for a peer
+// minutesAgo - Number of minutes ago (the cookie changes every minute)
+func (server *SrtServer) computeSynCookie(addr net.Addr, minutesAgo int64) uint32 {
+	minute := time.Now().Unix()/60 - minutesAgo
+
+	h := hmac.New(sha256.New, server.cookieSecret)
+	h.Write([]byte(addr.String() + "/" + fmt.Sprint(minute)))
+
+	return binary.BigEndian.Uint32(h.Sum(nil)[:4])
+}
+
+// Checks the SYN cookie sent by a peer
+func (server *SrtServer) checkSynCookie(addr net.Addr, cookie uint32) bool {
+	return cookie == server.computeSynCookie(addr, 0) || cookie == server.computeSynCookie(addr, 1)
+}
+
+// Sends a handshake rejection
+func (server *SrtServer) rejectHandshake(addr net.Addr, hs *SrtHandshake, reason uint32) {
+	response := &SrtHandshake{
+		Version:               hs.Version,
+		InitialSequenceNumber: hs.InitialSequenceNumber,
+		Mtu:                   hs.Mtu,
+		FlowWindow:            hs.FlowWindow,
+		HandshakeType:         reason,
+		SynCookie:             hs.SynCookie,
+	}
+
+	server.sendControl(addr, SRT_CONTROL_HANDSHAKE, 0, 0, hs.SocketId, response.Serialize())
+}
+
+// Handles a handshake sent to the listener
+func (server *SrtServer) handleHandshake(addr net.Addr, packet *SrtPacket) {
+	hs, err := parseSrtHandshake(packet.Payload)
+
+	if err != nil {
+		return
+	}
+
+	switch hs.HandshakeType {
+	case SRT_HANDSHAKE_INDUCTION:
+		response := &SrtHandshake{
+			Version:               5,
+			ExtensionField:        SRT_HANDSHAKE_MAGIC,
+			InitialSequenceNumber: hs.InitialSequenceNumber,
+			Mtu:                   hs.Mtu,
+			FlowWindow:            hs.FlowWindow,
+			HandshakeType:         SRT_HANDSHAKE_INDUCTION,
+			SynCookie:             server.computeSynCookie(addr, 0),
+			PeerIp:                hs.PeerIp,
+		}
+
+		server.sendControl(addr, SRT_CONTROL_HANDSHAKE, 0, 0, hs.SocketId, response.Serialize())
+	case SRT_HANDSHAKE_CONCLUSION:
+		server.handleConclusion(addr, hs)
+	}
+}
+
+// Handles a conclusion handshake, creating the session
+func (server *SrtServer) handleConclusion(addr net.Addr, hs *SrtHandshake) {
+	if !server.checkSynCookie(addr, hs.SynCookie) {
+		server.rejectHandshake(addr, hs, SRT_REJECT_ROGUE)
+		return
+	}
+
+	peerKey := addr.String() + "/" + fmt.Sprint(hs.SocketId)
+
+	server.mu.Lock()
+	existingSession := server.sessionsByPeer[peerKey]
+	server.mu.Unlock()
+
+	if existingSession != nil {
+		// The response was lost, send it again
+		_, _ = server.conn.WriteTo(existingSession.handshakeResponse, addr)
+		return
+	}
+
+	hsReq := hs.GetExtension(SRT_EXTENSION_HSREQ)
+
+	if hs.Version != 5 || len(hsReq) < 12 {
+		server.rejectHandshake(addr, hs, SRT_REJECT_VERSION)
+		return
+	}
+
+	flags := binary.BigEndian.Uint32(hsReq[4:8])
+
+	if flags&SRT_FLAG_STREAM != 0 {
+		server.rejectHandshake(addr, hs, SRT_REJECT_MESSAGEAPI)
+		return
+	}
+
+	if hs.ExtensionField&SRT_HANDSHAKE_FLAG_KMREQ != 0 || hs.GetExtension(SRT_EXTENSION_KMREQ) != nil {
+		// Encryption is not supported
+		server.rejectHandshake(addr, hs, SRT_REJECT_UNSECURE)
+		return
+	}
+
+	// Authentication
+
+	streamId, token, mode, ok := parseSrtStreamId(decodeSrtStreamId(hs.GetExtension(SRT_EXTENSION_SID)))
+
+	if !ok || len(streamId) > 255 {
+		server.rejectHandshake(addr, hs, SRT_REJECT_BAD_REQUEST)
+		return
+	}
+
+	if mode != "" && mode != "publish" {
+		server.rejectHandshake(addr, hs, SRT_REJECT_BAD_MODE)
+		return
+	}
+
+	if !server.authController.IsPushAllowed() {
+		server.rejectHandshake(addr, hs, SRT_REJECT_FORBIDDEN)
+		return
+	}
+
+	// Authorize in a separate goroutine, so the receive loop is not blocked.
+	// Repeated conclusions are ignored while the handshake is pending.
+
+	server.mu.Lock()
+
+	if server.sessionsByPeer[peerKey] != nil || server.pendingHandshakes[peerKey] || len(server.pendingHandshakes) >= SRT_MAX_PENDING_HANDSHAKES {
+		server.mu.Unlock()
+		return
+	}
+
+	server.pendingHandshakes[peerKey] = true
+
+	server.mu.Unlock()
+
+	go server.acceptConclusion(addr, hs, hsReq, peerKey, streamId, token)
+}
+
+// Removes a pending handshake
+func (server *SrtServer) removePendingHandshake(peerKey string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	delete(server.pendingHandshakes, peerKey)
+}
+
+// Authorizes a conclusion handshake, and creates the session
+// Runs in its own goroutine
+func (server *SrtServer) acceptConclusion(addr net.Addr, hs *SrtHandshake, hsReq []byte, peerKey string, streamId string, token string) {
+	ip, _, _ := net.SplitHostPort(addr.String())
+
+	validToken, claims := server.authController.ValidatePushTokenClaims(token, streamId, ip)
+
+	if !validToken {
+		server.removePendingHandshake(peerKey)
+		server.logger.Debugf("Invalid token for %v from %v", streamId, addr)
+		server.sourceController.eventWebhooks.NotifyPublisherAuthError(streamId, "Invalid token")
+		server.rejectHandshake(addr, hs, SRT_REJECT_UNAUTHORIZED)
+		return
+	}
+
+	// Negotiate latency
+
+	latency := uint16(server.config.Latency)
+	peerSenderDelay := binary.BigEndian.Uint16(hsReq[10:12])
+	peerReceiverDelay := binary.BigEndian.Uint16(hsReq[8:10])
+
+	if peerSenderDelay > latency {
+		latency = peerSenderDelay
+	}
+
+	mtu := hs.Mtu
+
+	if mtu > SRT_MAX_DATAGRAM_SIZE {
+		mtu = SRT_MAX_DATAGRAM_SIZE
+	}
+
+	// Create session
+
+	server.mu.Lock()
+
+	socketId := server.nextSocketId
+	server.nextSocketId = (server.nextSocketId + 1) & 0x3FFFFFFF
+
+	if server.nextSocketId == 0 {
+		server.nextSocketId = 1
+	}
+
+	server.mu.Unlock()
+
+	response := &SrtHandshake{
+		Version:               5,
+		ExtensionField:        SRT_HANDSHAKE_FLAG_HSREQ,
+		InitialSequenceNumber: hs.InitialSequenceNumber,
+		Mtu:                   mtu,
+		FlowWindow:            hs.FlowWindow,
+		HandshakeType:         SRT_HANDSHAKE_CONCLUSION,
+		SocketId:              socketId,
+		SynCookie:             hs.SynCookie,
+		PeerIp:                hs.PeerIp,
+		Extensions: []SrtHandshakeExtension{
+			{
+				Type:    SRT_EXTENSION_HSRSP,
+				Content: encodeSrtHandshakeOptions(SRT_FLAG_TSBPDSND|SRT_FLAG_TSBPDRCV|SRT_FLAG_TLPKTDROP|SRT_FLAG_PERIODICNAK|SRT_FLAG_REXMITFLG, latency, peerReceiverDelay),
+			},
+		},
+	}
+
+	responsePacket := &SrtPacket{
+		IsControl:           true,
+		ControlType:         SRT_CONTROL_HANDSHAKE,
+		DestinationSocketId: hs.SocketId,
+		Payload:             response.Serialize(),
+	}
+
+	session := &SrtSession{
+		server:            server,
+		logger:            server.logger.CreateChildLogger("[SRT #" + fmt.Sprint(socketId) + "] "),
+		addr:              addr,
+		socketId:          socketId,
+		peerSocketId:      hs.SocketId,
+		peerKey:           peerKey,
+		handshakeResponse: responsePacket.Serialize(),
+		latency:           time.Duration(latency) * time.Millisecond,
+		startTime:         time.Now(),
+		queue:             make(chan *SrtPacket, SRT_SESSION_QUEUE_SIZE),
+		closeChan:         make(chan bool),
+		streamId:          streamId,
+		nextSequence:      hs.InitialSequenceNumber & SRT_SEQUENCE_MASK,
+		lastSequence:      (hs.InitialSequenceNumber - 1) & SRT_SEQUENCE_MASK,
+		received:          make(map[uint32][]byte),
+	}
+
+	session.lastAckedSequence = session.nextSequence
+
+	server.mu.Lock()
+
+	delete(server.pendingHandshakes, peerKey)
+
+	if server.closed {
+		server.mu.Unlock()
+		return
+	}
+
+	server.sessions[socketId] = session
+	server.sessionsByPeer[peerKey] = session
+
+	server.mu.Unlock()
+
+	session.startPublishing(getBoolClaim(claims, "record"))
+
+	session.revocationWatcherId = server.authController.WatchTokenRevocation(claims, func() {
+		session.logger.Infof("Closing stream %v: The token was revoked", streamId)
+		session.Close()
+	})
+
+	_, _ = server.conn.WriteTo(session.handshakeResponse, addr)
+
+	go session.Run()
+}
+
+// SRT session (one per connected caller)
+type SrtSession struct {
+	// Server
+	server *SrtServer
+
+	// Logger
+	logger *glog.Logger
+
+	// Address of the peer
+	addr net.Addr
+
+	// Socket ID
+	socketId uint32
+
+	// Socket ID of the peer
+	peerSocketId uint32
+
+	// Key to find the session by peer
+	peerKey string
+
+	// Handshake response packet (sent again if the peer repeats the conclusion)
+	handshakeResponse []byte
+
+	// Latency. Lost packets not recovered in this time are skipped
+	latency time.Duration
+
+	// Time when the session started
+	startTime time.Time
+
+	// Queue of received packets
+	queue chan *SrtPacket
+
+	// Channel closed to close the session
+	closeChan chan bool
+
+	// True if closed
+	closed bool
+
+	// Stream ID
+	streamId string
+
+	// Source to push to
+	source *HlsSource
+
+	// Segmenter
+	segmenter *TsSegmenter
+
+	// Next expected sequence number (only accessed by the session thread)
+	nextSequence uint32
+
+	// Highest received sequence number
+	lastSequence uint32
+
+	// Received packets waiting for lost ones (Sequence number -> Payload)
+	received map[uint32][]byte
+
+	// Time when the oldest current loss was detected
+	lossTime time.Time
+
+	// Time when the last loss report was sent
+	lastNakTime time.Time
+
+	// Last acknowledgement number
+	ackNumber uint32
+
+	// Last acknowledged sequence number
+	lastAckedSequence uint32
+
+	// Time when the last packet was received
+	lastReceiveTime time.Time
+
+	// Time when the last packet was sent
+	lastSendTime time.Time
+
+	// ID of the watcher to close the session if the token is revoked
+	revocationWatcherId uint64
+}
+
+// Creates the source and starts publishing
+// record - True to record the stream
+func (session *SrtSession) startPublishing(record bool) {
+	sourceController := session.server.sourceController
+
+	source := sourceController.CreateSource(session.streamId)
+
+	go source.PeriodicallyAnnounce()
+
+	sourceController.StartRecordingIfRequested(source, record, session.logger)
+
+	session.source = source
+
+	session.segmenter = NewTsSegmenter(session.server.config.FragmentDuration, int(session.server.config.MaxFragmentSize), func(duration float32, data []byte) {
+		source.AddFragment(&HlsFragment{
+			Duration: duration,
+			Data:     data,
+		})
+	})
+
+	session.logger.Infof("Publishing stream %v from %v", session.streamId, session.addr)
+}
+
+// Queues a received packet
+// If the queue is full, the packet is discarded (it will be reported as lost)
+func (session *SrtSession) Receive(packet *SrtPacket) {
+	select {
+	case session.queue <- packet:
+	default:
+	}
+}
+
+// Closes the session
+func (session *SrtSession) Close() {
+	session.server.mu.Lock()
+	defer session.server.mu.Unlock()
+
+	if session.closed {
+		return
+	}
+
+	session.closed = true
+
+	close(session.closeChan)
+}
+
+// Gets the timestamp for the sent packets
+func (session *SrtSession) getTimestamp() uint32 {
+	return uint32(time.Since(session.startTime).Microseconds())
+}
+
+// Sends a control packet to the peer
+func (session *SrtSession) sendControl(controlType uint16, info uint32, payload []byte) {
+	session.server.sendControl(session.addr, controlType, info, session.getTimestamp(), session.peerSocketId, payload)
+	session.lastSendTime = time.Now()
+}
+
+// Runs the session
+func (session *SrtSession) Run() {
+	defer session.server.removeSession(session)
+	defer session.closeSource()
+
+	ticker := time.NewTicker(SRT_TICK_INTERVAL)
+	defer ticker.Stop()
+
+	session.lastReceiveTime = time.Now()
+
+	for {
+		select {
+		case packet := <-session.queue:
+			session.lastReceiveTime = time.Now()
+
+			if !session.handlePacket(packet) {
+				return
+			}
+		case <-ticker.C:
+			if !session.tick() {
+				return
+			}
+		case <-session.closeChan:
+			session.sendControl(SRT_CONTROL_SHUTDOWN, 0, []byte{0, 0, 0, 0})
+			return
+		}
+	}
+}
+
+// Handles a received packet
+// Returns false to close the session
+func (session *SrtSession) handlePacket(packet *SrtPacket) bool {
+	if !packet.IsControl {
+		session.handleData(packet.SequenceNumber, packet.Payload)
+		return true
+	}
+
+	switch packet.ControlType {
+	case SRT_CONTROL_HANDSHAKE:
+		// The response was lost, send it again
+		_, _ = session.server.conn.WriteTo(session.handshakeResponse, session.addr)
+	case SRT_CONTROL_SHUTDOWN:
+		session.logger.Infof("Stream %v unpublished", session.streamId)
+		return false
+	}
+
+	return true
+}
+
+// Handles a data packet
+func (session *SrtSession) handleData(seq uint32, payload []byte) {
+	diff := srtSequenceDiff(seq, session.nextSequence)
+
+	if diff < 0 {
+		// Duplicate
+		return
+	}
+
+	if diff >= SRT_RECEIVE_WINDOW {
+		// Too far, the peer dropped the packets
+		session.logger.Debugf("Skipped %v packets out of the receive window", diff)
+		session.received = make(map[uint32][]byte)
+		session.nextSequence = seq
+		session.lastSequence = (seq - 1) & SRT_SEQUENCE_MASK
+		diff = 0
+	}
+
+	if _, duplicate := session.received[seq]; duplicate {
+		return
+	}
+
+	session.received[seq] = payload
+
+	if srtSequenceDiff(seq, session.lastSequence) > 0 {
+		if diff > 0 && srtSequenceDiff(seq, srtSequenceNext(session.lastSequence)) > 0 {
+			// New loss, report it immediately
+			lossStart := srtSequenceNext(session.lastSequence)
+
+			if srtSequenceDiff(lossStart, session.nextSequence) < 0 {
+				lossStart = session.nextSequence
+			}
+
+			session.sendNak([][2]uint32{{lossStart, (seq - 1) & SRT_SEQUENCE_MASK}})
+		}
+
+		session.lastSequence = seq
+	}
+
+	session.deliver()
+}
+
+// Delivers the received packets in order, until the first lost one
+func (session *SrtSession) deliver() {
+	delivered := false
+
+	for {
+		payload, ok := session.received[session.nextSequence]
+
+		if !ok {
+			break
+		}
+
+		delete(session.received, session.nextSequence)
+		session.nextSequence = srtSequenceNext(session.nextSequence)
+		delivered = true
+
+		session.segmenter.Write(payload)
+	}
+
+	if len(session.received) == 0 {
+		session.lossTime = time.Time{}
+	} else if delivered || session.lossTime.IsZero() {
+		session.lossTime = time.Now()
+	}
+}
+
+// Gets the lost sequence number ranges
+func (session *SrtSession) getLosses() [][2]uint32 {
+	losses := make([][2]uint32, 0)
+	count := 0
+
+	for seq := session.nextSequence; srtSequenceDiff(seq, session.lastSequence) < 0 && count < SRT_MAX_NAK_LENGTH; seq = srtSequenceNext(seq) {
+		if _, ok := session.received[seq]; ok {
+			continue
+		}
+
+		count++
+
+		if len(losses) > 0 && srtSequenceNext(losses[len(losses)-1][1]) == seq {
+			losses[len(losses)-1][1] = seq
+		} else {
+			losses = append(losses, [2]uint32{seq, seq})
+		}
+	}
+
+	return losses
+}
+
+// Sends a loss report
+func (session *SrtSession) sendNak(losses [][2]uint32) {
+	if len(losses) == 0 {
+		return
+	}
+
+	payload := make([]byte, 0)
+
+	for _, loss := range losses {
+		if loss[0] == loss[1] {
+			payload = binary.BigEndian.AppendUint32(payload, loss[0])
+		} else {
+			payload = binary.BigEndian.AppendUint32(payload, loss[0]|0x80000000)
+			payload = binary.BigEndian.AppendUint32(payload, loss[1])
+		}
+	}
+
+	session.sendControl(SRT_CONTROL_NAK, 0, payload)
+	session.lastNakTime = time.Now()
+}
+
+// Sends an acknowledgement
+func (session *SrtSession) sendAck() {
+	session.ackNumber++
+	session.lastAckedSequence = session.nextSequence
+
+	payload := make([]byte, 0, 28)
+
+	payload = binary.BigEndian.AppendUint32(payload, session.nextSequence)                             // Last acknowledged sequence number
+	payload = binary.BigEndian.AppendUint32(payload, 100000)                                           // RTT (microseconds)
+	payload = binary.BigEndian.AppendUint32(payload, 50000)                                            // RTT variance
+	payload = binary.BigEndian.AppendUint32(payload, uint32(SRT_RECEIVE_WINDOW-len(session.received))) // Available buffer size (packets)
+	payload = binary.BigEndian.AppendUint32(payload, 0)                                                // Packets receiving rate
+	payload = binary.BigEndian.AppendUint32(payload, 0)                                                // Estimated link capacity
+	payload = binary.BigEndian.AppendUint32(payload, 0)                                                // Receiving rate
+
+	session.sendControl(SRT_CONTROL_ACK, session.ackNumber, payload)
+}
+
+// Periodic tasks
+// Returns false to close the session
+func (session *SrtSession) tick() bool {
+	now := time.Now()
+
+	if now.Sub(session.lastReceiveTime) > SRT_PEER_IDLE_TIMEOUT {
+		session.logger.Infof("Stream %v timed out", session.streamId)
+		return false
+	}
+
+	if session.source.IsClosed() {
+		session.logger.Infof("Stream %v was replaced by another publisher", session.streamId)
+		session.sendControl(SRT_CONTROL_SHUTDOWN, 0, []byte{0, 0, 0, 0})
+		return false
+	}
+
+	if len(session.received) > 0 {
+		if now.Sub(session.lossTime) > session.latency {
+			// Too late to recover the lost packets, skip them
+			skipped := 0
+
+			for {
+				if _, ok := session.received[session.nextSequence]; ok {
+					break
+				}
+
+				session.nextSequence = srtSequenceNext(session.nextSequence)
+				skipped++
+			}
+
+			session.logger.Debugf("Skipped %v lost packets", skipped)
+
+			session.deliver()
+		} else if now.Sub(session.lastNakTime) >= SRT_NAK_MIN_INTERVAL {
+			session.sendNak(session.getLosses())
+		}
+	}
+
+	if session.nextSequence != session.lastAckedSequence {
+		session.sendAck()
+	}
+
+	if now.Sub(session.lastSendTime) >= SRT_KEEPALIVE_INTERVAL {
+		session.sendControl(SRT_CONTROL_KEEPALIVE, 0, []byte{0, 0, 0, 0})
+	}
+
+	return true
+}
+
+// Closes the source, after sending the last fragment
+func (session *SrtSession) closeSource() {
+	if session.source == nil {
+		return
+	}
+
+	session.server.authController.UnwatchTokenRevocation(session.revocationWatcherId)
+
+	session.segmenter.End()
+
+	session.source.Close()
+	session.server.sourceController.RemoveSource(session.streamId, session.source)
+
+	session.source = nil
+	session.segmenter = nil
+}
@@ -0,0 +1,364 @@
+// Tests for the SRT ingest
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// Initial sequence number of the test SRT caller
+const TEST_SRT_INITIAL_SEQUENCE uint32 = SRT_SEQUENCE_MASK - 2
+
+// Test SRT caller
+type TestSrtCaller struct {
+	// Connection
+	conn *net.UDPConn
+
+	// Socket ID
+	socketId uint32
+
+	// Socket ID of the listener
+	peerSocketId uint32
+}
+
+// Sends a packet from the test SRT caller
+func (caller *TestSrtCaller) send(packet *SrtPacket) {
+	_, _ = caller.conn.Write(packet.Serialize())
+}
+
+// Sends a handshake from the test SRT caller
+func (caller *TestSrtCaller) sendHandshake(hs *SrtHandshake) {
+	caller.send(&SrtPacket{
+		IsControl:   true,
+		ControlType: SRT_CONTROL_HANDSHAKE,
+		Payload:     hs.Serialize(),
+	})
+}
+
+// Reads a control packet of a type, skipping the rest
+func (caller *TestSrtCaller) readControl(controlType uint16, t *testing.T) *SrtPacket {
+	buf := make([]byte, SRT_MAX_DATAGRAM_SIZE)
+
+	_ = caller.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		n, err := caller.conn.Read(buf)
+
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+
+		packet, err := parseSrtPacket(buf[:n])
+
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+
+		if packet.IsControl && packet.ControlType == controlType {
+			return packet
+		}
+	}
+}
+
+// Connects a test SRT caller
+// Returns the caller and the handshake type of the conclusion response
+func connectTestSrtCaller(address string, srtStreamId string, t *testing.T) (*TestSrtCaller, uint32) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+
+	if err != nil {
+		t.Error(err)
+		return nil, 0
+	}
+
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+
+	if err != nil {
+		t.Error(err)
+		return nil, 0
+	}
+
+	caller := &TestSrtCaller{
+		conn:     conn,
+		socketId: 0x1234,
+	}
+
+	// Induction
+
+	caller.sendHandshake(&SrtHandshake{
+		Version:               4,
+		ExtensionField:        2,
+		InitialSequenceNumber: TEST_SRT_INITIAL_SEQUENCE,
+		Mtu:                   SRT_MAX_DATAGRAM_SIZE,
+		FlowWindow:            SRT_RECEIVE_WINDOW,
+		HandshakeType:         SRT_HANDSHAKE_INDUCTION,
+		SocketId:              caller.socketId,
+	})
+
+	packet := caller.readControl(SRT_CONTROL_HANDSHAKE, t)
+
+	if packet == nil {
+		conn.Close()
+		return nil, 0
+	}
+
+	induction, err := parseSrtHandshake(packet.Payload)
+
+	if err != nil || induction.Version != 5 || induction.ExtensionField != SRT_HANDSHAKE_MAGIC || packet.DestinationSocketId != caller.socketId {
+		t.Errorf("Unexpected induction response: %v", induction)
+		conn.Close()
+		return nil, 0
+	}
+
+	// Conclusion
+
+	caller.sendHandshake(&SrtHandshake{
+		Version:               5,
+		ExtensionField:        SRT_HANDSHAKE_FLAG_HSREQ | SRT_HANDSHAKE_FLAG_CONFIG,
+		InitialSequenceNumber: TEST_SRT_INITIAL_SEQUENCE,
+		Mtu:                   SRT_MAX_DATAGRAM_SIZE,
+		FlowWindow:            SRT_RECEIVE_WINDOW,
+		HandshakeType:         SRT_HANDSHAKE_CONCLUSION,
+		SocketId:              caller.socketId,
+		SynCookie:             induction.SynCookie,
+		Extensions: []SrtHandshakeExtension{
+			{
+				Type:    SRT_EXTENSION_HSREQ,
+				Content: encodeSrtHandshakeOptions(SRT_FLAG_TSBPDSND|SRT_FLAG_TSBPDRCV|SRT_FLAG_TLPKTDROP|SRT_FLAG_PERIODICNAK|SRT_FLAG_REXMITFLG, 120, 120),
+			},
+			{
+				Type:    SRT_EXTENSION_SID,
+				Content: encodeSrtStreamId(srtStreamId),
+			},
+		},
+	})
+
+	packet = caller.readControl(SRT_CONTROL_HANDSHAKE, t)
+
+	if packet == nil {
+		conn.Close()
+		return nil, 0
+	}
+
+	conclusion, err := parseSrtHandshake(packet.Payload)
+
+	if err != nil {
+		t.Error(err)
+		conn.Close()
+		return nil, 0
+	}
+
+	if conclusion.HandshakeType == SRT_HANDSHAKE_CONCLUSION && len(conclusion.GetExtension(SRT_EXTENSION_HSRSP)) != 12 {
+		t.Errorf("Expected HSRSP extension in the conclusion response")
+	}
+
+	caller.peerSocketId = conclusion.SocketId
+
+	return caller, conclusion.HandshakeType
+}
+
+func TestSrtStreamId(t *testing.T) {
+	srtStreamId := "#!::r=live/test,m=publish,s=token"
+
+	if decoded := decodeSrtStreamId(encodeSrtStreamId(srtStreamId)); decoded != srtStreamId {
+		t.Errorf("Unexpected decoded stream ID: %v", decoded)
+	}
+
+	streamId, token, mode, ok := parseSrtStreamId(srtStreamId)
+
+	if !ok || streamId != "live/test" || token != "token" || mode != "publish" {
+		t.Errorf("Unexpected parsed stream ID: %v, %v, %v, %v", streamId, token, mode, ok)
+	}
+
+	_, _, _, ok = parseSrtStreamId("live/test")
+
+	if ok {
+		t.Errorf("Expected stream ID without the access control syntax to be invalid")
+	}
+
+	if srtSequenceDiff(1, SRT_SEQUENCE_MASK) != 2 || srtSequenceNext(SRT_SEQUENCE_MASK) != 0 {
+		t.Errorf("Unexpected sequence number arithmetic")
+	}
+}
+
+func TestSrtIngest(t *testing.T) {
+	logger := testMain()
+
+	server := makeTestServer(logger.CreateChildLogger("[Server] "), nil, true, "")
+	defer server.Close()
+
+	srtServer := NewSrtServer(SrtConfig{
+		Enabled:          true,
+		FragmentDuration: 2000,
+		MaxFragmentSize:  DEFAULT_MAX_BINARY_MSG_SIZE,
+		Latency:          120,
+	}, server.server.authController, server.server.sourceController, logger.CreateChildLogger("[SRT] "))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer conn.Close()
+
+	go srtServer.Serve(conn)
+
+	// Invalid stream IDs
+
+	caller, handshakeType := connectTestSrtCaller(conn.LocalAddr().String(), "#!::r="+TEST_STREAM_ID_1+",m=publish,s=invalid", t)
+
+	if caller != nil {
+		caller.conn.Close()
+	}
+
+	if handshakeType != SRT_REJECT_UNAUTHORIZED {
+		t.Errorf("Expected the connection to be rejected as unauthorized, but got: %v", handshakeType)
+	}
+
+	caller, handshakeType = connectTestSrtCaller(conn.LocalAddr().String(), TEST_STREAM_ID_1, t)
+
+	if caller != nil {
+		caller.conn.Close()
+	}
+
+	if handshakeType != SRT_REJECT_BAD_REQUEST {
+		t.Errorf("Expected the connection to be rejected as bad request, but got: %v", handshakeType)
+	}
+
+	// Valid stream ID
+
+	token, err := signAuthToken(TEST_JWT_SECRET, "PUSH", TEST_STREAM_ID_1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	caller, handshakeType = connectTestSrtCaller(conn.LocalAddr().String(), "#!::r="+TEST_STREAM_ID_1+",m=publish,s="+token, t)
+
+	if caller == nil {
+		return
+	}
+
+	defer caller.conn.Close()
+
+	if handshakeType != SRT_HANDSHAKE_CONCLUSION {
+		t.Errorf("Expected the connection to be accepted, but got: %v", handshakeType)
+		return
+	}
+
+	spectator := connectTestClient(server.url, "PULL", TEST_STREAM_ID_1, nil, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	// Expected fragments
+
+	stream := makeTestTsStream(5)
+	expectedFragments := make([][]byte, 0)
+
+	segmenter := NewTsSegmenter(2000, DEFAULT_MAX_BINARY_MSG_SIZE, func(duration float32, data []byte) {
+		expectedFragments = append(expectedFragments, data)
+	})
+
+	segmenter.Write(stream)
+	segmenter.End()
+
+	// Send the stream in packets of 7 MPEG-TS packets
+	// The third packet is lost, and the fifth and sixth are swapped
+
+	payloads := make([][]byte, 0)
+
+	for i := 0; i < len(stream); i += 7 * TS_PACKET_SIZE {
+		payloads = append(payloads, stream[i:min(i+7*TS_PACKET_SIZE, len(stream))])
+	}
+
+	sendData := func(i int) {
+		caller.send(&SrtPacket{
+			SequenceNumber:      (TEST_SRT_INITIAL_SEQUENCE + uint32(i)) & SRT_SEQUENCE_MASK,
+			Info:                0xC0000000 | uint32(i+1),
+			DestinationSocketId: caller.peerSocketId,
+			Payload:             payloads[i],
+		})
+	}
+
+	for i := range payloads {
+		switch i {
+		case 2:
+			continue
+		case 4:
+			sendData(5)
+		case 5:
+			sendData(4)
+		default:
+			sendData(i)
+		}
+	}
+
+	nak := caller.readControl(SRT_CONTROL_NAK, t)
+
+	if nak == nil {
+		return
+	}
+
+	lostSequence := (TEST_SRT_INITIAL_SEQUENCE + 2) & SRT_SEQUENCE_MASK
+
+	if len(nak.Payload) < 4 || binary.BigEndian.Uint32(nak.Payload[:4]) != lostSequence {
+		t.Errorf("Expected the loss report to contain %v, but got: %v", lostSequence, nak.Payload)
+	}
+
+	sendData(2)
+
+	for i := 0; i < 2; i++ {
+		msg, _ := readTestMessage(spectator, t)
+
+		if msg == nil || msg.MessageType != "F" || msg.GetParameter("duration") != "2" {
+			t.Errorf("Expected F message with duration 2, but received: %v", msg)
+			return
+		}
+
+		_, data := readTestMessage(spectator, t)
+
+		if !bytes.Equal(data, expectedFragments[i]) {
+			t.Errorf("Fragment %v does not match", i)
+		}
+	}
+
+	// Shutdown sends the last fragment and closes the stream
+
+	caller.send(&SrtPacket{
+		IsControl:           true,
+		ControlType:         SRT_CONTROL_SHUTDOWN,
+		DestinationSocketId: caller.peerSocketId,
+		Payload:             []byte{0, 0, 0, 0},
+	})
+
+	msg, _ := readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "F" {
+		t.Errorf("Expected F message, but received: %v", msg)
+		return
+	}
+
+	_, data := readTestMessage(spectator, t)
+
+	if !bytes.Equal(data, expectedFragments[2]) {
+		t.Errorf("Last fragment does not match")
+	}
+
+	msg, _ = readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "CLOSE" {
+		t.Errorf("Expected CLOSE message, but received: %v", msg)
+	}
+}
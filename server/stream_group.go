@@ -0,0 +1,349 @@
+// Stream groups (multiple renditions of the same stream)
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Rendition of a stream group
+type HlsRendition struct {
+	// Stream ID of the rendition
+	StreamId string `json:"stream"`
+
+	// Bandwidth (bits per second)
+	Bandwidth int `json:"bandwidth,omitempty"`
+
+	// Resolution (WIDTHxHEIGHT)
+	Resolution string `json:"resolution,omitempty"`
+
+	// Codecs
+	Codecs string `json:"codecs,omitempty"`
+
+	// Name of the rendition
+	Name string `json:"name,omitempty"`
+}
+
+// List of renditions (variants) of a stream group
+type HlsVariants struct {
+	// ID of the group
+	GroupId string
+
+	// Renditions, sorted by bandwidth (descending)
+	Renditions []HlsRendition
+}
+
+// Checks if the variants contain a stream
+func (variants *HlsVariants) HasStream(streamId string) bool {
+	for _, r := range variants.Renditions {
+		if r.StreamId == streamId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Gets the variants with only the allowed renditions
+// allowed - Function to check if a stream is allowed
+func (variants *HlsVariants) Filter(allowed func(streamId string) bool) *HlsVariants {
+	if variants == nil {
+		return nil
+	}
+
+	renditions := make([]HlsRendition, 0, len(variants.Renditions))
+
+	for _, r := range variants.Renditions {
+		if allowed(r.StreamId) {
+			renditions = append(renditions, r)
+		}
+	}
+
+	return &HlsVariants{
+		GroupId:    variants.GroupId,
+		Renditions: renditions,
+	}
+}
+
+// Serializes the variants into a VARIANTS message
+func (variants *HlsVariants) ToMessage() *WebsocketProtocolMessage {
+	renditionsJson, _ := json.Marshal(variants.Renditions)
+
+	return &WebsocketProtocolMessage{
+		MessageType: "VARIANTS",
+		Parameters: map[string]string{
+			"group":      variants.GroupId,
+			"renditions": string(renditionsJson),
+		},
+	}
+}
+
+// Parses variants from a VARIANTS message
+// Returns nil if the message does not contain valid variants
+func ParseVariantsMessage(msg *WebsocketProtocolMessage) *HlsVariants {
+	groupId := msg.GetParameter("group")
+
+	if groupId == "" {
+		return nil
+	}
+
+	renditions := make([]HlsRendition, 0)
+
+	err := json.Unmarshal([]byte(msg.GetParameter("renditions")), &renditions)
+
+	if err != nil {
+		return nil
+	}
+
+	return &HlsVariants{
+		GroupId:    groupId,
+		Renditions: renditions,
+	}
+}
+
+// Stream group
+type HlsStreamGroup struct {
+	// ID of the group
+	id string
+
+	// Renditions declared by the admin API
+	declared []HlsRendition
+
+	// Renditions declared by the publishers (Stream ID -> Rendition)
+	published map[string]HlsRendition
+}
+
+// Checks if a stream is declared in the group by the admin API
+func (group *HlsStreamGroup) isDeclared(streamId string) bool {
+	for _, r := range group.declared {
+		if r.StreamId == streamId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Computes the variants of the group
+// Renditions declared by the admin API cannot be overridden by the publishers
+func (group *HlsStreamGroup) computeVariants() *HlsVariants {
+	renditions := make([]HlsRendition, 0)
+
+	renditions = append(renditions, group.declared...)
+
+	for _, r := range group.published {
+		if group.isDeclared(r.StreamId) {
+			continue
+		}
+
+		renditions = append(renditions, r)
+	}
+
+	sort.SliceStable(renditions, func(i, j int) bool {
+		if renditions[i].Bandwidth != renditions[j].Bandwidth {
+			return renditions[i].Bandwidth > renditions[j].Bandwidth
+		}
+
+		return renditions[i].StreamId < renditions[j].StreamId
+	})
+
+	return &HlsVariants{
+		GroupId:    group.id,
+		Renditions: renditions,
+	}
+}
+
+// Checks if the group is empty
+func (group *HlsStreamGroup) isEmpty() bool {
+	return len(group.declared) == 0 && len(group.published) == 0
+}
+
+// Gets the stream group (must be called with the mutex locked)
+// If it does not exist, it is created
+func (sc *SourcesController) getOrCreateGroup(groupId string) *HlsStreamGroup {
+	group := sc.groups[groupId]
+
+	if group == nil {
+		group = &HlsStreamGroup{
+			id:        groupId,
+			declared:  make([]HlsRendition, 0),
+			published: make(map[string]HlsRendition),
+		}
+
+		sc.groups[groupId] = group
+	}
+
+	return group
+}
+
+// Updates the variants of the live sources in a group (must be called with the mutex locked)
+// Returns the sources to update, along with the variants to set
+func (sc *SourcesController) collectGroupUpdates(group *HlsStreamGroup, previousStreams []string) ([]*HlsSource, []*HlsVariants) {
+	sources := make([]*HlsSource, 0)
+	variantsList := make([]*HlsVariants, 0)
+
+	var variants *HlsVariants = nil
+
+	if !group.isEmpty() {
+		variants = group.computeVariants()
+
+		for _, r := range variants.Renditions {
+			sc.streamGroups[r.StreamId] = group.id
+
+			source := sc.sources[r.StreamId]
+
+			if source != nil {
+				sources = append(sources, source)
+				variantsList = append(variantsList, variants)
+			}
+		}
+	} else {
+		delete(sc.groups, group.id)
+	}
+
+	// Streams no longer in the group
+
+	for _, streamId := range previousStreams {
+		if variants != nil && variants.HasStream(streamId) {
+			continue
+		}
+
+		if sc.streamGroups[streamId] == group.id {
+			delete(sc.streamGroups, streamId)
+		}
+
+		source := sc.sources[streamId]
+
+		if source != nil {
+			sources = append(sources, source)
+			variantsList = append(variantsList, nil)
+		}
+	}
+
+	return sources, variantsList
+}
+
+// Gets the list of stream IDs of a group (must be called with the mutex locked)
+func (group *HlsStreamGroup) streamIds() []string {
+	result := make([]string, 0)
+
+	for _, r := range group.computeVariants().Renditions {
+		result = append(result, r.StreamId)
+	}
+
+	return result
+}
+
+// Declares a stream group (admin API)
+// Replaces the previously declared renditions of the group
+func (sc *SourcesController) DeclareGroup(groupId string, renditions []HlsRendition) {
+	sc.mu.Lock()
+
+	group := sc.getOrCreateGroup(groupId)
+	previousStreams := group.streamIds()
+
+	group.declared = renditions
+
+	sources, variantsList := sc.collectGroupUpdates(group, previousStreams)
+
+	sc.mu.Unlock()
+
+	for i, source := range sources {
+		source.SetVariants(variantsList[i])
+	}
+}
+
+// Removes the renditions of a group declared by the admin API
+func (sc *SourcesController) RemoveDeclaredGroup(groupId string) {
+	sc.DeclareGroup(groupId, make([]HlsRendition, 0))
+}
+
+// Gets the variants of a stream group
+// Returns nil if the group does not exist
+func (sc *SourcesController) GetGroupVariants(groupId string) *HlsVariants {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	group := sc.groups[groupId]
+
+	if group == nil {
+		return nil
+	}
+
+	return group.computeVariants()
+}
+
+// Checks if a stream is declared in a group by the admin API
+func (sc *SourcesController) IsDeclaredInGroup(groupId string, streamId string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	group := sc.groups[groupId]
+
+	return group != nil && group.isDeclared(streamId)
+}
+
+// Adds a published stream to a group, as a rendition
+func (sc *SourcesController) JoinGroup(groupId string, rendition HlsRendition) {
+	sc.mu.Lock()
+
+	group := sc.getOrCreateGroup(groupId)
+	previousStreams := group.streamIds()
+
+	group.published[rendition.StreamId] = rendition
+
+	sources, variantsList := sc.collectGroupUpdates(group, previousStreams)
+
+	sc.mu.Unlock()
+
+	for i, source := range sources {
+		source.SetVariants(variantsList[i])
+	}
+}
+
+// Gets the variants of the group a stream belongs to
+// (must be called with the mutex locked)
+func (sc *SourcesController) getVariantsForStream(streamId string) *HlsVariants {
+	groupId := sc.streamGroups[streamId]
+
+	if groupId == "" {
+		return nil
+	}
+
+	group := sc.groups[groupId]
+
+	if group == nil {
+		return nil
+	}
+
+	return group.computeVariants()
+}
+
+// Called when a source is removed, to remove it from its group
+// (must be called with the mutex locked)
+// Returns the sources to update, along with the variants to set
+func (sc *SourcesController) leaveGroup(streamId string) ([]*HlsSource, []*HlsVariants) {
+	groupId := sc.streamGroups[streamId]
+
+	if groupId == "" {
+		return nil, nil
+	}
+
+	group := sc.groups[groupId]
+
+	if group == nil {
+		delete(sc.streamGroups, streamId)
+		return nil, nil
+	}
+
+	if _, published := group.published[streamId]; !published {
+		return nil, nil
+	}
+
+	previousStreams := group.streamIds()
+
+	delete(group.published, streamId)
+
+	return sc.collectGroupUpdates(group, previousStreams)
+}
@@ -0,0 +1,277 @@
+// Tests for stream groups
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// Signs a push token allowing to join a stream group
+func signTestGroupPushToken(streamId string, groupId string) string {
+	return signTestAuthTokenWithClaims(TEST_JWT_SECRET, jwt.MapClaims{
+		"sub":   "PUSH:" + streamId,
+		"group": groupId,
+	})
+}
+
+// Reads messages until a VARIANTS message with the expected number of renditions is received
+func expectTestVariants(socket *websocket.Conn, groupId string, renditionsCount int, t *testing.T) *HlsVariants {
+	for {
+		msg, _ := readTestMessage(socket, t)
+
+		if msg == nil {
+			return nil
+		}
+
+		if msg.MessageType != "VARIANTS" {
+			t.Errorf("Expected VARIANTS message, but received: %v", msg.Serialize())
+			return nil
+		}
+
+		variants := ParseVariantsMessage(msg)
+
+		if variants == nil {
+			t.Errorf("Invalid VARIANTS message: %v", msg.Serialize())
+			return nil
+		}
+
+		if variants.GroupId != groupId {
+			t.Errorf("Group ID does not match. Expected: %v, Actual: %v", groupId, variants.GroupId)
+			return nil
+		}
+
+		if len(variants.Renditions) == renditionsCount {
+			return variants
+		}
+	}
+}
+
+func TestStreamGroupSwitch(t *testing.T) {
+	logger := testMain()
+
+	mockPublishRegistry := NewMockPublishRegistry()
+
+	server1 := makeTestServerWithOptions(logger.CreateChildLogger("[Server 1] "), mockPublishRegistry, true, "", TestServerOptions{AdminApi: true})
+	defer server1.Close()
+
+	server2 := makeTestServer(logger.CreateChildLogger("[Server 2] "), mockPublishRegistry, true, "")
+	defer server2.Close()
+
+	groupId := "room/stream"
+	streamHigh := "room/stream/1920x1080-30~4000"
+	streamLow := "room/stream/640x360-30~500"
+
+	// Publishers need a token allowing the group
+
+	unauthorizedToken, _ := signAuthToken(TEST_JWT_SECRET, "PUSH", streamHigh)
+
+	expectTestConnectionError(server1.url, "PUSH:stream="+streamHigh+"&group="+groupId+"&auth="+unauthorizedToken, "AUTH_ERROR", t)
+
+	publisherHigh := connectTestClient(server1.url, "PUSH", streamHigh, map[string]string{
+		"auth":       signTestGroupPushToken(streamHigh, groupId),
+		"group":      groupId,
+		"bandwidth":  "4000000",
+		"resolution": "1920x1080",
+	}, t)
+
+	if publisherHigh == nil {
+		return
+	}
+
+	defer publisherHigh.Close()
+
+	publisherLow := connectTestClient(server1.url, "PUSH", streamLow, map[string]string{
+		"auth": signTestAuthTokenWithClaims(TEST_JWT_SECRET, jwt.MapClaims{
+			"sub":   "PUSH:" + streamLow,
+			"group": []string{"other/group", groupId},
+		}),
+		"group":      groupId,
+		"bandwidth":  "500000",
+		"resolution": "640x360",
+	}, t)
+
+	if publisherLow == nil {
+		return
+	}
+
+	defer publisherLow.Close()
+
+	// Spectators receive the variants after OK (directly and through a relay)
+
+	spectator1 := connectTestClient(server1.url, "PULL", streamHigh, nil, t)
+
+	if spectator1 == nil {
+		return
+	}
+
+	defer spectator1.Close()
+
+	spectator2 := connectTestClient(server2.url, "PULL", streamHigh, nil, t)
+
+	if spectator2 == nil {
+		return
+	}
+
+	defer spectator2.Close()
+
+	for _, spectator := range []*websocket.Conn{spectator1, spectator2} {
+		variants := expectTestVariants(spectator, groupId, 2, t)
+
+		if variants == nil {
+			return
+		}
+
+		if variants.Renditions[0].StreamId != streamHigh || variants.Renditions[1].StreamId != streamLow {
+			t.Errorf("Renditions are not sorted by bandwidth: %v", variants.Renditions)
+		}
+	}
+
+	// Switch to the low rendition
+
+	for _, spectator := range []*websocket.Conn{spectator1, spectator2} {
+		authToken, err := signAuthToken(TEST_JWT_SECRET, "PULL", streamLow)
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		switchMessage := WebsocketProtocolMessage{
+			MessageType: "SWITCH",
+			Parameters: map[string]string{
+				"stream": streamLow,
+				"auth":   authToken,
+			},
+		}
+
+		_ = spectator.WriteMessage(websocket.TextMessage, []byte(switchMessage.Serialize()))
+	}
+
+	// Wait for the switch requests to be processed
+	// (the relay for the new rendition must be created in the second server)
+
+	time.Sleep(200 * time.Millisecond)
+
+	// The group can be queried with the admin API
+
+	status := sendTestAdminApiRequest(server1, "GET", "group?id="+groupId, "", t)
+
+	if status != 200 {
+		t.Errorf("Admin API returned status %v", status)
+	}
+
+	// Fragments must be sent until the switch happens at the fragment boundary
+
+	fragmentMessage := WebsocketProtocolMessage{
+		MessageType: "F",
+		Parameters: map[string]string{
+			"duration": "1",
+		},
+	}
+
+	_ = publisherLow.WriteMessage(websocket.TextMessage, []byte(fragmentMessage.Serialize()))
+	_ = publisherLow.WriteMessage(websocket.BinaryMessage, TEST_STREAM_DATA_2[0].Data)
+
+	for _, spectator := range []*websocket.Conn{spectator1, spectator2} {
+		msg, _ := readTestMessage(spectator, t)
+
+		if msg == nil || msg.MessageType != "SWITCHED" || msg.GetParameter("stream") != streamLow {
+			t.Errorf("Expected SWITCHED message, but received: %v", msg)
+			continue
+		}
+
+		msg, _ = readTestMessage(spectator, t)
+
+		if msg == nil || msg.MessageType != "F" {
+			t.Errorf("Expected F message, but received: %v", msg)
+			continue
+		}
+
+		_, data := readTestMessage(spectator, t)
+
+		if !bytes.Equal(data, TEST_STREAM_DATA_2[0].Data) {
+			t.Errorf("Fragment data does not match. Expected: %v, Actual: %v", TEST_STREAM_DATA_2[0].Data, data)
+		}
+	}
+
+	// When a rendition ends, the variants are updated
+
+	closeMessage := WebsocketProtocolMessage{
+		MessageType: "CLOSE",
+	}
+
+	_ = publisherHigh.WriteMessage(websocket.TextMessage, []byte(closeMessage.Serialize()))
+
+	expectTestVariants(spectator1, groupId, 1, t)
+}
+
+func TestStreamGroupDeclaredByAdmin(t *testing.T) {
+	logger := testMain()
+
+	server := makeTestServerWithOptions(logger.CreateChildLogger("[Server] "), nil, true, "", TestServerOptions{AdminApi: true})
+	defer server.Close()
+
+	groupId := "room2/stream"
+
+	status := sendTestAdminApiRequest(server, "POST", "group?id="+groupId, `{"renditions":[{"stream":"room2/stream/low","bandwidth":500000},{"stream":"room2/stream/high","bandwidth":4000000}]}`, t)
+
+	if status != 200 {
+		t.Errorf("Admin API returned status %v", status)
+	}
+
+	// Streams declared by the admin API can join the group without a group claim,
+	// but they cannot override the declared rendition
+
+	publisher := connectTestClient(server.url, "PUSH", "room2/stream/low", map[string]string{
+		"group":     groupId,
+		"bandwidth": "9000000",
+	}, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	spectator := connectTestClient(server.url, "PULL", "room2/stream/low", nil, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	variants := expectTestVariants(spectator, groupId, 2, t)
+
+	if variants != nil && (variants.Renditions[0].StreamId != "room2/stream/high" || variants.Renditions[1].Bandwidth != 500000) {
+		t.Errorf("Expected the declared renditions, sorted by bandwidth: %v", variants.Renditions)
+	}
+
+	// Streams not declared cannot join the group without a group claim
+
+	expectTestConnectionError(server.url, "PUSH:stream=room2/stream/other&group="+groupId+"&auth="+signTestAuthTokenWithClaims(TEST_JWT_SECRET, jwt.MapClaims{"sub": "PUSH:room2/stream/other"}), "AUTH_ERROR", t)
+
+	// Removing the group must clear the variants
+
+	status = sendTestAdminApiRequest(server, "DELETE", "group?id="+groupId, "", t)
+
+	if status != 200 {
+		t.Errorf("Admin API returned status %v", status)
+	}
+
+	msg, _ := readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "VARIANTS" || len(msg.Parameters) != 0 {
+		t.Errorf("Expected empty VARIANTS message, but received: %v", msg)
+	}
+
+	status = sendTestAdminApiRequest(server, "GET", "group?id="+groupId, "", t)
+
+	if status != 404 {
+		t.Errorf("Expected status 404 for a removed group, but received %v", status)
+	}
+}
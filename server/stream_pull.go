@@ -2,61 +2,545 @@
 
 package main
 
-// Pulls HLS stream from HLS source
-func (ch *ConnectionHandler) PullFromHlsSource(source *HlsSource, pullingInterruptChannel chan bool, maxInitialFragments int) {
-	listenSuccess, listenChan, initialFragments := source.AddListener(ch.id)
+import (
+	"fmt"
+	"time"
 
-	if !listenSuccess {
-		ch.SendClose()
-		return
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Switch reason: Requested by the client
+const HLS_SWITCH_REASON_CLIENT = "client"
+
+// Switch reason: Adaptive bitrate
+const HLS_SWITCH_REASON_ABR = "abr"
+
+// Stream that can be pulled (HLS source or HLS relay)
+type HlsPullableStream interface {
+	// Adds a listener
+	AddListener(id uint64, receiveParts bool) (success bool, channel chan HlsEvent, initialState *HlsListenerInitialState)
+
+	// Removes a listener
+	RemoveListener(id uint64)
+}
+
+// Request to switch the pulled stream to another rendition
+type HlsPullSwitchRequest struct {
+	// Stream ID
+	StreamId string
+
+	// Stream to switch to
+	Stream HlsPullableStream
+
+	// Reason of the switch
+	Reason string
+
+	// Claims of the auth token sent with the switch request (client switches)
+	Claims jwt.MapClaims
+}
+
+// Options to pull a stream
+type HlsPullOptions struct {
+	// ID of the stream
+	StreamId string
+
+	// True to only pull from a local source (not relaying)
+	OnlySource bool
+
+	// Max number of initial fragments to send (-1 for all of them)
+	MaxInitialFragments int
+
+	// True to send fragments in parts
+	ReceiveParts bool
+
+	// True to enable server-assisted adaptive bitrate
+	Abr bool
+
+	// Position to start playing from the DVR window (seconds ago). 0 to start from the live edge.
+	StartAt float64
+
+	// Sequence number of the fragment to start playing from the DVR window. 0 to start from the live edge.
+	FromSeq int64
+
+	// Claims of the auth token (nil if not authenticated with a token)
+	// Adaptive bitrate only switches to the renditions allowed by the token
+	Claims jwt.MapClaims
+}
+
+// Request to seek the pulled stream
+type HlsPullSeekRequest struct {
+	// True to seek to the live edge
+	Live bool
+
+	// Position to seek to (seconds ago)
+	StartAt float64
+
+	// Sequence number of the fragment to seek to
+	FromSeq int64
+}
+
+// Gets the DVR window of a stream
+// Returns nil if the stream has no DVR window
+func getStreamDvrWindow(stream HlsPullableStream) *HlsDvrWindow {
+	source, isSource := stream.(*HlsSource)
+
+	if !isSource {
+		return nil
+	}
+
+	return source.GetDvrWindow()
+}
+
+// Finds the sequence number of the fragment to start playing from the DVR window
+// Returns -1 if there are no fragments available
+func findDvrStartSequence(window *HlsDvrWindow, startAt float64, fromSeq int64) int64 {
+	if fromSeq > 0 {
+		firstSequence := window.FirstSequence()
+
+		if firstSequence < 0 {
+			return -1
+		}
+
+		if fromSeq < firstSequence {
+			return firstSequence
+		}
+
+		return fromSeq
 	}
 
-	defer source.RemoveListener(ch.id)
+	return window.FindSequenceByTimeAgo(startAt)
+}
+
+// Status of the fragment parts being sent
+type HlsPullPartsStatus struct {
+	// Number of parts sent for the current fragment
+	partsSent int
 
-	ch.PullStream(listenChan, pullingInterruptChannel, initialFragments, maxInitialFragments)
+	// True if all the parts of the current fragment were sent
+	partsComplete bool
 }
 
-// Pulls HLS stream from HLS relay
-func (ch *ConnectionHandler) PullFromHlsRelay(relay *HlsRelay, pullingInterruptChannel chan bool, maxInitialFragments int) {
-	listenSuccess, listenChan, initialFragments := relay.AddListener(ch.id)
+// Checks if the connection is in the middle of a fragment (some parts were sent, but not all of them)
+func (status *HlsPullPartsStatus) IsInTheMiddleOfFragment() bool {
+	return status.partsSent > 0 && !status.partsComplete
+}
 
-	if !listenSuccess {
-		ch.SendClose()
-		return
+// Finds the stream to pull, either a local source or a relay
+// Returns nil if the stream was not found
+func (ch *ConnectionHandler) FindStreamToPull(streamId string, onlySource bool) HlsPullableStream {
+	if ch.server.authController.IsPushAllowed() {
+		source := ch.server.sourceController.GetSource(streamId)
+
+		if source != nil {
+			return source
+		}
 	}
 
-	defer relay.RemoveListener(ch.id)
+	if !onlySource {
+		relay := ch.server.relayController.RelayStream(streamId)
 
-	ch.PullStream(listenChan, pullingInterruptChannel, initialFragments, maxInitialFragments)
+		if relay != nil {
+			return relay
+		}
+	}
+
+	return nil
 }
 
-// Pull stream from events channel and initial fragments list
-func (ch *ConnectionHandler) PullStream(listenChan chan HlsEvent, pullingInterruptChannel chan bool, initialFragments []*HlsFragment, maxInitialFragments int) {
+// Pull stream from events channel and initial state
+// If receiveParts is true, fragments are sent in parts as they arrive.
+// If any part of a fragment could not be sent, the complete fragment is sent instead.
+// Switch requests are applied at fragment boundaries.
+// If adaptive bitrate is enabled, the rendition is chosen after each fragment.
+// If a start position is set, and the stream has a DVR window, the fragments are played from it until the live edge is reached.
+func (ch *ConnectionHandler) PullStream(stream HlsPullableStream, listenChan chan HlsEvent, pullingInterruptChannel chan bool, initialState *HlsListenerInitialState, options HlsPullOptions) {
+	defer func() {
+		stream.RemoveListener(ch.id)
+	}()
+
+	receiveParts := options.ReceiveParts
+	currentStreamId := options.StreamId
+	claims := options.Claims
+	currentVariants := initialState.Variants
+
+	var abr *HlsAbrController = nil
+
+	if options.Abr {
+		abr = NewHlsAbrController()
+	}
+
+	// Send initial metadata
+
+	if len(initialState.Metadata) > 0 {
+		ch.SendMetadata(initialState.Metadata)
+	}
+
+	if initialState.Variants != nil {
+		ch.SendVariants(initialState.Variants)
+	}
+
+	partsStatus := &HlsPullPartsStatus{}
+
+	// Sends the buffered fragments, starting from a sequence number
+	// If fromSeq is 0, the max number of initial fragments is sent
+	sendInitialFragments := func(initialFragments []*HlsFragment, fromSeq int64) {
+		maxInitialFragments := options.MaxInitialFragments
+
+		if fromSeq > 0 || maxInitialFragments < 0 || maxInitialFragments > len(initialFragments) {
+			maxInitialFragments = len(initialFragments)
+		}
+
+		for i := len(initialFragments) - maxInitialFragments; i < len(initialFragments); i++ {
+			if initialFragments[i].Sequence < fromSeq {
+				continue
+			}
+
+			ch.SendFragment(initialFragments[i])
+		}
+	}
+
+	// DVR playback (when dvrWindow is not nil, the fragments are read from the DVR window instead of the live stream)
+
+	var dvrWindow *HlsDvrWindow = nil
+	var dvrNextSequence int64 = 0
+	var dvrPlaybackStart time.Time
+	var dvrMediaSent float64 = 0
+
+	startDvrPlayback := func(window *HlsDvrWindow, sequence int64) {
+		if listenChan != nil {
+			stream.RemoveListener(ch.id)
+			listenChan = nil
+		}
+
+		partsStatus = &HlsPullPartsStatus{}
+
+		dvrWindow = window
+		dvrNextSequence = sequence
+		dvrPlaybackStart = time.Now()
+		dvrMediaSent = 0
+	}
+
+	// Stops the DVR playback and starts listening to the live stream
+	// Returns false if the stream was closed
+	goLive := func(fromSeq int64) bool {
+		dvrWindow = nil
+
+		listenSuccess, newListenChan, newInitialState := stream.AddListener(ch.id, receiveParts)
+
+		if !listenSuccess {
+			ch.SendClose()
+			return false
+		}
+
+		listenChan = newListenChan
+
+		sendInitialFragments(newInitialState.Fragments, fromSeq)
+
+		return true
+	}
+
+	if options.StartAt > 0 || options.FromSeq > 0 {
+		window := getStreamDvrWindow(stream)
+
+		if window != nil {
+			startSequence := findDvrStartSequence(window, options.StartAt, options.FromSeq)
+
+			if startSequence > 0 {
+				startDvrPlayback(window, startSequence)
+			}
+		}
+	}
+
 	// Send initial fragments
 
-	if maxInitialFragments < 0 {
-		maxInitialFragments = len(initialFragments)
+	if dvrWindow == nil {
+		sendInitialFragments(initialState.Fragments, 0)
 	}
 
-	for i := len(initialFragments) - maxInitialFragments; i < len(initialFragments); i++ {
-		ch.SendFragment(initialFragments[i])
+	// Stream to switch to (pending)
+
+	var pendingSwitch *HlsPullSwitchRequest = nil
+	var pendingChan chan HlsEvent = nil
+	var pendingInitialState *HlsListenerInitialState = nil
+
+	cancelPendingSwitch := func() {
+		if pendingSwitch != nil {
+			pendingSwitch.Stream.RemoveListener(ch.id)
+		}
+
+		pendingSwitch = nil
+		pendingChan = nil
+		pendingInitialState = nil
+	}
+
+	defer cancelPendingSwitch()
+
+	requestSwitch := func(req *HlsPullSwitchRequest) {
+		cancelPendingSwitch()
+
+		if req.Stream == stream {
+			return // Already pulling
+		}
+
+		listenSuccess, newListenChan, newInitialState := req.Stream.AddListener(ch.id, receiveParts)
+
+		if !listenSuccess {
+			ch.logger.Debugf("Could not switch to %v: The stream was closed", req.StreamId)
+			return
+		}
+
+		pendingSwitch = req
+		pendingChan = newListenChan
+		pendingInitialState = newInitialState
 	}
 
 	// Listen for events
 
 	for {
+		var dvrReadyChan <-chan time.Time = nil
+
+		if dvrWindow != nil {
+			// Do not send too much media ahead of real time
+			wait := dvrMediaSent - DVR_PLAYBACK_MAX_AHEAD_SECONDS - time.Since(dvrPlaybackStart).Seconds()
+
+			if wait < 0 {
+				wait = 0
+			}
+
+			dvrReadyChan = time.After(time.Duration(wait * float64(time.Second)))
+		}
+
 		select {
+		case <-dvrReadyChan:
+			frag := dvrWindow.ReadFragment(dvrNextSequence)
+
+			if frag == nil {
+				// Reached the live edge
+				if !goLive(dvrNextSequence) {
+					return
+				}
+
+				continue
+			}
+
+			ch.SendFragment(frag)
+
+			dvrNextSequence = frag.Sequence + 1
+			dvrMediaSent += float64(frag.Duration)
+		case req := <-ch.pullingSeekChannel:
+			window := getStreamDvrWindow(stream)
+
+			if window == nil {
+				ch.Send(&WebsocketProtocolMessage{
+					MessageType: "SEEK_ERROR",
+					Parameters: map[string]string{
+						"message": "DVR is not available for the stream",
+					},
+				})
+				continue
+			}
+
+			if req.Live {
+				ch.Send(&WebsocketProtocolMessage{
+					MessageType: "SEEKED",
+					Parameters: map[string]string{
+						"live": "true",
+					},
+				})
+
+				if dvrWindow != nil && !goLive(0) {
+					return
+				}
+
+				continue
+			}
+
+			startSequence := findDvrStartSequence(window, req.StartAt, req.FromSeq)
+
+			if startSequence <= 0 {
+				ch.Send(&WebsocketProtocolMessage{
+					MessageType: "SEEK_ERROR",
+					Parameters: map[string]string{
+						"message": "There are no fragments in the DVR window",
+					},
+				})
+				continue
+			}
+
+			ch.logger.Debugf("Seek to sequence: %v", startSequence)
+
+			startDvrPlayback(window, startSequence)
+
+			ch.Send(&WebsocketProtocolMessage{
+				MessageType: "SEEKED",
+				Parameters: map[string]string{
+					"seq": fmt.Sprint(startSequence),
+				},
+			})
 		case ev := <-listenChan:
-			if ev.EventType == HLS_EVENT_TYPE_CLOSE {
-				ch.SendClose()
+			if !ch.SendPullEvent(ev, partsStatus, receiveParts, abr) {
 				return
 			}
 
-			if ev.Fragment != nil {
-				ch.SendFragment(ev.Fragment)
+			if ev.EventType == HLS_EVENT_TYPE_VARIANTS {
+				currentVariants = ev.Variants
+			}
+
+			if abr == nil || pendingSwitch != nil || ev.EventType != HLS_EVENT_TYPE_FRAGMENT || partsStatus.IsInTheMiddleOfFragment() {
+				continue
 			}
+
+			// Adaptive bitrate
+
+			allowedVariants := currentVariants.Filter(func(streamId string) bool {
+				return streamId == currentStreamId || ch.server.authController.IsStreamAllowedByPullClaims(claims, streamId)
+			})
+
+			rendition := abr.ChooseRendition(allowedVariants, currentStreamId, len(listenChan), cap(listenChan))
+
+			if rendition == nil {
+				continue
+			}
+
+			abrStream := ch.FindStreamToPull(rendition.StreamId, options.OnlySource)
+
+			if abrStream == nil {
+				continue
+			}
+
+			ch.logger.Debugf("Adaptive bitrate: Switching from %v to %v", currentStreamId, rendition.StreamId)
+
+			requestSwitch(&HlsPullSwitchRequest{
+				StreamId: rendition.StreamId,
+				Stream:   abrStream,
+				Reason:   HLS_SWITCH_REASON_ABR,
+			})
+		case ev := <-pendingChan:
+			if ev.EventType == HLS_EVENT_TYPE_CLOSE {
+				ch.logger.Debugf("Could not switch to %v: The stream was closed", pendingSwitch.StreamId)
+				cancelPendingSwitch()
+				continue
+			}
+
+			// Fragments always start with a key frame, so the switch is only done at fragment boundaries
+
+			isBoundary := (ev.EventType == HLS_EVENT_TYPE_FRAGMENT && ev.Fragment != nil) ||
+				(receiveParts && ev.EventType == HLS_EVENT_TYPE_PART && ev.Part != nil && ev.Part.Index == 0)
+
+			if !isBoundary || partsStatus.IsInTheMiddleOfFragment() {
+				continue
+			}
+
+			// Switch (if playing from the DVR window, the new stream is played from the live edge)
+
+			stream.RemoveListener(ch.id)
+
+			stream = pendingSwitch.Stream
+			listenChan = pendingChan
+			dvrWindow = nil
+			currentStreamId = pendingSwitch.StreamId
+			currentVariants = pendingInitialState.Variants
+
+			if pendingSwitch.Reason == HLS_SWITCH_REASON_CLIENT {
+				claims = pendingSwitch.Claims
+			}
+
+			ch.logger.Debugf("Switched to stream: %v", pendingSwitch.StreamId)
+
+			ch.Send(&WebsocketProtocolMessage{
+				MessageType: "SWITCHED",
+				Parameters: map[string]string{
+					"stream": pendingSwitch.StreamId,
+					"reason": pendingSwitch.Reason,
+				},
+			})
+
+			if len(pendingInitialState.Metadata) > 0 {
+				ch.SendMetadata(pendingInitialState.Metadata)
+			}
+
+			pendingSwitch = nil
+			pendingChan = nil
+			pendingInitialState = nil
+
+			partsStatus = &HlsPullPartsStatus{}
+
+			if abr != nil {
+				abr.OnSwitch()
+			}
+
+			if !ch.SendPullEvent(ev, partsStatus, receiveParts, abr) {
+				return
+			}
+		case req := <-ch.pullingSwitchChannel:
+			requestSwitch(req)
 		case <-pullingInterruptChannel:
 			return
 		}
 	}
 }
+
+// Sends an event to the pulling client
+// If abr is not nil, the send throughput is measured
+// Returns false if the stream was closed
+func (ch *ConnectionHandler) SendPullEvent(ev HlsEvent, partsStatus *HlsPullPartsStatus, receiveParts bool, abr *HlsAbrController) bool {
+	switch ev.EventType {
+	case HLS_EVENT_TYPE_CLOSE:
+		ch.SendClose()
+		return false
+	case HLS_EVENT_TYPE_METADATA:
+		ch.SendMetadata(ev.Metadata)
+	case HLS_EVENT_TYPE_VARIANTS:
+		ch.SendVariants(ev.Variants)
+	case HLS_EVENT_TYPE_PART:
+		if !receiveParts || ev.Part == nil {
+			return true
+		}
+
+		if ev.Part.Index == 0 {
+			partsStatus.partsSent = 0
+			partsStatus.partsComplete = false
+		} else if ev.Part.Index != partsStatus.partsSent {
+			// Missing parts, the complete fragment will be sent instead
+			return true
+		}
+
+		sendStartTime := time.Now()
+
+		ch.SendFragmentPart(ev.Part)
+
+		if abr != nil {
+			abr.AddSample(len(ev.Part.Data), time.Since(sendStartTime), ev.Part.Duration)
+		}
+
+		partsStatus.partsSent++
+		partsStatus.partsComplete = ev.Part.Last
+	case HLS_EVENT_TYPE_FRAGMENT:
+		if ev.Fragment == nil {
+			return true
+		}
+
+		if abr != nil {
+			abr.OnFragmentSent()
+		}
+
+		if partsStatus.partsComplete {
+			// Already sent in parts
+			partsStatus.partsSent = 0
+			partsStatus.partsComplete = false
+			return true
+		}
+
+		partsStatus.partsSent = 0
+
+		sendStartTime := time.Now()
+
+		ch.SendFragment(ev.Fragment)
+
+		if abr != nil {
+			abr.AddSample(len(ev.Fragment.Data), time.Since(sendStartTime), ev.Fragment.Duration)
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,285 @@
+// Token revocation list
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Default duration of the token revocations (seconds)
+const DEFAULT_REVOCATION_TTL_SECONDS = 24 * 60 * 60
+
+// Store to share the revoked tokens between nodes
+type TokenRevocationStore interface {
+	// Revokes a token ID until the expiration time
+	RevokeToken(id string, expiration time.Time) error
+
+	// Gets the revoked token IDs (ID -> Expiration time)
+	GetRevokedTokens() (map[string]time.Time, error)
+}
+
+// Configuration of the token revocation list
+type TokenRevocationListConfig struct {
+	// Period to load the revoked tokens from the store (seconds)
+	SyncPeriodSeconds int
+}
+
+// Watcher of a connected session, closed if its token is revoked
+type tokenRevocationWatcher struct {
+	// Revocation IDs of the token
+	ids []string
+
+	// Function called if the token is revoked
+	onRevoked func()
+}
+
+// List of revoked tokens
+// Tokens are revoked by token ID (jti claim) or user ID (uid claim)
+// If a store is set, the revocations are shared with other nodes. Otherwise, they are only kept in memory.
+type TokenRevocationList struct {
+	// Configuration
+	config TokenRevocationListConfig
+
+	// Store (nil for in-memory only)
+	store TokenRevocationStore
+
+	// Logger
+	logger *glog.Logger
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Revoked IDs (ID -> Expiration time)
+	revoked map[string]time.Time
+
+	// Watchers of connected sessions (Watcher ID -> Watcher)
+	watchers map[uint64]*tokenRevocationWatcher
+
+	// ID for the next watcher
+	nextWatcherId uint64
+
+	// Channel to interrupt the sync thread
+	interruptChannel chan bool
+}
+
+// Creates new instance of TokenRevocationList
+// store - Store to share the revocations (can be nil)
+func NewTokenRevocationList(config TokenRevocationListConfig, store TokenRevocationStore, logger *glog.Logger) *TokenRevocationList {
+	rl := &TokenRevocationList{
+		config:           config,
+		store:            store,
+		logger:           logger,
+		mu:               &sync.Mutex{},
+		revoked:          make(map[string]time.Time),
+		watchers:         make(map[uint64]*tokenRevocationWatcher),
+		nextWatcherId:    1,
+		interruptChannel: make(chan bool, 1),
+	}
+
+	if store != nil {
+		rl.Sync()
+
+		if config.SyncPeriodSeconds > 0 {
+			go rl.periodicallySync()
+		}
+	}
+
+	return rl
+}
+
+// Gets the revocation IDs of a token, given its claims
+func getTokenRevocationIds(claims jwt.MapClaims) []string {
+	ids := make([]string, 0)
+
+	if jti, ok := claims["jti"].(string); ok && jti != "" {
+		ids = append(ids, "jti:"+jti)
+	}
+
+	if uid, ok := claims["uid"].(string); ok && uid != "" {
+		ids = append(ids, "uid:"+uid)
+	}
+
+	return ids
+}
+
+// Stops loading the revoked tokens from the store
+func (rl *TokenRevocationList) Close() {
+	select {
+	case rl.interruptChannel <- true:
+	default:
+	}
+}
+
+// Loads the revoked tokens from the store periodically
+func (rl *TokenRevocationList) periodicallySync() {
+	period := time.Duration(rl.config.SyncPeriodSeconds) * time.Second
+
+	for {
+		select {
+		case <-rl.interruptChannel:
+			return
+		case <-time.After(period):
+			rl.Sync()
+		}
+	}
+}
+
+// Loads the revoked tokens from the store,
+// closing the connected sessions with tokens revoked by other nodes
+func (rl *TokenRevocationList) Sync() {
+	revoked, err := rl.store.GetRevokedTokens()
+
+	if err != nil {
+		rl.logger.Errorf("Could not load the revoked tokens: %v", err)
+		return
+	}
+
+	rl.mu.Lock()
+
+	rl.removeExpired()
+
+	now := time.Now()
+
+	for id, expiration := range revoked {
+		if expiration.After(now) {
+			rl.revoked[id] = expiration
+		}
+	}
+
+	revokedWatchers := rl.removeRevokedWatchers()
+
+	rl.mu.Unlock()
+
+	for _, w := range revokedWatchers {
+		w.onRevoked()
+	}
+}
+
+// Revokes an ID until the expiration time
+// Connected sessions with tokens matching the ID are closed
+func (rl *TokenRevocationList) Revoke(id string, expiration time.Time) error {
+	rl.mu.Lock()
+
+	rl.removeExpired()
+
+	rl.revoked[id] = expiration
+
+	revokedWatchers := rl.removeRevokedWatchers()
+
+	rl.mu.Unlock()
+
+	for _, w := range revokedWatchers {
+		w.onRevoked()
+	}
+
+	if rl.store == nil {
+		return nil
+	}
+
+	return rl.store.RevokeToken(id, expiration)
+}
+
+// Removes the expired revocations
+// Must be called with the mutex locked
+func (rl *TokenRevocationList) removeExpired() {
+	now := time.Now()
+
+	for id, expiration := range rl.revoked {
+		if !expiration.After(now) {
+			delete(rl.revoked, id)
+		}
+	}
+}
+
+// Checks if an ID is revoked
+// Must be called with the mutex locked
+func (rl *TokenRevocationList) isRevoked(id string) bool {
+	expiration, ok := rl.revoked[id]
+	return ok && expiration.After(time.Now())
+}
+
+// Removes the watchers of revoked tokens
+// Must be called with the mutex locked
+// Returns the removed watchers
+func (rl *TokenRevocationList) removeRevokedWatchers() []*tokenRevocationWatcher {
+	revokedWatchers := make([]*tokenRevocationWatcher, 0)
+
+	for watcherId, w := range rl.watchers {
+		for _, id := range w.ids {
+			if rl.isRevoked(id) {
+				revokedWatchers = append(revokedWatchers, w)
+				delete(rl.watchers, watcherId)
+				break
+			}
+		}
+	}
+
+	return revokedWatchers
+}
+
+// Checks if a token is revoked, given its claims
+func (rl *TokenRevocationList) IsRevoked(claims jwt.MapClaims) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for _, id := range getTokenRevocationIds(claims) {
+		if rl.isRevoked(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Watches a connected session, in order to close it if its token is revoked
+// claims - Claims of the token
+// onRevoked - Function called if the token is revoked
+// Returns the watcher ID, or 0 if the token cannot be revoked (no jti or uid claims)
+// If the token is already revoked, onRevoked is called before returning 0
+func (rl *TokenRevocationList) Watch(claims jwt.MapClaims, onRevoked func()) uint64 {
+	ids := getTokenRevocationIds(claims)
+
+	if len(ids) == 0 {
+		return 0
+	}
+
+	rl.mu.Lock()
+
+	for _, id := range ids {
+		if rl.isRevoked(id) {
+			// Revoked after the token was validated
+			rl.mu.Unlock()
+			onRevoked()
+			return 0
+		}
+	}
+
+	defer rl.mu.Unlock()
+
+	watcherId := rl.nextWatcherId
+	rl.nextWatcherId++
+
+	rl.watchers[watcherId] = &tokenRevocationWatcher{
+		ids:       ids,
+		onRevoked: onRevoked,
+	}
+
+	return watcherId
+}
+
+// Stops watching a session
+// Must be called once the session is closed
+func (rl *TokenRevocationList) Unwatch(watcherId uint64) {
+	if watcherId == 0 {
+		return
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	delete(rl.watchers, watcherId)
+}
@@ -0,0 +1,207 @@
+// Tests for the token revocation list
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AgustinSRG/glog"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenRevocationList(t *testing.T) {
+	logger := glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction)
+
+	store := NewMockPublishRegistry()
+
+	list1 := NewTokenRevocationList(TokenRevocationListConfig{}, store, logger)
+	defer list1.Close()
+
+	list2 := NewTokenRevocationList(TokenRevocationListConfig{}, store, logger)
+	defer list2.Close()
+
+	tokenClaims := jwt.MapClaims{"jti": "token1"}
+	userClaims := jwt.MapClaims{"jti": "token2", "uid": "user1"}
+	otherClaims := jwt.MapClaims{"uid": "user2"}
+
+	// Watch sessions in the second list
+
+	revoked := make(chan string, 3)
+
+	for name, claims := range map[string]jwt.MapClaims{"token": tokenClaims, "user": userClaims, "other": otherClaims} {
+		name := name
+
+		if list2.Watch(claims, func() { revoked <- name }) == 0 {
+			t.Errorf("[%v] Expected the session to be watched", name)
+		}
+	}
+
+	if list2.Watch(jwt.MapClaims{}, func() { revoked <- "no IDs" }) != 0 {
+		t.Errorf("Tokens without jti or uid must not be watched")
+	}
+
+	// Revoke in the first list
+
+	_ = list1.Revoke("jti:token1", time.Now().Add(time.Hour))
+	_ = list1.Revoke("uid:user1", time.Now().Add(time.Hour))
+	_ = list1.Revoke("uid:user2", time.Now().Add(-time.Second)) // Already expired
+
+	if !list1.IsRevoked(tokenClaims) || !list1.IsRevoked(userClaims) || list1.IsRevoked(otherClaims) {
+		t.Errorf("Unexpected revocation status in the first list")
+	}
+
+	if list2.IsRevoked(tokenClaims) || len(revoked) != 0 {
+		t.Errorf("The second list must not know the revocations before syncing")
+	}
+
+	// Sync the second list
+
+	list2.Sync()
+
+	if !list2.IsRevoked(tokenClaims) || !list2.IsRevoked(userClaims) || list2.IsRevoked(otherClaims) {
+		t.Errorf("Unexpected revocation status in the second list")
+	}
+
+	if len(revoked) != 2 {
+		t.Fatalf("Expected 2 sessions to be closed, but %v were closed", len(revoked))
+	}
+
+	for i := 0; i < 2; i++ {
+		if name := <-revoked; name != "token" && name != "user" {
+			t.Errorf("Unexpected session closed: %v", name)
+		}
+	}
+
+	// Watching a revoked token closes the session immediately
+
+	if list1.Watch(userClaims, func() { revoked <- "late" }) != 0 || len(revoked) != 1 {
+		t.Errorf("Expected the session of the revoked token to be closed immediately")
+	}
+}
+
+func TestTokenRevocationListPrune(t *testing.T) {
+	logger := glog.CreateRootLogger(glog.CreateLoggerConfigurationFromLevel(glog.TRACE), glog.StandardLogFunction)
+
+	// Without a store, the expired revocations are removed when revoking
+
+	list := NewTokenRevocationList(TokenRevocationListConfig{}, nil, logger)
+	defer list.Close()
+
+	_ = list.Revoke("jti:expired1", time.Now().Add(-time.Second))
+	_ = list.Revoke("jti:expired2", time.Now().Add(-time.Second))
+	_ = list.Revoke("jti:active", time.Now().Add(time.Hour))
+
+	list.mu.Lock()
+	revokedCount := len(list.revoked)
+	list.mu.Unlock()
+
+	if revokedCount != 1 {
+		t.Errorf("Expected only the active revocation to be kept, but got %v", revokedCount)
+	}
+}
+
+func TestTokenRevocationKick(t *testing.T) {
+	logger := testMain()
+
+	mockPublishRegistry := NewMockPublishRegistry()
+
+	server1 := makeTestServerWithOptions(logger.CreateChildLogger("[Server 1] "), mockPublishRegistry, true, "", TestServerOptions{AdminApi: true})
+	defer server1.Close()
+
+	server2 := makeTestServer(logger.CreateChildLogger("[Server 2] "), mockPublishRegistry, true, "")
+	defer server2.Close()
+
+	publisher := connectTestClient(server1.url, "PUSH", TEST_STREAM_ID_1, map[string]string{
+		"auth": signTestAuthTokenWithClaims(TEST_JWT_SECRET, jwt.MapClaims{
+			"sub": "PUSH:" + TEST_STREAM_ID_1,
+			"jti": "publisher",
+		}),
+	}, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	userToken := signTestAuthTokenWithClaims(TEST_JWT_SECRET, jwt.MapClaims{
+		"sub": "PULL:" + TEST_STREAM_ID_1,
+		"uid": "user1",
+	})
+
+	spectator1 := connectTestClient(server1.url, "PULL", TEST_STREAM_ID_1, map[string]string{"auth": userToken}, t)
+
+	if spectator1 == nil {
+		return
+	}
+
+	defer spectator1.Close()
+
+	spectator2 := connectTestClient(server2.url, "PULL", TEST_STREAM_ID_1, map[string]string{"auth": userToken}, t)
+
+	if spectator2 == nil {
+		return
+	}
+
+	defer spectator2.Close()
+
+	// Revoke the user
+
+	if status := sendTestAdminApiRequest(server1, "POST", "revoke", `{"uid":"user1"}`, t); status != 200 {
+		t.Fatalf("Expected status 200, but got %v", status)
+	}
+
+	msg, _ := readTestMessage(spectator1, t)
+
+	if msg == nil || msg.MessageType != "E" || msg.GetParameter("code") != "TOKEN_REVOKED" {
+		t.Errorf("[Spectator 1] Expected TOKEN_REVOKED error, but received: %v", msg)
+	}
+
+	// The other node closes the session once synced
+
+	server2.server.authController.revocations.Sync()
+
+	msg, _ = readTestMessage(spectator2, t)
+
+	if msg == nil || msg.MessageType != "E" || msg.GetParameter("code") != "TOKEN_REVOKED" {
+		t.Errorf("[Spectator 2] Expected TOKEN_REVOKED error, but received: %v", msg)
+	}
+
+	// New connections are rejected
+
+	socket, _, err := websocket.DefaultDialer.Dial(server1.url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer socket.Close()
+
+	_ = socket.WriteMessage(websocket.TextMessage, []byte("PULL:stream="+TEST_STREAM_ID_1+"&auth="+userToken))
+
+	msg, _ = readTestMessage(socket, t)
+
+	if msg == nil || msg.MessageType != "E" || msg.GetParameter("code") != "AUTH_ERROR" {
+		t.Errorf("Expected AUTH_ERROR for the revoked token, but received: %v", msg)
+	}
+
+	// Revoke the publisher token
+
+	if status := sendTestAdminApiRequest(server1, "POST", "revoke", `{"jti":"publisher","ttl":60}`, t); status != 200 {
+		t.Fatalf("Expected status 200, but got %v", status)
+	}
+
+	msg, _ = readTestMessage(publisher, t)
+
+	if msg == nil || msg.MessageType != "E" || msg.GetParameter("code") != "TOKEN_REVOKED" {
+		t.Errorf("[Publisher] Expected TOKEN_REVOKED error, but received: %v", msg)
+	}
+
+	// Invalid requests
+
+	if status := sendTestAdminApiRequest(server1, "POST", "revoke", `{}`, t); status != 400 {
+		t.Errorf("Expected status 400, but got %v", status)
+	}
+}
@@ -0,0 +1,315 @@
+// MPEG-TS muxer (H.264 and AAC)
+
+package main
+
+// Size of MPEG-TS packets
+const TS_PACKET_SIZE = 188
+
+// PIDs
+const (
+	TS_PID_PAT   = 0x0000
+	TS_PID_PMT   = 0x1000
+	TS_PID_VIDEO = 0x0100
+	TS_PID_AUDIO = 0x0101
+)
+
+// Stream types (PMT)
+const (
+	TS_STREAM_TYPE_H264 = 0x1B
+	TS_STREAM_TYPE_AAC  = 0x0F
+)
+
+// PES stream IDs
+const (
+	TS_PES_STREAM_ID_VIDEO = 0xE0
+	TS_PES_STREAM_ID_AUDIO = 0xC0
+)
+
+// CRC32 table for MPEG-2 PSI sections
+var tsCrcTable = makeTsCrcTable()
+
+// Makes the CRC32 table for MPEG-2 (polynomial 0x04C11DB7, not reflected)
+func makeTsCrcTable() [256]uint32 {
+	var table [256]uint32
+
+	for i := 0; i < 256; i++ {
+		crc := uint32(i) << 24
+
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = (crc << 1) ^ 0x04C11DB7
+			} else {
+				crc = crc << 1
+			}
+		}
+
+		table[i] = crc
+	}
+
+	return table
+}
+
+// Computes the CRC32 of a PSI section
+func tsCrc32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+
+	for _, b := range data {
+		crc = (crc << 8) ^ tsCrcTable[byte(crc>>24)^b]
+	}
+
+	return crc
+}
+
+// MPEG-TS muxer
+// Writes the packets to a memory buffer
+type TsMuxer struct {
+	// True if the stream has video (H.264)
+	hasVideo bool
+
+	// True if the stream has audio (AAC)
+	hasAudio bool
+
+	// Continuity counters (PID -> Counter)
+	continuityCounters map[uint16]byte
+
+	// Muxed data
+	buffer []byte
+}
+
+// Creates new instance of TsMuxer
+func NewTsMuxer(hasVideo bool, hasAudio bool) *TsMuxer {
+	return &TsMuxer{
+		hasVideo:           hasVideo,
+		hasAudio:           hasAudio,
+		continuityCounters: make(map[uint16]byte),
+		buffer:             make([]byte, 0),
+	}
+}
+
+// Gets the muxed data, clearing the buffer
+func (muxer *TsMuxer) TakeData() []byte {
+	data := muxer.buffer
+	muxer.buffer = make([]byte, 0)
+	return data
+}
+
+// Gets the PID carrying the PCR
+func (muxer *TsMuxer) getPcrPid() uint16 {
+	if muxer.hasVideo {
+		return TS_PID_VIDEO
+	}
+
+	return TS_PID_AUDIO
+}
+
+// Gets the next continuity counter of a PID
+func (muxer *TsMuxer) nextContinuityCounter(pid uint16) byte {
+	cc := muxer.continuityCounters[pid]
+	muxer.continuityCounters[pid] = (cc + 1) & 0x0F
+	return cc
+}
+
+// Writes the program tables (PAT and PMT)
+func (muxer *TsMuxer) WriteTables() {
+	// PAT
+
+	pat := []byte{
+		0x00,       // Table ID
+		0xB0, 0x0D, // Section length
+		0x00, 0x01, // Transport stream ID
+		0xC1,       // Version, current
+		0x00, 0x00, // Section numbers
+		0x00, 0x01, // Program number
+		0xE0 | byte(TS_PID_PMT>>8), byte(TS_PID_PMT & 0xFF),
+	}
+
+	muxer.writePsi(TS_PID_PAT, pat)
+
+	// PMT
+
+	streams := make([]byte, 0)
+
+	if muxer.hasVideo {
+		streams = append(streams, TS_STREAM_TYPE_H264, 0xE0|byte(TS_PID_VIDEO>>8), byte(TS_PID_VIDEO&0xFF), 0xF0, 0x00)
+	}
+
+	if muxer.hasAudio {
+		streams = append(streams, TS_STREAM_TYPE_AAC, 0xE0|byte(TS_PID_AUDIO>>8), byte(TS_PID_AUDIO&0xFF), 0xF0, 0x00)
+	}
+
+	sectionLength := 9 + len(streams) + 4
+	pcrPid := muxer.getPcrPid()
+
+	pmt := []byte{
+		0x02, // Table ID
+		0xB0 | byte(sectionLength>>8), byte(sectionLength & 0xFF),
+		0x00, 0x01, // Program number
+		0xC1,       // Version, current
+		0x00, 0x00, // Section numbers
+		0xE0 | byte(pcrPid>>8), byte(pcrPid & 0xFF),
+		0xF0, 0x00, // Program info length
+	}
+
+	pmt = append(pmt, streams...)
+
+	muxer.writePsi(TS_PID_PMT, pmt)
+}
+
+// Writes a PSI section (the CRC is appended)
+func (muxer *TsMuxer) writePsi(pid uint16, section []byte) {
+	crc := tsCrc32(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	packet := make([]byte, TS_PACKET_SIZE)
+
+	packet[0] = 0x47
+	packet[1] = 0x40 | byte(pid>>8)
+	packet[2] = byte(pid & 0xFF)
+	packet[3] = 0x10 | muxer.nextContinuityCounter(pid)
+	packet[4] = 0x00 // Pointer field
+
+	n := copy(packet[5:], section)
+
+	for i := 5 + n; i < TS_PACKET_SIZE; i++ {
+		packet[i] = 0xFF
+	}
+
+	muxer.buffer = append(muxer.buffer, packet...)
+}
+
+// Encodes a PES timestamp (PTS or DTS)
+func appendTsTimestamp(buf []byte, prefix byte, ts int64) []byte {
+	return append(buf,
+		(prefix<<4)|byte((ts>>29)&0x0E)|1,
+		byte(ts>>22),
+		byte((ts>>14)&0xFE)|1,
+		byte(ts>>7),
+		byte((ts<<1)&0xFE)|1,
+	)
+}
+
+// Writes a video frame
+// data - Access unit (H.264 Annex B)
+// pts, dts - Timestamps (90 kHz)
+// keyframe - True if the frame is a keyframe
+func (muxer *TsMuxer) WriteVideoFrame(data []byte, pts int64, dts int64, keyframe bool) {
+	if !muxer.hasVideo {
+		return
+	}
+
+	muxer.writePes(TS_PID_VIDEO, TS_PES_STREAM_ID_VIDEO, data, pts, dts, keyframe)
+}
+
+// Writes an audio frame
+// data - AAC frame, with ADTS header
+// pts - Timestamp (90 kHz)
+func (muxer *TsMuxer) WriteAudioFrame(data []byte, pts int64) {
+	if !muxer.hasAudio {
+		return
+	}
+
+	muxer.writePes(TS_PID_AUDIO, TS_PES_STREAM_ID_AUDIO, data, pts, pts, false)
+}
+
+// Writes a PES packet, split into TS packets
+func (muxer *TsMuxer) writePes(pid uint16, streamId byte, data []byte, pts int64, dts int64, randomAccess bool) {
+	// PES header
+
+	pes := []byte{0x00, 0x00, 0x01, streamId, 0x00, 0x00, 0x80}
+
+	if pts != dts {
+		pes = append(pes, 0xC0, 10)
+		pes = appendTsTimestamp(pes, 0x03, pts)
+		pes = appendTsTimestamp(pes, 0x01, dts)
+	} else {
+		pes = append(pes, 0x80, 5)
+		pes = appendTsTimestamp(pes, 0x02, pts)
+	}
+
+	pesLength := len(pes) - 6 + len(data)
+
+	if pesLength <= 0xFFFF && streamId != TS_PES_STREAM_ID_VIDEO {
+		pes[4] = byte(pesLength >> 8)
+		pes[5] = byte(pesLength & 0xFF)
+	}
+
+	pes = append(pes, data...)
+
+	// TS packets
+
+	withPcr := pid == muxer.getPcrPid()
+	first := true
+
+	for len(pes) > 0 {
+		var adaptation []byte = nil
+
+		if first && (withPcr || randomAccess) {
+			flags := byte(0x00)
+
+			if randomAccess {
+				flags |= 0x40
+			}
+
+			adaptation = []byte{flags}
+
+			if withPcr {
+				adaptation[0] |= 0x10
+
+				pcr := dts
+				adaptation = append(adaptation, byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1), byte((pcr&1)<<7)|0x7E, 0x00)
+			}
+		}
+
+		space := TS_PACKET_SIZE - 4
+
+		if adaptation != nil {
+			space -= 1 + len(adaptation)
+		}
+
+		if len(pes) < space {
+			// Stuffing
+			stuffing := space - len(pes)
+
+			if adaptation == nil {
+				adaptation = []byte{}
+				stuffing--
+			}
+
+			if stuffing > 0 && len(adaptation) == 0 {
+				adaptation = append(adaptation, 0x00)
+				stuffing--
+			}
+
+			for i := 0; i < stuffing; i++ {
+				adaptation = append(adaptation, 0xFF)
+			}
+		}
+
+		packet := make([]byte, 4, TS_PACKET_SIZE)
+
+		packet[0] = 0x47
+		packet[1] = byte(pid >> 8)
+		packet[2] = byte(pid & 0xFF)
+
+		if first {
+			packet[1] |= 0x40
+		}
+
+		if adaptation != nil {
+			packet[3] = 0x30 | muxer.nextContinuityCounter(pid)
+			packet = append(packet, byte(len(adaptation)))
+			packet = append(packet, adaptation...)
+		} else {
+			packet[3] = 0x10 | muxer.nextContinuityCounter(pid)
+		}
+
+		n := TS_PACKET_SIZE - len(packet)
+
+		packet = append(packet, pes[:n]...)
+		pes = pes[n:]
+
+		muxer.buffer = append(muxer.buffer, packet...)
+
+		first = false
+	}
+}
@@ -0,0 +1,131 @@
+// Tests for the MPEG-TS muxer
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTsCrc32(t *testing.T) {
+	// PAT with a single program (PMT PID = 0x1000)
+	pat := []byte{0x00, 0xB0, 0x0D, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xF0, 0x00}
+
+	if crc := tsCrc32(pat); crc != 0x2AB104B2 {
+		t.Errorf("Unexpected CRC: %x", crc)
+	}
+}
+
+// Demuxes the PES payloads of a PID from MPEG-TS data, for testing
+// Returns the payloads (without PES headers)
+func demuxTestTsPayloads(data []byte, pid uint16, t *testing.T) [][]byte {
+	if len(data)%TS_PACKET_SIZE != 0 {
+		t.Errorf("Invalid MPEG-TS data size: %v", len(data))
+		return nil
+	}
+
+	payloads := make([][]byte, 0)
+	var current []byte = nil
+	expectedCc := -1
+
+	for i := 0; i < len(data); i += TS_PACKET_SIZE {
+		packet := data[i : i+TS_PACKET_SIZE]
+
+		if packet[0] != 0x47 {
+			t.Errorf("Invalid sync byte at packet %v", i/TS_PACKET_SIZE)
+			return nil
+		}
+
+		packetPid := (uint16(packet[1]&0x1F) << 8) | uint16(packet[2])
+
+		if packetPid != pid {
+			continue
+		}
+
+		cc := int(packet[3] & 0x0F)
+
+		if expectedCc >= 0 && cc != expectedCc {
+			t.Errorf("Unexpected continuity counter. Expected: %v, Actual: %v", expectedCc, cc)
+		}
+
+		expectedCc = (cc + 1) & 0x0F
+
+		payload := packet[4:]
+
+		if packet[3]&0x20 != 0 {
+			payload = payload[1+int(packet[4]):]
+		}
+
+		if packet[1]&0x40 != 0 {
+			if current != nil {
+				payloads = append(payloads, current)
+			}
+
+			current = make([]byte, 0)
+		}
+
+		current = append(current, payload...)
+	}
+
+	if current != nil {
+		payloads = append(payloads, current)
+	}
+
+	for i, pes := range payloads {
+		if len(pes) < 9 || !bytes.Equal(pes[:3], []byte{0x00, 0x00, 0x01}) {
+			t.Errorf("Invalid PES packet")
+			return nil
+		}
+
+		payloads[i] = pes[9+int(pes[8]):]
+	}
+
+	return payloads
+}
+
+func TestTsMuxer(t *testing.T) {
+	muxer := NewTsMuxer(true, true)
+
+	muxer.WriteTables()
+
+	frames := make([][]byte, 0)
+
+	// Sizes around the packet boundaries, to test the stuffing
+	for size := 1; size <= 2*TS_PACKET_SIZE+10; size += 7 {
+		frame := make([]byte, size)
+
+		for i := range frame {
+			frame[i] = byte(size + i)
+		}
+
+		frames = append(frames, frame)
+
+		muxer.WriteVideoFrame(frame, int64(size)*90+3000, int64(size)*90, size == 1)
+		muxer.WriteAudioFrame(frame, int64(size)*90)
+	}
+
+	data := muxer.TakeData()
+
+	if len(muxer.TakeData()) != 0 {
+		t.Errorf("Expected the buffer to be empty after taking the data")
+	}
+
+	if !bytes.Equal(data[:4], []byte{0x47, 0x40, 0x00, 0x10}) {
+		t.Errorf("Expected the PAT to be the first packet")
+	}
+
+	for _, pid := range []uint16{TS_PID_VIDEO, TS_PID_AUDIO} {
+		payloads := demuxTestTsPayloads(data, pid, t)
+
+		if len(payloads) != len(frames) {
+			t.Errorf("Expected %v payloads, but got %v", len(frames), len(payloads))
+			continue
+		}
+
+		for i, frame := range frames {
+			if !bytes.Equal(payloads[i], frame) {
+				t.Errorf("Payload %v does not match. Expected: %v, Actual: %v", i, frame, payloads[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,359 @@
+// Segmenter of MPEG-TS streams into fragments
+
+package main
+
+// Sync byte of MPEG-TS packets
+const TS_SYNC_BYTE = 0x47
+
+// Stream type (PMT) for H.265 (HEVC)
+const TS_STREAM_TYPE_H265 = 0x24
+
+// Max value of the MPEG-TS timestamps (33 bits)
+const TS_TIMESTAMP_MASK = (1 << 33) - 1
+
+// H.264 NAL unit type for IDR slices
+const H264_NAL_TYPE_IDR = 5
+
+// Range of H.265 NAL unit types for random access pictures (BLA, IDR, CRA)
+const (
+	H265_NAL_TYPE_IRAP_MIN = 16
+	H265_NAL_TYPE_IRAP_MAX = 21
+)
+
+// Segmenter of MPEG-TS streams
+// Splits a continuous stream of MPEG-TS packets into fragments, cut at keyframes
+type TsSegmenter struct {
+	// Min duration of the fragments (milliseconds)
+	fragmentDuration int64
+
+	// Max size of the fragments (bytes)
+	// If reached, the fragment is cut even if there is no keyframe
+	maxFragmentSize int
+
+	// Function called for each complete fragment
+	onFragment func(duration float32, data []byte)
+
+	// Received bytes not forming a full packet yet
+	pending []byte
+
+	// PID of the program map table (-1 if unknown)
+	pmtPid int
+
+	// PID of the video stream (-1 if unknown)
+	videoPid int
+
+	// Stream type of the video stream
+	videoStreamType byte
+
+	// PID of the first non-video stream (-1 if unknown)
+	audioPid int
+
+	// Last program association table packet
+	patPacket []byte
+
+	// Last program map table packet
+	pmtPacket []byte
+
+	// Data of the current fragment (nil if no fragment was started)
+	buffer []byte
+
+	// Timestamp of the start of the current fragment (90 kHz)
+	fragmentStart int64
+
+	// Timestamp of the last PES packet (90 kHz)
+	lastTimestamp int64
+}
+
+// Creates new instance of TsSegmenter
+// fragmentDuration - Min duration of the fragments (milliseconds)
+// maxFragmentSize - Max size of the fragments (bytes)
+// onFragment - Function called for each complete fragment
+func NewTsSegmenter(fragmentDuration int64, maxFragmentSize int, onFragment func(duration float32, data []byte)) *TsSegmenter {
+	return &TsSegmenter{
+		fragmentDuration: fragmentDuration,
+		maxFragmentSize:  maxFragmentSize,
+		onFragment:       onFragment,
+		pending:          make([]byte, 0),
+		pmtPid:           -1,
+		videoPid:         -1,
+		audioPid:         -1,
+	}
+}
+
+// Writes MPEG-TS data
+// The data does not need to be aligned to the packets
+func (segmenter *TsSegmenter) Write(data []byte) {
+	segmenter.pending = append(segmenter.pending, data...)
+
+	offset := 0
+
+	for len(segmenter.pending)-offset >= TS_PACKET_SIZE {
+		if segmenter.pending[offset] != TS_SYNC_BYTE {
+			// Lost sync, skip until the next sync byte
+			offset++
+			continue
+		}
+
+		segmenter.handlePacket(segmenter.pending[offset : offset+TS_PACKET_SIZE])
+
+		offset += TS_PACKET_SIZE
+	}
+
+	segmenter.pending = append(segmenter.pending[:0], segmenter.pending[offset:]...)
+}
+
+// Ends the current fragment, at the timestamp of the last PES packet
+func (segmenter *TsSegmenter) End() {
+	segmenter.Flush(segmenter.lastTimestamp)
+}
+
+// Ends the current fragment
+// timestamp - Timestamp of the end of the fragment (90 kHz)
+func (segmenter *TsSegmenter) Flush(timestamp int64) {
+	if segmenter.buffer == nil {
+		return
+	}
+
+	data := segmenter.buffer
+	segmenter.buffer = nil
+
+	duration := (timestamp - segmenter.fragmentStart) & TS_TIMESTAMP_MASK
+
+	if duration > TS_TIMESTAMP_MASK/2 {
+		// Timestamp went backwards
+		duration = 0
+	}
+
+	segmenter.onFragment(float32(duration)/90000, data)
+}
+
+// Starts a new fragment, ending the current one
+// The new fragment starts with the program tables
+func (segmenter *TsSegmenter) startFragment(timestamp int64) {
+	segmenter.Flush(timestamp)
+
+	segmenter.buffer = make([]byte, 0, len(segmenter.patPacket)+len(segmenter.pmtPacket))
+	segmenter.buffer = append(segmenter.buffer, segmenter.patPacket...)
+	segmenter.buffer = append(segmenter.buffer, segmenter.pmtPacket...)
+	segmenter.fragmentStart = timestamp
+}
+
+// Gets the PID used to cut the fragments
+// It is the video PID, or the audio PID for audio-only streams
+func (segmenter *TsSegmenter) getTimingPid() int {
+	if segmenter.videoPid >= 0 {
+		return segmenter.videoPid
+	}
+
+	return segmenter.audioPid
+}
+
+// Handles a packet
+func (segmenter *TsSegmenter) handlePacket(packet []byte) {
+	pid := int(packet[1]&0x1F)<<8 | int(packet[2])
+	payloadUnitStart := packet[1]&0x40 != 0
+	adaptationFieldControl := (packet[3] >> 4) & 0x03
+
+	payloadOffset := 4
+	randomAccess := false
+
+	if adaptationFieldControl&0x02 != 0 {
+		adaptationFieldLength := int(packet[4])
+
+		if adaptationFieldLength > 0 {
+			randomAccess = packet[5]&0x40 != 0
+		}
+
+		payloadOffset = 5 + adaptationFieldLength
+	}
+
+	var payload []byte
+
+	if adaptationFieldControl&0x01 != 0 && payloadOffset < TS_PACKET_SIZE {
+		payload = packet[payloadOffset:]
+	}
+
+	switch {
+	case pid == TS_PID_PAT:
+		if payloadUnitStart && segmenter.parsePat(payload) {
+			segmenter.patPacket = append(segmenter.patPacket[:0], packet...)
+		}
+	case pid == segmenter.pmtPid:
+		if payloadUnitStart && segmenter.parsePmt(payload) {
+			segmenter.pmtPacket = append(segmenter.pmtPacket[:0], packet...)
+		}
+	case pid == segmenter.getTimingPid() && payloadUnitStart:
+		timestamp, ok := parsePesTimestamp(payload)
+
+		if ok {
+			keyframe := pid != segmenter.videoPid || randomAccess || segmenter.isKeyframePayload(payload)
+
+			if keyframe && (segmenter.buffer == nil || (timestamp-segmenter.fragmentStart)&TS_TIMESTAMP_MASK >= segmenter.fragmentDuration*90) {
+				segmenter.startFragment(timestamp)
+			}
+
+			segmenter.lastTimestamp = timestamp
+		}
+	}
+
+	if segmenter.buffer == nil {
+		// Waiting for the first keyframe
+		return
+	}
+
+	if len(segmenter.buffer)+TS_PACKET_SIZE > segmenter.maxFragmentSize {
+		segmenter.startFragment(segmenter.lastTimestamp)
+	}
+
+	segmenter.buffer = append(segmenter.buffer, packet...)
+}
+
+// Gets the payload of a PSI section, skipping the pointer field
+// Returns nil if the section is invalid
+func getTsPsiSection(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+
+	start := 1 + int(payload[0])
+
+	if start+3 > len(payload) {
+		return nil
+	}
+
+	sectionLength := int(payload[start+1]&0x0F)<<8 | int(payload[start+2])
+	end := start + 3 + sectionLength
+
+	if end > len(payload) || sectionLength < 9 {
+		return nil
+	}
+
+	// Remove the CRC
+	return payload[start : end-4]
+}
+
+// Parses the program association table
+// Returns true if it is valid
+func (segmenter *TsSegmenter) parsePat(payload []byte) bool {
+	section := getTsPsiSection(payload)
+
+	if section == nil {
+		return false
+	}
+
+	for i := 8; i+4 <= len(section); i += 4 {
+		programNumber := int(section[i])<<8 | int(section[i+1])
+
+		if programNumber == 0 {
+			// Network PID
+			continue
+		}
+
+		segmenter.pmtPid = int(section[i+2]&0x1F)<<8 | int(section[i+3])
+
+		return true
+	}
+
+	return false
+}
+
+// Parses the program map table
+// Returns true if it is valid
+func (segmenter *TsSegmenter) parsePmt(payload []byte) bool {
+	section := getTsPsiSection(payload)
+
+	if section == nil || len(section) < 12 {
+		return false
+	}
+
+	programInfoLength := int(section[10]&0x0F)<<8 | int(section[11])
+
+	videoPid := -1
+	audioPid := -1
+
+	for i := 12 + programInfoLength; i+5 <= len(section); {
+		streamType := section[i]
+		pid := int(section[i+1]&0x1F)<<8 | int(section[i+2])
+		esInfoLength := int(section[i+3]&0x0F)<<8 | int(section[i+4])
+
+		if (streamType == TS_STREAM_TYPE_H264 || streamType == TS_STREAM_TYPE_H265) && videoPid < 0 {
+			videoPid = pid
+			segmenter.videoStreamType = streamType
+		} else if audioPid < 0 {
+			audioPid = pid
+		}
+
+		i += 5 + esInfoLength
+	}
+
+	if videoPid < 0 && audioPid < 0 {
+		return false
+	}
+
+	segmenter.videoPid = videoPid
+	segmenter.audioPid = audioPid
+
+	return true
+}
+
+// Parses the timestamp of a PES packet (DTS, or PTS if there is no DTS)
+// Returns false if the packet has no timestamp
+func parsePesTimestamp(payload []byte) (int64, bool) {
+	if len(payload) < 14 || payload[0] != 0x00 || payload[1] != 0x00 || payload[2] != 0x01 {
+		return 0, false
+	}
+
+	ptsDtsFlags := payload[7] >> 6
+
+	switch ptsDtsFlags {
+	case 0x03:
+		if len(payload) < 19 {
+			return 0, false
+		}
+
+		return parsePesTimestampField(payload[14:19]), true
+	case 0x02:
+		return parsePesTimestampField(payload[9:14]), true
+	default:
+		return 0, false
+	}
+}
+
+// Parses a 33 bit timestamp field of a PES header
+func parsePesTimestampField(field []byte) int64 {
+	return int64(field[0]&0x0E)<<29 |
+		int64(field[1])<<22 |
+		int64(field[2]&0xFE)<<14 |
+		int64(field[3])<<7 |
+		int64(field[4])>>1
+}
+
+// Checks if the start of a video PES packet contains a keyframe
+// Used when the encoder does not set the random access indicator
+func (segmenter *TsSegmenter) isKeyframePayload(payload []byte) bool {
+	if len(payload) < 9 || 9+int(payload[8]) > len(payload) {
+		return false
+	}
+
+	data := payload[9+int(payload[8]):]
+
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] != 0x00 || data[i+1] != 0x00 || data[i+2] != 0x01 {
+			continue
+		}
+
+		header := data[i+3]
+
+		if segmenter.videoStreamType == TS_STREAM_TYPE_H265 {
+			nalType := (header >> 1) & 0x3F
+
+			if nalType >= H265_NAL_TYPE_IRAP_MIN && nalType <= H265_NAL_TYPE_IRAP_MAX {
+				return true
+			}
+		} else if header&0x1F == H264_NAL_TYPE_IDR {
+			return true
+		}
+	}
+
+	return false
+}
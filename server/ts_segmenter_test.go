@@ -0,0 +1,85 @@
+// Tests for the MPEG-TS segmenter
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Makes a test MPEG-TS stream, with a video frame and an audio frame every 250 ms, and a keyframe every second
+// seconds - Duration of the stream
+func makeTestTsStream(seconds int) []byte {
+	muxer := NewTsMuxer(true, true)
+
+	muxer.WriteTables()
+
+	for i := 0; i < seconds*4; i++ {
+		ts := int64(i) * 250 * 90
+		frame := []byte{0x00, 0x00, 0x00, 0x01, 0x41, byte(i), 0x01, 0x02}
+
+		if i%4 == 0 {
+			frame = []byte{0x00, 0x00, 0x00, 0x01, 0x65, byte(i), 0x01, 0x02}
+		}
+
+		muxer.WriteVideoFrame(frame, ts, ts, i%4 == 0)
+		muxer.WriteAudioFrame([]byte{0xFF, 0xF1, 0x50, 0x80, 0x01, 0x3F, 0xFC, byte(i)}, ts)
+	}
+
+	return muxer.TakeData()
+}
+
+func TestTsSegmenter(t *testing.T) {
+	type TestFragment struct {
+		Duration float32
+		Data     []byte
+	}
+
+	fragments := make([]TestFragment, 0)
+
+	segmenter := NewTsSegmenter(2000, DEFAULT_MAX_BINARY_MSG_SIZE, func(duration float32, data []byte) {
+		fragments = append(fragments, TestFragment{
+			Duration: duration,
+			Data:     data,
+		})
+	})
+
+	stream := makeTestTsStream(5)
+
+	// Garbage before the stream, to test the synchronization
+	segmenter.Write([]byte{0x01, 0x02, 0x03})
+
+	// Chunks not aligned to the packets
+	for i := 0; i < len(stream); i += 100 {
+		segmenter.Write(stream[i:min(i+100, len(stream))])
+	}
+
+	segmenter.End()
+
+	expectedDurations := []float32{2, 2, 0.75}
+
+	if len(fragments) != len(expectedDurations) {
+		t.Errorf("Expected %v fragments, but got %v", len(expectedDurations), len(fragments))
+		return
+	}
+
+	for i, frag := range fragments {
+		if frag.Duration != expectedDurations[i] {
+			t.Errorf("Fragment %v: Expected duration %v, but got %v", i, expectedDurations[i], frag.Duration)
+		}
+
+		if !bytes.Equal(frag.Data[:TS_PACKET_SIZE], stream[:TS_PACKET_SIZE]) {
+			t.Errorf("Fragment %v: Expected the PAT to be the first packet", i)
+		}
+
+		videoPayloads := demuxTestTsPayloads(frag.Data, TS_PID_VIDEO, t)
+
+		if len(videoPayloads) == 0 || videoPayloads[0][4] != 0x65 {
+			t.Errorf("Fragment %v: Expected to start with a keyframe", i)
+		}
+	}
+
+	if len(demuxTestTsPayloads(fragments[0].Data, TS_PID_AUDIO, t)) != 8 {
+		t.Errorf("Expected 8 audio frames in the first fragment")
+	}
+}
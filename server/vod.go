@@ -0,0 +1,167 @@
+// VOD playback of recordings
+
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Max amount of media (seconds) to send ahead of real time when playing a recording
+const VOD_PLAYBACK_MAX_AHEAD_SECONDS = 20
+
+// Recording to be played (VOD)
+type HlsVodRecording struct {
+	// Path of the recording in the storage
+	Path string
+
+	// Segments
+	Segments []*HlsRecordedSegment
+}
+
+// Parses the playlist of a recording
+func parseRecordingPlaylist(playlist string) []*HlsRecordedSegment {
+	segments := make([]*HlsRecordedSegment, 0)
+
+	discontinuity := false
+
+	for _, fragment := range DecodeHlsPlaylist(playlist).Fragments {
+		discontinuity = discontinuity || fragment.Discontinuity
+
+		if strings.Contains(fragment.Uri, "/") || strings.Contains(fragment.Uri, "\\") || strings.Contains(fragment.Uri, "..") {
+			// Only files of the recording are allowed
+			continue
+		}
+
+		segments = append(segments, &HlsRecordedSegment{
+			FileName:      fragment.Uri,
+			Duration:      float32(fragment.Duration),
+			Discontinuity: discontinuity,
+		})
+
+		discontinuity = false
+	}
+
+	return segments
+}
+
+// Finds the latest recording of a stream
+// Returns nil if VOD playback is disabled, or the stream has no recordings
+func (rc *RecordingController) FindRecording(streamId string) *HlsVodRecording {
+	if !rc.IsVodEnabled() {
+		return nil
+	}
+
+	streamDirectory := getRecordingStreamDirectoryName(streamId)
+
+	latest, err := rc.storage.ReadFile(streamDirectory + "/" + RECORDING_LATEST_FILE)
+
+	if err != nil {
+		rc.logger.Debugf("No recordings found for %v: %v", streamId, err)
+		return nil
+	}
+
+	path := strings.TrimSpace(string(latest))
+
+	if !strings.HasPrefix(path, streamDirectory+"/") || strings.Contains(path, "..") {
+		rc.logger.Warningf("Invalid latest recording path for %v: %v", streamId, path)
+		return nil
+	}
+
+	playlist, err := rc.storage.ReadFile(path + "/" + RECORDING_PLAYLIST_FILE)
+
+	if err != nil {
+		rc.logger.Errorf("Could not read the playlist of the recording %v: %v", path, err)
+		return nil
+	}
+
+	return &HlsVodRecording{
+		Path:     path,
+		Segments: parseRecordingPlaylist(string(playlist)),
+	}
+}
+
+// Reads a segment of a recording
+func (rc *RecordingController) ReadSegment(recording *HlsVodRecording, segment *HlsRecordedSegment) ([]byte, error) {
+	return rc.storage.ReadFile(recording.Path + "/" + segment.FileName)
+}
+
+// Finds the latest recording of a stream and sends its fragments, then closes the connection
+// If the stream has no recordings, the connection is closed with no fragments.
+// If fast is true, the fragments are sent as fast as possible. Otherwise, they are paced in real time.
+func (ch *ConnectionHandler) PullVod(streamId string, pullingInterruptChannel chan bool, fast bool) {
+	recordingController := ch.server.sourceController.recordingController
+
+	recording := recordingController.FindRecording(streamId)
+
+	if recording == nil {
+		ch.SendClose()
+		return
+	}
+
+	playbackStart := time.Now()
+	var mediaSent float64 = 0
+
+	for _, segment := range recording.Segments {
+		var readyChan <-chan time.Time = nil
+
+		if !fast {
+			// Do not send too much media ahead of real time
+			wait := mediaSent - VOD_PLAYBACK_MAX_AHEAD_SECONDS - time.Since(playbackStart).Seconds()
+
+			if wait > 0 {
+				readyChan = time.After(time.Duration(wait * float64(time.Second)))
+			}
+		}
+
+		if readyChan != nil {
+			ready := false
+
+			for !ready {
+				select {
+				case <-readyChan:
+					ready = true
+				case <-ch.pullingSeekChannel:
+					ch.Send(&WebsocketProtocolMessage{
+						MessageType: "SEEK_ERROR",
+						Parameters: map[string]string{
+							"message": "Seeking is not available for recordings",
+						},
+					})
+				case req := <-ch.pullingSwitchChannel:
+					ch.Send(&WebsocketProtocolMessage{
+						MessageType: "SWITCH_ERROR",
+						Parameters: map[string]string{
+							"stream":  req.StreamId,
+							"message": "Switching is not available for recordings",
+						},
+					})
+				case <-pullingInterruptChannel:
+					return
+				}
+			}
+		} else {
+			select {
+			case <-pullingInterruptChannel:
+				return
+			default:
+			}
+		}
+
+		data, err := recordingController.ReadSegment(recording, segment)
+
+		if err != nil {
+			ch.logger.Errorf("Could not read segment %v of the recording %v: %v", segment.FileName, recording.Path, err)
+			break
+		}
+
+		ch.SendFragment(&HlsFragment{
+			Duration: segment.Duration,
+			Data:     data,
+		})
+
+		mediaSent += float64(segment.Duration)
+	}
+
+	ch.SendClose()
+}
@@ -0,0 +1,149 @@
+// Tests for the VOD playback
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseRecordingPlaylist(t *testing.T) {
+	playlist := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-PLAYLIST-TYPE:EVENT\n" +
+		"#EXT-X-TARGETDURATION:3\n" +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXTINF:1.000000,\n" +
+		"1.ts\n" +
+		"#EXT-X-DISCONTINUITY\n" +
+		"#EXTINF:2.500000,\n" +
+		"3.ts\n" +
+		"#EXTINF:2.000000,\n" +
+		"../other/4.ts\n" +
+		"#EXT-X-ENDLIST\n"
+
+	segments := parseRecordingPlaylist(playlist)
+
+	if len(segments) != 2 {
+		t.Errorf("Expected 2 segments, but got %v", len(segments))
+		return
+	}
+
+	if segments[0].FileName != "1.ts" || segments[0].Duration != 1 || segments[0].Discontinuity {
+		t.Errorf("Unexpected segment: %v", segments[0])
+	}
+
+	if segments[1].FileName != "3.ts" || segments[1].Duration != 2.5 || !segments[1].Discontinuity {
+		t.Errorf("Unexpected segment: %v", segments[1])
+	}
+}
+
+func TestVodPlayback(t *testing.T) {
+	logger := testMain()
+
+	server := makeTestServerWithOptions(logger.CreateChildLogger("[Server] "), nil, true, "", TestServerOptions{Recording: true})
+	defer server.Close()
+
+	// Record a stream
+
+	publisher := connectTestClient(server.url, "PUSH", TEST_STREAM_ID_1, map[string]string{
+		"record": "true",
+	}, t)
+
+	if publisher == nil {
+		return
+	}
+
+	defer publisher.Close()
+
+	for _, frag := range TEST_STREAM_DATA_1 {
+		fragmentMessage := WebsocketProtocolMessage{
+			MessageType: "F",
+			Parameters: map[string]string{
+				"duration": fmt.Sprint(frag.Duration),
+			},
+		}
+
+		_ = publisher.WriteMessage(websocket.TextMessage, []byte(fragmentMessage.Serialize()))
+		_ = publisher.WriteMessage(websocket.BinaryMessage, frag.Data)
+	}
+
+	closeMessage := WebsocketProtocolMessage{
+		MessageType: "CLOSE",
+	}
+
+	_ = publisher.WriteMessage(websocket.TextMessage, []byte(closeMessage.Serialize()))
+
+	waitTestRecordingEnded(filepath.Join(server.dataDirectory, "recordings", getRecordingStreamDirectoryName(TEST_STREAM_ID_1)), t)
+
+	// Pull the recording, both paced in real time and as fast as possible
+
+	for _, fast := range []string{"false", "true"} {
+		spectator := connectTestClient(server.url, "PULL", TEST_STREAM_ID_1, map[string]string{
+			"vod_fast": fast,
+		}, t)
+
+		if spectator == nil {
+			return
+		}
+
+		for _, frag := range TEST_STREAM_DATA_1 {
+			msg, _ := readTestMessage(spectator, t)
+
+			if msg == nil || msg.MessageType != "F" || msg.GetParameter("duration") != fmt.Sprint(frag.Duration) {
+				t.Errorf("Expected F message, but received: %v", msg)
+				continue
+			}
+
+			_, data := readTestMessage(spectator, t)
+
+			if !bytes.Equal(data, frag.Data) {
+				t.Errorf("Fragment data does not match. Expected: %v, Actual: %v", frag.Data, data)
+			}
+		}
+
+		msg, _ := readTestMessage(spectator, t)
+
+		if msg == nil || msg.MessageType != "CLOSE" {
+			t.Errorf("Expected CLOSE message, but received: %v", msg)
+		}
+
+		spectator.Close()
+	}
+
+	// Recordings are not played when only the source is requested (relays)
+
+	sourceSpectator := connectTestClient(server.url, "PULL", TEST_STREAM_ID_1, map[string]string{
+		"only_source": "true",
+	}, t)
+
+	if sourceSpectator == nil {
+		return
+	}
+
+	defer sourceSpectator.Close()
+
+	if msg, _ := readTestMessage(sourceSpectator, t); msg == nil || msg.MessageType != "CLOSE" {
+		t.Errorf("Expected CLOSE message, but received: %v", msg)
+	}
+
+	// Streams without recordings are empty
+
+	spectator := connectTestClient(server.url, "PULL", TEST_STREAM_ID_2, nil, t)
+
+	if spectator == nil {
+		return
+	}
+
+	defer spectator.Close()
+
+	msg, _ := readTestMessage(spectator, t)
+
+	if msg == nil || msg.MessageType != "CLOSE" {
+		t.Errorf("Expected CLOSE message, but received: %v", msg)
+	}
+}